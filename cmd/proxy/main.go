@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -15,9 +16,12 @@ import (
 	"github.com/cooldownp/cooldown-proxy/internal/config"
 	"github.com/cooldownp/cooldown-proxy/internal/handler"
 	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/cooldownp/cooldown-proxy/internal/provider"
 	"github.com/cooldownp/cooldown-proxy/internal/proxy"
 	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 	"github.com/cooldownp/cooldown-proxy/internal/router"
+	"github.com/cooldownp/cooldown-proxy/internal/state"
+	"github.com/cooldownp/cooldown-proxy/internal/token"
 )
 
 var (
@@ -34,18 +38,54 @@ func main() {
 	}
 
 	// Create rate limiter for OpenAI handler
-	rateLimiter := ratelimit.New(cfg.RateLimits)
+	rateLimiter := ratelimit.NewWithDefault(cfg.RateLimits, cfg.DefaultRateLimit)
+	rateLimiter.SetHeaderSchemas(cfg.RateLimitHeaders)
+
+	// Per-client limits apply on top of the per-domain ones
+	var clientLimiter *ratelimit.ClientLimiter
+	if cfg.ClientRateLimits != nil {
+		clientLimiter = ratelimit.NewClientLimiter(cfg.ClientRateLimits)
+	}
 
 	// Create handlers
 	anthropicHandler := handler.NewAnthropicHandler(cfg)
+	anthropicHandler.SetRateLimiter(rateLimiter)
 
 	// Create base proxy handler for OpenAI compatibility
 	baseProxyHandler := proxy.NewHandler(rateLimiter)
+	if clientLimiter != nil {
+		anthropicHandler.SetClientLimiter(clientLimiter)
+		baseProxyHandler.SetClientLimiter(clientLimiter)
+	}
+
+	// Requests for Cerebras hosts also go through its RPM/TPM queue,
+	// sharing the limits with any configured peers
+	cerebrasLimiter := ratelimit.NewCerebrasLimiter(cfg.CerebrasLimits.RPMLimit, cfg.CerebrasLimits.TPMLimit)
+	cerebrasHandler := proxy.NewCerebrasProxyHandler(cerebrasLimiter, token.NewTokenEstimator(), &cfg.CerebrasLimits)
+	if cfg.ModelRouting != nil && cfg.ModelRouting.MaxBodyBytes > 0 {
+		cerebrasHandler.SetMaxBodyBytes(cfg.ModelRouting.MaxBodyBytes)
+	}
+	baseProxyHandler.SetCerebras(cerebrasHandler)
+
+	// Restore limiter and key usage from before the last restart
+	var stateStore *state.Store
+	if cfg.State != nil {
+		stateStore = state.NewStore(cfg.State)
+		registerState(stateStore, rateLimiter, clientLimiter, anthropicHandler.Providers(), cerebrasLimiter)
+		if err := stateStore.Load(); err != nil {
+			log.Printf("Starting without saved state: %v", err)
+		}
+		stateStore.Start()
+	}
 
 	// Wrap with model routing middleware for intelligent routing
 	var mainRouter http.Handler
+	var routingMiddleware *modelrouting.ModelRoutingMiddleware
 	if cfg.ModelRouting != nil && cfg.ModelRouting.Enabled {
-		mainRouter = modelrouting.NewModelRoutingMiddleware(cfg.ModelRouting, baseProxyHandler)
+		routingMiddleware = modelrouting.NewModelRoutingMiddleware(cfg.ModelRouting, baseProxyHandler)
+		routingMiddleware.SetRateLimiter(rateLimiter)
+		registerAdapters(routingMiddleware, cfg, rateLimiter)
+		mainRouter = routingMiddleware
 	} else {
 		// Fallback to simple router with default routes
 		routes := make(map[string]*url.URL)
@@ -55,7 +95,12 @@ func main() {
 				routes["default"] = defaultURL
 			}
 		}
-		mainRouter = router.New(routes, rateLimiter)
+		simpleRouter := router.New(routes, rateLimiter)
+		if clientLimiter != nil {
+			simpleRouter.SetClientLimiter(clientLimiter)
+		}
+		simpleRouter.SetCerebras(cerebrasHandler)
+		mainRouter = simpleRouter
 	}
 
 	// Setup routes
@@ -75,6 +120,32 @@ func main() {
 	}
 	mux.Handle(openaiPath+"/", http.StripPrefix(openaiPath, baseProxyHandler))
 
+	// Peers read this instance's share of the Cerebras limits here
+	coordinator := cerebrasHandler.Coordinator()
+	if coordinator != nil {
+		mux.Handle(ratelimit.PeerLeasePath, coordinator)
+		coordinator.Start()
+	}
+
+	// Routing health, including per-target response counts for canaries
+	if routingMiddleware != nil {
+		mux.HandleFunc("/health/model-routing", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(routingMiddleware.HealthCheck())
+		})
+	}
+
+	// Rate limiter state per domain rule and per client
+	mux.HandleFunc("/health/rate-limits", func(w http.ResponseWriter, r *http.Request) {
+		status := map[string]interface{}{"domains": rateLimiter.GetAllMetrics()}
+		if clientLimiter != nil {
+			status["clients"] = clientLimiter.GetAllMetrics()
+		}
+		status["daily"] = anthropicHandler.Providers().DailyQuotas()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+
 	// Default proxy routes (existing behavior)
 	mux.Handle("/", mainRouter)
 
@@ -118,5 +189,54 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	if coordinator != nil {
+		coordinator.Stop()
+	}
+
+	if stateStore != nil {
+		if err := stateStore.Stop(); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
+
 	log.Println("Server exited")
 }
+
+// registerState adds the limiters and key usage that survive a restart to
+// store. clientLimiter may be nil.
+func registerState(store *state.Store, rateLimiter *ratelimit.Limiter, clientLimiter *ratelimit.ClientLimiter,
+	providers *provider.ProviderManager, cerebrasLimiter *ratelimit.CerebrasLimiter) {
+	store.Register("domains", rateLimiter)
+	if clientLimiter != nil {
+		store.Register("clients", clientLimiter)
+	}
+	store.Register("providers", providers)
+	store.Register("cerebras", cerebrasLimiter)
+}
+
+// registerAdapters installs translating adapters for upstreams that do not
+// speak the OpenAI/Anthropic wire format
+func registerAdapters(m *modelrouting.ModelRoutingMiddleware, cfg *config.Config, rateLimiter *ratelimit.Limiter) {
+	geminiConfigured := false
+	for i := range cfg.Providers {
+		switch cfg.Providers[i].Name {
+		case "gemini":
+			m.AddAdapter(provider.NewGeminiProvider(&cfg.Providers[i]))
+			geminiConfigured = true
+		case "bedrock":
+			bedrock := provider.NewBedrockProvider(&cfg.Providers[i])
+			bedrock.SetRateLimiter(rateLimiter)
+			m.AddAdapter(bedrock)
+		case "azure":
+			azure := provider.NewAzureProvider(&cfg.Providers[i])
+			azure.SetRateLimiter(rateLimiter)
+			m.AddAdapter(azure)
+		}
+	}
+
+	// Without a gemini provider, still translate for the public endpoint and
+	// pass the client's own key through
+	if !geminiConfigured {
+		m.AddAdapter(provider.NewGeminiProvider(&config.ProviderConfig{Name: "gemini"}))
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"testing"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/provider"
 	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 	"github.com/cooldownp/cooldown-proxy/internal/router"
+	"github.com/cooldownp/cooldown-proxy/internal/state"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -327,3 +331,26 @@ func TestProviderConfigurationValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterStatePersistsCerebrasLimiter(t *testing.T) {
+	cfg := &config.Config{}
+	stateCfg := &config.StateConfig{Path: filepath.Join(t.TempDir(), "state.json")}
+
+	before := ratelimit.NewCerebrasLimiter(10, 1000)
+	require.Zero(t, before.CheckRequest(300))
+	require.Zero(t, before.CheckRequest(200))
+
+	store := state.NewStore(stateCfg)
+	registerState(store, ratelimit.New(nil), nil, provider.NewProviderManager(cfg), before)
+	require.NoError(t, store.Save())
+
+	// A restarted process builds fresh components and loads the snapshot
+	after := ratelimit.NewCerebrasLimiter(10, 1000)
+	store = state.NewStore(stateCfg)
+	registerState(store, ratelimit.New(nil), nil, provider.NewProviderManager(cfg), after)
+	require.NoError(t, store.Load())
+
+	requests, tokens, _ := after.Usage()
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 500, tokens)
+}
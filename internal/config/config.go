@@ -5,6 +5,7 @@ import (
 	"gopkg.in/yaml.v3"
 	"os"
 	"regexp"
+	"time"
 )
 
 func Load(configPath string) (*Config, error) {
@@ -37,6 +38,9 @@ func LoadFromYAMLBytes(data []byte) (*Config, error) {
 
 	// Set CerebrasLimits defaults
 	config.CerebrasLimits.SetDefaults()
+	if config.State != nil && config.State.Interval == 0 {
+		config.State.Interval = 30 * time.Second
+	}
 
 	// Expand environment variables
 	expandEnvironmentVariablesInConfig(&config)
@@ -76,6 +80,36 @@ func expandEnvironmentVariablesInConfig(config *Config) {
 	config.EnvironmentModels.Haiku = expandEnvironmentVariables(config.EnvironmentModels.Haiku)
 	config.EnvironmentModels.Sonnet = expandEnvironmentVariables(config.EnvironmentModels.Sonnet)
 	config.EnvironmentModels.Opus = expandEnvironmentVariables(config.EnvironmentModels.Opus)
+	for i := range config.ModelMappings {
+		config.ModelMappings[i].Model = expandEnvironmentVariables(config.ModelMappings[i].Model)
+	}
+
+	// Expand client keys
+	if config.ClientRateLimits != nil {
+		for i := range config.ClientRateLimits.Clients {
+			config.ClientRateLimits.Clients[i].Client = expandEnvironmentVariables(config.ClientRateLimits.Clients[i].Client)
+		}
+	}
+	if peers := config.CerebrasLimits.Peers; peers != nil {
+		peers.Secret = expandEnvironmentVariables(peers.Secret)
+	}
+	if fq := config.CerebrasLimits.FairQueuing; fq != nil {
+		for i := range fq.Tenants {
+			fq.Tenants[i].Client = expandEnvironmentVariables(fq.Tenants[i].Client)
+		}
+	}
+
+	// Expand target credentials
+	if config.ModelRouting != nil {
+		for _, target := range config.ModelRouting.Targets {
+			if auth := target.Auth; auth != nil {
+				auth.APIKey = expandEnvironmentVariables(auth.APIKey)
+				for i := range auth.APIKeys {
+					auth.APIKeys[i] = expandEnvironmentVariables(auth.APIKeys[i])
+				}
+			}
+		}
+	}
 
 	// Expand provider configurations
 	for i := range config.Providers {
@@ -89,5 +123,14 @@ func expandEnvironmentVariablesInConfig(config *Config) {
 					config.Providers[i].LoadBalancing.APIKeys[j].Key)
 			}
 		}
+
+		if aws := config.Providers[i].AWS; aws != nil {
+			aws.Region = expandEnvironmentVariables(aws.Region)
+			aws.AccessKeyID = expandEnvironmentVariables(aws.AccessKeyID)
+			aws.SecretAccessKey = expandEnvironmentVariables(aws.SecretAccessKey)
+			aws.SessionToken = expandEnvironmentVariables(aws.SessionToken)
+			aws.CredentialsFile = expandEnvironmentVariables(aws.CredentialsFile)
+			aws.Profile = expandEnvironmentVariables(aws.Profile)
+		}
 	}
 }
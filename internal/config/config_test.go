@@ -122,3 +122,420 @@ environment_models:
 	assert.NoError(t, err)
 	assert.Equal(t, "glm-4.5-test", config.EnvironmentModels.Haiku)
 }
+
+func TestBedrockProviderConfig(t *testing.T) {
+	os.Setenv("TEST_AWS_SECRET", "secret-from-env")
+	defer os.Unsetenv("TEST_AWS_SECRET")
+
+	yamlContent := `
+providers:
+  - name: "bedrock"
+    endpoint: "https://bedrock-runtime.us-west-2.amazonaws.com"
+    models: ["anthropic.claude-3-haiku-20240307-v1:0"]
+    aws:
+      region: "us-west-2"
+      access_key_id: "AKID"
+      secret_access_key: "${TEST_AWS_SECRET}"
+`
+
+	config, err := LoadFromYAMLBytes([]byte(yamlContent))
+	assert.NoError(t, err)
+	assert.Equal(t, "us-west-2", config.Providers[0].AWS.Region)
+	assert.Equal(t, "secret-from-env", config.Providers[0].AWS.SecretAccessKey)
+
+	_, err = LoadFromYAMLBytes([]byte(`
+providers:
+  - name: "bedrock"
+    endpoint: "https://bedrock-runtime.us-west-2.amazonaws.com"
+    models: ["anthropic.claude-3-haiku-20240307-v1:0"]
+    aws:
+      region: "us-west-2"
+`))
+	assert.Error(t, err)
+
+	// A static key without its secret would only fail when signing
+	_, err = LoadFromYAMLBytes([]byte(`
+providers:
+  - name: "bedrock"
+    endpoint: "https://bedrock-runtime.us-west-2.amazonaws.com"
+    models: ["anthropic.claude-3-haiku-20240307-v1:0"]
+    aws:
+      region: "us-west-2"
+      access_key_id: "AKID"
+`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "secret_access_key")
+
+	_, err = LoadFromYAMLBytes([]byte(`
+providers:
+  - name: "bedrock"
+    endpoint: "https://bedrock-runtime.us-west-2.amazonaws.com"
+    models: ["anthropic.claude-3-haiku-20240307-v1:0"]
+    aws:
+      region: "us-west-2"
+      secret_access_key: "secret"
+      credentials_file: "/etc/aws/credentials"
+`))
+	assert.Error(t, err)
+}
+
+func TestAzureProviderConfig(t *testing.T) {
+	yamlContent := `
+providers:
+  - name: "azure"
+    endpoint: "https://my-resource.openai.azure.com"
+    models: ["gpt-4o"]
+    azure:
+      api_version: "2024-06-01"
+      deployments:
+        "gpt-4o":
+          deployment: "gpt4o-prod"
+`
+
+	config, err := LoadFromYAMLBytes([]byte(yamlContent))
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt4o-prod", config.Providers[0].Azure.Deployments["gpt-4o"].Deployment)
+
+	_, err = LoadFromYAMLBytes([]byte(`
+providers:
+  - name: "azure"
+    endpoint: "https://my-resource.openai.azure.com"
+    models: ["gpt-4o"]
+    azure:
+      deployments:
+        "gpt-4o":
+          deployment: "gpt4o-prod"
+`))
+	assert.Error(t, err)
+}
+
+func TestModelMappingsConfig(t *testing.T) {
+	os.Setenv("TEST_FAST_MODEL", "llama3.1-8b")
+	defer os.Unsetenv("TEST_FAST_MODEL")
+
+	yamlContent := `
+model_mappings:
+  - match: regex
+    pattern: 'claude-(sonnet|opus)-4.*'
+    model: "qwen-3-coder-480b"
+  - match: glob
+    pattern: "claude-*"
+    model: "${TEST_FAST_MODEL}"
+    headers:
+      X-Route: "fast"
+`
+
+	config, err := LoadFromYAMLBytes([]byte(yamlContent))
+	assert.NoError(t, err)
+	assert.Len(t, config.ModelMappings, 2)
+	assert.Equal(t, "llama3.1-8b", config.ModelMappings[1].Model)
+	assert.Equal(t, "fast", config.ModelMappings[1].Headers["X-Route"])
+
+	_, err = LoadFromYAMLBytes([]byte(`
+model_mappings:
+  - match: regex
+    pattern: 'claude-('
+    model: "glm-4.6"
+`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "model mapping 1")
+	}
+}
+
+func TestTargetAuthConfig(t *testing.T) {
+	os.Setenv("TEST_CEREBRAS_KEY_1", "csk-1")
+	os.Setenv("TEST_CEREBRAS_KEY_2", "csk-2")
+	defer os.Unsetenv("TEST_CEREBRAS_KEY_1")
+	defer os.Unsetenv("TEST_CEREBRAS_KEY_2")
+
+	yamlContent := `
+model_routing:
+  enabled: true
+  default_target: "https://api.cerebras.ai/v1"
+  targets:
+    "https://api.cerebras.ai/v1":
+      auth:
+        api_keys: ["${TEST_CEREBRAS_KEY_1}", "${TEST_CEREBRAS_KEY_2}"]
+`
+
+	config, err := LoadFromYAMLBytes([]byte(yamlContent))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"csk-1", "csk-2"}, config.ModelRouting.Targets["https://api.cerebras.ai/v1"].Auth.APIKeys)
+
+	_, err = LoadFromYAMLBytes([]byte(`
+model_routing:
+  enabled: true
+  default_target: "https://api.cerebras.ai/v1"
+  targets:
+    "https://api.cerebras.ai/v1":
+      auth:
+        api_key: "${TEST_UNSET_TARGET_KEY}"
+`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "auth has no API key")
+	}
+
+	_, err = LoadFromYAMLBytes([]byte(`
+model_routing:
+  enabled: true
+  default_target: "https://api.cerebras.ai/v1"
+  targets:
+    "https://api.cerebras.ai/v1":
+      auth:
+        style: header
+        api_key: "k"
+`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires a header name")
+	}
+}
+
+func TestRateLimitRules(t *testing.T) {
+	config, err := LoadFromYAMLBytes([]byte(`
+rate_limits:
+  - domain: "api.openai.com"
+    requests: 500
+    period: minute
+    burst: 50
+    windows:
+      - requests: 10000
+        period: day
+  - domain: "slow.example.com"
+    requests_per_second: 0.2
+default_rate_limit:
+  requests_per_second: 5
+`))
+	assert.NoError(t, err)
+
+	rates, err := config.RateLimits[0].Rates()
+	assert.NoError(t, err)
+	assert.Equal(t, []Rate{
+		{PerSecond: 500.0 / 60, Burst: 50},
+		{PerSecond: 10000.0 / 86400, Burst: 10000},
+	}, rates)
+
+	rates, err = config.RateLimits[1].Rates()
+	assert.NoError(t, err)
+	assert.Equal(t, []Rate{{PerSecond: 0.2, Burst: 1}}, rates)
+
+	rates, err = config.DefaultRateLimit.Rates()
+	assert.NoError(t, err)
+	assert.Equal(t, []Rate{{PerSecond: 5, Burst: 10}}, rates)
+
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"rate_limits:\n  - requests_per_second: 1\n", "domain is required"},
+		{"rate_limits:\n  - domain: a.com\n", "no requests_per_second, requests or windows set"},
+		{"rate_limits:\n  - domain: a.com\n    requests_per_second: 1\n    requests: 60\n", "sets both"},
+		{"rate_limits:\n  - domain: a.com\n    requests: 10\n    period: fortnight\n", `invalid period "fortnight"`},
+		{"rate_limits:\n  - domain: a.com\n    requests: 10\n    burst: -1\n", "burst must not be negative"},
+		{"rate_limits:\n  - domain: a.com\n    windows:\n      - period: hour\n", "window 1: requests must be positive"},
+		{"default_rate_limit:\n  requests_per_second: -1\n", "default_rate_limit: requests_per_second must be positive"},
+	} {
+		_, err := LoadFromYAMLBytes([]byte(tt.yaml))
+		if assert.Error(t, err, tt.yaml) {
+			assert.Contains(t, err.Error(), tt.want)
+		}
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	for period, want := range map[string]time.Duration{
+		"":       time.Second,
+		"second": time.Second,
+		"min":    time.Minute,
+		"hour":   time.Hour,
+		"day":    24 * time.Hour,
+		"10s":    10 * time.Second,
+	} {
+		got, err := ParsePeriod(period)
+		assert.NoError(t, err, period)
+		assert.Equal(t, want, got, period)
+	}
+
+	_, err := ParsePeriod("-1m")
+	assert.Error(t, err)
+}
+
+func TestRateLimitRuleScope(t *testing.T) {
+	_, err := LoadFromYAMLBytes([]byte(`
+rate_limits:
+  - domain: "api.openai.com"
+    requests_per_second: 10
+  - domain: "api.openai.com"
+    path_prefix: "/v1/chat/completions"
+    methods: ["POST"]
+    requests: 500
+    period: minute
+`))
+	assert.NoError(t, err)
+
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"rate_limits:\n  - domain: a.*.com\n    requests_per_second: 1\n", "leading *. label"},
+		{"rate_limits:\n  - domain: '*'\n    requests_per_second: 1\n", "leading *. label"},
+		{"rate_limits:\n  - domain: a.com\n    path_prefix: v1\n    requests_per_second: 1\n", "must start with /"},
+		{"rate_limits:\n  - domain: a.com\n    methods: [post]\n    requests_per_second: 1\n  - domain: A.com\n    methods: [POST]\n    requests_per_second: 2\n", "duplicate rule for POST a.com"},
+	} {
+		_, err := LoadFromYAMLBytes([]byte(tt.yaml))
+		if assert.Error(t, err, tt.yaml) {
+			assert.Contains(t, err.Error(), tt.want)
+		}
+	}
+}
+
+func TestClientRateLimitsConfig(t *testing.T) {
+	config, err := LoadFromYAMLBytes([]byte(`
+client_rate_limits:
+  key: ip
+  default:
+    requests: 60
+    period: minute
+  clients:
+    - name: office
+      client: "10.0.0.0/8"
+      requests: 600
+      period: minute
+      burst: 100
+`))
+	assert.NoError(t, err)
+	office := config.ClientRateLimits.Clients[0]
+	assert.Equal(t, "10.0.0.0/8", office.Client)
+	assert.Equal(t, 600, office.Requests)
+	assert.Equal(t, 100, office.Burst)
+
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"client_rate_limits:\n  key: cookie\n", `unknown key "cookie"`},
+		{"client_rate_limits:\n  key: header\n", "requires a header name"},
+		{"client_rate_limits:\n  key: ip\n  clients:\n    - client: office\n      requests: 1\n", "not an IP address or CIDR"},
+		{"client_rate_limits:\n  clients:\n    - client: k\n      domain: a.com\n      requests: 1\n", "do not apply to client limits"},
+		{"client_rate_limits:\n  default:\n    burst: 3\n", "default: burst needs"},
+	} {
+		_, err := LoadFromYAMLBytes([]byte(tt.yaml))
+		if assert.Error(t, err, tt.yaml) {
+			assert.Contains(t, err.Error(), tt.want)
+		}
+	}
+}
+
+func TestCerebrasPeersConfig(t *testing.T) {
+	os.Setenv("TEST_PEER_SECRET", "shared-secret")
+	defer os.Unsetenv("TEST_PEER_SECRET")
+
+	config, err := LoadFromYAMLBytes([]byte(`
+cerebras_limits:
+  rpm_limit: 600
+  peers:
+    self: "http://10.0.0.5:8080"
+    peers: ["http://10.0.0.6:8080", "http://10.0.0.7:8080"]
+    secret: "${TEST_PEER_SECRET}"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, config.CerebrasLimits.Peers.Interval)
+	assert.Equal(t, 15*time.Second, config.CerebrasLimits.Peers.LeaseTTL)
+	assert.Equal(t, "shared-secret", config.CerebrasLimits.Peers.Secret)
+
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"cerebras_limits:\n  peers:\n    peers: [\"http://b:8080\"]\n", "self: must be an http(s) URL"},
+		{"cerebras_limits:\n  peers:\n    self: \"http://a:8080\"\n", "at least one peer"},
+		{"cerebras_limits:\n  peers:\n    self: \"http://a:8080\"\n    peers: [\"http://a:8080\"]\n", "this instance's self URL"},
+		{"cerebras_limits:\n  peers:\n    self: \"http://a:8080\"\n    peers: [\"http://b:8080\"]\n    interval: 10s\n    lease_ttl: 5s\n    secret: s\n", "lease_ttl must be longer than interval"},
+		{"cerebras_limits:\n  peers:\n    self: \"http://a:8080\"\n    peers: [\"http://b:8080\"]\n", "secret is required"},
+	} {
+		_, err := LoadFromYAMLBytes([]byte(tt.yaml))
+		if assert.Error(t, err, tt.yaml) {
+			assert.Contains(t, err.Error(), tt.want)
+		}
+	}
+}
+
+func TestCerebrasFairQueuingConfig(t *testing.T) {
+	config, err := LoadFromYAMLBytes([]byte(`
+cerebras_limits:
+  fair_queuing:
+    key: header
+    header: X-Team
+    tenants:
+      - name: interactive
+        client: ide
+        weight: 4
+`))
+	assert.NoError(t, err)
+	fq := config.CerebrasLimits.FairQueuing
+	assert.Equal(t, time.Minute, fq.Aging)
+	assert.Equal(t, 4, fq.Tenants[0].Weight)
+
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"cerebras_limits:\n  fair_queuing:\n    key: header\n", "cerebras_limits.fair_queuing: key header requires a header name"},
+		{"cerebras_limits:\n  fair_queuing:\n    tenants:\n      - client: k\n", "tenant 1: weight must be positive"},
+		{"cerebras_limits:\n  fair_queuing:\n    tenants:\n      - client: k\n        weight: 1\n      - client: k\n        weight: 2\n", "tenant 2: duplicate rule for k"},
+		{"cerebras_limits:\n  fair_queuing:\n    key: ip\n    tenants:\n      - client: office\n        weight: 1\n", "not an IP address or CIDR"},
+		{"cerebras_limits:\n  fair_queuing:\n    aging: -1s\n", "aging must not be negative"},
+	} {
+		_, err := LoadFromYAMLBytes([]byte(tt.yaml))
+		if assert.Error(t, err, tt.yaml) {
+			assert.Contains(t, err.Error(), tt.want)
+		}
+	}
+}
+
+func TestStateConfig(t *testing.T) {
+	config, err := LoadFromYAMLBytes([]byte("state:\n  path: /tmp/state.json\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, config.State.Interval)
+
+	_, err = LoadFromYAMLBytes([]byte("state:\n  interval: 10s\n"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "state: path is required")
+	}
+}
+
+func TestRateLimitHeaderSchemas(t *testing.T) {
+	config, err := LoadFromYAMLBytes([]byte(`
+rate_limit_headers:
+  github:
+    remaining_requests: x-ratelimit-remaining
+    reset_requests: x-ratelimit-reset
+    reset_format: unix
+rate_limits:
+  - domain: "api.openai.com"
+    requests_per_second: 5
+    headers: openai
+  - domain: "api.github.com"
+    requests_per_second: 5
+    headers: github
+`))
+	assert.NoError(t, err)
+	schema, ok := config.HeaderSchema("github")
+	assert.True(t, ok)
+	assert.Equal(t, ResetUnix, schema.ResetFormat)
+
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"rate_limits:\n  - domain: a.com\n    requests_per_second: 1\n    headers: nope\n", `unknown headers schema "nope"`},
+		{"default_rate_limit:\n  requests_per_second: 1\n  headers: nope\n", "default_rate_limit: unknown headers schema"},
+		{"rate_limit_headers:\n  x:\n    reset_requests: x-reset\n", "remaining_requests or remaining_tokens is required"},
+		{"rate_limit_headers:\n  x:\n    remaining_requests: x-left\n    reset_format: iso\n", `unknown reset_format "iso"`},
+		{"client_rate_limits:\n  default:\n    requests_per_second: 1\n    headers: openai\n", "headers do not apply to client limits"},
+	} {
+		_, err := LoadFromYAMLBytes([]byte(tt.yaml))
+		if assert.Error(t, err, tt.yaml) {
+			assert.Contains(t, err.Error(), tt.want)
+		}
+	}
+}
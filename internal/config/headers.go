@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Formats of the reset headers in a HeaderSchema
+const (
+	ResetSeconds  = "seconds"  // seconds until reset, may be fractional (default)
+	ResetDuration = "duration" // a Go-style duration such as 6m0s or 20ms
+	ResetRFC3339  = "rfc3339"  // the time of the reset
+	ResetUnix     = "unix"     // the time of the reset in seconds since the epoch
+)
+
+// HeaderFormatIETF reads the IETF RateLimit and RateLimit-Policy fields
+// instead of named headers
+const HeaderFormatIETF = "ietf"
+
+// HeaderSchema names the response headers an upstream reports its quota in.
+// Any header may be left out; requests and tokens are tracked separately.
+type HeaderSchema struct {
+	Format            string `yaml:"format,omitempty"` // ietf, or empty for the named headers below
+	LimitRequests     string `yaml:"limit_requests,omitempty"`
+	RemainingRequests string `yaml:"remaining_requests,omitempty"`
+	ResetRequests     string `yaml:"reset_requests,omitempty"`
+	LimitTokens       string `yaml:"limit_tokens,omitempty"`
+	RemainingTokens   string `yaml:"remaining_tokens,omitempty"`
+	ResetTokens       string `yaml:"reset_tokens,omitempty"`
+	ResetFormat       string `yaml:"reset_format,omitempty"` // seconds (default), duration, rfc3339 or unix
+}
+
+// HeaderSchemas are the schemas rate limit rules can name without declaring
+// them in rate_limit_headers
+var HeaderSchemas = map[string]HeaderSchema{
+	"openai": {
+		LimitRequests:     "x-ratelimit-limit-requests",
+		RemainingRequests: "x-ratelimit-remaining-requests",
+		ResetRequests:     "x-ratelimit-reset-requests",
+		LimitTokens:       "x-ratelimit-limit-tokens",
+		RemainingTokens:   "x-ratelimit-remaining-tokens",
+		ResetTokens:       "x-ratelimit-reset-tokens",
+		ResetFormat:       ResetDuration,
+	},
+	"anthropic": {
+		LimitRequests:     "anthropic-ratelimit-requests-limit",
+		RemainingRequests: "anthropic-ratelimit-requests-remaining",
+		ResetRequests:     "anthropic-ratelimit-requests-reset",
+		LimitTokens:       "anthropic-ratelimit-tokens-limit",
+		RemainingTokens:   "anthropic-ratelimit-tokens-remaining",
+		ResetTokens:       "anthropic-ratelimit-tokens-reset",
+		ResetFormat:       ResetRFC3339,
+	},
+	"cerebras": {
+		LimitRequests:     "x-ratelimit-limit-requests-day",
+		RemainingRequests: "x-ratelimit-remaining-requests-day",
+		ResetRequests:     "x-ratelimit-reset-requests-day",
+		LimitTokens:       "x-ratelimit-limit-tokens-minute",
+		RemainingTokens:   "x-ratelimit-remaining-tokens-minute",
+		ResetTokens:       "x-ratelimit-reset-tokens-minute",
+		ResetFormat:       ResetSeconds,
+	},
+	"ietf": {Format: HeaderFormatIETF},
+}
+
+// HeaderSchema returns the schema a rule's headers setting names, looking in
+// rate_limit_headers before the built-in ones
+func (c *Config) HeaderSchema(name string) (HeaderSchema, bool) {
+	if schema, ok := c.RateLimitHeaders[name]; ok {
+		return schema, true
+	}
+	schema, ok := HeaderSchemas[name]
+	return schema, ok
+}
+
+func (s HeaderSchema) validate() error {
+	switch s.Format {
+	case HeaderFormatIETF:
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("unknown format %q", s.Format)
+	}
+
+	switch s.ResetFormat {
+	case "", ResetSeconds, ResetDuration, ResetRFC3339, ResetUnix:
+	default:
+		return fmt.Errorf("unknown reset_format %q", s.ResetFormat)
+	}
+
+	if s.RemainingRequests == "" && s.RemainingTokens == "" {
+		return fmt.Errorf("remaining_requests or remaining_tokens is required")
+	}
+	return nil
+}
+
+func (c *Config) validateHeaderSchemas() error {
+	names := make([]string, 0, len(c.RateLimitHeaders))
+	for name := range c.RateLimitHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := c.RateLimitHeaders[name].validate(); err != nil {
+			return fmt.Errorf("rate_limit_headers %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validateHeaders checks that the schema a rule names exists
+func (c *Config) validateHeaders(rule RateLimitRule) error {
+	if rule.Headers == "" {
+		return nil
+	}
+	if _, ok := c.HeaderSchema(rule.Headers); !ok {
+		known := make([]string, 0, len(HeaderSchemas))
+		for name := range HeaderSchemas {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("unknown headers schema %q; use %s or declare it in rate_limit_headers", rule.Headers, strings.Join(known, ", "))
+	}
+	return nil
+}
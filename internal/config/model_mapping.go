@@ -0,0 +1,39 @@
+package config
+
+import "fmt"
+
+// ModelMapping maps requested Claude model names to a provider model on the
+// Anthropic endpoint. Mappings are tried in order and the first match wins;
+// one with Headers only applies when every header has the given value, or
+// any value for "*".
+type ModelMapping struct {
+	Match   string            `yaml:"match,omitempty"` // exact (default), prefix, glob or regex
+	Pattern string            `yaml:"pattern"`
+	Model   string            `yaml:"model"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// Matcher compiles the mapping's pattern like a model routing rule's
+func (m ModelMapping) Matcher() (func(model string) bool, error) {
+	return ModelRule{Match: m.Match, Pattern: m.Pattern}.Matcher()
+}
+
+func (c *Config) validateModelMappings() error {
+	for i, mapping := range c.ModelMappings {
+		if mapping.Pattern == "" {
+			return fmt.Errorf("model mapping %d: pattern is required", i+1)
+		}
+		if mapping.Model == "" {
+			return fmt.Errorf("model mapping %d (%s): model is required", i+1, mapping.Pattern)
+		}
+		if _, err := mapping.Matcher(); err != nil {
+			return fmt.Errorf("model mapping %d (%s): %w", i+1, mapping.Pattern, err)
+		}
+		for name, value := range mapping.Headers {
+			if name == "" || value == "" {
+				return fmt.Errorf("model mapping %d (%s): header conditions need a name and a value", i+1, mapping.Pattern)
+			}
+		}
+	}
+	return nil
+}
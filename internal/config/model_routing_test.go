@@ -1,6 +1,7 @@
 package config
 
 import (
+	"strings"
 	"testing"
 
 	"gopkg.in/yaml.v3"
@@ -63,3 +64,169 @@ server:
 		t.Error("Model routing should be disabled by default")
 	}
 }
+
+func TestModelRoutingRuleValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []ModelRule
+		wantErr string
+	}{
+		{
+			name: "valid ordered rules",
+			rules: []ModelRule{
+				{Match: MatchRegex, Pattern: `gpt-4o-\d{4}-\d{2}-\d{2}`, Target: "https://a.example.com"},
+				{Match: MatchPrefix, Pattern: "gpt-4o", Target: "https://b.example.com"},
+				{Match: MatchGlob, Pattern: "*", Target: "https://c.example.com"},
+			},
+		},
+		{
+			name:    "unknown match type",
+			rules:   []ModelRule{{Match: "fuzzy", Pattern: "gpt", Target: "https://a.example.com"}},
+			wantErr: "unknown match type",
+		},
+		{
+			name:    "invalid regex",
+			rules:   []ModelRule{{Match: MatchRegex, Pattern: "gpt-(", Target: "https://a.example.com"}},
+			wantErr: "invalid pattern",
+		},
+		{
+			name:    "exact rule duplicating models table",
+			rules:   []ModelRule{{Pattern: "gpt-4", Target: "https://a.example.com"}},
+			wantErr: "rule 1 (exact:gpt-4) is unreachable",
+		},
+		{
+			name: "narrower prefix after broader prefix",
+			rules: []ModelRule{
+				{Match: MatchPrefix, Pattern: "gpt-", Target: "https://a.example.com"},
+				{Match: MatchPrefix, Pattern: "gpt-4o", Target: "https://b.example.com"},
+			},
+			wantErr: "rule 2 (prefix:gpt-4o) is unreachable: shadowed by rule 1 (prefix:gpt-)",
+		},
+		{
+			name: "regex after catch-all glob",
+			rules: []ModelRule{
+				{Name: "everything", Match: MatchGlob, Pattern: "*", Target: "https://a.example.com"},
+				{Match: MatchRegex, Pattern: "claude-.*", Target: "https://b.example.com"},
+			},
+			wantErr: "shadowed by rule 1 (everything)",
+		},
+		{
+			name: "exact model matched by earlier glob",
+			rules: []ModelRule{
+				{Match: MatchGlob, Pattern: "claude-3-*-sonnet", Target: "https://a.example.com"},
+				{Pattern: "claude-3-5-sonnet", Target: "https://b.example.com"},
+			},
+			wantErr: "rule 2 (exact:claude-3-5-sonnet) is unreachable",
+		},
+		{
+			name: "weighted targets",
+			rules: []ModelRule{{Pattern: "llama3-70b", Sticky: "header:X-Session-Id", Targets: []WeightedTarget{
+				{URL: "https://api.cerebras.ai/v1", Weight: 90},
+				{URL: "https://api.groq.com/openai/v1", Weight: 10},
+			}}},
+		},
+		{
+			name: "target and targets",
+			rules: []ModelRule{{Pattern: "llama3-70b", Target: "https://a.example.com", Targets: []WeightedTarget{
+				{URL: "https://b.example.com", Weight: 1},
+			}}},
+			wantErr: "sets both target and targets",
+		},
+		{
+			name:    "zero weight",
+			rules:   []ModelRule{{Pattern: "llama3-70b", Targets: []WeightedTarget{{URL: "https://a.example.com"}}}},
+			wantErr: "non-positive weight",
+		},
+		{
+			name: "unknown sticky mode",
+			rules: []ModelRule{{Pattern: "llama3-70b", Sticky: "random", Targets: []WeightedTarget{
+				{URL: "https://a.example.com", Weight: 1},
+			}}},
+			wantErr: `unknown sticky mode "random"`,
+		},
+		{
+			name: "content rules skip unreachable checks",
+			rules: []ModelRule{
+				{Match: MatchGlob, Pattern: "*", Target: "https://a.example.com"},
+				{Pattern: "gpt-4", When: &RuleConditions{MinPromptTokens: 32000}, Target: "https://b.example.com"},
+				{When: &RuleConditions{Headers: map[string]string{"X-Team": "*"}}, Target: "https://c.example.com"},
+			},
+		},
+		{
+			name:    "inverted prompt token bounds",
+			rules:   []ModelRule{{When: &RuleConditions{MinPromptTokens: 100, MaxPromptTokens: 10}, Target: "https://a.example.com"}},
+			wantErr: "min_prompt_tokens 100 exceeds max_prompt_tokens 10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ModelRoutingConfig{
+				Enabled:       true,
+				DefaultTarget: "https://api.openai.com/v1",
+				Models:        map[string]string{"gpt-4": "https://api.openai.com/v1"},
+				Rules:         tt.rules,
+			}
+			err := cfg.validateModelRules()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestModelRoutingPricingValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		pricing map[string]ModelPrice
+		classes map[string][]ClassTarget
+		wantErr string
+	}{
+		{
+			name:    "valid class",
+			pricing: map[string]ModelPrice{"gpt-4o": {Input: 2.5, Output: 10}, "llama3.1-70b": {Input: 0.6, Output: 0.6}},
+			classes: map[string][]ClassTarget{"smart": {
+				{Target: "https://api.openai.com/v1", Model: "gpt-4o"},
+				{Target: "https://api.cerebras.ai/v1", Model: "llama3.1-70b"},
+			}},
+		},
+		{
+			name:    "negative price",
+			pricing: map[string]ModelPrice{"gpt-4o": {Input: -1}},
+			wantErr: "pricing for model gpt-4o must not be negative",
+		},
+		{
+			name:    "unpriced class model",
+			pricing: map[string]ModelPrice{"gpt-4o": {Input: 2.5, Output: 10}},
+			classes: map[string][]ClassTarget{"smart": {{Target: "https://api.cerebras.ai/v1", Model: "llama3.1-70b"}}},
+			wantErr: "no pricing for model llama3.1-70b",
+		},
+		{
+			name:    "empty class",
+			classes: map[string][]ClassTarget{"smart": {}},
+			wantErr: "capability class smart has no targets",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ModelRoutingConfig{Pricing: tt.pricing, Classes: tt.classes}
+			err := cfg.validatePricing()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Match types for model routing rules
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchGlob   = "glob"
+	MatchRegex  = "regex"
+)
+
+// Sticky modes for weighted targets
+const (
+	StickyClient       = "client"
+	StickyConversation = "conversation"
+	StickyHeaderPrefix = "header:"
+)
+
+// ModelRule routes models matching Pattern to Target. Rules are evaluated in
+// order after the exact-match Models table and the first match wins.
+// TargetModel rewrites the request's model field; RestoreModel puts the
+// client's model name back into responses.
+//
+// Instead of Target a rule may list weighted Targets to split traffic, for
+// example to canary a new provider. Sticky picks what keeps a session on the
+// same target: client (default), conversation or header:<Name>.
+//
+// Rules with When conditions also look at the request content. They are
+// evaluated before the Models table so they can refine routing for models
+// it already covers; an empty Pattern then matches every model.
+type ModelRule struct {
+	Name         string           `yaml:"name,omitempty"`
+	Match        string           `yaml:"match,omitempty"` // exact (default), prefix, glob or regex
+	Pattern      string           `yaml:"pattern"`
+	When         *RuleConditions  `yaml:"when,omitempty"`
+	Target       string           `yaml:"target,omitempty"`
+	Targets      []WeightedTarget `yaml:"targets,omitempty"`
+	Sticky       string           `yaml:"sticky,omitempty"`
+	TargetModel  string           `yaml:"target_model,omitempty"`
+	RestoreModel bool             `yaml:"restore_model,omitempty"`
+}
+
+// RuleConditions match on request content. Every condition that is set must
+// hold. Headers maps a header name to its required value, or "*" for any
+// value.
+type RuleConditions struct {
+	MinPromptTokens int               `yaml:"min_prompt_tokens,omitempty"`
+	MaxPromptTokens int               `yaml:"max_prompt_tokens,omitempty"`
+	HasTools        *bool             `yaml:"has_tools,omitempty"`
+	HasImages       *bool             `yaml:"has_images,omitempty"`
+	Stream          *bool             `yaml:"stream,omitempty"`
+	Headers         map[string]string `yaml:"headers,omitempty"`
+}
+
+// Conditional reports whether the rule looks at request content
+func (r ModelRule) Conditional() bool {
+	return r.When != nil
+}
+
+// WeightedTarget is one leg of a traffic split. Weights are relative.
+type WeightedTarget struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// Label identifies the rule in logs and routing decisions
+func (r ModelRule) Label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	if r.Pattern == "" && r.Conditional() {
+		return "when"
+	}
+	return r.matchType() + ":" + r.Pattern
+}
+
+func (r ModelRule) matchType() string {
+	if r.Match == "" {
+		return MatchExact
+	}
+	return r.Match
+}
+
+// Matcher compiles the rule into a predicate over model names. Globs support
+// * and ?; regexes must match the whole model name.
+func (r ModelRule) Matcher() (func(model string) bool, error) {
+	if r.Pattern == "" && r.Conditional() {
+		return func(string) bool { return true }, nil
+	}
+	switch r.matchType() {
+	case MatchExact:
+		pattern := r.Pattern
+		return func(model string) bool { return model == pattern }, nil
+	case MatchPrefix:
+		prefix := r.Pattern
+		return func(model string) bool { return strings.HasPrefix(model, prefix) }, nil
+	case MatchGlob, MatchRegex:
+		re, err := r.regexp()
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	default:
+		return nil, fmt.Errorf("unknown match type %q", r.Match)
+	}
+}
+
+// regexp returns the anchored expression for glob and regex rules
+func (r ModelRule) regexp() (*regexp.Regexp, error) {
+	expr := r.Pattern
+	if r.matchType() == MatchGlob {
+		var b strings.Builder
+		for _, c := range r.Pattern {
+			switch c {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		expr = b.String()
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", r.Pattern, err)
+	}
+	return re, nil
+}
+
+// literalPrefix returns a prefix every model matched by the rule starts with
+func (r ModelRule) literalPrefix() string {
+	switch r.matchType() {
+	case MatchGlob:
+		if i := strings.IndexAny(r.Pattern, "*?"); i >= 0 {
+			return r.Pattern[:i]
+		}
+		return r.Pattern
+	case MatchRegex:
+		re, err := r.regexp()
+		if err != nil {
+			return ""
+		}
+		prefix, _ := re.LiteralPrefix()
+		return prefix
+	default:
+		return r.Pattern
+	}
+}
+
+// coveredPrefix reports whether the rule matches every model starting with
+// some prefix, and returns that prefix
+func (r ModelRule) coveredPrefix() (string, bool) {
+	switch r.matchType() {
+	case MatchPrefix:
+		return r.Pattern, true
+	case MatchGlob:
+		if strings.HasSuffix(r.Pattern, "*") && !strings.ContainsAny(r.Pattern[:len(r.Pattern)-1], "*?") {
+			return r.Pattern[:len(r.Pattern)-1], true
+		}
+	case MatchRegex:
+		if r.Pattern == ".*" {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// shadows reports whether r matches everything later could match, leaving
+// later unreachable
+func (r ModelRule) shadows(later ModelRule) bool {
+	// Conditional rules are evaluated first and only when their conditions
+	// hold, so they neither shadow nor are shadowed by plain rules
+	if r.Conditional() || later.Conditional() {
+		return r.Conditional() && later.Conditional() && r.Pattern == later.Pattern &&
+			r.matchType() == later.matchType() && reflect.DeepEqual(r.When, later.When)
+	}
+	if r.matchType() == later.matchType() && r.Pattern == later.Pattern {
+		return true
+	}
+	if later.matchType() == MatchExact {
+		if match, err := r.Matcher(); err == nil && match(later.Pattern) {
+			return true
+		}
+	}
+	if prefix, ok := r.coveredPrefix(); ok && strings.HasPrefix(later.literalPrefix(), prefix) {
+		return true
+	}
+	return false
+}
+
+// validateModelRules checks rule syntax and flags rules that can never match
+// because the Models table or an earlier rule always wins
+func (c *ModelRoutingConfig) validateModelRules() error {
+	for i, rule := range c.Rules {
+		if rule.Pattern == "" && rule.matchType() != MatchPrefix && !rule.Conditional() {
+			return fmt.Errorf("model routing rule %d (%s): pattern is required", i+1, rule.Label())
+		}
+		if err := rule.validateTargets(); err != nil {
+			return fmt.Errorf("model routing rule %d (%s) %w", i+1, rule.Label(), err)
+		}
+		if rule.RestoreModel && rule.TargetModel == "" {
+			return fmt.Errorf("model routing rule %d (%s): restore_model requires target_model", i+1, rule.Label())
+		}
+		if _, err := rule.Matcher(); err != nil {
+			return fmt.Errorf("model routing rule %d (%s): %w", i+1, rule.Label(), err)
+		}
+
+		if err := rule.When.validate(); err != nil {
+			return fmt.Errorf("model routing rule %d (%s): %w", i+1, rule.Label(), err)
+		}
+
+		if rule.matchType() == MatchExact && !rule.Conditional() {
+			if _, ok := c.Models[rule.Pattern]; ok {
+				return fmt.Errorf("model routing rule %d (%s) is unreachable: %s is in the models table", i+1, rule.Label(), rule.Pattern)
+			}
+		}
+		for j, earlier := range c.Rules[:i] {
+			if earlier.shadows(rule) {
+				return fmt.Errorf("model routing rule %d (%s) is unreachable: shadowed by rule %d (%s)",
+					i+1, rule.Label(), j+1, earlier.Label())
+			}
+		}
+	}
+	return nil
+}
+
+func (c *RuleConditions) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.MinPromptTokens < 0 || c.MaxPromptTokens < 0 {
+		return fmt.Errorf("prompt token bounds must not be negative")
+	}
+	if c.MaxPromptTokens > 0 && c.MinPromptTokens > c.MaxPromptTokens {
+		return fmt.Errorf("min_prompt_tokens %d exceeds max_prompt_tokens %d", c.MinPromptTokens, c.MaxPromptTokens)
+	}
+	for name, value := range c.Headers {
+		if name == "" || value == "" {
+			return fmt.Errorf("header conditions need a name and a value")
+		}
+	}
+	return nil
+}
+
+func (r ModelRule) validateTargets() error {
+	if len(r.Targets) == 0 {
+		if r.Target == "" {
+			return fmt.Errorf("has empty target URL")
+		}
+		return nil
+	}
+	if r.Target != "" {
+		return fmt.Errorf("sets both target and targets")
+	}
+	for i, target := range r.Targets {
+		if target.URL == "" {
+			return fmt.Errorf("has empty URL for target %d", i+1)
+		}
+		if target.Weight <= 0 {
+			return fmt.Errorf("has non-positive weight for target %s", target.URL)
+		}
+	}
+
+	switch {
+	case r.Sticky == "", r.Sticky == StickyClient, r.Sticky == StickyConversation:
+	case strings.HasPrefix(r.Sticky, StickyHeaderPrefix) && len(r.Sticky) > len(StickyHeaderPrefix):
+	default:
+		return fmt.Errorf("has unknown sticky mode %q", r.Sticky)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import "fmt"
+
+// ModelPrice is what a model costs in USD per million tokens. Cached input
+// tokens are billed at Cached instead of Input when it is set.
+type ModelPrice struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+	Cached float64 `yaml:"cached,omitempty"`
+}
+
+// Cost returns the USD cost of a request. cached is the part of input
+// served from the prompt cache.
+func (p ModelPrice) Cost(input, cached, output int) float64 {
+	if cached > input {
+		cached = input
+	}
+	cachedPrice := p.Cached
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	return (float64(input-cached)*p.Input + float64(cached)*cachedPrice + float64(output)*p.Output) / 1e6
+}
+
+// ClassTarget is one way to serve a capability class: a model on a target
+type ClassTarget struct {
+	Target string `yaml:"target"`
+	Model  string `yaml:"model"`
+}
+
+func (c *ModelRoutingConfig) validatePricing() error {
+	for model, price := range c.Pricing {
+		if price.Input < 0 || price.Output < 0 || price.Cached < 0 {
+			return fmt.Errorf("pricing for model %s must not be negative", model)
+		}
+	}
+
+	for class, candidates := range c.Classes {
+		if len(candidates) == 0 {
+			return fmt.Errorf("capability class %s has no targets", class)
+		}
+		for _, candidate := range candidates {
+			if candidate.Target == "" || candidate.Model == "" {
+				return fmt.Errorf("capability class %s: every entry needs a target and a model", class)
+			}
+			if _, ok := c.Pricing[candidate.Model]; !ok {
+				return fmt.Errorf("capability class %s: no pricing for model %s", class, candidate.Model)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RateLimitWindow allows Requests per Period, with bursts of up to Burst
+// requests. Burst defaults to Requests, so a whole window's allowance can be
+// used at once.
+type RateLimitWindow struct {
+	Requests int    `yaml:"requests"`
+	Period   string `yaml:"period,omitempty"` // second (default), minute, hour, day or a duration such as 10s
+	Burst    int    `yaml:"burst,omitempty"`
+}
+
+// Rate is a window resolved to a per-second rate
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Rates returns every window the rule configures. A request must fit all of
+// them.
+func (r RateLimitRule) Rates() ([]Rate, error) {
+	var rates []Rate
+
+	if r.RequestsPerSecond != 0 {
+		if r.Requests != 0 {
+			return nil, fmt.Errorf("sets both requests_per_second and requests")
+		}
+		if r.RequestsPerSecond < 0 {
+			return nil, fmt.Errorf("requests_per_second must be positive")
+		}
+		if r.Burst < 0 {
+			return nil, fmt.Errorf("burst must not be negative")
+		}
+		burst := r.Burst
+		if burst == 0 {
+			// Up to 2 seconds worth of requests
+			burst = int(r.RequestsPerSecond * 2)
+		}
+		rates = append(rates, Rate{PerSecond: r.RequestsPerSecond, Burst: max(burst, 1)})
+	} else if r.Requests != 0 || r.Period != "" {
+		rate, err := RateLimitWindow{Requests: r.Requests, Period: r.Period, Burst: r.Burst}.rate()
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	} else if r.Burst != 0 {
+		return nil, fmt.Errorf("burst needs requests_per_second or requests")
+	}
+
+	for i, window := range r.Windows {
+		rate, err := window.rate()
+		if err != nil {
+			return nil, fmt.Errorf("window %d: %w", i+1, err)
+		}
+		rates = append(rates, rate)
+	}
+
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("no requests_per_second, requests or windows set")
+	}
+	return rates, nil
+}
+
+func (w RateLimitWindow) rate() (Rate, error) {
+	if w.Requests <= 0 {
+		return Rate{}, fmt.Errorf("requests must be positive")
+	}
+	if w.Burst < 0 {
+		return Rate{}, fmt.Errorf("burst must not be negative")
+	}
+	period, err := ParsePeriod(w.Period)
+	if err != nil {
+		return Rate{}, err
+	}
+
+	burst := w.Burst
+	if burst == 0 {
+		burst = w.Requests
+	}
+	return Rate{PerSecond: float64(w.Requests) / period.Seconds(), Burst: burst}, nil
+}
+
+// ParsePeriod accepts a unit name (second, minute, hour, day and their
+// abbreviations) or a Go duration. An empty period is one second.
+func ParsePeriod(period string) (time.Duration, error) {
+	switch strings.ToLower(strings.TrimSpace(period)) {
+	case "", "s", "sec", "second":
+		return time.Second, nil
+	case "min", "minute":
+		return time.Minute, nil
+	case "h", "hr", "hour":
+		return time.Hour, nil
+	case "d", "day":
+		return 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(period)
+	if err != nil {
+		return 0, fmt.Errorf("invalid period %q", period)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("period %q must be positive", period)
+	}
+	return d, nil
+}
+
+// validateScope checks the domain pattern, path prefix and methods
+func (r RateLimitRule) validateScope() error {
+	if strings.Contains(strings.TrimPrefix(r.Domain, "*."), "*") {
+		return fmt.Errorf("wildcards must be a leading *. label, e.g. *.example.com")
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("path_prefix %q must start with /", r.PathPrefix)
+	}
+	for _, method := range r.Methods {
+		if method == "" {
+			return fmt.Errorf("methods must not be empty")
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateRateLimits() error {
+	if err := c.validateHeaderSchemas(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range c.RateLimits {
+		if rule.Domain == "" {
+			return fmt.Errorf("rate limit %d: domain is required", i+1)
+		}
+		if err := rule.validateScope(); err != nil {
+			return fmt.Errorf("rate limit %s: %w", rule.Domain, err)
+		}
+		if _, err := rule.Rates(); err != nil {
+			return fmt.Errorf("rate limit %s: %w", rule.Domain, err)
+		}
+		if err := c.validateHeaders(rule); err != nil {
+			return fmt.Errorf("rate limit %s: %w", rule.Domain, err)
+		}
+
+		methods := make([]string, len(rule.Methods))
+		for j, method := range rule.Methods {
+			methods[j] = strings.ToUpper(method)
+		}
+		sort.Strings(methods)
+		key := strings.Join(methods, ",") + " " + strings.ToLower(rule.Domain) + rule.PathPrefix
+		if seen[key] {
+			return fmt.Errorf("rate limit %d: duplicate rule for %s", i+1, strings.TrimSpace(key))
+		}
+		seen[key] = true
+	}
+
+	if c.DefaultRateLimit != nil {
+		if _, err := c.DefaultRateLimit.Rates(); err != nil {
+			return fmt.Errorf("default_rate_limit: %w", err)
+		}
+		if err := c.validateHeaders(*c.DefaultRateLimit); err != nil {
+			return fmt.Errorf("default_rate_limit: %w", err)
+		}
+	}
+
+	if c.ClientRateLimits != nil {
+		if err := c.ClientRateLimits.validate(); err != nil {
+			return fmt.Errorf("client_rate_limits: %w", err)
+		}
+	}
+	return nil
+}
+
+// Ways to identify the client a request comes from
+const (
+	ClientKeyAPIKey = "api_key"
+	ClientKeyIP     = "ip"
+	ClientKeyHeader = "header"
+)
+
+// ClientRateLimits limits requests per inbound client on top of the per
+// domain limits. Clients are told apart by the API key they send the proxy,
+// their IP address or a header such as X-Team.
+type ClientRateLimits struct {
+	Key               string            `yaml:"key,omitempty"` // api_key (default), ip or header
+	Header            string            `yaml:"header,omitempty"`
+	TrustForwardedFor bool              `yaml:"trust_forwarded_for,omitempty"` // use X-Forwarded-For for ip
+	Default           *RateLimitRule    `yaml:"default,omitempty"`             // each client without a rule
+	Clients           []ClientRateLimit `yaml:"clients,omitempty"`
+}
+
+// ClientRateLimit gives the clients matching Client, an API key, header
+// value, IP or CIDR, one shared budget. Name labels it in metrics.
+type ClientRateLimit struct {
+	Name          string `yaml:"name,omitempty"`
+	Client        string `yaml:"client"`
+	RateLimitRule `yaml:",inline"`
+}
+
+func (c *ClientRateLimits) validate() error {
+	if err := validateClientKey(c.Key, c.Header); err != nil {
+		return err
+	}
+
+	if c.Default != nil {
+		if err := c.Default.validateClientRule(); err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, client := range c.Clients {
+		if err := validateClient(c.Key, client.Client, seen); err != nil {
+			return fmt.Errorf("client %d: %w", i+1, err)
+		}
+		if err := client.RateLimitRule.validateClientRule(); err != nil {
+			return fmt.Errorf("client %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (f *FairQueuingConfig) validate() error {
+	if f == nil {
+		return nil
+	}
+	if err := validateClientKey(f.Key, f.Header); err != nil {
+		return err
+	}
+	if f.Aging < 0 {
+		return fmt.Errorf("aging must not be negative")
+	}
+
+	seen := make(map[string]bool)
+	for i, tenant := range f.Tenants {
+		if err := validateClient(f.Key, tenant.Client, seen); err != nil {
+			return fmt.Errorf("tenant %d: %w", i+1, err)
+		}
+		if tenant.Weight <= 0 {
+			return fmt.Errorf("tenant %d: weight must be positive", i+1)
+		}
+	}
+	return nil
+}
+
+// validateClientKey checks how clients are told apart
+func validateClientKey(key, header string) error {
+	switch key {
+	case "", ClientKeyAPIKey, ClientKeyIP:
+	case ClientKeyHeader:
+		if header == "" {
+			return fmt.Errorf("key header requires a header name")
+		}
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+// validateClient checks a client value for the key, and that no other rule
+// in seen has it
+func validateClient(key, client string, seen map[string]bool) error {
+	if client == "" {
+		return fmt.Errorf("client is required")
+	}
+	if seen[client] {
+		return fmt.Errorf("duplicate rule for %s", client)
+	}
+	seen[client] = true
+
+	if key == ClientKeyIP && net.ParseIP(client) == nil {
+		if _, _, err := net.ParseCIDR(client); err != nil {
+			return fmt.Errorf("%q is not an IP address or CIDR", client)
+		}
+	}
+	return nil
+}
+
+// validateClientRule checks a rule used for clients, which have no domain,
+// path or methods
+func (r RateLimitRule) validateClientRule() error {
+	if r.Domain != "" || r.PathPrefix != "" || len(r.Methods) > 0 {
+		return fmt.Errorf("domain, path_prefix and methods do not apply to client limits")
+	}
+	if r.Headers != "" {
+		return fmt.Errorf("headers do not apply to client limits")
+	}
+	_, err := r.Rates()
+	return err
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
 	"time"
 )
 
@@ -18,6 +20,31 @@ type ProviderConfig struct {
 	LoadBalancing *LoadBalancingConfig     `yaml:"load_balancing,omitempty"`
 	APIKey        string                   `yaml:"api_key,omitempty"`
 	RateLimiting  *ProviderRateLimitConfig `yaml:"rate_limiting,omitempty"`
+	AWS           *AWSConfig               `yaml:"aws,omitempty"`
+	Azure         *AzureConfig             `yaml:"azure,omitempty"`
+}
+
+// AWSConfig holds SigV4 signing settings for AWS-hosted providers (Bedrock).
+// Static keys take precedence over the shared credentials file.
+type AWSConfig struct {
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+	SessionToken    string `yaml:"session_token,omitempty"`
+	CredentialsFile string `yaml:"credentials_file,omitempty"`
+	Profile         string `yaml:"profile,omitempty"`
+}
+
+// AzureConfig maps model names to Azure OpenAI deployments. Models without
+// an entry use the model name as the deployment and the default api-version.
+type AzureConfig struct {
+	APIVersion  string                     `yaml:"api_version"`
+	Deployments map[string]AzureDeployment `yaml:"deployments,omitempty"`
+}
+
+type AzureDeployment struct {
+	Deployment string `yaml:"deployment"`
+	APIVersion string `yaml:"api_version,omitempty"`
 }
 
 type LoadBalancingConfig struct {
@@ -37,6 +64,7 @@ type ProviderRateLimitConfig struct {
 	BackoffThreshold  int     `yaml:"backoff_threshold,omitempty"`
 	RequestsPerMinute int     `yaml:"requests_per_minute,omitempty"`
 	TokensPerMinute   int     `yaml:"tokens_per_minute,omitempty"`
+	SpreadDaily       bool    `yaml:"spread_daily,omitempty"` // pace the day's remaining requests until its reset
 }
 
 type ReasoningConfig struct {
@@ -53,15 +81,19 @@ type MonitoringConfig struct {
 }
 
 type Config struct {
-	Server            ServerConfig        `yaml:"server"`
-	EnvironmentModels EnvironmentModels   `yaml:"environment_models"`
-	Providers         []ProviderConfig    `yaml:"providers"`
-	ReasoningConfig   ReasoningConfig     `yaml:"reasoning_injection"`
-	RateLimits        []RateLimitRule     `yaml:"rate_limits"`
-	DefaultRateLimit  *RateLimitRule      `yaml:"default_rate_limit"`
-	CerebrasLimits    CerebrasLimits      `yaml:"cerebras_limits"`
-	ModelRouting      *ModelRoutingConfig `yaml:"model_routing"`
-	Monitoring        MonitoringConfig    `yaml:"monitoring,omitempty"`
+	Server            ServerConfig            `yaml:"server"`
+	EnvironmentModels EnvironmentModels       `yaml:"environment_models"`
+	ModelMappings     []ModelMapping          `yaml:"model_mappings,omitempty"`
+	Providers         []ProviderConfig        `yaml:"providers"`
+	ReasoningConfig   ReasoningConfig         `yaml:"reasoning_injection"`
+	RateLimits        []RateLimitRule         `yaml:"rate_limits"`
+	DefaultRateLimit  *RateLimitRule          `yaml:"default_rate_limit"`
+	RateLimitHeaders  map[string]HeaderSchema `yaml:"rate_limit_headers,omitempty"`
+	ClientRateLimits  *ClientRateLimits       `yaml:"client_rate_limits,omitempty"`
+	CerebrasLimits    CerebrasLimits          `yaml:"cerebras_limits"`
+	ModelRouting      *ModelRoutingConfig     `yaml:"model_routing"`
+	Monitoring        MonitoringConfig        `yaml:"monitoring,omitempty"`
+	State             *StateConfig            `yaml:"state,omitempty"`
 }
 
 type ServerConfig struct {
@@ -73,9 +105,21 @@ type ServerConfig struct {
 	OpenAIEndpoint    string `yaml:"openai_endpoint"`
 }
 
+// RateLimitRule limits requests to a domain, optionally only those under
+// PathPrefix or with one of Methods. requests_per_second is shorthand for a
+// one-second window with a two-second burst; requests, period and burst
+// describe any window, and windows stacks more of them. Headers names the
+// schema of the quota headers the upstream sends, if it should be followed.
 type RateLimitRule struct {
-	Domain            string `yaml:"domain"`
-	RequestsPerSecond int    `yaml:"requests_per_second"`
+	Domain            string            `yaml:"domain"`
+	PathPrefix        string            `yaml:"path_prefix,omitempty"`
+	Methods           []string          `yaml:"methods,omitempty"`
+	RequestsPerSecond float64           `yaml:"requests_per_second,omitempty"`
+	Requests          int               `yaml:"requests,omitempty"`
+	Period            string            `yaml:"period,omitempty"`
+	Burst             int               `yaml:"burst,omitempty"`
+	Windows           []RateLimitWindow `yaml:"windows,omitempty"`
+	Headers           string            `yaml:"headers,omitempty"` // quota headers to adapt to, see HeaderSchema
 }
 
 type CerebrasRateLimitConfig struct {
@@ -92,12 +136,163 @@ type CerebrasLimits struct {
 	MaxQueueDepth     int                     `yaml:"max_queue_depth"`
 	RequestTimeout    time.Duration           `yaml:"request_timeout"`
 	PriorityThreshold float64                 `yaml:"priority_threshold"`
+	Peers             *PeerConfig             `yaml:"peers,omitempty"`
+	FairQueuing       *FairQueuingConfig      `yaml:"fair_queuing,omitempty"`
+}
+
+// FairQueuingConfig shares the Cerebras queue between tenants, told apart
+// like clients in client_rate_limits. Tenants with waiting requests are
+// served in turn, each in proportion to its weight.
+type FairQueuingConfig struct {
+	Key               string        `yaml:"key,omitempty"` // api_key (default), ip or header
+	Header            string        `yaml:"header,omitempty"`
+	TrustForwardedFor bool          `yaml:"trust_forwarded_for,omitempty"` // use X-Forwarded-For for ip
+	Tenants           []TenantShare `yaml:"tenants,omitempty"`
+	Aging             time.Duration `yaml:"aging,omitempty"` // wait worth one priority point, default 1m
+}
+
+// TenantShare gives the clients matching Client, an API key, header value,
+// IP or CIDR, a Weight; tenants not listed have weight 1. Name labels the
+// tenant in metrics.
+type TenantShare struct {
+	Name   string `yaml:"name,omitempty"`
+	Client string `yaml:"client"`
+	Weight int    `yaml:"weight"`
+}
+
+// PeerConfig shares the RPM/TPM limits between proxy instances using the
+// same Cerebras org. Each instance leases a slice of the limits from a
+// static peer list and the slices are rebalanced by demand.
+type PeerConfig struct {
+	Self     string        `yaml:"self"`                // URL the peers reach this instance at
+	Peers    []string      `yaml:"peers"`               // URLs of the other instances
+	Interval time.Duration `yaml:"interval,omitempty"`  // how often leases are exchanged, default 5s
+	LeaseTTL time.Duration `yaml:"lease_ttl,omitempty"` // a peer silent this long is gone, default 3 intervals
+	Secret   string        `yaml:"secret"`              // shared by all instances; only holders may read leases
+}
+
+// StateConfig persists rate limiter and key usage state to a local file so
+// a restart does not hand out the budget already spent
+type StateConfig struct {
+	Path     string        `yaml:"path"`               // snapshot file, written atomically
+	Interval time.Duration `yaml:"interval,omitempty"` // how often it is written, default 30s
 }
 
 type ModelRoutingConfig struct {
 	Enabled       bool              `yaml:"enabled"`
 	DefaultTarget string            `yaml:"default_target"`
 	Models        map[string]string `yaml:"models"`
+	Rules         []ModelRule       `yaml:"rules,omitempty"`
+	// Targets holds per-target path handling, keyed by target URL
+	Targets map[string]TargetConfig `yaml:"targets,omitempty"`
+	// Pricing is keyed by upstream model name
+	Pricing map[string]ModelPrice `yaml:"pricing,omitempty"`
+	// Classes lists interchangeable model/target pairs per capability class;
+	// requests for a class go to the cheapest one with rate-limit headroom
+	Classes map[string][]ClassTarget `yaml:"classes,omitempty"`
+	// MaxBodyBytes rejects larger request bodies with 413; 0 means 32 MiB
+	MaxBodyBytes int64 `yaml:"max_body_bytes,omitempty"`
+}
+
+// TargetConfig adjusts the request path before it is joined onto a target's
+// base path. StripPrefix is removed first, then the first matching
+// RewritePath rule is applied. Auth replaces the client's credentials with
+// the target's own.
+type TargetConfig struct {
+	StripPrefix string        `yaml:"strip_prefix,omitempty"`
+	RewritePath []PathRewrite `yaml:"rewrite_path,omitempty"`
+	Auth        *TargetAuth   `yaml:"auth,omitempty"`
+}
+
+// Auth styles for TargetAuth
+const (
+	AuthStyleBearer  = "bearer"    // Authorization: Bearer <key>
+	AuthStyleXAPIKey = "x-api-key" // Anthropic
+	AuthStyleAPIKey  = "api-key"   // Azure OpenAI
+	AuthStyleHeader  = "header"    // <Header>: <key>
+)
+
+// TargetAuth holds the credentials model routing injects for a target.
+// APIKeys is a pool used round robin instead of APIKey.
+type TargetAuth struct {
+	Style   string   `yaml:"style,omitempty"` // bearer (default), x-api-key, api-key or header
+	Header  string   `yaml:"header,omitempty"`
+	APIKey  string   `yaml:"api_key,omitempty"`
+	APIKeys []string `yaml:"api_keys,omitempty"`
+}
+
+// PathRewrite replaces request paths matching the Match regex with Replace,
+// which may reference capture groups as $1
+type PathRewrite struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+func (a *TargetAuth) validate() error {
+	if a == nil {
+		return nil
+	}
+	switch a.Style {
+	case "", AuthStyleBearer, AuthStyleXAPIKey, AuthStyleAPIKey:
+	case AuthStyleHeader:
+		if a.Header == "" {
+			return fmt.Errorf("auth style header requires a header name")
+		}
+	default:
+		return fmt.Errorf("unknown auth style %q", a.Style)
+	}
+
+	if a.APIKey != "" && len(a.APIKeys) > 0 {
+		return fmt.Errorf("auth sets both api_key and api_keys")
+	}
+	keys := a.APIKeys
+	if a.APIKey != "" {
+		keys = []string{a.APIKey}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("auth has no API key")
+	}
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("auth has an empty API key; check its environment variable")
+		}
+	}
+	return nil
+}
+
+func (p *PeerConfig) validate() error {
+	if p == nil {
+		return nil
+	}
+	if err := validatePeerURL(p.Self); err != nil {
+		return fmt.Errorf("self: %w", err)
+	}
+	if len(p.Peers) == 0 {
+		return fmt.Errorf("at least one peer is required")
+	}
+	for _, peer := range p.Peers {
+		if err := validatePeerURL(peer); err != nil {
+			return fmt.Errorf("peer %q: %w", peer, err)
+		}
+		if peer == p.Self {
+			return fmt.Errorf("peer %q is this instance's self URL", peer)
+		}
+	}
+	if p.Interval < 0 || p.LeaseTTL <= p.Interval {
+		return fmt.Errorf("lease_ttl must be longer than interval")
+	}
+	if p.Secret == "" {
+		return fmt.Errorf("secret is required; check its environment variable")
+	}
+	return nil
+}
+
+func validatePeerURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http(s) URL")
+	}
+	return nil
 }
 
 // Set default values for CerebrasLimits
@@ -128,6 +323,18 @@ func (c *CerebrasLimits) SetDefaults() {
 	if c.RateLimits.ResetBuffer == 0 {
 		c.RateLimits.ResetBuffer = 100 * time.Millisecond
 	}
+
+	if c.FairQueuing != nil && c.FairQueuing.Aging == 0 {
+		c.FairQueuing.Aging = time.Minute
+	}
+	if c.Peers != nil {
+		if c.Peers.Interval == 0 {
+			c.Peers.Interval = 5 * time.Second
+		}
+		if c.Peers.LeaseTTL == 0 {
+			c.Peers.LeaseTTL = 3 * c.Peers.Interval
+		}
+	}
 }
 
 // Validate validates the configuration
@@ -150,6 +357,51 @@ func (c *Config) Validate() error {
 		if len(provider.Models) == 0 {
 			return fmt.Errorf("provider %s: at least one model is required", provider.Name)
 		}
+		if provider.Name == "bedrock" {
+			if provider.AWS == nil || provider.AWS.Region == "" {
+				return fmt.Errorf("provider %s: aws.region is required", provider.Name)
+			}
+			if provider.AWS.AccessKeyID == "" && provider.AWS.CredentialsFile == "" {
+				return fmt.Errorf("provider %s: aws access_key_id or credentials_file is required", provider.Name)
+			}
+			if (provider.AWS.AccessKeyID == "") != (provider.AWS.SecretAccessKey == "") {
+				return fmt.Errorf("provider %s: aws access_key_id and secret_access_key must be set together", provider.Name)
+			}
+		}
+		if provider.Name == "azure" && provider.Azure != nil {
+			for model, deployment := range provider.Azure.Deployments {
+				if deployment.Deployment == "" {
+					return fmt.Errorf("provider %s: deployment name is required for model %s", provider.Name, model)
+				}
+				if deployment.APIVersion == "" && provider.Azure.APIVersion == "" {
+					return fmt.Errorf("provider %s: api_version is required for model %s", provider.Name, model)
+				}
+			}
+		}
+	}
+
+	if err := c.validateRateLimits(); err != nil {
+		return err
+	}
+
+	if err := c.CerebrasLimits.Peers.validate(); err != nil {
+		return fmt.Errorf("cerebras_limits.peers: %w", err)
+	}
+	if err := c.CerebrasLimits.FairQueuing.validate(); err != nil {
+		return fmt.Errorf("cerebras_limits.fair_queuing: %w", err)
+	}
+
+	if c.State != nil {
+		if c.State.Path == "" {
+			return fmt.Errorf("state: path is required")
+		}
+		if c.State.Interval < 0 {
+			return fmt.Errorf("state: interval must not be negative")
+		}
+	}
+
+	if err := c.validateModelMappings(); err != nil {
+		return err
 	}
 
 	// Validate model routing configuration
@@ -157,6 +409,9 @@ func (c *Config) Validate() error {
 		if c.ModelRouting.DefaultTarget == "" {
 			return fmt.Errorf("model routing is enabled but no default target is specified")
 		}
+		if c.ModelRouting.MaxBodyBytes < 0 {
+			return fmt.Errorf("model routing max_body_bytes must not be negative")
+		}
 
 		// Validate that model targets are valid URLs
 		for model, target := range c.ModelRouting.Models {
@@ -164,6 +419,25 @@ func (c *Config) Validate() error {
 				return fmt.Errorf("model %s has empty target URL", model)
 			}
 		}
+
+		if err := c.ModelRouting.validateModelRules(); err != nil {
+			return err
+		}
+
+		if err := c.ModelRouting.validatePricing(); err != nil {
+			return err
+		}
+
+		for target, targetConfig := range c.ModelRouting.Targets {
+			for _, rewrite := range targetConfig.RewritePath {
+				if _, err := regexp.Compile(rewrite.Match); err != nil {
+					return fmt.Errorf("target %s: invalid rewrite_path pattern %q: %w", target, rewrite.Match, err)
+				}
+			}
+			if err := targetConfig.Auth.validate(); err != nil {
+				return fmt.Errorf("target %s: %w", target, err)
+			}
+		}
 	}
 
 	return nil
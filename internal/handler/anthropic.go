@@ -1,15 +1,20 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
 	"github.com/cooldownp/cooldown-proxy/internal/model"
 	"github.com/cooldownp/cooldown-proxy/internal/provider"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 	"github.com/cooldownp/cooldown-proxy/internal/reasoning"
 )
 
@@ -19,6 +24,8 @@ type AnthropicHandler struct {
 	modelRouter     *model.ModelRouter
 	providerManager *provider.ProviderManager
 	reasonInjector  *reasoning.ReasoningInjector
+	rateLimiter     *ratelimit.Limiter
+	clientLimiter   *ratelimit.ClientLimiter
 }
 
 type Router struct {
@@ -59,6 +66,32 @@ type AnthropicContent struct {
 	Text string `json:"text,omitempty"`
 }
 
+// waitForProvider waits for the domain limit of the endpoint serving model,
+// looked up like a POST to the endpoint URL so path and method rules apply.
+// Endpoints without a rate_limits rule are not held to the default rate,
+// which is meant for arbitrary proxied hosts.
+func (h *AnthropicHandler) waitForProvider(r *http.Request, model string) *proxyerrors.ProxyError {
+	if h.rateLimiter == nil {
+		return nil
+	}
+	providerConfig := h.modelRouter.GetProviderForModel(model)
+	if providerConfig == nil {
+		return nil
+	}
+	endpoint, err := url.Parse(providerConfig.Endpoint)
+	if err != nil {
+		return nil
+	}
+	upstream := &http.Request{Method: http.MethodPost, Host: endpoint.Host, URL: endpoint}
+	if !h.rateLimiter.HasRequestRule(upstream) {
+		return nil
+	}
+	if err := h.rateLimiter.ReserveRequest(upstream).Wait(r.Context()); err != nil {
+		return proxyerrors.NewRateLimitWaitError(endpoint.Host, err)
+	}
+	return nil
+}
+
 func NewRouter(config *config.Config) *Router {
 	return &Router{
 		routes: make(map[string]*url.URL),
@@ -75,12 +108,36 @@ func NewAnthropicHandler(config *config.Config) *AnthropicHandler {
 	}
 }
 
+// SetRateLimiter applies the per-domain rules to the provider endpoint each
+// request goes to
+func (h *AnthropicHandler) SetRateLimiter(limiter *ratelimit.Limiter) {
+	h.rateLimiter = limiter
+}
+
+// SetClientLimiter applies per-client limits before the per-domain ones
+func (h *AnthropicHandler) SetClientLimiter(limiter *ratelimit.ClientLimiter) {
+	h.clientLimiter = limiter
+}
+
+// Providers returns the manager of the providers requests are sent to
+func (h *AnthropicHandler) Providers() *provider.ProviderManager {
+	return h.providerManager
+}
+
 func (h *AnthropicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if h.clientLimiter != nil {
+		if err := h.clientLimiter.Reserve(r).Wait(r.Context()); err != nil {
+			waitErr := proxyerrors.NewRateLimitWaitError(r.Host, err)
+			http.Error(w, waitErr.Message, waitErr.HTTPStatus())
+			return
+		}
+	}
+
 	// Parse request
 	var anthropicReq AnthropicRequest
 	if err := json.NewDecoder(r.Body).Decode(&anthropicReq); err != nil {
@@ -89,7 +146,7 @@ func (h *AnthropicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Map Claude model to provider model
-	providerModel := h.modelRouter.MapModel(anthropicReq.Model)
+	providerModel := h.modelRouter.MapRequestModel(anthropicReq.Model, r.Header)
 
 	// Convert Anthropic messages to provider format
 	providerMessages := make([]map[string]interface{}, len(anthropicReq.Messages))
@@ -110,6 +167,11 @@ func (h *AnthropicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if waitErr := h.waitForProvider(r, providerModel); waitErr != nil {
+		http.Error(w, waitErr.Message, waitErr.HTTPStatus())
+		return
+	}
+
 	// Make request to provider
 	options := map[string]interface{}{
 		"max_tokens": anthropicReq.MaxTokens,
@@ -120,7 +182,21 @@ func (h *AnthropicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		options["tools"] = anthropicReq.Tools
 	}
 
-	providerResp, err := provider.MakeRequest(providerModel, convertToInterfaceSlice(providerMessages), options)
+	providerResp, err := provider.MakeRequest(r.Context(), providerModel, convertToInterfaceSlice(providerMessages), options)
+	var quotaErr *ratelimit.DailyQuotaError
+	if errors.As(err, &quotaErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(quotaErr.RetryAfter().Seconds())+1))
+		http.Error(w, fmt.Sprintf("Provider %s: %v", provider.Name(), quotaErr), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil && r.Context().Err() != nil {
+		status := http.StatusGatewayTimeout
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			status = proxyerrors.StatusClientClosedRequest
+		}
+		http.Error(w, "Request cancelled while waiting for the provider", status)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Provider error: %v", err), http.StatusInternalServerError)
 		return
@@ -1,12 +1,19 @@
 package handler
 
 import (
+	"context"
+	"io"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAnthropicEndpointBasics(t *testing.T) {
@@ -89,3 +96,55 @@ func TestAnthropicHandlerEndToEndFlow(t *testing.T) {
 	assert.Equal(t, 500, w.Code)
 	assert.Contains(t, w.Body.String(), "Provider error")
 }
+
+func TestAnthropicHandlerAppliesProviderPathRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id": "cmpl-1", "choices": [{"message": {"role": "assistant", "content": "Hi"}}]}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		EnvironmentModels: config.EnvironmentModels{Sonnet: "glm-4.6"},
+		Providers: []config.ProviderConfig{{
+			Name:     "cerebras",
+			Endpoint: upstream.URL + "/v1",
+			Models:   []string{"glm-4.6"},
+			LoadBalancing: &config.LoadBalancingConfig{
+				Strategy: "round_robin",
+				APIKeys:  []config.APIKeyConfig{{Key: "test-key", Weight: 1}},
+			},
+		}},
+	}
+
+	handler := NewAnthropicHandler(cfg)
+	// Only a path and method scoped rule covers the provider endpoint
+	handler.SetRateLimiter(ratelimit.New([]config.RateLimitRule{
+		{Domain: "127.0.0.1", PathPrefix: "/v1", Methods: []string{"POST"}, Requests: 1, Period: "minute"},
+	}))
+
+	send := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/anthropic/v1/messages", strings.NewReader(
+			`{"model": "claude-3-5-sonnet-20241022", "max_tokens": 10, "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, send(context.Background()).Code)
+
+	// The rule holds the next request until its deadline...
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := send(ctx)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "Timed out waiting for rate limit")
+
+	// ...and a client that goes away while waiting is reported as cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	w = send(ctx)
+	assert.Equal(t, proxyerrors.StatusClientClosedRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Request cancelled while rate limited")
+}
@@ -1,45 +1,81 @@
 package model
 
 import (
+	"log"
+	"net/http"
+
 	"github.com/cooldownp/cooldown-proxy/internal/config"
 )
 
 type ModelRouter struct {
-	config *config.Config
+	config   *config.Config
+	mappings []mapping
 }
 
-func NewModelRouter(config *config.Config) *ModelRouter {
-	return &ModelRouter{config: config}
+type mapping struct {
+	match   func(model string) bool
+	model   string
+	headers map[string]string
 }
 
-func (r *ModelRouter) MapModel(claudeModel string) string {
-	switch {
-	case contains(claudeModel, "haiku"):
-		return r.config.EnvironmentModels.Haiku
-	case contains(claudeModel, "sonnet"):
-		return r.config.EnvironmentModels.Sonnet
-	case contains(claudeModel, "opus"):
-		return r.config.EnvironmentModels.Opus
-	default:
-		return r.config.EnvironmentModels.Sonnet // default fallback
+// tierPatterns keep the environment_models haiku/sonnet/opus tiers working
+// after any configured mappings
+var tierPatterns = []string{"*haiku*", "*sonnet*", "*opus*"}
+
+func NewModelRouter(cfg *config.Config) *ModelRouter {
+	r := &ModelRouter{config: cfg}
+
+	for _, m := range cfg.ModelMappings {
+		match, err := m.Matcher()
+		if err != nil {
+			log.Printf("Skipping invalid model mapping %s: %v", m.Pattern, err)
+			continue
+		}
+		r.mappings = append(r.mappings, mapping{match: match, model: m.Model, headers: m.Headers})
+	}
+
+	tiers := []string{cfg.EnvironmentModels.Haiku, cfg.EnvironmentModels.Sonnet, cfg.EnvironmentModels.Opus}
+	for i, pattern := range tierPatterns {
+		if tiers[i] == "" {
+			continue
+		}
+		tier := config.ModelMapping{Match: config.MatchGlob, Pattern: pattern, Model: tiers[i]}
+		match, _ := tier.Matcher()
+		r.mappings = append(r.mappings, mapping{match: match, model: tier.Model})
 	}
+
+	return r
+}
+
+// MapModel maps a requested model to a provider model without header
+// overrides
+func (r *ModelRouter) MapModel(claudeModel string) string {
+	return r.MapRequestModel(claudeModel, nil)
 }
 
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr ||
-		(len(s) > len(substr) &&
-			(s[:len(substr)+1] == substr+"-" ||
-				s[len(s)-len(substr)-1:] == "-"+substr ||
-				findSubstring(s, substr))))
+// MapRequestModel passes provider models through unchanged, then tries the
+// mappings in order and falls back to the sonnet tier
+func (r *ModelRouter) MapRequestModel(requested string, header http.Header) string {
+	if r.GetProviderForModel(requested) != nil {
+		return requested
+	}
+
+	for _, m := range r.mappings {
+		if m.match(requested) && headersMatch(m.headers, header) {
+			return m.model
+		}
+	}
+	return r.config.EnvironmentModels.Sonnet // default fallback
 }
 
-func findSubstring(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
+func headersMatch(want map[string]string, header http.Header) bool {
+	for name, value := range want {
+		got := header.Get(name)
+		if got == "" || (value != "*" && got != value) {
+			return false
 		}
 	}
-	return false
+	return true
 }
 
 func (r *ModelRouter) GetProviderForModel(model string) *config.ProviderConfig {
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"net/http"
 	"testing"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
@@ -22,3 +23,45 @@ func TestModelRouterMapsClaudeToProviderModels(t *testing.T) {
 	assert.Equal(t, "glm-4.6", router.MapModel("claude-3-5-sonnet-20241022"))
 	assert.Equal(t, "glm-4.6", router.MapModel("claude-3-opus-20240229"))
 }
+
+func TestModelRouterMappingTable(t *testing.T) {
+	cfg := &config.Config{
+		EnvironmentModels: config.EnvironmentModels{
+			Haiku:  "glm-4.5-air",
+			Sonnet: "glm-4.6",
+			Opus:   "glm-4.6",
+		},
+		ModelMappings: []config.ModelMapping{
+			{Match: config.MatchGlob, Pattern: "claude-*", Model: "llama3.1-8b", Headers: map[string]string{"X-Route": "fast"}},
+			{Match: config.MatchRegex, Pattern: `claude-(sonnet|opus)-4(-\d+)*`, Model: "qwen-3-coder-480b"},
+			{Match: config.MatchPrefix, Pattern: "claude-neo", Model: "gpt-oss-120b"},
+		},
+		Providers: []config.ProviderConfig{
+			{Name: "cerebras", Models: []string{"glm-4.6", "glm-4.5-air", "gpt-oss-120b"}},
+		},
+	}
+
+	router := NewModelRouter(cfg)
+	fast := http.Header{}
+	fast.Set("X-Route", "fast")
+
+	tests := []struct {
+		name      string
+		requested string
+		header    http.Header
+		want      string
+	}{
+		{"regex mapping", "claude-sonnet-4-5-20250929", nil, "qwen-3-coder-480b"},
+		{"new model family", "claude-neo-1", nil, "gpt-oss-120b"},
+		{"header override", "claude-sonnet-4-5-20250929", fast, "llama3.1-8b"},
+		{"provider model passes through", "gpt-oss-120b", fast, "gpt-oss-120b"},
+		{"tier fallback", "claude-3-5-haiku-20241022", nil, "glm-4.5-air"},
+		{"unknown model", "mystery", nil, "glm-4.6"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, router.MapRequestModel(tt.requested, tt.header))
+		})
+	}
+}
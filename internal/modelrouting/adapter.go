@@ -0,0 +1,43 @@
+package modelrouting
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Adapter translates routed requests for upstreams whose wire format or
+// addressing differs from the OpenAI/Anthropic shape clients send.
+type Adapter interface {
+	// Name identifies the adapter in logs
+	Name() string
+	// Matches reports whether the adapter handles requests routed to target
+	Matches(target *url.URL) bool
+	// RewriteRequest returns r rewritten for the upstream. body holds the
+	// buffered client request body.
+	RewriteRequest(r *http.Request, target *url.URL, body []byte) (*http.Request, error)
+	// WrapResponseWriter returns a writer that translates the upstream
+	// response back into the client's format.
+	WrapResponseWriter(w http.ResponseWriter, r *http.Request) ResponseTranslator
+}
+
+// ResponseTranslator is an http.ResponseWriter that must be finished once the
+// upstream response has been fully written to it.
+type ResponseTranslator interface {
+	http.ResponseWriter
+	Finish() error
+}
+
+// AddAdapter registers an adapter. Adapters are consulted in registration
+// order and the first one matching the routed target wins.
+func (m *ModelRoutingMiddleware) AddAdapter(adapter Adapter) {
+	m.adapters = append(m.adapters, adapter)
+}
+
+func (m *ModelRoutingMiddleware) adapterFor(target *url.URL) Adapter {
+	for _, adapter := range m.adapters {
+		if adapter.Matches(target) {
+			return adapter
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package modelrouting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// rewriteModel replaces the value of the request body's top-level model
+// field, found by the scan, and fixes up Content-Length. The rest of the body
+// streams through untouched.
+func rewriteModel(r *http.Request, field modelField, targetModel string) error {
+	if r.Body == nil {
+		return fmt.Errorf("request has no body")
+	}
+	if field.start < 0 {
+		return fmt.Errorf("request has no model field to rewrite")
+	}
+	var encoded bytes.Buffer
+	enc := json.NewEncoder(&encoded)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(targetModel); err != nil {
+		return err
+	}
+	value := bytes.TrimSuffix(encoded.Bytes(), []byte("\n"))
+
+	r.Body = spliceBody(r.Body, field.start, field.end, value)
+	if r.ContentLength >= 0 {
+		r.ContentLength += int64(len(value)) - (field.end - field.start)
+		r.Header.Set("Content-Length", fmt.Sprintf("%d", r.ContentLength))
+	} else {
+		r.Header.Del("Content-Length")
+	}
+	return nil
+}
+
+// spliceBody returns body with the bytes from start to end replaced by value
+func spliceBody(body io.ReadCloser, start, end int64, value []byte) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(
+			io.LimitReader(body, start),
+			bytes.NewReader(value),
+			&skipReader{r: body, skip: end - start},
+		),
+		Closer: body,
+	}
+}
+
+// skipReader discards the first skip bytes of r
+type skipReader struct {
+	r    io.Reader
+	skip int64
+}
+
+func (s *skipReader) Read(p []byte) (int, error) {
+	if s.skip > 0 {
+		n, err := io.CopyN(io.Discard, s.r, s.skip)
+		s.skip -= n
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return s.r.Read(p)
+}
+
+// modelRestorer rewrites the upstream model name back to the client's alias
+// in responses. Event streams are rewritten line by line as they pass;
+// other bodies are buffered so Content-Length can be corrected.
+type modelRestorer struct {
+	rw          http.ResponseWriter
+	pattern     *regexp.Regexp
+	replacement []byte
+
+	wroteHeader    bool
+	bufferedStatus int
+	stream         bool
+	passthrough    bool
+	buf            bytes.Buffer
+}
+
+func newModelRestorer(w http.ResponseWriter, upstreamModel, clientModel string) *modelRestorer {
+	quoted, _ := json.Marshal(upstreamModel)
+	alias, _ := json.Marshal(clientModel)
+	return &modelRestorer{
+		rw:          w,
+		pattern:     regexp.MustCompile(`"model"\s*:\s*` + regexp.QuoteMeta(string(quoted))),
+		replacement: append([]byte(`"model":`), alias...),
+	}
+}
+
+func (w *modelRestorer) Header() http.Header {
+	return w.rw.Header()
+}
+
+func (w *modelRestorer) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.rw.Header()
+	if header.Get("Content-Encoding") != "" {
+		w.passthrough = true
+		w.rw.WriteHeader(status)
+		return
+	}
+
+	w.stream = strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+	if w.stream {
+		header.Del("Content-Length")
+		w.rw.WriteHeader(status)
+	}
+	// Buffered responses send their header from Finish
+	w.bufferedStatus = status
+}
+
+func (w *modelRestorer) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.rw.Write(p)
+	}
+
+	w.buf.Write(p)
+	if !w.stream {
+		return len(p), nil
+	}
+
+	// Only rewrite complete lines so a model name is never split
+	data := w.buf.Bytes()
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	if _, err := w.rw.Write(w.pattern.ReplaceAllLiteral(data[:end+1], w.replacement)); err != nil {
+		return 0, err
+	}
+	w.buf.Next(end + 1)
+	return len(p), nil
+}
+
+func (w *modelRestorer) Flush() {
+	if flusher, ok := w.rw.(http.Flusher); ok && (w.stream || w.passthrough) {
+		flusher.Flush()
+	}
+}
+
+// Finish writes any buffered body
+func (w *modelRestorer) Finish() error {
+	if !w.wroteHeader || w.passthrough {
+		return nil
+	}
+
+	body := w.pattern.ReplaceAllLiteral(w.buf.Bytes(), w.replacement)
+	w.buf.Reset()
+	if w.stream {
+		_, err := w.rw.Write(body)
+		return err
+	}
+
+	w.rw.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	w.rw.WriteHeader(w.bufferedStatus)
+	_, err := w.rw.Write(body)
+	return err
+}
@@ -0,0 +1,52 @@
+package modelrouting
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// inboundAuthHeaders carry client credentials that must not reach a target
+// with its own
+var inboundAuthHeaders = []string{"Authorization", "X-Api-Key", "Api-Key", "X-Goog-Api-Key"}
+
+// targetAuth injects a target's credentials, rotating through a key pool
+type targetAuth struct {
+	header string
+	prefix string
+	keys   []string
+	next   uint64
+}
+
+func newTargetAuth(cfg *config.TargetAuth) *targetAuth {
+	auth := &targetAuth{keys: cfg.APIKeys}
+	if cfg.APIKey != "" {
+		auth.keys = []string{cfg.APIKey}
+	}
+
+	switch cfg.Style {
+	case config.AuthStyleXAPIKey:
+		auth.header = "X-Api-Key"
+	case config.AuthStyleAPIKey:
+		auth.header = "Api-Key"
+	case config.AuthStyleHeader:
+		auth.header = cfg.Header
+	default:
+		auth.header = "Authorization"
+		auth.prefix = "Bearer "
+	}
+	return auth
+}
+
+// apply strips the client's credentials and sets the target's
+func (a *targetAuth) apply(header http.Header) {
+	for _, name := range inboundAuthHeaders {
+		header.Del(name)
+	}
+	if len(a.keys) == 0 {
+		return
+	}
+	key := a.keys[(atomic.AddUint64(&a.next, 1)-1)%uint64(len(a.keys))]
+	header.Set(a.header, a.prefix+key)
+}
@@ -1,6 +1,9 @@
 package modelrouting
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -143,3 +146,113 @@ func BenchmarkModelRoutingUnknownModel(b *testing.B) {
 		middleware.ServeHTTP(w, req)
 	}
 }
+
+// claudeCodeBody builds a request the size of a long Claude Code session,
+// with the model either before or after the messages
+func claudeCodeBody(size int, modelFirst bool) string {
+	message := `{"role": "user", "content": [{"type": "text", "text": "` + strings.Repeat(`func main() { fmt.Println(\"hi\") } `, 30) + `"}]},`
+	var b strings.Builder
+	b.WriteString("{")
+	if modelFirst {
+		b.WriteString(`"model": "claude-sonnet-4-5", `)
+	}
+	b.WriteString(`"system": "You are a coding assistant.", "messages": [`)
+	for b.Len() < size {
+		b.WriteString(message)
+	}
+	b.WriteString(`{"role": "user", "content": "done"}]`)
+	if !modelFirst {
+		b.WriteString(`, "model": "claude-sonnet-4-5"`)
+	}
+	b.WriteString(`, "max_tokens": 4096, "stream": true}`)
+	return b.String()
+}
+
+// decodeModel is the previous approach: decode the whole body into a map
+func decodeModel(r io.Reader) (string, error) {
+	var data map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return "", err
+	}
+	model, _ := data["model"].(string)
+	return model, nil
+}
+
+func BenchmarkModelExtraction(b *testing.B) {
+	for _, size := range []int{64 << 10, 1 << 20, 4 << 20} {
+		for _, modelFirst := range []bool{true, false} {
+			body := claudeCodeBody(size, modelFirst)
+			position := "model-last"
+			if modelFirst {
+				position = "model-first"
+			}
+
+			b.Run(fmt.Sprintf("decode/%dKiB/%s", size>>10, position), func(b *testing.B) {
+				b.SetBytes(int64(len(body)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := decodeModel(strings.NewReader(body)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(fmt.Sprintf("scan/%dKiB/%s", size>>10, position), func(b *testing.B) {
+				b.SetBytes(int64(len(body)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := scanModel(strings.NewReader(body)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMiddlewareLargeBody(b *testing.B) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Models:        map[string]string{"claude-sonnet-4-5": "https://api.anthropic.com/v1"},
+	}
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	middleware.logger.SetOutput(io.Discard)
+
+	body := claudeCodeBody(4<<20, true)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkMiddlewareLargeBodyPriced(b *testing.B) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Models:        map[string]string{"claude-sonnet-4-5": "https://api.anthropic.com/v1"},
+		Pricing:       map[string]config.ModelPrice{"claude-sonnet-4-5": {Input: 3, Output: 15, Cached: 0.30}},
+	}
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	middleware.logger.SetOutput(io.Discard)
+
+	body := claudeCodeBody(4<<20, true)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
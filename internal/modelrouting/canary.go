@@ -0,0 +1,210 @@
+package modelrouting
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// TargetMetrics counts responses per upstream target so canary error rates
+// can be compared before raising a weight
+type TargetMetrics struct {
+	Requests    int64
+	Errors      int64 // 5xx responses
+	RateLimited int64 // 429 responses
+	// EstimatedCostMicros is the estimated spend in millionths of a USD
+	EstimatedCostMicros int64
+}
+
+// ErrorRate returns the percentage of requests that failed with a 5xx
+func (t TargetMetrics) ErrorRate() float64 {
+	if t.Requests == 0 {
+		return 0
+	}
+	return float64(t.Errors) / float64(t.Requests) * 100
+}
+
+type targetStats struct {
+	mu      sync.RWMutex
+	targets map[string]*TargetMetrics
+}
+
+func (s *targetStats) record(target string, status int, costMicros int64) {
+	s.mu.RLock()
+	metrics := s.targets[target]
+	s.mu.RUnlock()
+	if metrics == nil {
+		s.mu.Lock()
+		if s.targets == nil {
+			s.targets = make(map[string]*TargetMetrics)
+		}
+		if metrics = s.targets[target]; metrics == nil {
+			metrics = &TargetMetrics{}
+			s.targets[target] = metrics
+		}
+		s.mu.Unlock()
+	}
+
+	atomic.AddInt64(&metrics.Requests, 1)
+	atomic.AddInt64(&metrics.EstimatedCostMicros, costMicros)
+	switch {
+	case status == http.StatusTooManyRequests:
+		atomic.AddInt64(&metrics.RateLimited, 1)
+	case status >= 500:
+		atomic.AddInt64(&metrics.Errors, 1)
+	}
+}
+
+func (s *targetStats) snapshot() map[string]TargetMetrics {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]TargetMetrics, len(s.targets))
+	for target, metrics := range s.targets {
+		result[target] = TargetMetrics{
+			Requests:    atomic.LoadInt64(&metrics.Requests),
+			Errors:      atomic.LoadInt64(&metrics.Errors),
+			RateLimited: atomic.LoadInt64(&metrics.RateLimited),
+
+			EstimatedCostMicros: atomic.LoadInt64(&metrics.EstimatedCostMicros),
+		}
+	}
+	return result
+}
+
+// pickWeighted maps key onto one of targets. The key is hashed to a fixed
+// point in [0, total weight), so a client keeps its target while weights
+// are unchanged, and moving weight onto the last target only moves clients
+// onto it.
+func pickWeighted(targets []config.WeightedTarget, salt, key string) string {
+	total := 0
+	for _, target := range targets {
+		total += target.Weight
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	point := int(h.Sum64() % uint64(total))
+
+	for _, target := range targets {
+		if point < target.Weight {
+			return target.URL
+		}
+		point -= target.Weight
+	}
+	return targets[len(targets)-1].URL
+}
+
+// stickyKey returns the value that keeps a session on one target
+func stickyKey(mode string, r *http.Request, body func() map[string]interface{}) string {
+	switch {
+	case strings.HasPrefix(mode, config.StickyHeaderPrefix):
+		if value := r.Header.Get(strings.TrimPrefix(mode, config.StickyHeaderPrefix)); value != "" {
+			return value
+		}
+	case mode == config.StickyConversation:
+		if key := conversationKey(body()); key != "" {
+			return key
+		}
+	}
+	return clientKey(r)
+}
+
+// clientKey identifies the caller by API key, falling back to client IP
+func clientKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return auth
+	}
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// conversationKey identifies a conversation by its opening: the system
+// prompt and first message stay the same as the conversation grows
+func conversationKey(body map[string]interface{}) string {
+	opening := map[string]interface{}{}
+	if system, ok := body["system"]; ok {
+		opening["system"] = system
+	}
+	if messages, ok := body["messages"].([]interface{}); ok && len(messages) > 0 {
+		opening["first"] = messages[0]
+	} else if prompt, ok := body["prompt"]; ok {
+		opening["first"] = prompt
+	}
+	if len(opening) == 0 {
+		return ""
+	}
+
+	// Map keys are marshalled in sorted order, so this is stable
+	data, err := json.Marshal(opening)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// statusRecorder remembers the status written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// GetTargetMetrics returns a copy of the per-target response counts
+func (m *ModelRoutingMiddleware) GetTargetMetrics() map[string]TargetMetrics {
+	return m.targetStats.snapshot()
+}
+
+func (m *ModelRoutingMiddleware) targetHealth() map[string]interface{} {
+	metrics := m.GetTargetMetrics()
+	result := make(map[string]interface{}, len(metrics))
+	for target, t := range metrics {
+		result[target] = map[string]interface{}{
+			"requests":     t.Requests,
+			"errors":       t.Errors,
+			"rate_limited": t.RateLimited,
+			"error_rate":   t.ErrorRate(),
+
+			"estimated_cost_usd": float64(t.EstimatedCostMicros) / 1e6,
+		}
+	}
+	return result
+}
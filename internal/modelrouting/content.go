@@ -0,0 +1,201 @@
+package modelrouting
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/token"
+)
+
+// bytesPerToken sizes a prompt from its body length when the body is not
+// decoded
+const bytesPerToken = 4
+
+// routeRequest is the request as seen by routing rules. The body is only
+// read in full and decoded when a rule needs more than the model, and
+// content features are computed on first use.
+type routeRequest struct {
+	r         *http.Request
+	model     modelField
+	body      map[string]interface{}
+	parsed    bool
+	err       error // reading the rest of the body failed
+	estimator *token.TokenEstimator
+
+	tokens        int
+	cached        int
+	tokensCounted bool
+}
+
+// fields decodes the whole body, reading what the model scan left unread
+func (req *routeRequest) fields() map[string]interface{} {
+	if req.parsed || req.r == nil || req.r.Body == nil {
+		return req.body
+	}
+	req.parsed = true
+
+	data, err := io.ReadAll(req.r.Body)
+	req.r.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		req.err = err
+		return nil
+	}
+	json.Unmarshal(data, &req.body)
+	return req.body
+}
+
+func (req *routeRequest) stickyKey(mode string) string {
+	if req == nil {
+		return ""
+	}
+	return stickyKey(mode, req.r, req.fields)
+}
+
+// matches reports whether every condition that is set holds
+func (req *routeRequest) matches(c *config.RuleConditions) bool {
+	if req == nil || c == nil {
+		return false
+	}
+
+	for name, want := range c.Headers {
+		got := req.r.Header.Get(name)
+		if got == "" || (want != "*" && got != want) {
+			return false
+		}
+	}
+	if c.Stream != nil && *c.Stream != req.stream() {
+		return false
+	}
+	if c.HasTools != nil && *c.HasTools != req.hasTools() {
+		return false
+	}
+	if c.HasImages != nil && *c.HasImages != req.hasImages() {
+		return false
+	}
+	if c.MinPromptTokens > 0 || c.MaxPromptTokens > 0 {
+		tokens := req.promptTokens()
+		if tokens < c.MinPromptTokens {
+			return false
+		}
+		if c.MaxPromptTokens > 0 && tokens > c.MaxPromptTokens {
+			return false
+		}
+	}
+	return true
+}
+
+func (req *routeRequest) stream() bool {
+	stream, _ := req.fields()["stream"].(bool)
+	return stream
+}
+
+// hasTools reports tool or legacy function definitions
+func (req *routeRequest) hasTools() bool {
+	for _, key := range []string{"tools", "functions"} {
+		if list, ok := req.fields()[key].([]interface{}); ok && len(list) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasImages looks for OpenAI image_url and Anthropic image content blocks
+func (req *routeRequest) hasImages() bool {
+	messages, _ := req.fields()["messages"].([]interface{})
+	for _, msg := range messages {
+		message, ok := msg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		blocks, _ := message["content"].([]interface{})
+		for _, b := range blocks {
+			block, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "image", "image_url", "input_image":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// promptTokens estimates the tokens in the system prompt, messages and
+// completion prompt
+func (req *routeRequest) promptTokens() int {
+	req.countTokens()
+	return req.tokens
+}
+
+// cachedTokens estimates the prompt tokens up to the last cache_control
+// breakpoint, which the upstream can serve from its prompt cache
+func (req *routeRequest) cachedTokens() int {
+	req.countTokens()
+	return req.cached
+}
+
+// outputTokens is the requested max_tokens, or an estimate without one
+func (req *routeRequest) outputTokens() int {
+	for _, key := range []string{"max_tokens", "max_completion_tokens"} {
+		if limit, ok := req.fields()[key].(float64); ok && limit > 0 {
+			return int(limit)
+		}
+	}
+	return req.estimator.EstimateOutputTokens(0, req.promptTokens())
+}
+
+func (req *routeRequest) countTokens() {
+	if req.tokensCounted {
+		return
+	}
+	req.tokensCounted = true
+
+	var text promptText
+	text.add(req.fields()["system"])
+	text.add(req.fields()["prompt"])
+	messages, _ := req.fields()["messages"].([]interface{})
+	for _, msg := range messages {
+		if message, ok := msg.(map[string]interface{}); ok {
+			text.add(message["content"])
+		}
+	}
+
+	model, _ := req.fields()["model"].(string)
+	req.tokens, _ = req.estimator.EstimateInputTokens(model, text.String())
+	if text.cachedLen > 0 {
+		req.cached, _ = req.estimator.EstimateInputTokens(model, text.String()[:text.cachedLen])
+	}
+}
+
+// promptText collects text from strings, lists of strings and content
+// blocks, remembering where the last cache_control breakpoint ended
+type promptText struct {
+	strings.Builder
+	cachedLen int
+}
+
+func (t *promptText) add(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		t.WriteString(v)
+		t.WriteByte(' ')
+	case []interface{}:
+		for _, item := range v {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				t.add(item)
+				continue
+			}
+			t.add(block["text"])
+			if _, ok := block["cache_control"]; ok {
+				t.cachedLen = t.Len()
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package modelrouting
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+)
+
+// CapabilityClassHeader lets a client ask for a capability class without
+// naming it as the model
+const CapabilityClassHeader = "X-Model-Class"
+
+// Cost estimate headers, in USD
+const (
+	EstimatedCostHeader    = "X-Estimated-Cost-USD"
+	EstimatedSavingsHeader = "X-Estimated-Savings-USD"
+)
+
+// ClassRulePrefix labels decisions made by cost-aware class routing
+const ClassRulePrefix = "class:"
+
+// SetRateLimiter lets class routing skip targets without rate-limit headroom
+func (m *ModelRoutingMiddleware) SetRateLimiter(limiter *ratelimit.Limiter) {
+	m.limiter = limiter
+}
+
+// requestedClass returns the capability class the request asks for, if any
+func (m *ModelRoutingMiddleware) requestedClass(model string, req *routeRequest) (string, []config.ClassTarget) {
+	if req != nil {
+		if class := req.r.Header.Get(CapabilityClassHeader); class != "" {
+			if candidates, ok := m.config.Classes[class]; ok {
+				return class, candidates
+			}
+		}
+	}
+	if candidates, ok := m.config.Classes[model]; ok {
+		return model, candidates
+	}
+	return "", nil
+}
+
+// resolveClass picks the cheapest candidate with rate-limit headroom. If
+// every target is throttled, the one that frees up first wins. Savings are
+// measured against the most expensive candidate. As the candidate changes
+// from request to request, responses always carry the model the client
+// sent, as with restore_model on a rule.
+func (m *ModelRoutingMiddleware) resolveClass(decision RouteDecision, class string, candidates []config.ClassTarget, req *routeRequest) RouteDecision {
+	type option struct {
+		candidate config.ClassTarget
+		cost      float64
+		delay     time.Duration
+	}
+
+	options := make([]option, 0, len(candidates))
+	var highest float64
+	for _, candidate := range candidates {
+		cost, _ := m.estimateCost(candidate.Model, req)
+		if cost > highest {
+			highest = cost
+		}
+		options = append(options, option{candidate: candidate, cost: cost, delay: m.targetDelay(candidate.Target)})
+	}
+	sort.SliceStable(options, func(i, j int) bool { return options[i].cost < options[j].cost })
+
+	chosen := options[0]
+	for _, opt := range options {
+		if opt.delay == 0 {
+			chosen = opt
+			break
+		}
+		if opt.delay < chosen.delay {
+			chosen = opt
+		}
+	}
+
+	decision.Target = chosen.candidate.Target
+	decision.Rule = ClassRulePrefix + class
+	if chosen.candidate.Model != decision.Model {
+		decision.TargetModel = chosen.candidate.Model
+		decision.RestoreModel = true
+	}
+	decision.EstimatedCost = chosen.cost
+	decision.EstimatedSavings = highest - chosen.cost
+	return decision
+}
+
+// estimateCost prices a request for model. Without a request, candidates
+// are compared on list price for a million input and output tokens.
+func (m *ModelRoutingMiddleware) estimateCost(model string, req *routeRequest) (float64, bool) {
+	price, ok := m.config.Pricing[model]
+	if !ok {
+		return 0, false
+	}
+	if req == nil {
+		return price.Cost(1e6, 0, 1e6), true
+	}
+	return price.Cost(req.promptTokens(), req.cachedTokens(), req.outputTokens()), true
+}
+
+// priceDecision fills in the cost estimate for decisions made without class
+// routing, using the model the upstream will see. Unless a rule already
+// decoded the body, the prompt is sized from Content-Length, so pricing does
+// not buffer a body the model scan let stream through. Bodies of unknown
+// length are not priced.
+func (m *ModelRoutingMiddleware) priceDecision(decision *RouteDecision, req *routeRequest) {
+	if decision.EstimatedCost > 0 || m.config == nil || req == nil {
+		return
+	}
+	model := decision.Model
+	if decision.TargetModel != "" {
+		model = decision.TargetModel
+	}
+	if req.parsed {
+		if cost, ok := m.estimateCost(model, req); ok {
+			decision.EstimatedCost = cost
+		}
+		return
+	}
+
+	price, ok := m.config.Pricing[model]
+	if !ok || req.r.ContentLength <= 0 {
+		return
+	}
+	prompt := int(req.r.ContentLength / bytesPerToken)
+	decision.EstimatedCost = price.Cost(prompt, 0, req.estimator.EstimateOutputTokens(0, prompt))
+}
+
+func (m *ModelRoutingMiddleware) targetDelay(target string) time.Duration {
+	if m.limiter == nil {
+		return 0
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return 0
+	}
+	return m.limiter.PeekDelay(targetURL.Host)
+}
+
+// reportCost sets the cost headers and adds the estimate to the metrics
+func (m *ModelRoutingMiddleware) reportCost(w http.ResponseWriter, decision RouteDecision) int64 {
+	if decision.EstimatedCost <= 0 {
+		return 0
+	}
+
+	w.Header().Set(EstimatedCostHeader, fmt.Sprintf("%.6f", decision.EstimatedCost))
+	if decision.EstimatedSavings > 0 {
+		w.Header().Set(EstimatedSavingsHeader, fmt.Sprintf("%.6f", decision.EstimatedSavings))
+	}
+
+	costMicros := int64(decision.EstimatedCost * 1e6)
+	atomic.AddInt64(&m.metrics.EstimatedCostMicros, costMicros)
+	atomic.AddInt64(&m.metrics.EstimatedSavingsMicros, int64(decision.EstimatedSavings*1e6))
+	return costMicros
+}
@@ -2,7 +2,8 @@ package modelrouting
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -12,6 +13,10 @@ import (
 	"time"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/proxy"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+	"github.com/cooldownp/cooldown-proxy/internal/token"
 )
 
 // Metrics tracks model routing statistics
@@ -21,6 +26,37 @@ type Metrics struct {
 	RoutingFallback       int64
 	ParsingErrors         int64
 	TotalProcessingTimeNs int64 // Stored as nanoseconds for atomic operations
+	// Cost estimates in millionths of a USD
+	EstimatedCostMicros    int64
+	EstimatedSavingsMicros int64
+}
+
+// RouteRuleHeader is set on routed responses to report the rule that chose
+// the target
+const RouteRuleHeader = "X-Model-Route-Rule"
+
+// ModelsTableRule labels decisions made by the exact-match models table
+const ModelsTableRule = "models"
+
+// DefaultTargetRule labels decisions that fell back to the default target
+const DefaultTargetRule = "default"
+
+// RouteDecision records where a model was routed and why. TargetModel is
+// set when the matched rule renames the model for the upstream. Cost
+// estimates are in USD and zero when the model has no pricing.
+type RouteDecision struct {
+	Model            string
+	Target           string
+	Rule             string
+	TargetModel      string
+	RestoreModel     bool
+	EstimatedCost    float64
+	EstimatedSavings float64
+}
+
+type compiledRule struct {
+	rule  config.ModelRule
+	match func(model string) bool
 }
 
 type ModelRoutingMiddleware struct {
@@ -28,15 +64,115 @@ type ModelRoutingMiddleware struct {
 	nextHandler http.Handler
 	logger      *log.Logger
 	metrics     *Metrics
+	adapters    []Adapter
+	rules       []compiledRule
+	// contentRules are rules with request conditions, checked before the
+	// models table
+	contentRules []compiledRule
+	targets      map[string]*targetPaths
+	auth         map[string]*targetAuth
+	targetStats  targetStats
+	estimator    *token.TokenEstimator
+	limiter      *ratelimit.Limiter
 }
 
 func NewModelRoutingMiddleware(cfg *config.ModelRoutingConfig, next http.Handler) *ModelRoutingMiddleware {
-	return &ModelRoutingMiddleware{
+	m := &ModelRoutingMiddleware{
 		config:      cfg,
 		nextHandler: next,
 		logger:      log.New(log.Writer(), "[model-routing] ", log.LstdFlags),
 		metrics:     &Metrics{},
+		estimator:   token.NewTokenEstimator(),
+	}
+
+	if cfg != nil {
+		for _, rule := range cfg.Rules {
+			match, err := rule.Matcher()
+			if err != nil {
+				m.logger.Printf("Skipping invalid rule %s: %v", rule.Label(), err)
+				continue
+			}
+			if rule.Conditional() {
+				m.contentRules = append(m.contentRules, compiledRule{rule: rule, match: match})
+				continue
+			}
+			m.rules = append(m.rules, compiledRule{rule: rule, match: match})
+		}
+
+		m.targets = make(map[string]*targetPaths)
+		m.auth = make(map[string]*targetAuth)
+		for target, targetConfig := range cfg.Targets {
+			if targetConfig.Auth != nil {
+				m.auth[target] = newTargetAuth(targetConfig.Auth)
+			}
+			paths, err := compileTargetPaths(targetConfig)
+			if err != nil {
+				m.logger.Printf("Skipping invalid path rules for %s: %v", target, err)
+				continue
+			}
+			m.targets[target] = paths
+		}
 	}
+
+	return m
+}
+
+// Resolve picks the target for model: a capability class of that name, the
+// exact-match models table, then rules in order. An empty Target means no rule matched. Without a
+// request, rules with content conditions never match and weighted targets
+// are picked as for a request with no sticky key.
+func (m *ModelRoutingMiddleware) Resolve(model string) RouteDecision {
+	return m.resolve(model, nil)
+}
+
+// resolve is Resolve for a parsed request: content rules are checked first,
+// then capability classes, and weighted targets stick to the request's
+// session
+func (m *ModelRoutingMiddleware) resolve(model string, req *routeRequest) RouteDecision {
+	decision := RouteDecision{Model: model}
+	if m.config == nil {
+		return decision
+	}
+
+	if req != nil {
+		for _, rule := range m.contentRules {
+			if rule.match(model) && req.matches(rule.rule.When) {
+				return decideRule(decision, rule.rule, req)
+			}
+		}
+	}
+	if class, candidates := m.requestedClass(model, req); class != "" {
+		return m.resolveClass(decision, class, candidates, req)
+	}
+	if model == "" {
+		return decision
+	}
+
+	if target, ok := m.config.Models[model]; ok {
+		decision.Target = target
+		decision.Rule = ModelsTableRule
+		return decision
+	}
+
+	for _, rule := range m.rules {
+		if rule.match(model) {
+			return decideRule(decision, rule.rule, req)
+		}
+	}
+	return decision
+}
+
+func decideRule(decision RouteDecision, rule config.ModelRule, req *routeRequest) RouteDecision {
+	decision.Target = rule.Target
+	if len(rule.Targets) > 0 {
+		decision.Target = pickWeighted(rule.Targets, rule.Label(), req.stickyKey(rule.Sticky))
+	}
+	decision.Rule = rule.Label()
+	if rule.TargetModel != "" && rule.TargetModel != decision.Model {
+		decision.TargetModel = rule.TargetModel
+		decision.RestoreModel = rule.RestoreModel
+	}
+	return decision
 }
 
 func (m *ModelRoutingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -53,10 +189,16 @@ func (m *ModelRoutingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 
 	atomic.AddInt64(&m.metrics.RoutingAttempts, 1)
 
-	target, err := m.extractTargetFromModel(r)
-	if err != nil || target == "" {
+	decision, req, err := m.extractTargetFromModel(r)
+	if errors.Is(err, errBodyTooLarge) {
+		atomic.AddInt64(&m.metrics.ParsingErrors, 1)
+		m.writeError(w, proxyerrors.NewRequestTooLargeError(m.maxBodyBytes()))
+		return
+	}
+	if err != nil || decision.Target == "" {
 		// Fallback to default target on any error
-		target = m.config.DefaultTarget
+		decision.Target = m.config.DefaultTarget
+		decision.Rule = DefaultTargetRule
 		atomic.AddInt64(&m.metrics.RoutingFallback, 1)
 		if err != nil {
 			m.logger.Printf("Model routing failed, using default: %v", err)
@@ -66,14 +208,88 @@ func (m *ModelRoutingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		atomic.AddInt64(&m.metrics.RoutingSuccess, 1)
 	}
 
+	if decision.TargetModel != "" {
+		if err := rewriteModel(r, req.model, decision.TargetModel); err != nil {
+			m.logger.Printf("Failed to rewrite model %s to %s: %v", decision.Model, decision.TargetModel, err)
+			decision.TargetModel = ""
+		} else if decision.RestoreModel {
+			// Compressed bodies cannot be rewritten
+			r.Header.Del("Accept-Encoding")
+			restorer := newModelRestorer(w, decision.TargetModel, decision.Model)
+			defer restorer.Finish()
+			w = restorer
+		}
+	}
+
+	target := decision.Target
 	if target != "" {
+		recorder := &statusRecorder{ResponseWriter: w}
+		costMicros := m.reportCost(w, decision)
+		defer func() { m.targetStats.record(target, recorder.status, costMicros) }()
+		w = recorder
+
+		w.Header().Set(RouteRuleHeader, decision.Rule)
+		if targetURL, err := url.Parse(target); err == nil {
+			if adapter := m.adapterFor(targetURL); adapter != nil {
+				m.logger.Printf("Routed request to: %s (rule %s, %s adapter)", target, decision.Rule, adapter.Name())
+				m.serveAdapted(w, r, adapter, targetURL)
+				return
+			}
+		}
 		m.rewriteRequest(r, target)
-		m.logger.Printf("Routed request to: %s", target)
+		if decision.TargetModel != "" {
+			m.logger.Printf("Routed request to: %s (rule %s, model %s as %s)", target, decision.Rule, decision.Model, decision.TargetModel)
+		} else {
+			m.logger.Printf("Routed request to: %s (rule %s)", target, decision.Rule)
+		}
 	}
 
 	m.nextHandler.ServeHTTP(w, r)
 }
 
+// serveAdapted lets adapter rewrite the request for its upstream and
+// translate the response on the way back.
+func (m *ModelRoutingMiddleware) serveAdapted(w http.ResponseWriter, r *http.Request, adapter Adapter, target *url.URL) {
+	var body []byte
+	if r.Body != nil {
+		data, err := io.ReadAll(r.Body)
+		if errors.Is(err, errBodyTooLarge) {
+			m.writeError(w, proxyerrors.NewRequestTooLargeError(m.maxBodyBytes()))
+			return
+		}
+		if err != nil {
+			m.writeError(w, proxyerrors.NewInvalidRequestError("failed to read request body"))
+			return
+		}
+		body = data
+	}
+
+	r, err := adapter.RewriteRequest(r, target, body)
+	if err != nil {
+		m.logger.Printf("%s adapter rejected request: %v", adapter.Name(), err)
+		m.writeError(w, err)
+		return
+	}
+
+	translator := adapter.WrapResponseWriter(w, r)
+	m.nextHandler.ServeHTTP(translator, r)
+	if err := translator.Finish(); err != nil {
+		m.logger.Printf("%s adapter failed to translate response: %v", adapter.Name(), err)
+	}
+}
+
+func (m *ModelRoutingMiddleware) writeError(w http.ResponseWriter, err error) {
+	var proxyErr *proxyerrors.ProxyError
+	if !errors.As(err, &proxyErr) {
+		proxyErr = proxyerrors.NewInvalidRequestError(err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(proxyErr.HTTPStatus())
+	fmt.Fprintf(w, `{"error":%d,"message":%q,"status":%d}`,
+		proxyErr.Type, proxyErr.Message, proxyErr.HTTPStatus())
+}
+
 func (m *ModelRoutingMiddleware) shouldApplyRouting(r *http.Request) bool {
 	if m.config == nil || !m.config.Enabled {
 		return false
@@ -83,36 +299,45 @@ func (m *ModelRoutingMiddleware) shouldApplyRouting(r *http.Request) bool {
 	return strings.Contains(contentType, "application/json")
 }
 
-func (m *ModelRoutingMiddleware) extractTargetFromModel(r *http.Request) (string, error) {
+func (m *ModelRoutingMiddleware) extractTargetFromModel(r *http.Request) (RouteDecision, *routeRequest, error) {
 	if r.Body == nil {
-		return "", nil
+		return RouteDecision{}, nil, nil
 	}
 
-	// Create TeeReader to stream while parsing
-	var buf bytes.Buffer
-	tee := io.TeeReader(r.Body, &buf)
+	limit := m.maxBodyBytes()
+	if r.ContentLength > limit {
+		return RouteDecision{}, nil, errBodyTooLarge
+	}
 
-	// Replace body with buffered content for downstream handlers
-	r.Body = io.NopCloser(&buf)
+	// Scan only as far as the model field. What was read is replayed ahead
+	// of the unread remainder, so large bodies stream through unbuffered.
+	var consumed bytes.Buffer
+	body := &cappedReader{r: r.Body, remaining: limit, limit: limit}
+	field, err := scanModelField(io.TeeReader(body, &consumed))
+	r.Body = replayBody(&consumed, body, r.Body)
+	if err != nil {
+		return RouteDecision{}, nil, err
+	}
 
-	// Parse JSON to extract model field
-	return m.parseModelField(tee)
+	req := &routeRequest{r: r, model: field, estimator: m.estimator}
+	decision := m.resolve(field.name, req)
+	m.priceDecision(&decision, req)
+	return decision, req, req.err
 }
 
-func (m *ModelRoutingMiddleware) parseModelField(reader io.Reader) (string, error) {
-	// Read the entire request body into a map to find the model field
-	// This is simpler and more reliable than streaming parsing for this use case
-	var data map[string]interface{}
-	if err := json.NewDecoder(reader).Decode(&data); err != nil {
-		return "", err
+func (m *ModelRoutingMiddleware) maxBodyBytes() int64 {
+	if m.config != nil && m.config.MaxBodyBytes > 0 {
+		return m.config.MaxBodyBytes
 	}
+	return DefaultMaxBodyBytes
+}
 
-	// Extract the model field
-	if modelValue, ok := data["model"].(string); ok {
-		return m.config.Models[modelValue], nil
+func (m *ModelRoutingMiddleware) parseModelField(reader io.Reader) (string, error) {
+	model, err := scanModel(reader)
+	if err != nil {
+		return "", err
 	}
-
-	return "", nil
+	return m.Resolve(model).Target, nil
 }
 
 // ParseModelField is a public method for testing parseModelField
@@ -128,6 +353,9 @@ func (m *ModelRoutingMiddleware) GetMetrics() Metrics {
 		RoutingFallback:       atomic.LoadInt64(&m.metrics.RoutingFallback),
 		ParsingErrors:         atomic.LoadInt64(&m.metrics.ParsingErrors),
 		TotalProcessingTimeNs: atomic.LoadInt64(&m.metrics.TotalProcessingTimeNs),
+
+		EstimatedCostMicros:    atomic.LoadInt64(&m.metrics.EstimatedCostMicros),
+		EstimatedSavingsMicros: atomic.LoadInt64(&m.metrics.EstimatedSavingsMicros),
 	}
 }
 
@@ -170,14 +398,22 @@ func (m *ModelRoutingMiddleware) HealthCheck() map[string]interface{} {
 		"parsing_errors":    errors,
 		"success_rate":      successRate,
 		"avg_processing_ms": avgProcessingTime,
+
+		"estimated_cost_usd":    float64(metrics.EstimatedCostMicros) / 1e6,
+		"estimated_savings_usd": float64(metrics.EstimatedSavingsMicros) / 1e6,
 	}
 
 	// Only add config fields if config exists
 	if m.config != nil {
 		result["models_configured"] = len(m.config.Models)
+		result["rules_configured"] = len(m.rules) + len(m.contentRules)
+		result["classes_configured"] = len(m.config.Classes)
 		result["default_target"] = m.config.DefaultTarget
+		result["targets"] = m.targetHealth()
 	} else {
 		result["models_configured"] = 0
+		result["rules_configured"] = 0
+		result["classes_configured"] = 0
 		result["default_target"] = ""
 	}
 
@@ -191,7 +427,12 @@ func (m *ModelRoutingMiddleware) rewriteRequest(r *http.Request, target string)
 		return
 	}
 
-	r.URL.Scheme = targetURL.Scheme
-	r.URL.Host = targetURL.Host
+	if paths := m.targets[target]; paths != nil {
+		paths.apply(r.URL)
+	}
+	if auth := m.auth[target]; auth != nil {
+		auth.apply(r.Header)
+	}
+	proxy.JoinTargetURL(r.URL, targetURL)
 	r.Host = targetURL.Host
 }
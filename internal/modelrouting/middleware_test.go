@@ -2,12 +2,19 @@ package modelrouting
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+	"github.com/cooldownp/cooldown-proxy/internal/token"
 )
 
 func TestModelRoutingMiddleware(t *testing.T) {
@@ -156,3 +163,609 @@ func TestParseModelField(t *testing.T) {
 		}
 	})
 }
+
+func TestResolveModelRules(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Models: map[string]string{
+			"gpt-4o": "https://exact.example.com",
+		},
+		Rules: []config.ModelRule{
+			{Name: "dated-gpt-4o", Match: config.MatchRegex, Pattern: `gpt-4o-\d{4}-\d{2}-\d{2}`, Target: "https://regex.example.com"},
+			{Match: config.MatchPrefix, Pattern: "gpt-4o", Target: "https://prefix.example.com"},
+			{Match: config.MatchGlob, Pattern: "claude-3-?-sonnet-*", Target: "https://glob.example.com"},
+			{Pattern: "llama3-8b", Target: "https://exact-rule.example.com"},
+		},
+	}
+	middleware := NewModelRoutingMiddleware(cfg, http.NotFoundHandler())
+
+	tests := []struct {
+		model      string
+		wantTarget string
+		wantRule   string
+	}{
+		{"gpt-4o", "https://exact.example.com", ModelsTableRule},
+		{"gpt-4o-2024-08-06", "https://regex.example.com", "dated-gpt-4o"},
+		{"gpt-4o-mini", "https://prefix.example.com", "prefix:gpt-4o"},
+		{"claude-3-5-sonnet-20241022", "https://glob.example.com", "glob:claude-3-?-sonnet-*"},
+		{"llama3-8b", "https://exact-rule.example.com", "exact:llama3-8b"},
+		{"xgpt-4o-2024-08-06", "", ""},
+		{"unknown", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			decision := middleware.Resolve(tt.model)
+			if decision.Target != tt.wantTarget || decision.Rule != tt.wantRule {
+				t.Errorf("Resolve(%q) = %s via %q, want %s via %q",
+					tt.model, decision.Target, decision.Rule, tt.wantTarget, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestRoutingReportsMatchedRule(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Rules: []config.ModelRule{
+			{Match: config.MatchPrefix, Pattern: "claude-", Target: "https://api.anthropic.com/v1"},
+		},
+	}
+
+	var capturedHost string
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capturedHost = r.URL.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		model    string
+		wantRule string
+		wantHost string
+	}{
+		{"claude-3-haiku-20240307", "prefix:claude-", "api.anthropic.com"},
+		{"gpt-4", DefaultTargetRule, "api.openai.com"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(`{"model": "`+tt.model+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		middleware.ServeHTTP(w, req)
+
+		if got := w.Header().Get(RouteRuleHeader); got != tt.wantRule {
+			t.Errorf("model %s: expected rule %q, got %q", tt.model, tt.wantRule, got)
+		}
+		if capturedHost != tt.wantHost {
+			t.Errorf("model %s: expected host %s, got %s", tt.model, tt.wantHost, capturedHost)
+		}
+	}
+}
+
+func TestWeightedTargetsAreSticky(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Rules: []config.ModelRule{
+			{Name: "llama-canary", Pattern: "llama3-70b", Targets: []config.WeightedTarget{
+				{URL: "https://api.cerebras.ai/v1", Weight: 90},
+				{URL: "https://api.groq.com/openai/v1", Weight: 10},
+			}},
+			{Name: "conversation", Pattern: "llama3-8b", Sticky: config.StickyConversation, Targets: []config.WeightedTarget{
+				{URL: "https://api.cerebras.ai/v1", Weight: 50},
+				{URL: "https://api.groq.com/openai/v1", Weight: 50},
+			}},
+		},
+	}
+
+	var capturedHost string
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capturedHost = r.URL.Host
+		if r.URL.Host == "api.groq.com" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(body, apiKey string) string {
+		req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+		return capturedHost
+	}
+
+	hosts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		host := send(`{"model": "llama3-70b"}`, key)
+		if again := send(`{"model": "llama3-70b"}`, key); again != host {
+			t.Fatalf("client %s moved from %s to %s", key, host, again)
+		}
+		hosts[host]++
+	}
+	if hosts["api.groq.com"] < 50 || hosts["api.groq.com"] > 150 {
+		t.Errorf("Expected about 10%% of clients on the canary, got %v", hosts)
+	}
+
+	// Conversation stickiness ignores the caller and follows the opening
+	// messages as the conversation grows
+	first := send(`{"model": "llama3-8b", "messages": [{"role": "user", "content": "hi"}]}`, "a")
+	for i := 0; i < 20; i++ {
+		host := send(`{"model": "llama3-8b", "messages": [{"role": "user", "content": "hi"}, {"role": "assistant", "content": "hello"}]}`, "key-"+strconv.Itoa(i))
+		if host != first {
+			t.Fatalf("conversation moved from %s to %s", first, host)
+		}
+	}
+
+	metrics := middleware.GetTargetMetrics()
+	canary := metrics["https://api.groq.com/openai/v1"]
+	if canary.Requests == 0 || canary.Errors != canary.Requests {
+		t.Errorf("Expected every canary request counted as an error, got %+v", canary)
+	}
+	if stable := metrics["https://api.cerebras.ai/v1"]; stable.Requests == 0 || stable.Errors != 0 {
+		t.Errorf("Expected error-free requests on the stable target, got %+v", stable)
+	}
+	if _, ok := middleware.HealthCheck()["targets"].(map[string]interface{})["https://api.groq.com/openai/v1"]; !ok {
+		t.Error("Expected canary target in health check")
+	}
+}
+
+func TestContentRules(t *testing.T) {
+	yes, no := true, false
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Models:        map[string]string{"llama3-8b": "https://api.cerebras.ai/v1"},
+		Rules: []config.ModelRule{
+			{Name: "long-context", When: &config.RuleConditions{MinPromptTokens: 50}, Target: "https://long.example.com/v1"},
+			{Name: "tools", Pattern: "llama3-8b", When: &config.RuleConditions{HasTools: &yes}, Target: "https://tools.example.com/v1"},
+			{Name: "vision", When: &config.RuleConditions{HasImages: &yes}, Target: "https://vision.example.com/v1"},
+			{Name: "batch", When: &config.RuleConditions{Stream: &no, Headers: map[string]string{"X-Priority": "batch"}}, Target: "https://batch.example.com/v1"},
+		},
+	}
+
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	longPrompt := strings.Repeat("word ", 60)
+	tests := []struct {
+		name     string
+		body     string
+		header   map[string]string
+		wantRule string
+	}{
+		{"short prompt uses models table", `{"model": "llama3-8b", "messages": [{"role": "user", "content": "hi"}]}`, nil, ModelsTableRule},
+		{"long prompt", `{"model": "llama3-8b", "messages": [{"role": "user", "content": "` + longPrompt + `"}]}`, nil, "long-context"},
+		{"long system prompt in blocks", `{"model": "claude-3", "system": [{"type": "text", "text": "` + longPrompt + `"}], "messages": []}`, nil, "long-context"},
+		{"tools", `{"model": "llama3-8b", "tools": [{"type": "function"}], "messages": []}`, nil, "tools"},
+		{"tools on another model", `{"model": "gpt-4", "tools": [{"type": "function"}], "messages": []}`, nil, DefaultTargetRule},
+		{"image block", `{"model": "gpt-4", "messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "data:"}}]}]}`, nil, "vision"},
+		{"batch header", `{"model": "gpt-4", "messages": []}`, map[string]string{"X-Priority": "batch"}, "batch"},
+		{"batch header while streaming", `{"model": "gpt-4", "stream": true, "messages": []}`, map[string]string{"X-Priority": "batch"}, DefaultTargetRule},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+
+			middleware.ServeHTTP(w, req)
+
+			if got := w.Header().Get(RouteRuleHeader); got != tt.wantRule {
+				t.Errorf("Expected rule %q, got %q", tt.wantRule, got)
+			}
+		})
+	}
+
+	// Without a request only model rules apply
+	if got := middleware.Resolve("llama3-8b").Rule; got != ModelsTableRule {
+		t.Errorf("Expected Resolve to skip content rules, got %q", got)
+	}
+}
+
+func TestCostAwareClassRouting(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Pricing: map[string]config.ModelPrice{
+			"gpt-4o":        {Input: 2.50, Output: 10.00, Cached: 1.25},
+			"llama3.1-70b":  {Input: 0.60, Output: 0.60},
+			"llama-3.3-70b": {Input: 0.59, Output: 0.79},
+		},
+		Classes: map[string][]config.ClassTarget{
+			"smart": {
+				{Target: "https://api.openai.com/v1", Model: "gpt-4o"},
+				{Target: "https://api.cerebras.ai/v1", Model: "llama3.1-70b"},
+				{Target: "https://api.groq.com/openai/v1", Model: "llama-3.3-70b"},
+			},
+		},
+	}
+
+	limiter := ratelimit.New([]config.RateLimitRule{{Domain: "api.cerebras.ai", RequestsPerSecond: 10}})
+	var captured *http.Request
+	var capturedBody []byte
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured = r
+		capturedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	middleware.SetRateLimiter(limiter)
+
+	send := func(body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, req)
+		return w
+	}
+
+	body := `{"model": "smart", "max_tokens": 1000, "messages": [{"role": "user", "content": "` + strings.Repeat("word ", 1000) + `"}]}`
+	w := send(body, nil)
+	if captured.URL.Host != "api.cerebras.ai" || w.Header().Get(RouteRuleHeader) != "class:smart" {
+		t.Fatalf("Expected cheapest target for class, got %s (%s)", captured.URL.Host, w.Header().Get(RouteRuleHeader))
+	}
+	if !strings.Contains(string(capturedBody), `"model": "llama3.1-70b"`) {
+		t.Errorf("Expected model rewritten for target, got %s", capturedBody)
+	}
+	// 1000 input and 1000 output tokens: $0.0012 on Cerebras vs $0.0125 on OpenAI
+	if got := w.Header().Get(EstimatedCostHeader); got != "0.001200" {
+		t.Errorf("Expected cost header 0.001200, got %q", got)
+	}
+	if got := w.Header().Get(EstimatedSavingsHeader); got != "0.011300" {
+		t.Errorf("Expected savings header 0.011300, got %q", got)
+	}
+
+	// Without headroom on Cerebras the next cheapest target is used
+	limiter.Pause("api.cerebras.ai", time.Minute)
+	send(body, nil)
+	if captured.URL.Host != "api.groq.com" {
+		t.Errorf("Expected throttled target to be skipped, got %s", captured.URL.Host)
+	}
+
+	// The class can also be requested by header; the client's model then
+	// only matters for pricing
+	send(`{"model": "gpt-4o", "messages": []}`, map[string]string{CapabilityClassHeader: "smart"})
+	if captured.URL.Host != "api.groq.com" {
+		t.Errorf("Expected header class routing, got %s", captured.URL.Host)
+	}
+
+	// Routes outside a class are still priced
+	w = send(`{"model": "gpt-4o", "max_tokens": 100, "messages": [{"role": "user", "content": "hi"}]}`, nil)
+	if w.Header().Get(EstimatedCostHeader) == "" || w.Header().Get(EstimatedSavingsHeader) != "" {
+		t.Errorf("Expected only a cost header, got %v", w.Header())
+	}
+
+	metrics := middleware.GetMetrics()
+	if metrics.EstimatedCostMicros == 0 || metrics.EstimatedSavingsMicros < 11300 {
+		t.Errorf("Expected cost metrics to accumulate, got %+v", metrics)
+	}
+	if got := middleware.GetTargetMetrics()["https://api.cerebras.ai/v1"].EstimatedCostMicros; got != 1200 {
+		t.Errorf("Expected per-target cost of 1200 micro-USD, got %d", got)
+	}
+}
+
+func TestClassRoutingRestoresClientModel(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Classes: map[string][]config.ClassTarget{
+			"fast": {{Target: "https://api.cerebras.ai/v1", Model: "llama3.1-8b"}},
+		},
+	}
+
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"cmpl-1","model":"llama3.1-8b","choices":[]}`)
+	}))
+
+	req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(`{"model": "fast", "messages": []}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	middleware.ServeHTTP(w, req)
+
+	want := `{"id":"cmpl-1","model":"fast","choices":[]}`
+	if w.Body.String() != want {
+		t.Errorf("Expected %s, got %s", want, w.Body.String())
+	}
+}
+
+func TestPricingLeavesBodyStreaming(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Pricing:       map[string]config.ModelPrice{"priced": {Input: 1, Output: 1}},
+	}
+
+	body := `{"model": "priced", "messages": [{"role": "user", "content": "` + strings.Repeat("word ", 40000) + `"}]}`
+	source := &countingReader{r: strings.NewReader(body)}
+	var readBeforeNext int
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readBeforeNext = source.n
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("POST", "/chat/completions", source)
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	middleware.ServeHTTP(w, req)
+
+	if readBeforeNext >= len(body) {
+		t.Errorf("Expected the body to stream past pricing, but %d of %d bytes were read first", readBeforeNext, len(body))
+	}
+	// Sized from Content-Length: a quarter of the bytes for the prompt and
+	// half of that again for the output
+	prompt := len(body) / bytesPerToken
+	want := fmt.Sprintf("%.6f", float64(prompt+prompt/2)/1e6)
+	if got := w.Header().Get(EstimatedCostHeader); got != want {
+		t.Errorf("Expected estimated cost %s, got %s", want, got)
+	}
+}
+
+func TestCachedPromptPricing(t *testing.T) {
+	price := config.ModelPrice{Input: 3, Output: 15, Cached: 0.30}
+	req := &routeRequest{
+		body: map[string]interface{}{
+			"system": []interface{}{
+				map[string]interface{}{"type": "text", "text": strings.Repeat("cached ", 900), "cache_control": map[string]interface{}{"type": "ephemeral"}},
+			},
+			"messages": []interface{}{
+				map[string]interface{}{"role": "user", "content": strings.Repeat("fresh ", 100)},
+			},
+			"max_tokens": float64(10),
+		},
+		estimator: token.NewTokenEstimator(),
+	}
+
+	if req.promptTokens() != 1000 || req.cachedTokens() != 900 || req.outputTokens() != 10 {
+		t.Fatalf("Expected 1000 prompt, 900 cached and 10 output tokens, got %d, %d, %d",
+			req.promptTokens(), req.cachedTokens(), req.outputTokens())
+	}
+	// 100*3 + 900*0.30 + 10*15 = 720 per million
+	if cost := price.Cost(req.promptTokens(), req.cachedTokens(), req.outputTokens()); cost < 0.000719 || cost > 0.000721 {
+		t.Errorf("Expected cost of $0.00072, got %f", cost)
+	}
+}
+
+func TestModelAliasRewritesRequestBody(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Rules: []config.ModelRule{
+			{Pattern: "gpt-4", Target: "https://api.cerebras.ai/v1", TargetModel: "llama3.1-70b"},
+			{Pattern: "gpt-4-restored", Target: "https://api.cerebras.ai/v1", TargetModel: "llama3.1-70b", RestoreModel: true},
+		},
+	}
+
+	var upstreamBody []byte
+	var upstreamLength int64
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		upstreamLength = r.ContentLength
+		body := `{"id":"cmpl-1","model": "llama3.1-70b","choices":[]}`
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		io.WriteString(w, body)
+	}))
+
+	t.Run("rewrites model and content length", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/chat/completions",
+			strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		middleware.ServeHTTP(w, req)
+
+		var sent map[string]interface{}
+		if err := json.Unmarshal(upstreamBody, &sent); err != nil {
+			t.Fatalf("Upstream body is not JSON: %v", err)
+		}
+		if sent["model"] != "llama3.1-70b" {
+			t.Errorf("Expected upstream model llama3.1-70b, got %v", sent["model"])
+		}
+		if sent["messages"] == nil {
+			t.Error("Expected other fields to be preserved")
+		}
+		if upstreamLength != int64(len(upstreamBody)) {
+			t.Errorf("Expected Content-Length %d, got %d", len(upstreamBody), upstreamLength)
+		}
+		if !strings.Contains(w.Body.String(), `"model": "llama3.1-70b"`) {
+			t.Errorf("Expected upstream model in response without restore, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("leaves the rest of the body as sent", func(t *testing.T) {
+		body := `{"stream":false,"messages":[{"role":"user","content":"a <b> & c"}],"model" : "gpt-4","z":1}`
+		req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+		want := `{"stream":false,"messages":[{"role":"user","content":"a <b> & c"}],"model" : "llama3.1-70b","z":1}`
+		if string(upstreamBody) != want {
+			t.Errorf("Expected only the model value replaced, got %s", upstreamBody)
+		}
+		if upstreamLength != int64(len(want)) {
+			t.Errorf("Expected Content-Length %d, got %d", len(want), upstreamLength)
+		}
+	})
+
+	t.Run("restores client model in response", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/chat/completions",
+			strings.NewReader(`{"model": "gpt-4-restored", "messages": []}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		middleware.ServeHTTP(w, req)
+
+		want := `{"id":"cmpl-1","model":"gpt-4-restored","choices":[]}`
+		if w.Body.String() != want {
+			t.Errorf("Expected %s, got %s", want, w.Body.String())
+		}
+		if w.Header().Get("Content-Length") != strconv.Itoa(len(want)) {
+			t.Errorf("Expected Content-Length %d, got %s", len(want), w.Header().Get("Content-Length"))
+		}
+	})
+}
+
+func TestModelAliasRestoresStreamingResponses(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Rules: []config.ModelRule{
+			{Match: config.MatchPrefix, Pattern: "gpt-", Target: "https://api.cerebras.ai/v1", TargetModel: "llama3.1-70b", RestoreModel: true},
+		},
+	}
+
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// Split a chunk mid-model-name to check line buffering
+		io.WriteString(w, "data: {\"model\":\"llama3.1")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "-70b\",\"choices\":[]}\n\ndata: {\"model\":\"llama3.1-70b\"}\n\ndata: [DONE]\n\n")
+	}))
+
+	req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(`{"model": "gpt-4o", "stream": true}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	middleware.ServeHTTP(w, req)
+
+	want := "data: {\"model\":\"gpt-4o\",\"choices\":[]}\n\ndata: {\"model\":\"gpt-4o\"}\n\ndata: [DONE]\n\n"
+	if w.Body.String() != want {
+		t.Errorf("Expected %q, got %q", want, w.Body.String())
+	}
+}
+
+func TestRewriteRequestPaths(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Models: map[string]string{
+			"llama3.1-8b": "https://api.cerebras.ai/v1",
+			"glm-4.6":     "https://open.bigmodel.cn/api/paas/v4",
+			"claude-3":    "https://api.anthropic.com",
+		},
+		Targets: map[string]config.TargetConfig{
+			"https://api.cerebras.ai/v1": {StripPrefix: "/openai"},
+			"https://open.bigmodel.cn/api/paas/v4": {
+				StripPrefix: "/v1",
+				RewritePath: []config.PathRewrite{
+					{Match: `^/engines/([^/]+)/completions$`, Replace: "/completions"},
+				},
+			},
+		},
+	}
+
+	var captured *http.Request
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured = r
+	}))
+
+	tests := []struct {
+		name    string
+		model   string
+		path    string
+		wantURL string
+	}{
+		{"base path joined", "llama3.1-8b", "/chat/completions", "https://api.cerebras.ai/v1/chat/completions"},
+		{"base path not duplicated", "llama3.1-8b", "/v1/chat/completions", "https://api.cerebras.ai/v1/chat/completions"},
+		{"prefix stripped before join", "llama3.1-8b", "/openai/chat/completions?stream=true", "https://api.cerebras.ai/v1/chat/completions?stream=true"},
+		{"strip then rewrite", "glm-4.6", "/v1/engines/glm/completions", "https://open.bigmodel.cn/api/paas/v4/completions"},
+		{"strip only", "glm-4.6", "/v1/chat/completions", "https://open.bigmodel.cn/api/paas/v4/chat/completions"},
+		{"host only target", "claude-3", "/v1/messages", "https://api.anthropic.com/v1/messages"},
+		{"default target", "unknown", "/chat/completions", "https://api.openai.com/v1/chat/completions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(`{"model": "`+tt.model+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+			if captured == nil {
+				t.Fatal("Request was not captured")
+			}
+			if got := captured.URL.String(); got != tt.wantURL {
+				t.Errorf("Expected %s, got %s", tt.wantURL, got)
+			}
+		})
+	}
+}
+
+func TestTargetAuthInjection(t *testing.T) {
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Models: map[string]string{
+			"llama3.1-8b": "https://api.cerebras.ai/v1",
+			"claude-3":    "https://api.anthropic.com",
+			"glm-4.6":     "https://open.bigmodel.cn/api/paas/v4",
+			"local":       "http://localhost:11434/v1",
+		},
+		Targets: map[string]config.TargetConfig{
+			"https://api.cerebras.ai/v1":           {Auth: &config.TargetAuth{APIKeys: []string{"csk-1", "csk-2"}}},
+			"https://api.anthropic.com":            {Auth: &config.TargetAuth{Style: config.AuthStyleXAPIKey, APIKey: "sk-ant"}},
+			"https://open.bigmodel.cn/api/paas/v4": {Auth: &config.TargetAuth{Style: config.AuthStyleHeader, Header: "X-Zhipu-Key", APIKey: "zp"}},
+			"https://api.openai.com/v1":            {Auth: &config.TargetAuth{APIKey: "sk-openai"}},
+		},
+	}
+
+	var captured http.Header
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured = r.Header.Clone()
+	}))
+
+	send := func(model string) http.Header {
+		req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(`{"model": "`+model+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer proxy-key")
+		req.Header.Set("X-Api-Key", "proxy-key")
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+		return captured
+	}
+
+	tests := []struct {
+		name   string
+		model  string
+		want   map[string]string
+		absent []string
+	}{
+		{"bearer pool", "llama3.1-8b", map[string]string{"Authorization": "Bearer csk-1"}, []string{"X-Api-Key"}},
+		{"pool rotates", "llama3.1-8b", map[string]string{"Authorization": "Bearer csk-2"}, []string{"X-Api-Key"}},
+		{"x-api-key style", "claude-3", map[string]string{"X-Api-Key": "sk-ant"}, []string{"Authorization"}},
+		{"custom header", "glm-4.6", map[string]string{"X-Zhipu-Key": "zp"}, []string{"Authorization", "X-Api-Key"}},
+		{"default target", "unknown", map[string]string{"Authorization": "Bearer sk-openai"}, []string{"X-Api-Key"}},
+		{"target without auth passes client credentials", "local", map[string]string{"Authorization": "Bearer proxy-key", "X-Api-Key": "proxy-key"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := send(tt.model)
+			for name, value := range tt.want {
+				if got := header.Get(name); got != value {
+					t.Errorf("Expected %s %q, got %q", name, value, got)
+				}
+			}
+			for _, name := range tt.absent {
+				if got := header.Get(name); got != "" {
+					t.Errorf("Expected %s stripped, got %q", name, got)
+				}
+			}
+		})
+	}
+}
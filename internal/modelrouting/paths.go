@@ -0,0 +1,55 @@
+package modelrouting
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// targetPaths is the compiled form of a config.TargetConfig
+type targetPaths struct {
+	stripPrefix string
+	rewrites    []pathRewrite
+}
+
+type pathRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func compileTargetPaths(cfg config.TargetConfig) (*targetPaths, error) {
+	paths := &targetPaths{stripPrefix: strings.TrimSuffix(cfg.StripPrefix, "/")}
+	for _, rewrite := range cfg.RewritePath {
+		re, err := regexp.Compile(rewrite.Match)
+		if err != nil {
+			return nil, err
+		}
+		paths.rewrites = append(paths.rewrites, pathRewrite{match: re, replace: rewrite.Replace})
+	}
+	return paths, nil
+}
+
+// apply strips the prefix and applies the first matching rewrite to u's path
+func (p *targetPaths) apply(u *url.URL) {
+	path := u.Path
+	if p.stripPrefix != "" && (path == p.stripPrefix || strings.HasPrefix(path, p.stripPrefix+"/")) {
+		path = strings.TrimPrefix(path, p.stripPrefix)
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	for _, rewrite := range p.rewrites {
+		if rewrite.match.MatchString(path) {
+			path = rewrite.match.ReplaceAllString(path, rewrite.replace)
+			break
+		}
+	}
+
+	if path != u.Path {
+		u.Path = path
+		u.RawPath = ""
+	}
+}
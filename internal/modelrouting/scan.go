@@ -0,0 +1,356 @@
+package modelrouting
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
+)
+
+// DefaultMaxBodyBytes caps request bodies when max_body_bytes is not set
+const DefaultMaxBodyBytes int64 = 32 << 20
+
+// errBodyTooLarge is returned by cappedReader once the limit is passed
+var errBodyTooLarge = errors.New("request body too large")
+
+// cappedReader fails with errBodyTooLarge instead of returning more than
+// remaining bytes. The error is a 413 ProxyError wrapping errBodyTooLarge, so
+// the proxy still answers 413 when the limit is only hit while the body
+// streams upstream.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return 0, c.tooLarge()
+	}
+	// Read one byte past the limit to tell "exactly at" from "over"
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return n + int(c.remaining), c.tooLarge()
+	}
+	return n, err
+}
+
+func (c *cappedReader) tooLarge() error {
+	return proxyerrors.NewProxyError(proxyerrors.ErrorTypeRequestTooLarge,
+		fmt.Sprintf("Request body exceeds %d bytes", c.limit), errBodyTooLarge)
+}
+
+// modelField is the top-level model member of a request body. start and end
+// are the byte offsets of its raw string value, quotes included, or -1 when
+// the model is missing or not a string.
+type modelField struct {
+	name       string
+	start, end int64
+}
+
+// scanModel reads a JSON object from r only as far as its top-level "model"
+// member and returns the member's value. Other members are skipped without
+// being decoded. A missing or non-string model yields "".
+func scanModel(r io.Reader) (string, error) {
+	field, err := scanModelField(r)
+	return field.name, err
+}
+
+// scanModelField is scanModel that also reports where the model's value is
+// in the body, so it can be replaced without decoding the rest
+func scanModelField(r io.Reader) (modelField, error) {
+	src := &scanSource{r: r}
+	s := &scanner{r: bufio.NewReader(src), src: src}
+	absent := modelField{start: -1, end: -1}
+
+	if err := s.expect('{'); err != nil {
+		return absent, err
+	}
+	c, err := s.next()
+	if err != nil {
+		return absent, err
+	}
+	if c == '}' {
+		return absent, nil
+	}
+	s.r.UnreadByte()
+
+	for {
+		if err := s.expect('"'); err != nil {
+			return absent, err
+		}
+		key, escaped, err := s.readString()
+		if err != nil {
+			return absent, err
+		}
+		if err := s.expect(':'); err != nil {
+			return absent, err
+		}
+
+		if isModelKey(key, escaped) {
+			return s.readModelValue()
+		}
+		if err := s.skipValue(); err != nil {
+			return absent, err
+		}
+
+		c, err := s.next()
+		if err != nil {
+			return absent, err
+		}
+		switch c {
+		case ',':
+		case '}':
+			return absent, nil
+		default:
+			return absent, fmt.Errorf("invalid character %q after object member", c)
+		}
+	}
+}
+
+func isModelKey(key []byte, escaped bool) bool {
+	if !escaped {
+		return string(key) == "model"
+	}
+	var decoded string
+	quoted := append(append([]byte{'"'}, key...), '"')
+	return json.Unmarshal(quoted, &decoded) == nil && decoded == "model"
+}
+
+type scanner struct {
+	r   *bufio.Reader
+	src *scanSource
+	buf []byte
+}
+
+// scanSource counts the bytes the scanner's buffer has pulled from the body
+type scanSource struct {
+	r io.Reader
+	n int64
+}
+
+func (s *scanSource) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// offset is the position in the body of the next byte the scanner reads
+func (s *scanner) offset() int64 {
+	return s.src.n - int64(s.r.Buffered())
+}
+
+// readByte is ReadByte for input that must not end yet
+func (s *scanner) readByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return c, err
+}
+
+// next returns the next byte that is not JSON whitespace
+func (s *scanner) next() (byte, error) {
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		return c, nil
+	}
+}
+
+func (s *scanner) expect(want byte) error {
+	c, err := s.next()
+	if err != nil {
+		return err
+	}
+	if c != want {
+		return fmt.Errorf("invalid character %q, expected %q", c, want)
+	}
+	return nil
+}
+
+// readString reads the rest of a string after its opening quote and returns
+// the raw contents, reusing an internal buffer
+func (s *scanner) readString() ([]byte, bool, error) {
+	s.buf = s.buf[:0]
+	escaped := false
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return nil, false, err
+		}
+		switch c {
+		case '"':
+			return s.buf, escaped, nil
+		case '\\':
+			escaped = true
+			next, err := s.readByte()
+			if err != nil {
+				return nil, false, err
+			}
+			s.buf = append(s.buf, c, next)
+			continue
+		}
+		s.buf = append(s.buf, c)
+	}
+}
+
+// skipString consumes the rest of a string without keeping it. It jumps
+// from quote to quote in the read buffer, counting the backslashes before
+// each quote to tell an escaped quote from the closing one.
+func (s *scanner) skipString() error {
+	carried := 0 // backslashes ending the previous chunk
+	for {
+		chunk, err := s.r.ReadSlice('"')
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		closed := err == nil
+		if closed {
+			chunk = chunk[:len(chunk)-1]
+		}
+		run := 0
+		for run < len(chunk) && chunk[len(chunk)-1-run] == '\\' {
+			run++
+		}
+		if run == len(chunk) {
+			run += carried
+		}
+
+		if closed {
+			if run%2 == 0 {
+				return nil
+			}
+			carried = 0
+		} else {
+			carried = run
+		}
+	}
+}
+
+// skipValue consumes one JSON value. Nested objects and arrays are skipped
+// by tracking depth, which is enough to find where the value ends.
+func (s *scanner) skipValue() error {
+	depth := 0
+	for {
+		c, err := s.next()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '"':
+			if err := s.skipString(); err != nil {
+				return err
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("invalid character %q in value", c)
+			}
+		case ',', ':':
+			if depth == 0 {
+				return fmt.Errorf("invalid character %q in value", c)
+			}
+			continue
+		default:
+			// Numbers, true, false and null run until a delimiter
+			if err := s.skipLiteral(); err != nil {
+				return err
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *scanner) skipLiteral() error {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch c {
+		case ',', '}', ']', ' ', '\t', '\n', '\r':
+			s.r.UnreadByte()
+			return nil
+		}
+	}
+}
+
+func (s *scanner) readModelValue() (modelField, error) {
+	field := modelField{start: -1, end: -1}
+	c, err := s.next()
+	if err != nil {
+		return field, err
+	}
+	if c != '"' {
+		// Not a string; the model is treated as absent
+		return field, nil
+	}
+	start := s.offset() - 1
+
+	raw, escaped, err := s.readString()
+	if err != nil {
+		return field, err
+	}
+	field.start, field.end = start, s.offset()
+	if !escaped {
+		field.name = string(raw)
+		return field, nil
+	}
+	quoted := append(append([]byte{'"'}, raw...), '"')
+	if err := json.Unmarshal(quoted, &field.name); err != nil {
+		return modelField{start: -1, end: -1}, err
+	}
+	return field, nil
+}
+
+// replayBody returns a body that yields what was already read into consumed,
+// then the rest of rest
+func replayBody(consumed *bytes.Buffer, rest io.Reader, closer io.Closer) io.ReadCloser {
+	return &replayReader{consumed: consumed, rest: rest, Closer: closer}
+}
+
+// replayReader is io.MultiReader, except that a Read spanning both parts
+// returns data from each, as reading the original body would
+type replayReader struct {
+	consumed *bytes.Buffer
+	rest     io.Reader
+	io.Closer
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	n, _ := r.consumed.Read(p)
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := r.rest.Read(p[n:])
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n + m, err
+}
@@ -0,0 +1,174 @@
+package modelrouting
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/proxy"
+)
+
+func TestScanModel(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"model first", `{"model": "gpt-4", "messages": []}`, "gpt-4", false},
+		{"model after nested values", `{"messages": [{"role": "user", "content": "a \"quoted\" }] {"}], "n": -1.5e3, "ok": true, "x": null, "model": "gpt-4"}`, "gpt-4", false},
+		{"escaped backslashes before quotes", `{"a": "x\\", "b": "y\\\"}\\\\", "model": "gpt-4"}`, "gpt-4", false},
+		{"backslash run across read buffer", `{"a": "` + strings.Repeat(`\\`, 3000) + `\"", "model": "gpt-4"}`, "gpt-4", false},
+		{"nested model is ignored", `{"metadata": {"model": "nested"}, "model": "top"}`, "top", false},
+		{"escaped key and value", `{"mod\u0065l": "claude\u002d3"}`, "claude-3", false},
+		{"missing model", `{"messages": []}`, "", false},
+		{"empty object", ` { } `, "", false},
+		{"non-string model", `{"model": 4}`, "", false},
+		{"not an object", `["model"]`, "", true},
+		{"not json", `not json`, "", true},
+		{"truncated before model", `{"messages": [{"role": "us`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scanModel(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected model %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScanModelFieldOffsets(t *testing.T) {
+	body := `{"messages": [{"model": "x"}], "model" :  "gpt\u002d4", "n": 1}`
+	field, err := scanModelField(strings.NewReader(body))
+	if err != nil || field.name != "gpt-4" {
+		t.Fatalf("Expected gpt-4, got %q (%v)", field.name, err)
+	}
+	if raw := body[field.start:field.end]; raw != `"gpt\u002d4"` {
+		t.Errorf("Expected offsets of the raw value, got %q", raw)
+	}
+
+	field, err = scanModelField(strings.NewReader(`{"model": 4}`))
+	if err != nil || field.start != -1 || field.end != -1 {
+		t.Errorf("Expected no offsets for a non-string model, got %+v (%v)", field, err)
+	}
+}
+
+func TestScanModelStopsAtModel(t *testing.T) {
+	// Everything after the model must stay unread
+	body := `{"model": "gpt-4", "messages": [` + strings.Repeat(`{"role": "user", "content": "x"},`, 100000) + `{}]}`
+	reader := &countingReader{r: strings.NewReader(body)}
+
+	if model, err := scanModel(reader); err != nil || model != "gpt-4" {
+		t.Fatalf("Expected gpt-4, got %q (%v)", model, err)
+	}
+	if reader.n > 8192 {
+		t.Errorf("Expected the scan to stop early, read %d of %d bytes", reader.n, len(body))
+	}
+}
+
+func TestCappedReader(t *testing.T) {
+	exact := &cappedReader{r: strings.NewReader("12345"), remaining: 5}
+	if data, err := io.ReadAll(exact); err != nil || string(data) != "12345" {
+		t.Errorf("Expected body at the limit to pass, got %q (%v)", data, err)
+	}
+
+	over := &cappedReader{r: strings.NewReader("123456"), remaining: 5}
+	if data, err := io.ReadAll(over); !errors.Is(err, errBodyTooLarge) || len(data) > 5 {
+		t.Errorf("Expected errBodyTooLarge after 5 bytes, got %q (%v)", data, err)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	yes := true
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		MaxBodyBytes:  1024,
+		Rules: []config.ModelRule{
+			{Name: "tools", Pattern: "decoded", When: &config.RuleConditions{HasTools: &yes}, Target: "https://tools.example.com/v1"},
+		},
+	}
+
+	var forwarded []byte
+	middleware := NewModelRoutingMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(body string, chunked bool) int {
+		req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	small := `{"model": "gpt-4", "messages": [{"role": "user", "content": "hi"}]}`
+	if code := send(small, false); code != http.StatusOK || string(forwarded) != small {
+		t.Errorf("Expected small body forwarded intact, got %d %q", code, forwarded)
+	}
+
+	large := `{"model": "gpt-4", "messages": [{"role": "user", "content": "` + strings.Repeat("x", 2048) + `"}]}`
+	if code := send(large, false); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 from Content-Length, got %d", code)
+	}
+
+	// Without Content-Length the limit is hit while reading the whole body
+	// for a content rule
+	largeDecoded := strings.Replace(large, "gpt-4", "decoded", 1)
+	if code := send(largeDecoded, true); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 while reading a chunked body, got %d", code)
+	}
+}
+
+func TestMaxBodySizeWhileStreaming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: upstream.URL,
+		Models:        map[string]string{"gpt-4": upstream.URL},
+		MaxBodyBytes:  1024,
+	}
+	middleware := NewModelRoutingMiddleware(cfg, proxy.NewHandler(nil))
+
+	// The model comes first, so the limit is only hit once the body is
+	// already streaming upstream
+	body := `{"model": "gpt-4", "messages": [{"role": "user", "content": "` + strings.Repeat("x", 64<<10) + `"}]}`
+	req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	middleware.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over the limit after the model, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,313 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+)
+
+const (
+	azureDefaultAPIVersion = "2024-06-01"
+
+	// Azure enforces per-minute quotas in 10 second slices, so remaining
+	// capacity is spread over that window
+	azureQuotaWindow = 10 * time.Second
+	// azureLowWater is the remaining request count below which requests
+	// start being spaced out
+	azureLowWater = 10
+)
+
+// azureOperations are the OpenAI endpoints Azure serves under a deployment
+var azureOperations = []string{"chat/completions", "completions", "embeddings"}
+
+// AzureProvider routes OpenAI-format requests to Azure OpenAI deployments.
+// It also acts as a model routing adapter.
+type AzureProvider struct {
+	config     *config.ProviderConfig
+	endpoint   *url.URL
+	httpClient *http.Client
+	limiter    *ratelimit.Limiter
+}
+
+func NewAzureProvider(config *config.ProviderConfig) *AzureProvider {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		endpoint = &url.URL{}
+	}
+
+	return &AzureProvider{
+		config:     config,
+		endpoint:   endpoint,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// SetRateLimiter lets Azure quota headers slow down or pause the endpoint in
+// the domain limiter
+func (p *AzureProvider) SetRateLimiter(limiter *ratelimit.Limiter) {
+	p.limiter = limiter
+}
+
+func (p *AzureProvider) Name() string {
+	return "azure"
+}
+
+func (p *AzureProvider) GetAPIKey() string {
+	return p.config.APIKey
+}
+
+// CheckRateLimit always succeeds; Azure quota is enforced through the domain
+// limiter
+func (p *AzureProvider) CheckRateLimit() error {
+	return nil
+}
+
+// deployment returns the deployment name and api-version for model
+func (p *AzureProvider) deployment(model string) (string, string) {
+	deployment := model
+	apiVersion := azureDefaultAPIVersion
+
+	if azure := p.config.Azure; azure != nil {
+		if azure.APIVersion != "" {
+			apiVersion = azure.APIVersion
+		}
+		if mapped, ok := azure.Deployments[model]; ok {
+			deployment = mapped.Deployment
+			if mapped.APIVersion != "" {
+				apiVersion = mapped.APIVersion
+			}
+		}
+	}
+	return deployment, apiVersion
+}
+
+// deploymentURL builds the deployment-scoped URL for operation. Unmapped
+// models are used as the deployment name as sent, so names that could leave
+// the deployment's path are refused.
+func (p *AzureProvider) deploymentURL(target *url.URL, model, operation string) (*url.URL, error) {
+	deployment, apiVersion := p.deployment(model)
+	if deployment == "" || strings.Contains(deployment, "/") || strings.Contains(deployment, "..") {
+		return nil, proxyerrors.NewInvalidRequestError(fmt.Sprintf("invalid Azure deployment name %q", deployment))
+	}
+
+	basePath := strings.TrimSuffix(target.Path, "/")
+	rawBasePath := strings.TrimSuffix(target.EscapedPath(), "/")
+	if !strings.HasSuffix(basePath, "/openai") {
+		basePath += "/openai"
+		rawBasePath += "/openai"
+	}
+
+	u := *target
+	u.Path = basePath + "/deployments/" + deployment + "/" + operation
+	u.RawPath = rawBasePath + "/deployments/" + url.PathEscape(deployment) + "/" + operation
+	query := url.Values{}
+	query.Set("api-version", apiVersion)
+	u.RawQuery = query.Encode()
+	return &u, nil
+}
+
+// observe adapts the limiter to the quota state reported on a response
+func (p *AzureProvider) observe(status int, header http.Header) {
+	if p.limiter == nil {
+		return
+	}
+	quota, err := ratelimit.ParseQuota(config.HeaderSchemas["openai"], header, time.Now())
+	if err != nil {
+		if status == http.StatusTooManyRequests {
+			p.limiter.Pause(p.endpoint.Host, azureQuotaWindow)
+		}
+		return
+	}
+
+	switch {
+	case status == http.StatusTooManyRequests || quota.RemainingRequests == 0 || quota.RemainingTokens == 0:
+		pause := quota.RetryAfter
+		if pause == 0 {
+			pause = azureQuotaWindow
+		}
+		p.limiter.Pause(p.endpoint.Host, pause)
+	case quota.RemainingRequests > 0 && quota.RemainingRequests < azureLowWater:
+		// Spread what is left over the window instead of bursting into a 429
+		p.limiter.Pause(p.endpoint.Host, azureQuotaWindow/time.Duration(quota.RemainingRequests+1))
+	}
+}
+
+// Adapter implementation
+
+// Matches reports whether target points at the configured Azure resource
+func (p *AzureProvider) Matches(target *url.URL) bool {
+	return p.endpoint.Host != "" && strings.EqualFold(target.Host, p.endpoint.Host)
+}
+
+// RewriteRequest maps the request onto its deployment URL and swaps bearer
+// auth for the api-key header. The body is forwarded unchanged.
+func (p *AzureProvider) RewriteRequest(r *http.Request, target *url.URL, body []byte) (*http.Request, error) {
+	operation := ""
+	for _, op := range azureOperations {
+		if strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/"+op) {
+			operation = op
+			break
+		}
+	}
+	if operation == "" {
+		return nil, proxyerrors.NewInvalidRequestError(
+			fmt.Sprintf("path %s is not served by Azure OpenAI deployments", r.URL.Path))
+	}
+
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, proxyerrors.NewInvalidRequestError(fmt.Sprintf("failed to parse request body: %v", err))
+	}
+	if req.Model == "" {
+		return nil, proxyerrors.NewInvalidRequestError("model is required for Azure OpenAI requests")
+	}
+
+	apiKey := p.GetAPIKey()
+	if apiKey == "" {
+		apiKey = clientAPIKey(r)
+	}
+
+	// Keep any extra client query parameters alongside api-version
+	deploymentURL, err := p.deploymentURL(target, req.Model, operation)
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	query.Set("api-version", deploymentURL.Query().Get("api-version"))
+	deploymentURL.RawQuery = query.Encode()
+
+	r.URL = deploymentURL
+	r.Host = target.Host
+
+	r.Header.Del("Authorization")
+	r.Header.Del("X-Api-Key")
+	if apiKey != "" {
+		r.Header.Set("Api-Key", apiKey)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	return r, nil
+}
+
+// WrapResponseWriter passes responses through while feeding Azure's quota
+// headers to the limiter
+func (p *AzureProvider) WrapResponseWriter(w http.ResponseWriter, r *http.Request) modelrouting.ResponseTranslator {
+	return &azureWriter{ResponseWriter: w, provider: p}
+}
+
+type azureWriter struct {
+	http.ResponseWriter
+	provider    *AzureProvider
+	wroteHeader bool
+}
+
+func (w *azureWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.provider.observe(status, w.Header())
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *azureWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *azureWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *azureWriter) Finish() error {
+	return nil
+}
+
+// MakeRequest sends a non-streaming chat completion to the model's deployment
+func (p *AzureProvider) MakeRequest(ctx context.Context, model string, messages []interface{}, options map[string]interface{}) (*Response, error) {
+	reqBody := map[string]interface{}{"messages": messages}
+	for key, value := range options {
+		reqBody[key] = value
+	}
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	deploymentURL, err := p.deploymentURL(p.endpoint, model, "chat/completions")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", deploymentURL.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Api-Key", p.GetAPIKey())
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	p.observe(resp.StatusCode, resp.Header)
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("azure returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var chatResp openAIChatResponse
+	if err := json.Unmarshal(respBody, &chatResp); err != nil {
+		return nil, err
+	}
+
+	content := ""
+	if len(chatResp.Choices) > 0 && chatResp.Choices[0].Message != nil && chatResp.Choices[0].Message.Content != nil {
+		content = *chatResp.Choices[0].Message.Content
+	}
+
+	usage := map[string]interface{}{}
+	if chatResp.Usage != nil {
+		usage["prompt_tokens"] = chatResp.Usage.PromptTokens
+		usage["completion_tokens"] = chatResp.Usage.CompletionTokens
+		usage["total_tokens"] = chatResp.Usage.TotalTokens
+	}
+
+	headers := make(map[string]string)
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headers[key] = values[0]
+		}
+	}
+
+	return &Response{
+		Content: content,
+		Model:   model,
+		Usage:   usage,
+		Headers: headers,
+	}, nil
+}
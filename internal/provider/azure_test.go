@@ -0,0 +1,195 @@
+package provider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// azureModels are routed to the test upstream. gpt-4o is mapped to a
+// deployment by testAzureProvider and gpt-35-turbo is not.
+var azureModels = []string{"gpt-4o", "gpt-35-turbo"}
+
+func testAzureProvider(apiKey string) func(endpoint string) modelrouting.Adapter {
+	return func(endpoint string) modelrouting.Adapter {
+		return NewAzureProvider(&config.ProviderConfig{
+			Name:     "azure",
+			Endpoint: endpoint,
+			APIKey:   apiKey,
+			Azure: &config.AzureConfig{
+				APIVersion: "2024-06-01",
+				Deployments: map[string]config.AzureDeployment{
+					"gpt-4o": {Deployment: "gpt4o-prod", APIVersion: "2024-08-01-preview"},
+				},
+			},
+		})
+	}
+}
+
+func TestAzureAdapterRewritesDeploymentRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		apiKey      string
+		path        string
+		model       string
+		wantPath    string
+		wantVersion string
+		wantKey     string
+	}{
+		{
+			name:        "mapped deployment with its own api-version",
+			apiKey:      "azure-key",
+			path:        "/v1/chat/completions",
+			model:       "gpt-4o",
+			wantPath:    "/openai/deployments/gpt4o-prod/chat/completions",
+			wantVersion: "2024-08-01-preview",
+			wantKey:     "azure-key",
+		},
+		{
+			name:        "unmapped model uses model name and default api-version",
+			path:        "/embeddings",
+			model:       "gpt-35-turbo",
+			wantPath:    "/openai/deployments/gpt-35-turbo/embeddings",
+			wantVersion: "2024-06-01",
+			wantKey:     "client-key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath, gotVersion, gotKey, gotAuth, gotBody string
+			_, _, handler := newRoutingStack(t, "", azureModels, testAzureProvider(tt.apiKey),
+				func(w http.ResponseWriter, r *http.Request) {
+					gotPath = r.URL.Path
+					gotVersion = r.URL.Query().Get("api-version")
+					gotKey = r.Header.Get("Api-Key")
+					gotAuth = r.Header.Get("Authorization")
+					body, _ := io.ReadAll(r.Body)
+					gotBody = string(body)
+					w.Header().Set("Content-Type", "application/json")
+					io.WriteString(w, `{"choices": []}`)
+				})
+
+			body := `{"model": "` + tt.model + `", "messages": [{"role": "user", "content": "Hi"}]}`
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer client-key")
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tt.wantPath, gotPath)
+			assert.Equal(t, tt.wantVersion, gotVersion)
+			assert.Equal(t, tt.wantKey, gotKey)
+			assert.Empty(t, gotAuth)
+			assert.Equal(t, body, gotBody)
+		})
+	}
+}
+
+func TestAzureAdapterRejectsMessagesEndpoint(t *testing.T) {
+	_, _, handler := newRoutingStack(t, "", azureModels, testAzureProvider("azure-key"),
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Error("request should not reach Azure")
+		})
+
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model": "gpt-4o", "max_tokens": 10, "messages": []}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAzureRewriteRequestKeepsDeploymentScope(t *testing.T) {
+	azure := testAzureProvider("azure-key")("https://example.openai.azure.com").(*AzureProvider)
+	target, _ := url.Parse("https://example.openai.azure.com")
+
+	rewrite := func(model string) (*http.Request, error) {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		return azure.RewriteRequest(req, target, []byte(`{"model": "`+model+`"}`))
+	}
+
+	for _, model := range []string{"x/../../other", "..", "a/b"} {
+		_, err := rewrite(model)
+		assert.Error(t, err, model)
+	}
+
+	req, err := rewrite("gpt 4o?v=1")
+	require.NoError(t, err)
+	assert.Equal(t, "/openai/deployments/gpt 4o?v=1/chat/completions", req.URL.Path)
+	assert.Equal(t, "/openai/deployments/gpt%204o%3Fv=1/chat/completions", req.URL.EscapedPath())
+}
+
+func TestAzureAdapterAdaptsToQuotaHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		headers   map[string]string
+		wantPause time.Duration
+	}{
+		{
+			name:      "plenty of quota left",
+			status:    http.StatusOK,
+			headers:   map[string]string{"x-ratelimit-remaining-requests": "500", "x-ratelimit-remaining-tokens": "90000"},
+			wantPause: 0,
+		},
+		{
+			name:      "few requests left are spread over the window",
+			status:    http.StatusOK,
+			headers:   map[string]string{"x-ratelimit-remaining-requests": "4"},
+			wantPause: azureQuotaWindow / 5,
+		},
+		{
+			name:      "token quota exhausted",
+			status:    http.StatusOK,
+			headers:   map[string]string{"x-ratelimit-remaining-requests": "40", "x-ratelimit-remaining-tokens": "0"},
+			wantPause: azureQuotaWindow,
+		},
+		{
+			name:      "throttled with retry-after-ms",
+			status:    http.StatusTooManyRequests,
+			headers:   map[string]string{"retry-after-ms": "3000", "Retry-After": "3"},
+			wantPause: 3 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter, limiter, handler := newRoutingStack(t, "", azureModels, testAzureProvider("azure-key"),
+				func(w http.ResponseWriter, r *http.Request) {
+					for name, value := range tt.headers {
+						w.Header().Set(name, value)
+					}
+					w.WriteHeader(tt.status)
+				})
+			azure := adapter.(*AzureProvider)
+
+			req := httptest.NewRequest("POST", "/v1/chat/completions",
+				strings.NewReader(`{"model": "gpt-4o", "messages": []}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, tt.status, w.Code)
+
+			delay := limiter.GetDelay(azure.endpoint.Host)
+			if tt.wantPause == 0 {
+				assert.Zero(t, delay)
+				return
+			}
+			assert.InDelta(t, float64(tt.wantPause), float64(delay), float64(100*time.Millisecond))
+		})
+	}
+}
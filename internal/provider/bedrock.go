@@ -0,0 +1,885 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+)
+
+const (
+	bedrockService          = "bedrock"
+	bedrockAnthropicVersion = "bedrock-2023-05-31"
+	bedrockDefaultMaxTokens = 4096
+
+	// Bedrock sends no retry hint with throttling errors, so back off
+	// exponentially between these bounds
+	bedrockMinBackoff = time.Second
+	bedrockMaxBackoff = 30 * time.Second
+)
+
+// Bedrock model families with different native request formats
+const (
+	bedrockFamilyAnthropic = "anthropic"
+	bedrockFamilyMeta      = "meta"
+)
+
+// BedrockProvider calls Claude and Llama models through AWS Bedrock
+// InvokeModel and InvokeModelWithResponseStream, signing every request with
+// SigV4. It also acts as a model routing adapter.
+type BedrockProvider struct {
+	config     *config.ProviderConfig
+	endpoint   *url.URL
+	region     string
+	creds      *awsCredentialsSource
+	httpClient *http.Client
+	limiter    *ratelimit.Limiter
+
+	mu      sync.Mutex
+	backoff time.Duration
+}
+
+// bedrockCall carries per-request translation state from RewriteRequest to
+// WrapResponseWriter
+type bedrockCall struct {
+	format ClientFormat
+	model  string
+	family string
+	stream bool
+}
+
+type bedrockCallKey struct{}
+
+type llamaRequest struct {
+	Prompt      string   `json:"prompt"`
+	MaxGenLen   int      `json:"max_gen_len,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+}
+
+type llamaResponse struct {
+	Generation           string `json:"generation"`
+	PromptTokenCount     int    `json:"prompt_token_count"`
+	GenerationTokenCount int    `json:"generation_token_count"`
+	StopReason           string `json:"stop_reason"`
+	InvocationMetrics    *struct {
+		InputTokenCount  int `json:"inputTokenCount"`
+		OutputTokenCount int `json:"outputTokenCount"`
+	} `json:"amazon-bedrock-invocationMetrics,omitempty"`
+}
+
+func NewBedrockProvider(config *config.ProviderConfig) *BedrockProvider {
+	region := "us-east-1"
+	var static AWSCredentials
+	var credentialsFile, profile string
+	if aws := config.AWS; aws != nil {
+		if aws.Region != "" {
+			region = aws.Region
+		}
+		static = AWSCredentials{
+			AccessKeyID:     aws.AccessKeyID,
+			SecretAccessKey: aws.SecretAccessKey,
+			SessionToken:    aws.SessionToken,
+		}
+		credentialsFile = aws.CredentialsFile
+		profile = aws.Profile
+	}
+
+	defaultEndpoint := fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", region)
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		endpointURL, _ = url.Parse(defaultEndpoint)
+	}
+
+	return &BedrockProvider{
+		config:     config,
+		endpoint:   endpointURL,
+		region:     region,
+		creds:      newAWSCredentialsSource(static, credentialsFile, profile),
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// SetRateLimiter makes throttling exceptions pause the Bedrock endpoint in
+// the domain limiter
+func (p *BedrockProvider) SetRateLimiter(limiter *ratelimit.Limiter) {
+	p.limiter = limiter
+}
+
+func (p *BedrockProvider) Name() string {
+	return "bedrock"
+}
+
+// GetAPIKey returns the access key ID requests are signed with
+func (p *BedrockProvider) GetAPIKey() string {
+	creds, err := p.creds.Credentials()
+	if err != nil {
+		return ""
+	}
+	return creds.AccessKeyID
+}
+
+// CheckRateLimit always succeeds; throttling backoff is enforced through the
+// domain limiter
+func (p *BedrockProvider) CheckRateLimit() error {
+	return nil
+}
+
+// recordThrottle doubles the backoff and pauses the endpoint in the limiter
+func (p *BedrockProvider) recordThrottle() time.Duration {
+	p.mu.Lock()
+	p.backoff *= 2
+	if p.backoff < bedrockMinBackoff {
+		p.backoff = bedrockMinBackoff
+	}
+	if p.backoff > bedrockMaxBackoff {
+		p.backoff = bedrockMaxBackoff
+	}
+	backoff := p.backoff
+	p.mu.Unlock()
+
+	if p.limiter != nil {
+		p.limiter.Pause(p.endpoint.Host, backoff)
+	}
+	return backoff
+}
+
+func (p *BedrockProvider) recordSuccess() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.backoff = 0
+}
+
+// isBedrockThrottle reports whether an error response is a throttling or
+// quota exception
+func isBedrockThrottle(status int, header http.Header) bool {
+	if status == http.StatusTooManyRequests {
+		return true
+	}
+	errType := header.Get("X-Amzn-Errortype")
+	return strings.HasPrefix(errType, "ThrottlingException") ||
+		strings.HasPrefix(errType, "ServiceQuotaExceededException")
+}
+
+func bedrockFamily(modelID string) string {
+	switch {
+	case strings.Contains(modelID, "anthropic."):
+		return bedrockFamilyAnthropic
+	case strings.Contains(modelID, "meta.llama"):
+		return bedrockFamilyMeta
+	default:
+		return ""
+	}
+}
+
+// Adapter implementation
+
+// Matches reports whether target points at the configured Bedrock endpoint
+func (p *BedrockProvider) Matches(target *url.URL) bool {
+	return strings.EqualFold(target.Host, p.endpoint.Host)
+}
+
+// RewriteRequest translates an OpenAI or Anthropic request into a signed
+// InvokeModel or InvokeModelWithResponseStream call
+func (p *BedrockProvider) RewriteRequest(r *http.Request, target *url.URL, body []byte) (*http.Request, error) {
+	call := &bedrockCall{format: DetectClientFormat(r.URL.Path)}
+
+	payload, err := p.buildInvokeBody(call, body)
+	if err != nil {
+		return nil, proxyerrors.NewInvalidRequestError(err.Error())
+	}
+
+	creds, err := p.creds.Credentials()
+	if err != nil {
+		return nil, proxyerrors.NewConfigurationError("bedrock credentials unavailable", err)
+	}
+
+	action := "invoke"
+	accept := "application/json"
+	if call.stream {
+		action = "invoke-with-response-stream"
+		accept = "application/vnd.amazon.eventstream"
+	}
+
+	basePath := strings.TrimSuffix(target.Path, "/")
+	r = r.WithContext(context.WithValue(r.Context(), bedrockCallKey{}, call))
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = basePath + "/model/" + call.model + "/" + action
+	r.URL.RawPath = basePath + "/model/" + sigV4Escape(call.model) + "/" + action
+	r.URL.RawQuery = ""
+	r.Host = target.Host
+
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			r.Header.Del(name)
+		}
+	}
+	r.Header.Del("Authorization")
+	r.Header.Del("X-Api-Key")
+	r.Header.Del("Anthropic-Version")
+	r.Header.Del("Anthropic-Beta")
+	r.Header.Del("Accept-Encoding")
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", accept)
+
+	r.Body = io.NopCloser(bytes.NewReader(payload))
+	r.ContentLength = int64(len(payload))
+	r.Header.Set("Content-Length", fmt.Sprintf("%d", len(payload)))
+
+	SignV4(r, payload, creds, p.region, bedrockService, time.Now())
+	return r, nil
+}
+
+// buildInvokeBody converts the client body into the model family's native
+// request and fills in call
+func (p *BedrockProvider) buildInvokeBody(call *bedrockCall, body []byte) ([]byte, error) {
+	if call.format == FormatAnthropic {
+		var req anthropicRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, fmt.Errorf("failed to parse messages request: %w", err)
+		}
+		call.model, call.stream = req.Model, req.Stream
+		if call.family = bedrockFamily(call.model); call.family == "" {
+			return nil, fmt.Errorf("unsupported Bedrock model %q", call.model)
+		}
+
+		if call.family == bedrockFamilyMeta {
+			if len(req.Tools) > 0 {
+				return nil, fmt.Errorf("tools are not supported for Llama models on Bedrock")
+			}
+			return json.Marshal(llamaFromAnthropic(&req))
+		}
+
+		// Claude on Bedrock takes the Messages body minus model and stream
+		var native map[string]interface{}
+		if err := json.Unmarshal(body, &native); err != nil {
+			return nil, fmt.Errorf("failed to parse messages request: %w", err)
+		}
+		delete(native, "model")
+		delete(native, "stream")
+		if _, ok := native["anthropic_version"]; !ok {
+			native["anthropic_version"] = bedrockAnthropicVersion
+		}
+		return json.Marshal(native)
+	}
+
+	var req openAIChatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse chat completions request: %w", err)
+	}
+	call.model, call.stream = req.Model, req.Stream
+	if call.family = bedrockFamily(call.model); call.family == "" {
+		return nil, fmt.Errorf("unsupported Bedrock model %q", call.model)
+	}
+
+	if call.family == bedrockFamilyMeta {
+		if len(req.Tools) > 0 {
+			return nil, fmt.Errorf("tools are not supported for Llama models on Bedrock")
+		}
+		return json.Marshal(llamaFromOpenAI(&req))
+	}
+
+	native := anthropicFromOpenAI(&req)
+	native["anthropic_version"] = bedrockAnthropicVersion
+	return json.Marshal(native)
+}
+
+// WrapResponseWriter translates Bedrock responses back into the client
+// format
+func (p *BedrockProvider) WrapResponseWriter(w http.ResponseWriter, r *http.Request) modelrouting.ResponseTranslator {
+	call, ok := r.Context().Value(bedrockCallKey{}).(*bedrockCall)
+	if !ok {
+		call = &bedrockCall{format: DetectClientFormat(r.URL.Path)}
+	}
+
+	return &translatingWriter{
+		rw:     w,
+		header: make(http.Header),
+		newStream: func(status int, header http.Header) streamTranslator {
+			if !call.stream || status != http.StatusOK {
+				return nil
+			}
+			return newBedrockStream(p, call)
+		},
+		translate: func(status int, header http.Header, body []byte) []byte {
+			return p.translateResponse(call, status, header, body)
+		},
+	}
+}
+
+func (p *BedrockProvider) translateResponse(call *bedrockCall, status int, header http.Header, body []byte) []byte {
+	header.Set("Content-Type", "application/json")
+
+	if status >= 300 {
+		var errResp struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &errResp)
+		if errResp.Message == "" {
+			errResp.Message = strings.TrimSpace(string(body))
+		}
+
+		if isBedrockThrottle(status, header) {
+			backoff := p.recordThrottle()
+			header.Set("Retry-After", fmt.Sprintf("%d", int(backoff.Seconds())))
+			return clientError(call.format, http.StatusTooManyRequests, errResp.Message)
+		}
+		return clientError(call.format, status, errResp.Message)
+	}
+
+	p.recordSuccess()
+
+	// Claude responses are already in Messages format
+	if call.format == FormatAnthropic && call.family == bedrockFamilyAnthropic {
+		return body
+	}
+
+	c, err := bedrockCompletion(call.family, body)
+	if err != nil {
+		return body
+	}
+	return c.render(call.format, call.model)
+}
+
+// MakeRequest sends a non-streaming InvokeModel call for the Anthropic
+// handler
+func (p *BedrockProvider) MakeRequest(ctx context.Context, model string, messages []interface{}, options map[string]interface{}) (*Response, error) {
+	family := bedrockFamily(model)
+	if family == "" {
+		return nil, fmt.Errorf("unsupported Bedrock model %q", model)
+	}
+
+	anthReq := &anthropicRequest{Model: model, MaxTokens: bedrockDefaultMaxTokens}
+	if maxTokens, ok := options["max_tokens"].(int); ok && maxTokens > 0 {
+		anthReq.MaxTokens = maxTokens
+	}
+	var system []string
+	for _, msg := range messages {
+		msgMap, ok := msg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := msgMap["role"].(string)
+		content, _ := msgMap["content"].(string)
+		if role == "system" {
+			system = append(system, content)
+			continue
+		}
+		raw, _ := json.Marshal(content)
+		anthReq.Messages = append(anthReq.Messages, anthropicMessage{Role: role, Content: raw})
+	}
+	if len(system) > 0 {
+		anthReq.System, _ = json.Marshal(strings.Join(system, "\n\n"))
+	}
+
+	var payload []byte
+	var err error
+	if family == bedrockFamilyMeta {
+		payload, err = json.Marshal(llamaFromAnthropic(anthReq))
+	} else {
+		native := map[string]interface{}{
+			"anthropic_version": bedrockAnthropicVersion,
+			"max_tokens":        anthReq.MaxTokens,
+			"messages":          anthReq.Messages,
+		}
+		if len(anthReq.System) > 0 {
+			native["system"] = anthReq.System
+		}
+		if tools, ok := options["tools"]; ok {
+			native["tools"] = tools
+		}
+		payload, err = json.Marshal(native)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := p.creds.Credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	basePath := strings.TrimSuffix(p.endpoint.Path, "/")
+	invokeURL := *p.endpoint
+	invokeURL.Path = basePath + "/model/" + model + "/invoke"
+	invokeURL.RawPath = basePath + "/model/" + sigV4Escape(model) + "/invoke"
+
+	req, err := http.NewRequestWithContext(ctx, "POST", invokeURL.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	SignV4(req, payload, creds, p.region, bedrockService, time.Now())
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		if isBedrockThrottle(resp.StatusCode, resp.Header) {
+			backoff := p.recordThrottle()
+			return nil, fmt.Errorf("bedrock throttled request, backing off %v", backoff)
+		}
+		return nil, fmt.Errorf("bedrock returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	p.recordSuccess()
+
+	c, err := bedrockCompletion(family, respBody)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string)
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headers[key] = values[0]
+		}
+	}
+
+	return &Response{
+		Content: c.text,
+		Model:   model,
+		Usage: map[string]interface{}{
+			"prompt_tokens":     c.usage.input,
+			"completion_tokens": c.usage.output,
+			"total_tokens":      c.usage.input + c.usage.output,
+		},
+		Headers: headers,
+	}, nil
+}
+
+// Request translation
+
+// anthropicFromOpenAI converts a chat completions request into a Messages
+// request body
+func anthropicFromOpenAI(req *openAIChatRequest) map[string]interface{} {
+	var system []string
+	var messages []map[string]interface{}
+
+	appendBlocks := func(role string, blocks ...map[string]interface{}) {
+		if n := len(messages); n > 0 && messages[n-1]["role"] == role {
+			messages[n-1]["content"] = append(messages[n-1]["content"].([]map[string]interface{}), blocks...)
+			return
+		}
+		messages = append(messages, map[string]interface{}{"role": role, "content": blocks})
+	}
+
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			if text := msg.text(); text != "" {
+				system = append(system, text)
+			}
+
+		case "tool":
+			appendBlocks("user", map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": msg.ToolCallID,
+				"content":     msg.text(),
+			})
+
+		default:
+			role := "user"
+			if msg.Role == "assistant" {
+				role = "assistant"
+			}
+
+			var blocks []map[string]interface{}
+			for _, part := range msg.parts() {
+				switch part.Type {
+				case "text":
+					if part.Text != "" {
+						blocks = append(blocks, map[string]interface{}{"type": "text", "text": part.Text})
+					}
+				case "image_url":
+					if part.ImageURL == nil {
+						continue
+					}
+					if inline := inlineDataFromURL(part.ImageURL.URL); inline != nil {
+						blocks = append(blocks, map[string]interface{}{
+							"type": "image",
+							"source": map[string]interface{}{
+								"type":       "base64",
+								"media_type": inline.MimeType,
+								"data":       inline.Data,
+							},
+						})
+					}
+				}
+			}
+			for _, call := range msg.ToolCalls {
+				input := map[string]interface{}{}
+				json.Unmarshal([]byte(call.Function.Arguments), &input)
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"id":    call.ID,
+					"name":  call.Function.Name,
+					"input": input,
+				})
+			}
+			if len(blocks) > 0 {
+				appendBlocks(role, blocks...)
+			}
+		}
+	}
+
+	maxTokens := req.maxTokens()
+	if maxTokens == 0 {
+		maxTokens = bedrockDefaultMaxTokens
+	}
+
+	native := map[string]interface{}{
+		"max_tokens": maxTokens,
+		"messages":   messages,
+	}
+	if len(system) > 0 {
+		native["system"] = strings.Join(system, "\n\n")
+	}
+	if req.Temperature != nil {
+		native["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		native["top_p"] = *req.TopP
+	}
+	if stop := req.stopSequences(); len(stop) > 0 {
+		native["stop_sequences"] = stop
+	}
+	if len(req.Tools) > 0 {
+		var tools []map[string]interface{}
+		for _, tool := range req.Tools {
+			schema := tool.Function.Parameters
+			if schema == nil {
+				schema = map[string]interface{}{"type": "object"}
+			}
+			tools = append(tools, map[string]interface{}{
+				"name":         tool.Function.Name,
+				"description":  tool.Function.Description,
+				"input_schema": schema,
+			})
+		}
+		native["tools"] = tools
+	}
+	return native
+}
+
+// llamaTurn is one message of a Llama 3 chat prompt
+type llamaTurn struct {
+	role string
+	text string
+}
+
+// llamaPrompt renders turns with the Llama 3 instruct chat template
+func llamaPrompt(turns []llamaTurn) string {
+	var b strings.Builder
+	b.WriteString("<|begin_of_text|>")
+	for _, turn := range turns {
+		fmt.Fprintf(&b, "<|start_header_id|>%s<|end_header_id|>\n\n%s<|eot_id|>", turn.role, turn.text)
+	}
+	b.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+	return b.String()
+}
+
+func llamaFromOpenAI(req *openAIChatRequest) *llamaRequest {
+	var turns []llamaTurn
+	for _, msg := range req.Messages {
+		role := msg.Role
+		switch role {
+		case "developer":
+			role = "system"
+		case "tool":
+			role = "ipython"
+		}
+		turns = append(turns, llamaTurn{role: role, text: msg.text()})
+	}
+	return &llamaRequest{
+		Prompt:      llamaPrompt(turns),
+		MaxGenLen:   req.maxTokens(),
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+	}
+}
+
+func llamaFromAnthropic(req *anthropicRequest) *llamaRequest {
+	var turns []llamaTurn
+	if system := anthropicText(req.System); system != "" {
+		turns = append(turns, llamaTurn{role: "system", text: system})
+	}
+	for _, msg := range req.Messages {
+		turns = append(turns, llamaTurn{role: msg.Role, text: anthropicText(msg.Content)})
+	}
+	return &llamaRequest{
+		Prompt:      llamaPrompt(turns),
+		MaxGenLen:   req.MaxTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+	}
+}
+
+// Response translation
+
+// bedrockCompletion parses a native InvokeModel response
+func bedrockCompletion(family string, body []byte) (*completion, error) {
+	if family == bedrockFamilyMeta {
+		var resp llamaResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		return &completion{
+			text:   resp.Generation,
+			finish: llamaFinish(resp.StopReason),
+			usage:  tokenUsage{input: resp.PromptTokenCount, output: resp.GenerationTokenCount},
+		}, nil
+	}
+
+	var resp struct {
+		Content    []anthropicBlock `json:"content"`
+		StopReason string           `json:"stop_reason"`
+		Usage      anthropicUsage   `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	c := &completion{
+		finish: anthropicFinish(resp.StopReason),
+		usage:  tokenUsage{input: resp.Usage.InputTokens, output: resp.Usage.OutputTokens},
+	}
+	var text strings.Builder
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			c.toolCalls = append(c.toolCalls, toolCall{id: block.ID, name: block.Name, args: block.Input})
+		}
+	}
+	c.text = text.String()
+	return c, nil
+}
+
+func llamaFinish(reason string) string {
+	switch reason {
+	case "length":
+		return finishLength
+	case "":
+		return ""
+	default:
+		return finishStop
+	}
+}
+
+func anthropicFinish(reason string) string {
+	switch reason {
+	case "max_tokens":
+		return finishLength
+	case "tool_use":
+		return finishToolUse
+	case "":
+		return ""
+	default:
+		return finishStop
+	}
+}
+
+// Stream translation
+
+// bedrockStream decodes event-stream frames and re-emits their chunks as
+// client stream events
+type bedrockStream struct {
+	provider *BedrockProvider
+	call     *bedrockCall
+	decoder  eventStreamDecoder
+	client   *clientStream
+	failed   bool
+
+	// tool_use block being assembled from input_json_delta events
+	pendingTool *toolCall
+	pendingArgs strings.Builder
+}
+
+func newBedrockStream(provider *BedrockProvider, call *bedrockCall) *bedrockStream {
+	return &bedrockStream{
+		provider: provider,
+		call:     call,
+		client:   newClientStream(call.format, call.model),
+	}
+}
+
+// passthrough reports whether Claude events can be relayed unchanged
+func (s *bedrockStream) passthrough() bool {
+	return s.call.format == FormatAnthropic && s.call.family == bedrockFamilyAnthropic
+}
+
+func (s *bedrockStream) Translate(p []byte) []byte {
+	if s.failed {
+		return nil
+	}
+
+	messages, err := s.decoder.feed(p)
+	var out bytes.Buffer
+	for _, msg := range messages {
+		out.Write(s.handleMessage(msg))
+	}
+	if err != nil && !s.failed {
+		s.failed = true
+		out.Write(s.client.fail(http.StatusBadGateway, err.Error()))
+	}
+	return out.Bytes()
+}
+
+func (s *bedrockStream) Close() []byte {
+	if s.failed || s.passthrough() {
+		return nil
+	}
+	return s.client.close()
+}
+
+func (s *bedrockStream) handleMessage(msg eventStreamMessage) []byte {
+	if s.failed {
+		return nil
+	}
+
+	switch msg.Headers[":message-type"] {
+	case "exception", "error":
+		s.failed = true
+		var errPayload struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(msg.Payload, &errPayload)
+
+		exceptionType := msg.Headers[":exception-type"]
+		if exceptionType == "" {
+			exceptionType = msg.Headers[":error-code"]
+		}
+		status := http.StatusBadGateway
+		if strings.EqualFold(exceptionType, "throttlingException") ||
+			strings.EqualFold(exceptionType, "serviceQuotaExceededException") {
+			status = http.StatusTooManyRequests
+			s.provider.recordThrottle()
+		}
+		return s.client.fail(status, fmt.Sprintf("%s: %s", exceptionType, errPayload.Message))
+
+	case "event":
+		if msg.Headers[":event-type"] != "chunk" {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	var chunk struct {
+		Bytes string `json:"bytes"`
+	}
+	if err := json.Unmarshal(msg.Payload, &chunk); err != nil {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk.Bytes)
+	if err != nil {
+		return nil
+	}
+
+	s.provider.recordSuccess()
+	if s.call.family == bedrockFamilyMeta {
+		return s.llamaChunk(data)
+	}
+	return s.anthropicChunk(data)
+}
+
+func (s *bedrockStream) llamaChunk(data []byte) []byte {
+	var chunk llamaResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil
+	}
+	s.client.setUsage(chunk.PromptTokenCount, 0)
+	if chunk.InvocationMetrics != nil {
+		s.client.setUsage(chunk.InvocationMetrics.InputTokenCount, chunk.InvocationMetrics.OutputTokenCount)
+	}
+	s.client.setFinish(llamaFinish(chunk.StopReason))
+	return s.client.text(chunk.Generation)
+}
+
+func (s *bedrockStream) anthropicChunk(data []byte) []byte {
+	var event struct {
+		Type    string `json:"type"`
+		Message *struct {
+			Usage anthropicUsage `json:"usage"`
+		} `json:"message"`
+		ContentBlock *anthropicBlock `json:"content_block"`
+		Delta        *struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			PartialJSON string `json:"partial_json"`
+			StopReason  string `json:"stop_reason"`
+		} `json:"delta"`
+		Usage *anthropicUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil
+	}
+
+	if s.passthrough() {
+		return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data))
+	}
+
+	switch event.Type {
+	case "message_start":
+		if event.Message != nil {
+			s.client.setUsage(event.Message.Usage.InputTokens, event.Message.Usage.OutputTokens)
+		}
+	case "content_block_start":
+		if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" {
+			s.pendingTool = &toolCall{id: event.ContentBlock.ID, name: event.ContentBlock.Name}
+			s.pendingArgs.Reset()
+		}
+	case "content_block_delta":
+		if event.Delta == nil {
+			return nil
+		}
+		switch event.Delta.Type {
+		case "text_delta":
+			return s.client.text(event.Delta.Text)
+		case "input_json_delta":
+			s.pendingArgs.WriteString(event.Delta.PartialJSON)
+		}
+	case "content_block_stop":
+		if s.pendingTool != nil {
+			call := *s.pendingTool
+			s.pendingTool = nil
+			json.Unmarshal([]byte(s.pendingArgs.String()), &call.args)
+			return s.client.toolCall(call)
+		}
+	case "message_delta":
+		if event.Delta != nil {
+			s.client.setFinish(anthropicFinish(event.Delta.StopReason))
+		}
+		if event.Usage != nil {
+			s.client.setUsage(0, event.Usage.OutputTokens)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBedrockModel = "anthropic.claude-3-haiku-20240307-v1:0"
+
+// encodeEventStreamMessage frames payload with string headers the way
+// InvokeModelWithResponseStream does
+func encodeEventStreamMessage(headers map[string]string, payload []byte) []byte {
+	var headerBytes bytes.Buffer
+	for name, value := range headers {
+		headerBytes.WriteByte(byte(len(name)))
+		headerBytes.WriteString(name)
+		headerBytes.WriteByte(7)
+		binary.Write(&headerBytes, binary.BigEndian, uint16(len(value)))
+		headerBytes.WriteString(value)
+	}
+
+	totalLen := uint32(eventStreamMinLen + headerBytes.Len() + len(payload))
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, totalLen)
+	binary.Write(&frame, binary.BigEndian, uint32(headerBytes.Len()))
+	binary.Write(&frame, binary.BigEndian, crc32.ChecksumIEEE(frame.Bytes()))
+	frame.Write(headerBytes.Bytes())
+	frame.Write(payload)
+	binary.Write(&frame, binary.BigEndian, crc32.ChecksumIEEE(frame.Bytes()))
+	return frame.Bytes()
+}
+
+func bedrockChunk(event string) []byte {
+	payload, _ := json.Marshal(map[string]string{"bytes": base64.StdEncoding.EncodeToString([]byte(event))})
+	return encodeEventStreamMessage(map[string]string{
+		":message-type": "event",
+		":event-type":   "chunk",
+		":content-type": "application/json",
+	}, payload)
+}
+
+// verifyBedrockSignature re-signs the received request and compares the
+// result, as the real service would
+func verifyBedrockSignature(t *testing.T, r *http.Request, body []byte) {
+	signedAt, err := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	require.NoError(t, err)
+
+	check, err := http.NewRequest(r.Method, "http://"+r.Host+r.RequestURI, bytes.NewReader(body))
+	require.NoError(t, err)
+	check.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+
+	SignV4(check, body, testAWSCredentials, "us-west-2", "bedrock", signedAt)
+	assert.Equal(t, check.Header.Get("Authorization"), r.Header.Get("Authorization"))
+}
+
+// bedrockModels are routed to the test upstream
+var bedrockModels = []string{testBedrockModel, "meta.llama3-8b-instruct-v1:0"}
+
+func testBedrockProvider(endpoint string) modelrouting.Adapter {
+	return NewBedrockProvider(&config.ProviderConfig{
+		Name:     "bedrock",
+		Endpoint: endpoint,
+		AWS: &config.AWSConfig{
+			Region:          "us-west-2",
+			AccessKeyID:     testAWSCredentials.AccessKeyID,
+			SecretAccessKey: testAWSCredentials.SecretAccessKey,
+		},
+	})
+}
+
+func TestAnthropicFromOpenAI(t *testing.T) {
+	var req openAIChatRequest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "anthropic.claude",
+		"messages": [
+			{"role": "system", "content": "Be brief"},
+			{"role": "user", "content": "List files"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "ls", "arguments": "{\"path\": \".\"}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "a.go"}
+		],
+		"tools": [{"type": "function", "function": {"name": "ls", "parameters": {"type": "object"}}}]
+	}`), &req))
+
+	native := anthropicFromOpenAI(&req)
+
+	assert.Equal(t, "Be brief", native["system"])
+	assert.Equal(t, bedrockDefaultMaxTokens, native["max_tokens"])
+
+	messages := native["messages"].([]map[string]interface{})
+	require.Len(t, messages, 3)
+	assert.Equal(t, "assistant", messages[1]["role"])
+	toolUse := messages[1]["content"].([]map[string]interface{})[0]
+	assert.Equal(t, "tool_use", toolUse["type"])
+	assert.Equal(t, map[string]interface{}{"path": "."}, toolUse["input"])
+	toolResult := messages[2]["content"].([]map[string]interface{})[0]
+	assert.Equal(t, "tool_result", toolResult["type"])
+	assert.Equal(t, "call_1", toolResult["tool_use_id"])
+
+	tools := native["tools"].([]map[string]interface{})
+	require.Len(t, tools, 1)
+	assert.Equal(t, "ls", tools[0]["name"])
+}
+
+func TestBedrockAdapterInvokesLlama(t *testing.T) {
+	var upstreamPath string
+	var upstreamBody llamaRequest
+	_, _, handler := newRoutingStack(t, "", bedrockModels, testBedrockProvider,
+		func(w http.ResponseWriter, r *http.Request) {
+			upstreamPath = r.URL.EscapedPath()
+			body, _ := io.ReadAll(r.Body)
+			verifyBedrockSignature(t, r, body)
+			json.Unmarshal(body, &upstreamBody)
+
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"generation": "Hello!", "prompt_token_count": 12, "generation_token_count": 3, "stop_reason": "stop"}`)
+		})
+
+	req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(
+		`{"model": "meta.llama3-8b-instruct-v1:0", "max_tokens": 50, "messages": [{"role": "system", "content": "Be kind"}, {"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer client-key")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "/model/meta.llama3-8b-instruct-v1%3A0/invoke", upstreamPath)
+	assert.Equal(t, 50, upstreamBody.MaxGenLen)
+	assert.Equal(t, "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nBe kind<|eot_id|>"+
+		"<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>"+
+		"<|start_header_id|>assistant<|end_header_id|>\n\n", upstreamBody.Prompt)
+
+	var resp openAIChatResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "Hello!", *resp.Choices[0].Message.Content)
+	assert.Equal(t, "stop", *resp.Choices[0].FinishReason)
+	assert.Equal(t, 15, resp.Usage.TotalTokens)
+}
+
+func TestBedrockAdapterStreamsClaudeAsOpenAIChunks(t *testing.T) {
+	_, _, handler := newRoutingStack(t, "", bedrockModels, testBedrockProvider,
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/model/anthropic.claude-3-haiku-20240307-v1%3A0/invoke-with-response-stream", r.URL.EscapedPath())
+			assert.Equal(t, "application/vnd.amazon.eventstream", r.Header.Get("Accept"))
+			body, _ := io.ReadAll(r.Body)
+			verifyBedrockSignature(t, r, body)
+
+			var native map[string]interface{}
+			require.NoError(t, json.Unmarshal(body, &native))
+			assert.Equal(t, bedrockAnthropicVersion, native["anthropic_version"])
+			assert.NotContains(t, native, "model")
+			assert.NotContains(t, native, "stream")
+
+			w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+			var frames bytes.Buffer
+			frames.Write(bedrockChunk(`{"type":"message_start","message":{"usage":{"input_tokens":9,"output_tokens":1}}}`))
+			frames.Write(bedrockChunk(`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`))
+			frames.Write(bedrockChunk(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi there"}}`))
+			frames.Write(bedrockChunk(`{"type":"content_block_stop","index":0}`))
+			frames.Write(bedrockChunk(`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"ls"}}`))
+			frames.Write(bedrockChunk(`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"path\":"}}`))
+			frames.Write(bedrockChunk(`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\".\"}"}}`))
+			frames.Write(bedrockChunk(`{"type":"content_block_stop","index":1}`))
+			frames.Write(bedrockChunk(`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":6}}`))
+			frames.Write(bedrockChunk(`{"type":"message_stop"}`))
+
+			// Split frames across writes to exercise the decoder's buffering
+			data := frames.Bytes()
+			w.Write(data[:7])
+			w.(http.Flusher).Flush()
+			w.Write(data[7:])
+		})
+
+	req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(
+		`{"model": "`+testBedrockModel+`", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	assert.Contains(t, body, `"content":"Hi there"`)
+	assert.Contains(t, body, `"arguments":"{\"path\":\".\"}"`)
+	assert.Contains(t, body, `"finish_reason":"tool_calls"`)
+	assert.Contains(t, body, `"total_tokens":15`)
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+}
+
+func TestBedrockAdapterPassesClaudeEventsThrough(t *testing.T) {
+	_, _, handler := newRoutingStack(t, "", bedrockModels, testBedrockProvider,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+			w.Write(bedrockChunk(`{"type":"message_start","message":{"usage":{"input_tokens":3}}}`))
+			w.Write(bedrockChunk(`{"type":"message_stop"}`))
+		})
+
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(
+		`{"model": "`+testBedrockModel+`", "stream": true, "max_tokens": 10, "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t,
+		"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":3}}}\n\n"+
+			"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+		w.Body.String())
+}
+
+func TestBedrockAdapterThrottlingPausesLimiter(t *testing.T) {
+	adapter, limiter, handler := newRoutingStack(t, "", bedrockModels, testBedrockProvider,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Amzn-Errortype", "ThrottlingException:http://internal.amazon.com/coral/com.amazon.bedrock/")
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"message": "Too many requests, please wait before trying again."}`)
+		})
+	bedrock := adapter.(*BedrockProvider)
+
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(
+		`{"model": "`+testBedrockModel+`", "max_tokens": 10, "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "rate_limit_error")
+	assert.True(t, limiter.GetDelay(bedrock.endpoint.Host) > 500*time.Millisecond)
+
+	// Repeated throttling backs off further
+	assert.Equal(t, 2*time.Second, bedrock.recordThrottle())
+}
+
+func TestBedrockAdapterRejectsUnknownModels(t *testing.T) {
+	bedrock := NewBedrockProvider(&config.ProviderConfig{Name: "bedrock", AWS: &config.AWSConfig{
+		AccessKeyID: "AKID", SecretAccessKey: "secret",
+	}})
+	target, _ := url.Parse("https://bedrock-runtime.us-east-1.amazonaws.com")
+
+	req := httptest.NewRequest("POST", "/chat/completions", nil)
+	_, err := bedrock.RewriteRequest(req, target, []byte(`{"model": "cohere.command-r", "messages": []}`))
+	assert.Error(t, err)
+}
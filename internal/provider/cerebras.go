@@ -2,19 +2,24 @@ package provider
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptrace"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 )
 
 type CerebrasProvider struct {
 	config     *config.ProviderConfig
 	currentKey int
 	keyStats   map[string]*KeyStats
+	daily      *ratelimit.DailyQuota // per key, from the reported quota
 	mu         sync.Mutex
 	httpClient *http.Client
 }
@@ -28,6 +33,7 @@ type KeyStats struct {
 	LimitTokensMinute int
 	RemainingRequests int
 	RemainingTokens   int
+	LastUpdate        time.Time // when the quota headers were last seen
 }
 
 type CerebrasRequest struct {
@@ -54,6 +60,7 @@ func NewCerebrasProvider(config *config.ProviderConfig) *CerebrasProvider {
 		config:     config,
 		currentKey: 0,
 		keyStats:   make(map[string]*KeyStats),
+		daily:      ratelimit.NewDailyQuota(config.RateLimiting != nil && config.RateLimiting.SpreadDaily),
 		httpClient: &http.Client{Timeout: 60 * time.Second},
 	}
 
@@ -74,52 +81,105 @@ func (p *CerebrasProvider) Name() string {
 	return "cerebras"
 }
 
+// GetAPIKey returns the next key in turn, skipping keys whose daily quota
+// is spent. If every key's is, it returns the one it would have used.
 func (p *CerebrasProvider) GetAPIKey() string {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	keys := p.config.LoadBalancing.APIKeys
 	if p.config.LoadBalancing.Strategy == "round_robin" {
-		key := p.config.LoadBalancing.APIKeys[p.currentKey].Key
-		p.currentKey = (p.currentKey + 1) % len(p.config.LoadBalancing.APIKeys)
-		return key
+		first := keys[p.currentKey].Key
+		for range keys {
+			key := keys[p.currentKey].Key
+			p.currentKey = (p.currentKey + 1) % len(keys)
+			if p.daily.Check(key) == nil {
+				return key
+			}
+		}
+		return first
 	}
 
-	// Default to first key
-	return p.config.LoadBalancing.APIKeys[0].Key
+	// Default to the first key with quota left
+	for _, key := range keys {
+		if p.daily.Check(key.Key) == nil {
+			return key.Key
+		}
+	}
+	return keys[0].Key
 }
 
+// CheckRateLimit fails early once every key's daily request quota is spent,
+// with a DailyQuotaError, or when the token budget a key last reported for
+// the current minute is nearly used up
 func (p *CerebrasProvider) CheckRateLimit() error {
-	key := p.GetAPIKey()
-	stats := p.keyStats[key]
+	keys := make([]string, len(p.config.LoadBalancing.APIKeys))
+	for i, key := range p.config.LoadBalancing.APIKeys {
+		keys[i] = key.Key
+	}
+	if err := p.daily.Check(keys...); err != nil {
+		return err
+	}
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Check if we need to reset counters
-	if time.Since(stats.LastReset) > 24*time.Hour {
-		stats.RequestsUsed = 0
-		stats.LastReset = time.Now()
-	}
+	for _, key := range keys {
+		stats := p.keyStats[key]
 
-	// Check daily limit
-	if stats.RemainingRequests < 100 {
-		return fmt.Errorf("approaching daily request limit: %d remaining", stats.RemainingRequests)
-	}
+		// Check if we need to reset counters
+		if time.Since(stats.LastReset) > 24*time.Hour {
+			stats.RequestsUsed = 0
+			stats.LastReset = time.Now()
+		}
 
-	// Check minute limit for tokens
-	// This is simplified - in production, you'd want per-minute tracking
-	if stats.RemainingTokens < 1000 {
-		return fmt.Errorf("approaching minute token limit: %d remaining", stats.RemainingTokens)
+		// Token budgets are per minute, so older reports say nothing
+		if time.Since(stats.LastUpdate) > time.Minute || stats.RemainingTokens >= 1000 {
+			return nil
+		}
 	}
+	return fmt.Errorf("approaching minute token limit on every key")
+}
 
-	return nil
+// DailyQuota returns the daily request quota of each key, by key hash
+func (p *CerebrasProvider) DailyQuota() map[string]ratelimit.DailyQuotaStatus {
+	status := make(map[string]ratelimit.DailyQuotaStatus)
+	for key, quota := range p.daily.Status() {
+		status[keyID(key)] = quota
+	}
+	return status
 }
 
-func (p *CerebrasProvider) MakeRequest(model string, messages []interface{}, options map[string]interface{}) (*Response, error) {
+func (p *CerebrasProvider) MakeRequest(ctx context.Context, model string, messages []interface{}, options map[string]interface{}) (*Response, error) {
 	if err := p.CheckRateLimit(); err != nil {
 		return nil, err
 	}
 
+	// Take the request from the key's daily quota, waiting for its turn
+	// when the rest of the day's requests are spread out. A request that
+	// is never written upstream, because its caller gave up meanwhile or
+	// it failed first, hands its slot back.
+	apiKey := p.GetAPIKey()
+	delay, err := p.daily.Reserve(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	var sent atomic.Bool
+	defer func() {
+		if !sent.Load() {
+			p.daily.Release(apiKey)
+		}
+	}()
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
 	// Convert messages to Cerebras format
 	cerebrasMessages := make([]CerebrasMessage, len(messages))
 	for i, msg := range messages {
@@ -147,12 +207,18 @@ func (p *CerebrasProvider) MakeRequest(model string, messages []interface{}, opt
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", p.config.Endpoint+"/chat/completions", bytes.NewBuffer(reqBody))
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				sent.Store(true)
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "POST", p.config.Endpoint+"/chat/completions", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, err
 	}
 
-	apiKey := p.GetAPIKey()
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
@@ -226,8 +292,14 @@ func (p *CerebrasProvider) updateRateLimitStats(apiKey string, headers http.Head
 	}
 	if minuteRemaining := headers.Get("x-ratelimit-remaining-tokens-minute"); minuteRemaining != "" {
 		fmt.Sscanf(minuteRemaining, "%d", &stats.RemainingTokens)
+		stats.LastUpdate = time.Now()
 	}
 
 	// Increment usage counters
 	stats.RequestsUsed++
+
+	quota, err := ratelimit.ParseQuota(config.HeaderSchemas["cerebras"], headers, time.Now())
+	if err == nil && quota.RemainingRequests >= 0 {
+		p.daily.Update(apiKey, quota.LimitRequests, quota.RemainingRequests, quota.ResetRequests)
+	}
 }
@@ -0,0 +1,108 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCerebrasEnforcesDailyQuota(t *testing.T) {
+	var calls int32
+	remaining := []string{"1", "0"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("x-ratelimit-limit-requests-day", "14400")
+		w.Header().Set("x-ratelimit-remaining-requests-day", remaining[n-1])
+		w.Header().Set("x-ratelimit-reset-requests-day", "3600")
+		w.Write([]byte(`{"choices":[{"message":{"content":"hi"}}],"model":"glm-4.6"}`))
+	}))
+	defer server.Close()
+
+	p := NewCerebrasProvider(&config.ProviderConfig{
+		Name:     "cerebras",
+		Endpoint: server.URL,
+		LoadBalancing: &config.LoadBalancingConfig{
+			APIKeys: []config.APIKeyConfig{{Key: "test-key-1", Weight: 1}},
+		},
+	})
+	messages := []interface{}{map[string]interface{}{"role": "user", "content": "hello"}}
+
+	for i := 0; i < 2; i++ {
+		_, err := p.MakeRequest(context.Background(), "glm-4.6", messages, nil)
+		assert.NoError(t, err)
+	}
+
+	// The day is spent: rejected without another upstream call
+	_, err := p.MakeRequest(context.Background(), "glm-4.6", messages, nil)
+	var spent *ratelimit.DailyQuotaError
+	assert.True(t, errors.As(err, &spent))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	status := p.DailyQuota()[keyID("test-key-1")]
+	assert.Equal(t, 14400, status.Limit)
+	assert.Equal(t, 0, status.Remaining)
+}
+
+func TestCerebrasCancelledWhileSpreadingReleasesQuota(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"choices":[{"message":{"content":"hi"}}],"model":"glm-4.6"}`))
+	}))
+	defer server.Close()
+
+	p := NewCerebrasProvider(&config.ProviderConfig{
+		Name:         "cerebras",
+		Endpoint:     server.URL,
+		RateLimiting: &config.ProviderRateLimitConfig{SpreadDaily: true},
+		LoadBalancing: &config.LoadBalancingConfig{
+			APIKeys: []config.APIKeyConfig{{Key: "test-key-1", Weight: 1}},
+		},
+	})
+	// Two requests left for the next hour: the second waits half an hour
+	p.daily.Update("test-key-1", 14400, 2, time.Hour)
+	_, err := p.daily.Reserve("test-key-1")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	messages := []interface{}{map[string]interface{}{"role": "user", "content": "hello"}}
+	_, err = p.MakeRequest(ctx, "glm-4.6", messages, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+	assert.Equal(t, 1, p.DailyQuota()[keyID("test-key-1")].Remaining)
+}
+
+func TestCerebrasFailedBeforeSendingReleasesQuota(t *testing.T) {
+	// Nothing listens at the endpoint, so every request fails to connect
+	server := httptest.NewServer(http.NotFoundHandler())
+	endpoint := server.URL
+	server.Close()
+
+	p := NewCerebrasProvider(&config.ProviderConfig{
+		Name:     "cerebras",
+		Endpoint: endpoint,
+		LoadBalancing: &config.LoadBalancingConfig{
+			APIKeys: []config.APIKeyConfig{{Key: "test-key-1", Weight: 1}},
+		},
+	})
+	p.daily.Update("test-key-1", 14400, 2, time.Hour)
+
+	messages := []interface{}{map[string]interface{}{"role": "user", "content": "hello"}}
+	for i := 0; i < 3; i++ {
+		_, err := p.MakeRequest(context.Background(), "glm-4.6", messages, nil)
+		assert.Error(t, err)
+		var spent *ratelimit.DailyQuotaError
+		assert.False(t, errors.As(err, &spent), "a request that was never sent must not use the quota")
+	}
+	assert.Equal(t, 2, p.DailyQuota()[keyID("test-key-1")].Remaining)
+}
@@ -0,0 +1,381 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Finish reasons shared by all adapters, mapped to each client format when
+// rendered
+const (
+	finishStop          = "stop"
+	finishLength        = "length"
+	finishToolUse       = "tool_use"
+	finishContentFilter = "content_filter"
+)
+
+// completion is a provider-neutral assistant reply
+type completion struct {
+	text      string
+	toolCalls []toolCall
+	finish    string
+	usage     tokenUsage
+}
+
+type toolCall struct {
+	id   string
+	name string
+	args map[string]interface{}
+}
+
+type tokenUsage struct {
+	input  int
+	output int
+}
+
+// render encodes the completion as a client-format response body
+func (c *completion) render(format ClientFormat, model string) []byte {
+	var out interface{}
+	if format == FormatAnthropic {
+		out = c.anthropic(model)
+	} else {
+		out = c.openAI(model)
+	}
+	body, _ := json.Marshal(out)
+	return body
+}
+
+func (c *completion) openAI(model string) *openAIChatResponse {
+	reply := &openAIReply{Role: "assistant"}
+	for _, call := range c.toolCalls {
+		reply.ToolCalls = append(reply.ToolCalls, call.openAI(nil))
+	}
+	if c.text != "" || len(reply.ToolCalls) == 0 {
+		reply.Content = stringPtr(c.text)
+	}
+
+	return &openAIChatResponse{
+		ID:      newID("chatcmpl-"),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openAIChatChoice{{
+			Index:        0,
+			Message:      reply,
+			FinishReason: stringPtr(openAIFinishReason(c.finish)),
+		}},
+		Usage: c.usage.openAI(),
+	}
+}
+
+func (c *completion) anthropic(model string) *anthropicResponse {
+	out := &anthropicResponse{
+		ID:         newID("msg_"),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    []map[string]interface{}{},
+		StopReason: anthropicStopReason(c.finish),
+		Usage:      anthropicUsage{InputTokens: c.usage.input, OutputTokens: c.usage.output},
+	}
+	if c.text != "" {
+		out.Content = append(out.Content, map[string]interface{}{"type": "text", "text": c.text})
+	}
+	for _, call := range c.toolCalls {
+		out.Content = append(out.Content, call.anthropic())
+	}
+	return out
+}
+
+func (t toolCall) arguments() string {
+	if t.args == nil {
+		return "{}"
+	}
+	args, err := json.Marshal(t.args)
+	if err != nil {
+		return "{}"
+	}
+	return string(args)
+}
+
+func (t toolCall) openAI(index *int) openAIToolCall {
+	var call openAIToolCall
+	call.Index = index
+	call.ID = t.id
+	if call.ID == "" {
+		call.ID = newID("call_")
+	}
+	call.Type = "function"
+	call.Function.Name = t.name
+	call.Function.Arguments = t.arguments()
+	return call
+}
+
+func (t toolCall) anthropic() map[string]interface{} {
+	input := t.args
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+	id := t.id
+	if id == "" {
+		id = newID("toolu_")
+	}
+	return map[string]interface{}{
+		"type":  "tool_use",
+		"id":    id,
+		"name":  t.name,
+		"input": input,
+	}
+}
+
+func (u tokenUsage) openAI() *openAIUsage {
+	if u.input == 0 && u.output == 0 {
+		return nil
+	}
+	return &openAIUsage{
+		PromptTokens:     u.input,
+		CompletionTokens: u.output,
+		TotalTokens:      u.input + u.output,
+	}
+}
+
+func openAIFinishReason(finish string) string {
+	switch finish {
+	case finishLength:
+		return "length"
+	case finishToolUse:
+		return "tool_calls"
+	case finishContentFilter:
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+func anthropicStopReason(finish string) string {
+	switch finish {
+	case finishLength:
+		return "max_tokens"
+	case finishToolUse:
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// clientStream renders provider-neutral stream events as OpenAI chunks or
+// Anthropic message events
+type clientStream struct {
+	format ClientFormat
+	model  string
+	id     string
+
+	started   bool
+	toolCalls int
+	finish    string
+	usage     tokenUsage
+
+	// Anthropic content block state
+	blockIndex int
+	blockOpen  bool
+	blockType  string
+}
+
+func newClientStream(format ClientFormat, model string) *clientStream {
+	prefix := "chatcmpl-"
+	if format == FormatAnthropic {
+		prefix = "msg_"
+	}
+	return &clientStream{format: format, model: model, id: newID(prefix)}
+}
+
+// setUsage records token counts; zero values leave the previous count
+func (s *clientStream) setUsage(input, output int) {
+	if input > 0 {
+		s.usage.input = input
+	}
+	if output > 0 {
+		s.usage.output = output
+	}
+}
+
+func (s *clientStream) setFinish(finish string) {
+	if finish != "" {
+		s.finish = finish
+	}
+}
+
+// text emits a text delta
+func (s *clientStream) text(text string) []byte {
+	if text == "" {
+		return nil
+	}
+
+	var out bytes.Buffer
+	out.Write(s.start())
+	if s.format != FormatAnthropic {
+		out.Write(s.openAIEvent(&openAIReply{Content: stringPtr(text)}, nil, nil))
+		return out.Bytes()
+	}
+
+	if s.blockOpen && s.blockType != "text" {
+		out.Write(s.closeBlock())
+	}
+	if !s.blockOpen {
+		s.blockOpen = true
+		s.blockType = "text"
+		out.Write(sseEvent("content_block_start", map[string]interface{}{
+			"type":          "content_block_start",
+			"index":         s.blockIndex,
+			"content_block": map[string]interface{}{"type": "text", "text": ""},
+		}))
+	}
+	out.Write(sseEvent("content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": s.blockIndex,
+		"delta": map[string]interface{}{"type": "text_delta", "text": text},
+	}))
+	return out.Bytes()
+}
+
+// toolCall emits a complete tool call
+func (s *clientStream) toolCall(call toolCall) []byte {
+	var out bytes.Buffer
+	out.Write(s.start())
+
+	index := s.toolCalls
+	s.toolCalls++
+
+	if s.format != FormatAnthropic {
+		out.Write(s.openAIEvent(&openAIReply{
+			ToolCalls: []openAIToolCall{call.openAI(&index)},
+		}, nil, nil))
+		return out.Bytes()
+	}
+
+	out.Write(s.closeBlock())
+	toolUse := call.anthropic()
+	toolUse["input"] = map[string]interface{}{}
+
+	s.blockOpen = true
+	s.blockType = "tool_use"
+	out.Write(sseEvent("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         s.blockIndex,
+		"content_block": toolUse,
+	}))
+	out.Write(sseEvent("content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": s.blockIndex,
+		"delta": map[string]interface{}{"type": "input_json_delta", "partial_json": call.arguments()},
+	}))
+	out.Write(s.closeBlock())
+	return out.Bytes()
+}
+
+// fail emits an in-stream error event
+func (s *clientStream) fail(status int, message string) []byte {
+	var out bytes.Buffer
+	out.Write(s.start())
+	if s.format == FormatAnthropic {
+		errType := "api_error"
+		if status == 429 {
+			errType = "rate_limit_error"
+		}
+		out.Write(sseEvent("error", map[string]interface{}{
+			"type":  "error",
+			"error": map[string]interface{}{"type": errType, "message": message},
+		}))
+		return out.Bytes()
+	}
+
+	out.WriteString("data: ")
+	out.Write(clientError(FormatOpenAI, status, message))
+	out.WriteString("\n\n")
+	return out.Bytes()
+}
+
+// close ends the stream with the finish reason and usage
+func (s *clientStream) close() []byte {
+	var out bytes.Buffer
+	out.Write(s.start())
+
+	if s.finish == "" && s.toolCalls > 0 {
+		s.finish = finishToolUse
+	}
+
+	if s.format != FormatAnthropic {
+		finish := openAIFinishReason(s.finish)
+		if s.toolCalls > 0 {
+			finish = "tool_calls"
+		}
+		out.Write(s.openAIEvent(&openAIReply{}, &finish, s.usage.openAI()))
+		out.WriteString("data: [DONE]\n\n")
+		return out.Bytes()
+	}
+
+	out.Write(s.closeBlock())
+	stopReason := anthropicStopReason(s.finish)
+	if s.toolCalls > 0 {
+		stopReason = "tool_use"
+	}
+	out.Write(sseEvent("message_delta", map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+		},
+		"usage": map[string]interface{}{"output_tokens": s.usage.output},
+	}))
+	out.Write(sseEvent("message_stop", map[string]interface{}{"type": "message_stop"}))
+	return out.Bytes()
+}
+
+func (s *clientStream) start() []byte {
+	if s.started {
+		return nil
+	}
+	s.started = true
+
+	if s.format != FormatAnthropic {
+		return s.openAIEvent(&openAIReply{Role: "assistant", Content: stringPtr("")}, nil, nil)
+	}
+	return sseEvent("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":            s.id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         s.model,
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         anthropicUsage{InputTokens: s.usage.input},
+		},
+	})
+}
+
+func (s *clientStream) closeBlock() []byte {
+	if !s.blockOpen {
+		return nil
+	}
+	s.blockOpen = false
+	event := sseEvent("content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": s.blockIndex,
+	})
+	s.blockIndex++
+	return event
+}
+
+func (s *clientStream) openAIEvent(delta *openAIReply, finish *string, usage *openAIUsage) []byte {
+	return sseEvent("", &openAIChatResponse{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   s.model,
+		Choices: []openAIChatChoice{{Index: 0, Delta: delta, FinishReason: finish}},
+		Usage:   usage,
+	})
+}
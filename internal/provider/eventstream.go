@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// AWS event-stream framing, as used by InvokeModelWithResponseStream:
+//
+//	total length (4) | headers length (4) | prelude CRC (4) |
+//	headers | payload | message CRC (4)
+
+const (
+	eventStreamPreludeLen = 12
+	eventStreamMinLen     = eventStreamPreludeLen + 4
+	// eventStreamMaxLen guards against corrupt length prefixes
+	eventStreamMaxLen = 16 << 20
+)
+
+// eventStreamMessage is one decoded event-stream frame. Only string header
+// values are kept; other header types are skipped.
+type eventStreamMessage struct {
+	Headers map[string]string
+	Payload []byte
+}
+
+// eventStreamDecoder decodes frames from a byte stream that may be split at
+// arbitrary points
+type eventStreamDecoder struct {
+	buf []byte
+}
+
+// feed appends p and returns every complete frame now available
+func (d *eventStreamDecoder) feed(p []byte) ([]eventStreamMessage, error) {
+	d.buf = append(d.buf, p...)
+
+	var messages []eventStreamMessage
+	for len(d.buf) >= eventStreamPreludeLen {
+		totalLen := binary.BigEndian.Uint32(d.buf[0:4])
+		headersLen := binary.BigEndian.Uint32(d.buf[4:8])
+		preludeCRC := binary.BigEndian.Uint32(d.buf[8:12])
+
+		if crc32.ChecksumIEEE(d.buf[0:8]) != preludeCRC {
+			return messages, fmt.Errorf("event stream prelude checksum mismatch")
+		}
+		if totalLen < eventStreamMinLen || totalLen > eventStreamMaxLen || headersLen > totalLen-eventStreamMinLen {
+			return messages, fmt.Errorf("invalid event stream frame length %d", totalLen)
+		}
+		if uint32(len(d.buf)) < totalLen {
+			break
+		}
+
+		frame := d.buf[:totalLen]
+		messageCRC := binary.BigEndian.Uint32(frame[totalLen-4:])
+		if crc32.ChecksumIEEE(frame[:totalLen-4]) != messageCRC {
+			return messages, fmt.Errorf("event stream message checksum mismatch")
+		}
+
+		headers, err := decodeEventStreamHeaders(frame[eventStreamPreludeLen : eventStreamPreludeLen+headersLen])
+		if err != nil {
+			return messages, err
+		}
+		payload := append([]byte(nil), frame[eventStreamPreludeLen+headersLen:totalLen-4]...)
+		messages = append(messages, eventStreamMessage{Headers: headers, Payload: payload})
+
+		d.buf = d.buf[totalLen:]
+	}
+	return messages, nil
+}
+
+func decodeEventStreamHeaders(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for len(data) > 0 {
+		nameLen := int(data[0])
+		if len(data) < 1+nameLen+1 {
+			return nil, fmt.Errorf("truncated event stream header")
+		}
+		name := string(data[1 : 1+nameLen])
+		valueType := data[1+nameLen]
+		data = data[2+nameLen:]
+
+		var skip int
+		switch valueType {
+		case 0, 1: // bool true/false
+			skip = 0
+		case 2: // byte
+			skip = 1
+		case 3: // int16
+			skip = 2
+		case 4: // int32
+			skip = 4
+		case 5, 8: // int64, timestamp
+			skip = 8
+		case 9: // uuid
+			skip = 16
+		case 6, 7: // bytes, string
+			if len(data) < 2 {
+				return nil, fmt.Errorf("truncated event stream header value")
+			}
+			valueLen := int(binary.BigEndian.Uint16(data[0:2]))
+			if len(data) < 2+valueLen {
+				return nil, fmt.Errorf("truncated event stream header value")
+			}
+			if valueType == 7 {
+				headers[name] = string(data[2 : 2+valueLen])
+			}
+			skip = 2 + valueLen
+		default:
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+
+		if len(data) < skip {
+			return nil, fmt.Errorf("truncated event stream header value")
+		}
+		data = data[skip:]
+	}
+	return headers, nil
+}
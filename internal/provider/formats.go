@@ -0,0 +1,307 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OpenAI chat completions wire types, as sent by clients
+
+type openAIChatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []openAIMessage `json:"messages"`
+	Tools               []openAITool    `json:"tools,omitempty"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	Stop                json.RawMessage `json:"stop,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description,omitempty"`
+		Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIChatResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []openAIChatChoice `json:"choices"`
+	Usage   *openAIUsage       `json:"usage,omitempty"`
+}
+
+type openAIChatChoice struct {
+	Index        int          `json:"index"`
+	Message      *openAIReply `json:"message,omitempty"`
+	Delta        *openAIReply `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type openAIReply struct {
+	Role      string           `json:"role,omitempty"`
+	Content   *string          `json:"content,omitempty"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// text returns the plain text of an OpenAI message content, which may be a
+// string or an array of content parts
+func (m openAIMessage) text() string {
+	var s string
+	if err := json.Unmarshal(m.Content, &s); err == nil {
+		return s
+	}
+
+	var parts []openAIContentPart
+	if err := json.Unmarshal(m.Content, &parts); err != nil {
+		return ""
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// parts returns the content parts of an OpenAI message, normalising a plain
+// string into a single text part
+func (m openAIMessage) parts() []openAIContentPart {
+	var s string
+	if err := json.Unmarshal(m.Content, &s); err == nil {
+		if s == "" {
+			return nil
+		}
+		return []openAIContentPart{{Type: "text", Text: s}}
+	}
+
+	var parts []openAIContentPart
+	json.Unmarshal(m.Content, &parts)
+	return parts
+}
+
+// stopSequences decodes the OpenAI stop field, which may be a string or an
+// array of strings
+func (r openAIChatRequest) stopSequences() []string {
+	if len(r.Stop) == 0 {
+		return nil
+	}
+	var one string
+	if err := json.Unmarshal(r.Stop, &one); err == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(r.Stop, &many)
+	return many
+}
+
+func (r openAIChatRequest) maxTokens() int {
+	if r.MaxCompletionTokens > 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// Anthropic messages wire types, as sent by clients
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        json.RawMessage    `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	Tools         []anthropicTool    `json:"tools,omitempty"`
+	MaxTokens     int                `json:"max_tokens,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string                 `json:"type"`
+	Text      string                 `json:"text,omitempty"`
+	ID        string                 `json:"id,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Input     map[string]interface{} `json:"input,omitempty"`
+	ToolUseID string                 `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage        `json:"content,omitempty"`
+	Source    *anthropicImageSource  `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID           string                   `json:"id"`
+	Type         string                   `json:"type"`
+	Role         string                   `json:"role"`
+	Model        string                   `json:"model"`
+	Content      []map[string]interface{} `json:"content"`
+	StopReason   string                   `json:"stop_reason"`
+	StopSequence *string                  `json:"stop_sequence"`
+	Usage        anthropicUsage           `json:"usage"`
+}
+
+// anthropicBlocks decodes Anthropic content, which may be a string or an
+// array of content blocks
+func anthropicBlocks(raw json.RawMessage) []anthropicBlock {
+	if len(raw) == 0 {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if s == "" {
+			return nil
+		}
+		return []anthropicBlock{{Type: "text", Text: s}}
+	}
+	var blocks []anthropicBlock
+	json.Unmarshal(raw, &blocks)
+	return blocks
+}
+
+// anthropicText joins the text blocks of Anthropic content
+func anthropicText(raw json.RawMessage) string {
+	var texts []string
+	for _, block := range anthropicBlocks(raw) {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// openAIError renders an error in the OpenAI error envelope
+func openAIError(message, errType string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+		},
+	})
+	return body
+}
+
+// anthropicError renders an error in the Anthropic error envelope
+func anthropicError(message, errType string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    errType,
+			"message": message,
+		},
+	})
+	return body
+}
+
+// clientError renders an upstream error in the client's format
+func clientError(format ClientFormat, status int, message string) []byte {
+	if format == FormatAnthropic {
+		errType := "api_error"
+		switch status {
+		case 429:
+			errType = "rate_limit_error"
+		case 400:
+			errType = "invalid_request_error"
+		case 401:
+			errType = "authentication_error"
+		case 403:
+			errType = "permission_error"
+		case 404:
+			errType = "not_found_error"
+		}
+		return anthropicError(message, errType)
+	}
+
+	errType := "api_error"
+	switch {
+	case status == 429:
+		errType = "rate_limit_exceeded"
+	case status >= 400 && status < 500:
+		errType = "invalid_request_error"
+	}
+	return openAIError(message, errType)
+}
+
+// sseEvent formats a server-sent event. An empty name emits a data-only
+// event as used by OpenAI streams.
+func sseEvent(name string, payload interface{}) []byte {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil
+	}
+	if name == "" {
+		return []byte(fmt.Sprintf("data: %s\n\n", data))
+	}
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, data))
+}
+
+var idCounter uint64
+
+// newID returns a unique identifier with the given prefix
+func newID(prefix string) string {
+	return fmt.Sprintf("%s%d%04d", prefix, time.Now().UnixNano(), atomic.AddUint64(&idCounter, 1)%10000)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
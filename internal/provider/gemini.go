@@ -0,0 +1,831 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
+)
+
+const (
+	geminiDefaultEndpoint = "https://generativelanguage.googleapis.com/v1beta"
+	// geminiDefaultRetryDelay is used when a quota error carries no RetryInfo
+	geminiDefaultRetryDelay = time.Minute
+)
+
+// GeminiProvider talks to Google's generateContent API. It serves the
+// Anthropic handler through MakeRequest and acts as a model routing adapter
+// that translates OpenAI and Anthropic requests on the fly.
+type GeminiProvider struct {
+	config     *config.ProviderConfig
+	endpoint   *url.URL
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	blocked map[string]geminiBlock // by model, as Gemini quotas are per model
+}
+
+// geminiBlock is a model's pending quota error retry delay
+type geminiBlock struct {
+	until time.Time
+	quota string
+}
+
+// Gemini wire types
+
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []geminiTool            `json:"tools,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *geminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFunctionCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type geminiGenerationConfig struct {
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason,omitempty"`
+	} `json:"candidates"`
+	UsageMetadata *geminiUsage `json:"usageMetadata,omitempty"`
+	ModelVersion  string       `json:"modelVersion,omitempty"`
+}
+
+type geminiUsage struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount,omitempty"`
+}
+
+type geminiErrorResponse struct {
+	Error struct {
+		Code    int                      `json:"code"`
+		Message string                   `json:"message"`
+		Status  string                   `json:"status"`
+		Details []map[string]interface{} `json:"details"`
+	} `json:"error"`
+}
+
+// GeminiQuotaError describes a RESOURCE_EXHAUSTED error returned by Gemini
+type GeminiQuotaError struct {
+	Message    string
+	QuotaID    string
+	RetryDelay time.Duration
+}
+
+func (e *GeminiQuotaError) Error() string {
+	if e.QuotaID != "" {
+		return fmt.Sprintf("gemini quota %s exhausted, retry in %v: %s", e.QuotaID, e.RetryDelay, e.Message)
+	}
+	return fmt.Sprintf("gemini quota exhausted, retry in %v: %s", e.RetryDelay, e.Message)
+}
+
+// geminiCall carries per-request translation state from RewriteRequest to
+// WrapResponseWriter
+type geminiCall struct {
+	format ClientFormat
+	model  string
+	stream bool
+}
+
+type geminiCallKey struct{}
+
+func NewGeminiProvider(config *config.ProviderConfig) *GeminiProvider {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = geminiDefaultEndpoint
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		endpointURL, _ = url.Parse(geminiDefaultEndpoint)
+	}
+
+	return &GeminiProvider{
+		config:     config,
+		endpoint:   endpointURL,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+		blocked:    make(map[string]geminiBlock),
+	}
+}
+
+func (p *GeminiProvider) Name() string {
+	return "gemini"
+}
+
+func (p *GeminiProvider) GetAPIKey() string {
+	return p.config.APIKey
+}
+
+// CheckRateLimit always succeeds; Gemini quotas are per model, see
+// CheckModelRateLimit
+func (p *GeminiProvider) CheckRateLimit() error {
+	return nil
+}
+
+// CheckModelRateLimit fails while a quota error's retry delay for model is
+// pending
+func (p *GeminiProvider) CheckModelRateLimit(model string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	block := p.blocked[model]
+	if wait := time.Until(block.until); wait > 0 {
+		return fmt.Errorf("gemini quota exhausted for %s (%s), retry in %v", model, block.quota, wait.Round(time.Second))
+	}
+	return nil
+}
+
+// BlockedUntil returns when the last quota error's retry delay for model
+// expires
+func (p *GeminiProvider) BlockedUntil(model string) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.blocked[model].until
+}
+
+func (p *GeminiProvider) recordQuotaError(model string, quota *GeminiQuotaError) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	block := p.blocked[model]
+	if until := time.Now().Add(quota.RetryDelay); until.After(block.until) {
+		block.until = until
+	}
+	block.quota = quota.QuotaID
+	if block.quota == "" {
+		block.quota = "RESOURCE_EXHAUSTED"
+	}
+	p.blocked[model] = block
+}
+
+// ParseGeminiQuotaError extracts quota details from a Gemini error body.
+// It returns nil when the body is not a RESOURCE_EXHAUSTED error.
+func ParseGeminiQuotaError(status int, body []byte) *GeminiQuotaError {
+	var errResp geminiErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		return nil
+	}
+	if errResp.Error.Status != "RESOURCE_EXHAUSTED" && status != http.StatusTooManyRequests {
+		return nil
+	}
+
+	quota := &GeminiQuotaError{
+		Message:    errResp.Error.Message,
+		RetryDelay: geminiDefaultRetryDelay,
+	}
+
+	for _, detail := range errResp.Error.Details {
+		switch detail["@type"] {
+		case "type.googleapis.com/google.rpc.RetryInfo":
+			if delay, ok := detail["retryDelay"].(string); ok {
+				if d, err := time.ParseDuration(delay); err == nil && d > 0 {
+					quota.RetryDelay = d
+				}
+			}
+		case "type.googleapis.com/google.rpc.QuotaFailure":
+			if violations, ok := detail["violations"].([]interface{}); ok && len(violations) > 0 {
+				if violation, ok := violations[0].(map[string]interface{}); ok {
+					quota.QuotaID, _ = violation["quotaId"].(string)
+				}
+			}
+		}
+	}
+
+	return quota
+}
+
+// Adapter implementation
+
+// Matches reports whether target points at the configured Gemini endpoint
+func (p *GeminiProvider) Matches(target *url.URL) bool {
+	return strings.EqualFold(target.Host, p.endpoint.Host)
+}
+
+// RewriteRequest translates an OpenAI or Anthropic request into a Gemini
+// generateContent or streamGenerateContent call
+func (p *GeminiProvider) RewriteRequest(r *http.Request, target *url.URL, body []byte) (*http.Request, error) {
+	call := &geminiCall{format: DetectClientFormat(r.URL.Path)}
+
+	var gemReq *geminiRequest
+	var err error
+	if call.format == FormatAnthropic {
+		gemReq, call.model, call.stream, err = geminiFromAnthropic(body)
+	} else {
+		gemReq, call.model, call.stream, err = geminiFromOpenAI(body)
+	}
+	if err != nil {
+		return nil, proxyerrors.NewInvalidRequestError(err.Error())
+	}
+	if call.model == "" {
+		return nil, proxyerrors.NewInvalidRequestError("model is required for Gemini requests")
+	}
+	if err := p.CheckModelRateLimit(call.model); err != nil {
+		return nil, proxyerrors.NewProxyError(proxyerrors.ErrorTypeRateLimitExceeded, err.Error(), nil)
+	}
+
+	payload, err := json.Marshal(gemReq)
+	if err != nil {
+		return nil, proxyerrors.NewInternalError("failed to encode Gemini request", err)
+	}
+
+	apiKey := p.GetAPIKey()
+	if apiKey == "" {
+		apiKey = clientAPIKey(r)
+	}
+
+	method := ":generateContent"
+	query := url.Values{}
+	if call.stream {
+		method = ":streamGenerateContent"
+		query.Set("alt", "sse")
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), geminiCallKey{}, call))
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	// The model is one path segment, whatever characters it holds
+	r.URL.Path = strings.TrimSuffix(target.Path, "/") + "/models/" + call.model + method
+	r.URL.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + "/models/" + url.PathEscape(call.model) + method
+	r.URL.RawQuery = query.Encode()
+	r.Host = target.Host
+
+	r.Header.Del("Authorization")
+	r.Header.Del("X-Api-Key")
+	r.Header.Del("Anthropic-Version")
+	r.Header.Del("Accept-Encoding")
+	if apiKey != "" {
+		r.Header.Set("X-Goog-Api-Key", apiKey)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	r.Body = io.NopCloser(bytes.NewReader(payload))
+	r.ContentLength = int64(len(payload))
+	r.Header.Set("Content-Length", fmt.Sprintf("%d", len(payload)))
+
+	return r, nil
+}
+
+// WrapResponseWriter translates Gemini responses back into the client format
+func (p *GeminiProvider) WrapResponseWriter(w http.ResponseWriter, r *http.Request) modelrouting.ResponseTranslator {
+	call, ok := r.Context().Value(geminiCallKey{}).(*geminiCall)
+	if !ok {
+		call = &geminiCall{format: DetectClientFormat(r.URL.Path)}
+	}
+
+	return &translatingWriter{
+		rw:     w,
+		header: make(http.Header),
+		newStream: func(status int, header http.Header) streamTranslator {
+			if !call.stream || status != http.StatusOK {
+				return nil
+			}
+			return newGeminiStream(call)
+		},
+		translate: func(status int, header http.Header, body []byte) []byte {
+			return p.translateResponse(call, status, header, body)
+		},
+	}
+}
+
+func (p *GeminiProvider) translateResponse(call *geminiCall, status int, header http.Header, body []byte) []byte {
+	header.Set("Content-Type", "application/json")
+
+	if status >= 300 {
+		if quota := ParseGeminiQuotaError(status, body); quota != nil {
+			p.recordQuotaError(call.model, quota)
+			header.Set("Retry-After", fmt.Sprintf("%d", int(quota.RetryDelay.Round(time.Second).Seconds())))
+			return clientError(call.format, http.StatusTooManyRequests, quota.Error())
+		}
+
+		var errResp geminiErrorResponse
+		if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error.Message != "" {
+			return clientError(call.format, status, errResp.Error.Message)
+		}
+		return body
+	}
+
+	var gemResp geminiResponse
+	if err := json.Unmarshal(body, &gemResp); err != nil {
+		return body
+	}
+
+	return geminiCompletion(&gemResp).render(call.format, call.model)
+}
+
+// MakeRequest sends a non-streaming generateContent call for the Anthropic
+// handler
+func (p *GeminiProvider) MakeRequest(ctx context.Context, model string, messages []interface{}, options map[string]interface{}) (*Response, error) {
+	if err := p.CheckModelRateLimit(model); err != nil {
+		return nil, err
+	}
+
+	gemReq := &geminiRequest{GenerationConfig: &geminiGenerationConfig{}}
+	for _, msg := range messages {
+		msgMap, ok := msg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := msgMap["role"].(string)
+		content, _ := msgMap["content"].(string)
+		if role == "system" {
+			gemReq.SystemInstruction = appendSystemText(gemReq.SystemInstruction, content)
+			continue
+		}
+		gemReq.Contents = appendGeminiParts(gemReq.Contents, geminiRole(role), geminiPart{Text: content})
+	}
+
+	if maxTokens, ok := options["max_tokens"].(int); ok && maxTokens > 0 {
+		gemReq.GenerationConfig.MaxOutputTokens = maxTokens
+	}
+
+	if tools, ok := options["tools"]; ok {
+		// Tools arrive in Anthropic shape from the handler package
+		var anthropicTools []anthropicTool
+		if raw, err := json.Marshal(tools); err == nil && json.Unmarshal(raw, &anthropicTools) == nil {
+			gemReq.Tools = geminiToolsFromAnthropic(anthropicTools)
+		}
+	}
+
+	reqBody, err := json.Marshal(gemReq)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimSuffix(p.endpoint.String(), "/") + "/models/" + url.PathEscape(model) + ":generateContent"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Api-Key", p.GetAPIKey())
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		if quota := ParseGeminiQuotaError(resp.StatusCode, respBody); quota != nil {
+			p.recordQuotaError(model, quota)
+			return nil, quota
+		}
+		return nil, fmt.Errorf("gemini returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var gemResp geminiResponse
+	if err := json.Unmarshal(respBody, &gemResp); err != nil {
+		return nil, err
+	}
+
+	var texts []string
+	if len(gemResp.Candidates) > 0 {
+		for _, part := range gemResp.Candidates[0].Content.Parts {
+			if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+		}
+	}
+
+	usage := map[string]interface{}{}
+	if gemResp.UsageMetadata != nil {
+		usage["prompt_tokens"] = gemResp.UsageMetadata.PromptTokenCount
+		usage["completion_tokens"] = gemResp.UsageMetadata.CandidatesTokenCount
+		usage["total_tokens"] = gemResp.UsageMetadata.TotalTokenCount
+		usage["cached_tokens"] = gemResp.UsageMetadata.CachedContentTokenCount
+	}
+
+	headers := make(map[string]string)
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headers[key] = values[0]
+		}
+	}
+
+	responseModel := gemResp.ModelVersion
+	if responseModel == "" {
+		responseModel = model
+	}
+
+	return &Response{
+		Content: strings.Join(texts, ""),
+		Model:   responseModel,
+		Usage:   usage,
+		Headers: headers,
+	}, nil
+}
+
+// Request translation
+
+func geminiFromOpenAI(body []byte) (*geminiRequest, string, bool, error) {
+	var req openAIChatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, "", false, fmt.Errorf("failed to parse chat completions request: %w", err)
+	}
+
+	gemReq := &geminiRequest{
+		GenerationConfig: &geminiGenerationConfig{
+			MaxOutputTokens: req.maxTokens(),
+			Temperature:     req.Temperature,
+			TopP:            req.TopP,
+			StopSequences:   req.stopSequences(),
+		},
+	}
+
+	// Gemini function responses are keyed by name, OpenAI tool results by
+	// call ID, so remember which call ID belongs to which function
+	toolNames := make(map[string]string)
+
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			gemReq.SystemInstruction = appendSystemText(gemReq.SystemInstruction, msg.text())
+
+		case "tool":
+			part := geminiPart{FunctionResponse: &geminiFunctionResponse{
+				Name:     toolNames[msg.ToolCallID],
+				Response: functionResponse(msg.text()),
+			}}
+			gemReq.Contents = appendGeminiParts(gemReq.Contents, "user", part)
+
+		default:
+			var parts []geminiPart
+			for _, part := range msg.parts() {
+				switch part.Type {
+				case "text":
+					if part.Text != "" {
+						parts = append(parts, geminiPart{Text: part.Text})
+					}
+				case "image_url":
+					if part.ImageURL != nil {
+						if inline := inlineDataFromURL(part.ImageURL.URL); inline != nil {
+							parts = append(parts, geminiPart{InlineData: inline})
+						}
+					}
+				}
+			}
+			for _, call := range msg.ToolCalls {
+				toolNames[call.ID] = call.Function.Name
+				var args map[string]interface{}
+				json.Unmarshal([]byte(call.Function.Arguments), &args)
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: call.Function.Name,
+					Args: args,
+				}})
+			}
+			if len(parts) > 0 {
+				gemReq.Contents = appendGeminiParts(gemReq.Contents, geminiRole(msg.Role), parts...)
+			}
+		}
+	}
+
+	if len(req.Tools) > 0 {
+		var declarations []geminiFunctionDeclaration
+		for _, tool := range req.Tools {
+			declarations = append(declarations, geminiFunctionDeclaration{
+				Name:        tool.Function.Name,
+				Description: tool.Function.Description,
+				Parameters:  sanitizeGeminiSchema(tool.Function.Parameters),
+			})
+		}
+		gemReq.Tools = []geminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	return gemReq, req.Model, req.Stream, nil
+}
+
+func geminiFromAnthropic(body []byte) (*geminiRequest, string, bool, error) {
+	var req anthropicRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, "", false, fmt.Errorf("failed to parse messages request: %w", err)
+	}
+
+	gemReq := &geminiRequest{
+		GenerationConfig: &geminiGenerationConfig{
+			MaxOutputTokens: req.MaxTokens,
+			Temperature:     req.Temperature,
+			TopP:            req.TopP,
+			StopSequences:   req.StopSequences,
+		},
+	}
+
+	if system := anthropicText(req.System); system != "" {
+		gemReq.SystemInstruction = appendSystemText(nil, system)
+	}
+
+	toolNames := make(map[string]string)
+
+	for _, msg := range req.Messages {
+		var parts []geminiPart
+		for _, block := range anthropicBlocks(msg.Content) {
+			switch block.Type {
+			case "text":
+				if block.Text != "" {
+					parts = append(parts, geminiPart{Text: block.Text})
+				}
+			case "image":
+				if block.Source != nil && block.Source.Type == "base64" {
+					parts = append(parts, geminiPart{InlineData: &geminiInlineData{
+						MimeType: block.Source.MediaType,
+						Data:     block.Source.Data,
+					}})
+				}
+			case "tool_use":
+				toolNames[block.ID] = block.Name
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: block.Name,
+					Args: block.Input,
+				}})
+			case "tool_result":
+				parts = append(parts, geminiPart{FunctionResponse: &geminiFunctionResponse{
+					Name:     toolNames[block.ToolUseID],
+					Response: functionResponse(anthropicText(block.Content)),
+				}})
+			}
+		}
+		if len(parts) > 0 {
+			gemReq.Contents = appendGeminiParts(gemReq.Contents, geminiRole(msg.Role), parts...)
+		}
+	}
+
+	gemReq.Tools = geminiToolsFromAnthropic(req.Tools)
+
+	return gemReq, req.Model, req.Stream, nil
+}
+
+func geminiToolsFromAnthropic(tools []anthropicTool) []geminiTool {
+	if len(tools) == 0 {
+		return nil
+	}
+	var declarations []geminiFunctionDeclaration
+	for _, tool := range tools {
+		declarations = append(declarations, geminiFunctionDeclaration{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  sanitizeGeminiSchema(tool.InputSchema),
+		})
+	}
+	return []geminiTool{{FunctionDeclarations: declarations}}
+}
+
+// geminiRole maps client roles onto Gemini's user/model roles
+func geminiRole(role string) string {
+	if role == "assistant" {
+		return "model"
+	}
+	return "user"
+}
+
+// appendGeminiParts adds parts to the conversation, merging consecutive turns
+// from the same role since Gemini expects alternating roles
+func appendGeminiParts(contents []geminiContent, role string, parts ...geminiPart) []geminiContent {
+	if n := len(contents); n > 0 && contents[n-1].Role == role {
+		contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+		return contents
+	}
+	return append(contents, geminiContent{Role: role, Parts: parts})
+}
+
+func appendSystemText(system *geminiContent, text string) *geminiContent {
+	if text == "" {
+		return system
+	}
+	if system == nil {
+		system = &geminiContent{}
+	}
+	system.Parts = append(system.Parts, geminiPart{Text: text})
+	return system
+}
+
+// functionResponse wraps a tool result for Gemini, which requires an object
+func functionResponse(result string) map[string]interface{} {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(result), &obj); err == nil {
+		return obj
+	}
+	return map[string]interface{}{"content": result}
+}
+
+// inlineDataFromURL converts a base64 data URL into Gemini inline data.
+// Remote image URLs are not supported by generateContent and are dropped.
+func inlineDataFromURL(dataURL string) *geminiInlineData {
+	if !strings.HasPrefix(dataURL, "data:") {
+		return nil
+	}
+	meta, data, found := strings.Cut(strings.TrimPrefix(dataURL, "data:"), ",")
+	if !found || !strings.HasSuffix(meta, ";base64") {
+		return nil
+	}
+	return &geminiInlineData{
+		MimeType: strings.TrimSuffix(meta, ";base64"),
+		Data:     data,
+	}
+}
+
+// sanitizeGeminiSchema drops JSON Schema keywords that Gemini's OpenAPI
+// subset rejects
+func sanitizeGeminiSchema(schema map[string]interface{}) map[string]interface{} {
+	if schema == nil {
+		return nil
+	}
+	clean := make(map[string]interface{}, len(schema))
+	for key, value := range schema {
+		switch key {
+		case "$schema", "additionalProperties", "$id", "$ref", "definitions", "$defs":
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			clean[key] = sanitizeGeminiSchema(v)
+		case []interface{}:
+			items := make([]interface{}, len(v))
+			for i, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					items[i] = sanitizeGeminiSchema(m)
+				} else {
+					items[i] = item
+				}
+			}
+			clean[key] = items
+		default:
+			clean[key] = value
+		}
+	}
+	return clean
+}
+
+// Response translation
+
+// geminiCompletion converts a generateContent response into a neutral
+// completion
+func geminiCompletion(resp *geminiResponse) *completion {
+	c := &completion{finish: finishStop}
+	if len(resp.Candidates) > 0 {
+		candidate := resp.Candidates[0]
+		var text strings.Builder
+		for _, part := range candidate.Content.Parts {
+			text.WriteString(part.Text)
+			if part.FunctionCall != nil {
+				c.toolCalls = append(c.toolCalls, toolCall{
+					name: part.FunctionCall.Name,
+					args: part.FunctionCall.Args,
+				})
+			}
+		}
+		c.text = text.String()
+		c.finish = geminiFinish(candidate.FinishReason, len(c.toolCalls) > 0)
+	}
+	if resp.UsageMetadata != nil {
+		c.usage = tokenUsage{
+			input:  resp.UsageMetadata.PromptTokenCount,
+			output: resp.UsageMetadata.CandidatesTokenCount,
+		}
+	}
+	return c
+}
+
+func geminiFinish(reason string, usedTools bool) string {
+	if usedTools {
+		return finishToolUse
+	}
+	switch reason {
+	case "MAX_TOKENS":
+		return finishLength
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return finishContentFilter
+	case "":
+		return ""
+	default:
+		return finishStop
+	}
+}
+
+// clientAPIKey picks the caller's key from whichever header style it used
+func clientAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Goog-Api-Key"); key != "" {
+		return key
+	}
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// Stream translation
+
+// geminiStream converts Gemini SSE chunks into client stream events
+type geminiStream struct {
+	lines  sseLines
+	client *clientStream
+}
+
+func newGeminiStream(call *geminiCall) *geminiStream {
+	return &geminiStream{client: newClientStream(call.format, call.model)}
+}
+
+func (s *geminiStream) Translate(p []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range s.lines.feed(p) {
+		out.Write(s.handleLine(line))
+	}
+	return out.Bytes()
+}
+
+func (s *geminiStream) Close() []byte {
+	var out bytes.Buffer
+	out.Write(s.handleLine(s.lines.rest()))
+	out.Write(s.client.close())
+	return out.Bytes()
+}
+
+func (s *geminiStream) handleLine(line string) []byte {
+	if !strings.HasPrefix(line, "data:") {
+		return nil
+	}
+	var chunk geminiResponse
+	if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &chunk); err != nil {
+		return nil
+	}
+
+	if chunk.UsageMetadata != nil {
+		s.client.setUsage(chunk.UsageMetadata.PromptTokenCount, chunk.UsageMetadata.CandidatesTokenCount)
+	}
+	if len(chunk.Candidates) == 0 {
+		return nil
+	}
+
+	var out bytes.Buffer
+	candidate := chunk.Candidates[0]
+	for _, part := range candidate.Content.Parts {
+		out.Write(s.client.text(part.Text))
+		if part.FunctionCall != nil {
+			out.Write(s.client.toolCall(toolCall{
+				name: part.FunctionCall.Name,
+				args: part.FunctionCall.Args,
+			}))
+		}
+	}
+	s.client.setFinish(geminiFinish(candidate.FinishReason, false))
+	return out.Bytes()
+}
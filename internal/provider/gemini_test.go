@@ -0,0 +1,234 @@
+package provider
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeminiFromOpenAI(t *testing.T) {
+	body := `{
+		"model": "gemini-pro",
+		"max_tokens": 256,
+		"stop": "END",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "{\"temp\":21}"}
+		],
+		"tools": [{"type": "function", "function": {
+			"name": "get_weather",
+			"description": "Current weather",
+			"parameters": {"$schema": "http://json-schema.org/draft-07/schema#", "type": "object", "additionalProperties": false,
+				"properties": {"city": {"type": "string"}}}
+		}}]
+	}`
+
+	req, model, stream, err := geminiFromOpenAI([]byte(body))
+	require.NoError(t, err)
+
+	assert.Equal(t, "gemini-pro", model)
+	assert.False(t, stream)
+	require.NotNil(t, req.SystemInstruction)
+	assert.Equal(t, "Be brief.", req.SystemInstruction.Parts[0].Text)
+	assert.Equal(t, 256, req.GenerationConfig.MaxOutputTokens)
+	assert.Equal(t, []string{"END"}, req.GenerationConfig.StopSequences)
+
+	require.Len(t, req.Contents, 3)
+	assert.Equal(t, "user", req.Contents[0].Role)
+	assert.Equal(t, "model", req.Contents[1].Role)
+	assert.Equal(t, "get_weather", req.Contents[1].Parts[0].FunctionCall.Name)
+	assert.Equal(t, "Paris", req.Contents[1].Parts[0].FunctionCall.Args["city"])
+	assert.Equal(t, "user", req.Contents[2].Role)
+	assert.Equal(t, "get_weather", req.Contents[2].Parts[0].FunctionResponse.Name)
+	assert.Equal(t, float64(21), req.Contents[2].Parts[0].FunctionResponse.Response["temp"])
+
+	require.Len(t, req.Tools, 1)
+	params := req.Tools[0].FunctionDeclarations[0].Parameters
+	assert.NotContains(t, params, "$schema")
+	assert.NotContains(t, params, "additionalProperties")
+	assert.Equal(t, "object", params["type"])
+}
+
+func TestGeminiFromAnthropic(t *testing.T) {
+	body := `{
+		"model": "gemini-1.5-pro",
+		"system": [{"type": "text", "text": "You are a coder."}],
+		"max_tokens": 1024,
+		"stream": true,
+		"messages": [
+			{"role": "user", "content": "List files"},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "ls", "input": {"path": "."}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_1", "content": "main.go"}]}
+		],
+		"tools": [{"name": "ls", "description": "List a directory", "input_schema": {"type": "object"}}]
+	}`
+
+	req, model, stream, err := geminiFromAnthropic([]byte(body))
+	require.NoError(t, err)
+
+	assert.Equal(t, "gemini-1.5-pro", model)
+	assert.True(t, stream)
+	assert.Equal(t, "You are a coder.", req.SystemInstruction.Parts[0].Text)
+	require.Len(t, req.Contents, 3)
+	assert.Equal(t, "ls", req.Contents[1].Parts[0].FunctionCall.Name)
+	assert.Equal(t, "ls", req.Contents[2].Parts[0].FunctionResponse.Name)
+	assert.Equal(t, "main.go", req.Contents[2].Parts[0].FunctionResponse.Response["content"])
+	assert.Equal(t, "ls", req.Tools[0].FunctionDeclarations[0].Name)
+}
+
+func TestParseGeminiQuotaError(t *testing.T) {
+	body := `{"error": {"code": 429, "message": "Quota exceeded", "status": "RESOURCE_EXHAUSTED", "details": [
+		{"@type": "type.googleapis.com/google.rpc.QuotaFailure", "violations": [{"quotaId": "GenerateRequestsPerMinutePerProjectPerModel"}]},
+		{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "17s"}
+	]}}`
+
+	quota := ParseGeminiQuotaError(http.StatusTooManyRequests, []byte(body))
+	require.NotNil(t, quota)
+	assert.Equal(t, 17*time.Second, quota.RetryDelay)
+	assert.Equal(t, "GenerateRequestsPerMinutePerProjectPerModel", quota.QuotaID)
+
+	assert.Nil(t, ParseGeminiQuotaError(http.StatusBadRequest, []byte(`{"error": {"code": 400, "status": "INVALID_ARGUMENT"}}`)))
+}
+
+func testGeminiProvider(endpoint string) modelrouting.Adapter {
+	return NewGeminiProvider(&config.ProviderConfig{Name: "gemini", Endpoint: endpoint, APIKey: "gemini-key"})
+}
+
+func TestGeminiAdapterTranslatesChatCompletion(t *testing.T) {
+	var upstreamPath, upstreamKey string
+	var upstreamBody geminiRequest
+	_, _, handler := newRoutingStack(t, "/v1beta", []string{"gemini-pro"}, testGeminiProvider,
+		func(w http.ResponseWriter, r *http.Request) {
+			upstreamPath = r.URL.Path
+			upstreamKey = r.Header.Get("X-Goog-Api-Key")
+			json.NewDecoder(r.Body).Decode(&upstreamBody)
+
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Bonjour"}]}, "finishReason": "STOP"}],
+				"usageMetadata": {"promptTokenCount": 7, "candidatesTokenCount": 2, "totalTokenCount": 9}}`)
+		})
+
+	req := httptest.NewRequest("POST", "/chat/completions",
+		strings.NewReader(`{"model": "gemini-pro", "messages": [{"role": "user", "content": "Hello"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer client-key")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "/v1beta/models/gemini-pro:generateContent", upstreamPath)
+	assert.Equal(t, "gemini-key", upstreamKey)
+	assert.Equal(t, "Hello", upstreamBody.Contents[0].Parts[0].Text)
+
+	var resp openAIChatResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "chat.completion", resp.Object)
+	assert.Equal(t, "gemini-pro", resp.Model)
+	assert.Equal(t, "Bonjour", *resp.Choices[0].Message.Content)
+	assert.Equal(t, "stop", *resp.Choices[0].FinishReason)
+	assert.Equal(t, 9, resp.Usage.TotalTokens)
+}
+
+func TestGeminiAdapterStreamsAnthropicEvents(t *testing.T) {
+	_, _, handler := newRoutingStack(t, "/v1beta", []string{"gemini-pro"}, testGeminiProvider,
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1beta/models/gemini-pro:streamGenerateContent", r.URL.Path)
+			assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"Hi\"}]}}], \"usageMetadata\": {\"promptTokenCount\": 5}}\r\n\r\n")
+			io.WriteString(w, "data: {\"candidates\": [{\"content\": {\"parts\": [{\"functionCall\": {\"name\": \"ls\", \"args\": {\"path\": \".\"}}}]}, \"finishReason\": \"STOP\"}], \"usageMetadata\": {\"promptTokenCount\": 5, \"candidatesTokenCount\": 4}}\r\n\r\n")
+		})
+
+	req := httptest.NewRequest("POST", "/messages",
+		strings.NewReader(`{"model": "gemini-pro", "stream": true, "max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	var events []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		}
+	}
+	assert.Equal(t, []string{
+		"message_start",
+		"content_block_start", "content_block_delta",
+		"content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}, events)
+	assert.Contains(t, w.Body.String(), `"stop_reason":"tool_use"`)
+	assert.Contains(t, w.Body.String(), `"output_tokens":4`)
+}
+
+func TestGeminiAdapterHonorsQuotaErrors(t *testing.T) {
+	calls := 0
+	adapter, _, handler := newRoutingStack(t, "/v1beta", []string{"gemini-pro"}, testGeminiProvider,
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"error": {"code": 429, "message": "Quota exceeded", "status": "RESOURCE_EXHAUSTED",
+				"details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "30s"}]}}`)
+		})
+	gemini := adapter.(*GeminiProvider)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/chat/completions",
+			strings.NewReader(`{"model": "gemini-pro", "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := send()
+	assert.Equal(t, http.StatusTooManyRequests, first.Code)
+	assert.Equal(t, "30", first.Header().Get("Retry-After"))
+	assert.Contains(t, first.Body.String(), "rate_limit_exceeded")
+	assert.Error(t, gemini.CheckModelRateLimit("gemini-pro"))
+
+	// The second request is rejected locally without reaching Gemini
+	second := send()
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	assert.Equal(t, 1, calls)
+
+	// Quotas are per model, so other models are still sent
+	assert.NoError(t, gemini.CheckModelRateLimit("gemini-flash"))
+	assert.NoError(t, gemini.CheckRateLimit())
+}
+
+func TestGeminiRewriteRequestEscapesModel(t *testing.T) {
+	gemini := NewGeminiProvider(&config.ProviderConfig{Name: "gemini", APIKey: "gemini-key"})
+	target, _ := url.Parse("https://generativelanguage.googleapis.com/v1beta")
+
+	body := `{"model": "tuned/../../files?x=1#frag", "messages": [{"role": "user", "content": "Hello"}]}`
+	req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(body))
+	rewritten, err := gemini.RewriteRequest(req, target, []byte(body))
+	require.NoError(t, err)
+
+	assert.Equal(t, "/v1beta/models/tuned%2F..%2F..%2Ffiles%3Fx=1%23frag:generateContent", rewritten.URL.EscapedPath())
+	assert.Empty(t, rewritten.URL.RawQuery)
+	assert.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/tuned%2F..%2F..%2Ffiles%3Fx=1%23frag:generateContent", rewritten.URL.String())
+}
@@ -1,15 +1,17 @@
 package provider
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 )
 
 type Provider interface {
 	Name() string
-	MakeRequest(model string, messages []interface{}, options map[string]interface{}) (*Response, error)
+	MakeRequest(ctx context.Context, model string, messages []interface{}, options map[string]interface{}) (*Response, error)
 	GetAPIKey() string
 	CheckRateLimit() error
 }
@@ -40,6 +42,12 @@ func NewProviderManager(config *config.Config) *ProviderManager {
 			pm.providers[providerConfig.Name] = NewCerebrasProvider(&providerConfig)
 		case "zhipu":
 			pm.providers[providerConfig.Name] = NewZhipuProvider(&providerConfig)
+		case "gemini":
+			pm.providers[providerConfig.Name] = NewGeminiProvider(&providerConfig)
+		case "bedrock":
+			pm.providers[providerConfig.Name] = NewBedrockProvider(&providerConfig)
+		case "azure":
+			pm.providers[providerConfig.Name] = NewAzureProvider(&providerConfig)
 		}
 	}
 
@@ -62,3 +70,20 @@ func (pm *ProviderManager) GetProviderForModel(model string) (Provider, error) {
 
 	return nil, fmt.Errorf("no provider found for model: %s", model)
 }
+
+// DailyQuotas returns the daily request quota of each key, by provider, for
+// providers that enforce one
+func (pm *ProviderManager) DailyQuotas() map[string]map[string]ratelimit.DailyQuotaStatus {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	quotas := make(map[string]map[string]ratelimit.DailyQuotaStatus)
+	for name, p := range pm.providers {
+		if q, ok := p.(interface {
+			DailyQuota() map[string]ratelimit.DailyQuotaStatus
+		}); ok {
+			quotas[name] = q.DailyQuota()
+		}
+	}
+	return quotas
+}
@@ -1,7 +1,9 @@
 package provider
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/cooldownp/cooldown-proxy/internal/config"
 	"github.com/stretchr/testify/assert"
@@ -30,3 +32,40 @@ func TestProviderManagerSelectsCerebrasForGLM(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "cerebras", provider.Name())
 }
+
+func TestProviderManagerStateSurvivesRestart(t *testing.T) {
+	config := &config.Config{
+		Providers: []config.ProviderConfig{
+			{
+				Name:     "cerebras",
+				Endpoint: "https://api.cerebras.ai/v1",
+				Models:   []string{"glm-4.6"},
+				LoadBalancing: &config.LoadBalancingConfig{
+					APIKeys: []config.APIKeyConfig{{Key: "test-key-1", Weight: 1}},
+				},
+			},
+		},
+	}
+
+	before := NewProviderManager(config)
+	stats := before.providers["cerebras"].(*CerebrasProvider).keyStats["test-key-1"]
+	stats.RemainingRequests = 500
+	stats.RemainingTokens = 10
+
+	data, err := json.Marshal(before.Snapshot())
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "test-key-1")
+
+	after := NewProviderManager(config)
+	assert.NoError(t, after.Restore(data, time.Now()))
+	restored := after.providers["cerebras"].(*CerebrasProvider).keyStats["test-key-1"]
+	assert.Equal(t, 500, restored.RemainingRequests)
+	assert.Equal(t, 10, restored.RemainingTokens)
+
+	// A minute later the token budget has refilled
+	later := NewProviderManager(config)
+	assert.NoError(t, later.Restore(data, time.Now().Add(-2*time.Minute)))
+	restored = later.providers["cerebras"].(*CerebrasProvider).keyStats["test-key-1"]
+	assert.Equal(t, 500, restored.RemainingRequests)
+	assert.Equal(t, 10000, restored.RemainingTokens)
+}
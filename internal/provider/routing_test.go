@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/modelrouting"
+	"github.com/cooldownp/cooldown-proxy/internal/proxy"
+	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+)
+
+// newRoutingStack serves upstream and returns model routing that sends
+// models to it through the adapter newAdapter builds. newAdapter is given
+// the upstream URL followed by path, which is also the models' target.
+// Adapters that adapt to throttling are given the returned limiter.
+func newRoutingStack(t *testing.T, path string, models []string, newAdapter func(endpoint string) modelrouting.Adapter,
+	upstream http.HandlerFunc) (modelrouting.Adapter, *ratelimit.Limiter, http.Handler) {
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	endpoint := server.URL + path
+
+	adapter := newAdapter(endpoint)
+	limiter := ratelimit.New(nil)
+	if limited, ok := adapter.(interface{ SetRateLimiter(*ratelimit.Limiter) }); ok {
+		limited.SetRateLimiter(limiter)
+	}
+
+	targets := make(map[string]string, len(models))
+	for _, model := range models {
+		targets[model] = endpoint
+	}
+	routing := modelrouting.NewModelRoutingMiddleware(&config.ModelRoutingConfig{
+		Enabled:       true,
+		DefaultTarget: "https://api.openai.com/v1",
+		Models:        targets,
+	}, proxy.NewHandler(nil))
+	routing.AddAdapter(adapter)
+
+	return adapter, limiter, routing
+}
@@ -0,0 +1,266 @@
+package provider
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+)
+
+// AWSCredentials is an access key pair with an optional session token
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// SignV4 signs r with AWS Signature Version 4. body must be the exact
+// payload that will be sent.
+func SignV4(r *http.Request, body []byte, creds AWSCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(sigV4TimeFormat)
+	scope := strings.Join([]string{now.Format(sigV4DateFormat), region, service, "aws4_request"}, "/")
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	signedHeaders, canonicalHeaders := canonicalSigV4Headers(r, host)
+	payloadHash := sha256Hex(body)
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalSigV4URI(r.URL.EscapedPath()),
+		canonicalSigV4Query(r.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalSigV4Headers signs host, content-type and all x-amz-* headers.
+// Other headers may be added or rewritten by proxies on the way and are left
+// unsigned.
+func canonicalSigV4Headers(r *http.Request, host string) (string, string) {
+	values := map[string]string{"host": host}
+	for name, vals := range r.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			trimmed := make([]string, len(vals))
+			for i, v := range vals {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			values[lower] = strings.Join(trimmed, ",")
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name)
+		canonical.WriteString(":")
+		canonical.WriteString(values[name])
+		canonical.WriteString("\n")
+	}
+	return strings.Join(names, ";"), canonical.String()
+}
+
+// canonicalSigV4URI encodes each segment of the already escaped path once
+// more, as SigV4 requires for every service except S3
+func canonicalSigV4URI(escapedPath string) string {
+	if escapedPath == "" {
+		return "/"
+	}
+	segments := strings.Split(escapedPath, "/")
+	for i, segment := range segments {
+		segments[i] = sigV4Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalSigV4Query(query map[string][]string) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, sigV4Escape(key)+"="+sigV4Escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// sigV4Escape percent-encodes everything except RFC 3986 unreserved
+// characters
+func sigV4Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsCredentialsSource resolves credentials from static configuration or an
+// AWS shared credentials file. The file is re-read when it changes so
+// rotated keys are picked up without a restart.
+type awsCredentialsSource struct {
+	static  AWSCredentials
+	path    string
+	profile string
+
+	mu      sync.Mutex
+	cached  AWSCredentials
+	modTime time.Time
+}
+
+func newAWSCredentialsSource(static AWSCredentials, path, profile string) *awsCredentialsSource {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	return &awsCredentialsSource{static: static, path: path, profile: profile}
+}
+
+// Credentials returns static credentials when configured, otherwise the
+// profile from the credentials file
+func (s *awsCredentialsSource) Credentials() (AWSCredentials, error) {
+	if s.static.AccessKeyID != "" && s.static.SecretAccessKey != "" {
+		return s.static, nil
+	}
+	if s.path == "" {
+		return AWSCredentials{}, fmt.Errorf("no AWS credentials configured")
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to read AWS credentials file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cached.AccessKeyID != "" && info.ModTime().Equal(s.modTime) {
+		return s.cached, nil
+	}
+
+	creds, err := loadAWSCredentialsFile(s.path, s.profile)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	s.cached = creds
+	s.modTime = info.ModTime()
+	return creds, nil
+}
+
+// loadAWSCredentialsFile reads a profile from an INI-style shared
+// credentials file
+func loadAWSCredentialsFile(path, profile string) (AWSCredentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to open AWS credentials file: %w", err)
+	}
+	defer file.Close()
+
+	var creds AWSCredentials
+	inProfile := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section := strings.TrimSpace(line[1 : len(line)-1])
+			inProfile = section == profile || section == "profile "+profile
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to read AWS credentials file: %w", err)
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return AWSCredentials{}, fmt.Errorf("profile %q not found or incomplete in %s", profile, path)
+	}
+	return creds, nil
+}
@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAWSCredentials = AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSignV4MatchesAWSTestSuite(t *testing.T) {
+	// get-vanilla from the AWS SigV4 test suite
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	SignV4(req, nil, testAWSCredentials, "us-east-1", "service", now)
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, "+
+			"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestSignV4SessionToken(t *testing.T) {
+	req, err := http.NewRequest("POST", "https://bedrock-runtime.us-east-1.amazonaws.com/model/x/invoke", nil)
+	require.NoError(t, err)
+
+	creds := testAWSCredentials
+	creds.SessionToken = "session"
+	SignV4(req, []byte("{}"), creds, "us-east-1", "bedrock", time.Now())
+
+	assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+}
+
+func TestCanonicalSigV4URIEscapesModelIDs(t *testing.T) {
+	escaped := "/model/" + sigV4Escape("anthropic.claude-3-haiku-20240307-v1:0") + "/invoke"
+	assert.Equal(t, "/model/anthropic.claude-3-haiku-20240307-v1%3A0/invoke", escaped)
+	assert.Equal(t, "/model/anthropic.claude-3-haiku-20240307-v1%253A0/invoke", canonicalSigV4URI(escaped))
+}
+
+func TestAWSCredentialsSourceReadsProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(path, []byte(`[default]
+aws_access_key_id = DEFAULTKEY
+aws_secret_access_key = defaultsecret
+
+[bedrock]
+aws_access_key_id = BEDROCKKEY
+aws_secret_access_key = bedrocksecret
+aws_session_token = token
+`), 0600))
+
+	creds, err := newAWSCredentialsSource(AWSCredentials{}, path, "bedrock").Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, AWSCredentials{AccessKeyID: "BEDROCKKEY", SecretAccessKey: "bedrocksecret", SessionToken: "token"}, creds)
+
+	_, err = newAWSCredentialsSource(AWSCredentials{}, path, "missing").Credentials()
+	assert.Error(t, err)
+
+	static := AWSCredentials{AccessKeyID: "STATIC", SecretAccessKey: "secret"}
+	creds, err = newAWSCredentialsSource(static, path, "bedrock").Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, static, creds)
+}
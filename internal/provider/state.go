@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// stateful is implemented by providers whose state survives restarts
+type stateful interface {
+	Snapshot() interface{}
+	Restore(data json.RawMessage, savedAt time.Time) error
+}
+
+// Snapshot returns the state of every provider that keeps any, by name
+func (pm *ProviderManager) Snapshot() interface{} {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	state := make(map[string]interface{})
+	for name, p := range pm.providers {
+		if s, ok := p.(stateful); ok {
+			state[name] = s.Snapshot()
+		}
+	}
+	return state
+}
+
+// Restore applies a Snapshot to the providers still configured
+func (pm *ProviderManager) Restore(data json.RawMessage, savedAt time.Time) error {
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for name, raw := range state {
+		if s, ok := pm.providers[name].(stateful); ok {
+			if err := s.Restore(raw, savedAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type keyState struct {
+	LastReset         time.Time `json:"last_reset"`
+	RequestsUsed      int       `json:"requests_used"`
+	TokensUsed        int64     `json:"tokens_used"`
+	LimitRequestsDay  int       `json:"limit_requests_day"`
+	LimitTokensMinute int       `json:"limit_tokens_minute"`
+	RemainingRequests int       `json:"remaining_requests"`
+	RemainingTokens   int       `json:"remaining_tokens"`
+	LastUpdate        time.Time `json:"last_update"`
+}
+
+// keyID identifies an API key in snapshots without writing it to disk
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Snapshot returns the usage of every API key, keyed by a hash of the key
+func (p *CerebrasProvider) Snapshot() interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := make(map[string]keyState)
+	for key, stats := range p.keyStats {
+		state[keyID(key)] = keyState{
+			LastReset:         stats.LastReset,
+			RequestsUsed:      stats.RequestsUsed,
+			TokensUsed:        stats.TokensUsed,
+			LimitRequestsDay:  stats.LimitRequestsDay,
+			LimitTokensMinute: stats.LimitTokensMinute,
+			RemainingRequests: stats.RemainingRequests,
+			RemainingTokens:   stats.RemainingTokens,
+			LastUpdate:        stats.LastUpdate,
+		}
+	}
+	return state
+}
+
+// Restore applies a Snapshot to the keys still configured. The per-minute
+// token budget has refilled if the snapshot is more than a minute old; the
+// daily counters reset on their own once LastReset is a day old.
+func (p *CerebrasProvider) Restore(data json.RawMessage, savedAt time.Time) error {
+	var state map[string]keyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, stats := range p.keyStats {
+		saved, ok := state[keyID(key)]
+		if !ok {
+			continue
+		}
+		stats.LastReset = saved.LastReset
+		stats.RequestsUsed = saved.RequestsUsed
+		stats.TokensUsed = saved.TokensUsed
+		stats.LimitRequestsDay = saved.LimitRequestsDay
+		stats.LimitTokensMinute = saved.LimitTokensMinute
+		stats.RemainingRequests = saved.RemainingRequests
+		stats.RemainingTokens = saved.RemainingTokens
+		stats.LastUpdate = saved.LastUpdate
+		if time.Since(savedAt) > time.Minute {
+			stats.RemainingTokens = saved.LimitTokensMinute
+		}
+	}
+	return nil
+}
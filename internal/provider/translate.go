@@ -0,0 +1,166 @@
+package provider
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClientFormat is the wire format the client used for a request
+type ClientFormat int
+
+const (
+	FormatOpenAI ClientFormat = iota
+	FormatAnthropic
+)
+
+// DetectClientFormat infers the client format from the request path.
+// Anthropic clients post to .../messages, everything else is treated as an
+// OpenAI chat completions request.
+func DetectClientFormat(path string) ClientFormat {
+	if strings.HasSuffix(strings.TrimSuffix(path, "/"), "/messages") {
+		return FormatAnthropic
+	}
+	return FormatOpenAI
+}
+
+// streamTranslator converts an upstream stream into client-format bytes
+type streamTranslator interface {
+	// Translate consumes upstream bytes and returns client bytes
+	Translate(p []byte) []byte
+	// Close returns any trailing client bytes once the upstream stream ends
+	Close() []byte
+}
+
+// translatingWriter sits between the reverse proxy and the client. Streaming
+// responses are translated as they arrive; everything else is buffered and
+// translated once in Finish.
+type translatingWriter struct {
+	rw          http.ResponseWriter
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	stream      streamTranslator
+
+	// newStream returns a translator when the response should be streamed,
+	// or nil when it should be buffered
+	newStream func(status int, header http.Header) streamTranslator
+	// translate converts a buffered upstream body into the client body
+	translate func(status int, header http.Header, body []byte) []byte
+}
+
+func (t *translatingWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *translatingWriter) WriteHeader(status int) {
+	if t.wroteHeader {
+		return
+	}
+	t.wroteHeader = true
+	t.status = status
+
+	if t.newStream == nil {
+		return
+	}
+	if t.stream = t.newStream(status, t.header); t.stream == nil {
+		return
+	}
+
+	copyHeaders(t.rw.Header(), t.header)
+	t.rw.Header().Del("Content-Length")
+	t.rw.Header().Set("Content-Type", "text/event-stream")
+	t.rw.Header().Set("Cache-Control", "no-cache")
+	t.rw.WriteHeader(status)
+}
+
+func (t *translatingWriter) Write(p []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+
+	if t.stream == nil {
+		return t.body.Write(p)
+	}
+
+	if out := t.stream.Translate(p); len(out) > 0 {
+		if _, err := t.rw.Write(out); err != nil {
+			return 0, err
+		}
+		t.Flush()
+	}
+	return len(p), nil
+}
+
+// Flush pushes translated stream events to the client immediately
+func (t *translatingWriter) Flush() {
+	if t.stream != nil {
+		http.NewResponseController(t.rw).Flush()
+	}
+}
+
+// Finish writes the translated response. It must be called once the
+// upstream response has been fully copied into the writer.
+func (t *translatingWriter) Finish() error {
+	if !t.wroteHeader {
+		return nil
+	}
+
+	if t.stream != nil {
+		if out := t.stream.Close(); len(out) > 0 {
+			if _, err := t.rw.Write(out); err != nil {
+				return err
+			}
+		}
+		t.Flush()
+		return nil
+	}
+
+	out := t.body.Bytes()
+	if t.translate != nil {
+		out = t.translate(t.status, t.header, out)
+	}
+
+	copyHeaders(t.rw.Header(), t.header)
+	t.rw.Header().Del("Content-Encoding")
+	t.rw.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	t.rw.WriteHeader(t.status)
+	_, err := t.rw.Write(out)
+	return err
+}
+
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append([]string(nil), values...)
+	}
+}
+
+// sseLines splits a byte stream into complete lines, keeping partial lines
+// until more data arrives.
+type sseLines struct {
+	pending []byte
+}
+
+func (s *sseLines) feed(p []byte) []string {
+	s.pending = append(s.pending, p...)
+
+	var lines []string
+	for {
+		idx := bytes.IndexByte(s.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		lines = append(lines, strings.TrimRight(string(s.pending[:idx]), "\r"))
+		s.pending = s.pending[idx+1:]
+	}
+	return lines
+}
+
+// rest returns whatever partial line is left once the stream has ended
+func (s *sseLines) rest() string {
+	line := strings.TrimRight(string(s.pending), "\r\n")
+	s.pending = nil
+	return line
+}
@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"context"
 	"github.com/cooldownp/cooldown-proxy/internal/config"
 )
 
@@ -25,7 +26,7 @@ func (p *ZhipuProvider) CheckRateLimit() error {
 	return nil
 }
 
-func (p *ZhipuProvider) MakeRequest(model string, messages []interface{}, options map[string]interface{}) (*Response, error) {
+func (p *ZhipuProvider) MakeRequest(ctx context.Context, model string, messages []interface{}, options map[string]interface{}) (*Response, error) {
 	// TODO: Implement Zhipu API integration
 	return &Response{
 		Content: "Zhipu response placeholder",
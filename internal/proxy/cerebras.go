@@ -2,7 +2,9 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,10 +17,19 @@ import (
 
 	"github.com/cooldownp/cooldown-proxy/internal/circuitbreaker"
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
 	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 	"github.com/cooldownp/cooldown-proxy/internal/token"
 )
 
+// defaultMaxBodyBytes caps the request bodies read for token estimates,
+// matching model routing's default
+const defaultMaxBodyBytes int64 = 32 << 20
+
+// admissionKey holds the request's admission, so the tokens it is charged
+// can be corrected once the response reports its usage
+type admissionKey struct{}
+
 type CerebrasProxyHandler struct {
 	Limiter        *ratelimit.CerebrasLimiter
 	Estimator      *token.TokenEstimator
@@ -26,6 +37,9 @@ type CerebrasProxyHandler struct {
 	proxy          *httputil.ReverseProxy
 	cerebrasHosts  []string
 	circuitBreaker *circuitbreaker.CircuitBreaker
+	tenants        *ratelimit.Tenants     // nil without fair queuing
+	coordinator    *ratelimit.Coordinator // nil without peers
+	maxBodyBytes   int64
 }
 
 func NewCerebrasProxyHandler(
@@ -53,7 +67,22 @@ func NewCerebrasProxyHandler(
 		},
 	})
 
-	return &CerebrasProxyHandler{
+	if config.MaxQueueDepth > 0 && config.RequestTimeout > 0 {
+		limiter.SetQueueLimits(config.MaxQueueDepth, config.RequestTimeout)
+	}
+	var tenants *ratelimit.Tenants
+	if config.FairQueuing != nil {
+		tenants = ratelimit.NewTenants(config.FairQueuing)
+		limiter.SetFairQueuing(tenants.Weights(), config.FairQueuing.Aging)
+	}
+	// With peers, the configured limits are the org's and the limiter only
+	// gets this instance's lease of them
+	var coordinator *ratelimit.Coordinator
+	if config.Peers != nil {
+		coordinator = ratelimit.NewCoordinator(config.Peers, limiter, config.RPMLimit, config.TPMLimit)
+	}
+
+	handler := &CerebrasProxyHandler{
 		Limiter:   limiter,
 		Estimator: estimator,
 		Config:    config,
@@ -62,31 +91,69 @@ func NewCerebrasProxyHandler(
 			"inference.cerebras.ai",
 		},
 		circuitBreaker: circuitBreaker,
+		tenants:        tenants,
+		coordinator:    coordinator,
+		maxBodyBytes:   defaultMaxBodyBytes,
 		proxy: &httputil.ReverseProxy{
 			Director: director,
-			ModifyResponse: func(resp *http.Response) error {
-				// Parse and update limiter with header data
-				if err := limiter.UpdateFromHeaders(resp.Header); err != nil {
-					// Log but don't fail the request
-					log.Printf("Failed to parse rate limit headers: %v", err)
-				}
+		},
+	}
+	handler.proxy.ModifyResponse = func(resp *http.Response) error {
+		handler.modifyResponse(resp)
+		return nil
+	}
+	return handler
+}
 
-				// Add proxy headers with current state
-				resp.Header.Set("X-RateLimit-Limit-RPM", strconv.Itoa(config.RPMLimit))
-				resp.Header.Set("X-RateLimit-Limit-TPM", strconv.Itoa(config.TPMLimit))
-				resp.Header.Set("X-RateLimit-Current-TPM-Limit", strconv.Itoa(limiter.CurrentTPMLimit()))
-				resp.Header.Set("X-RateLimit-Remaining-TPM", strconv.Itoa(limiter.CurrentTPMRemaining()))
-				resp.Header.Set("X-RateLimit-Queue-Length", strconv.Itoa(limiter.QueueLength()))
+// Coordinator returns what shares the limits with the configured peers, or
+// nil without peers. Its ServeHTTP must be mounted at
+// ratelimit.PeerLeasePath and it must be started for the lease to follow
+// demand.
+func (h *CerebrasProxyHandler) Coordinator() *ratelimit.Coordinator {
+	return h.coordinator
+}
 
-				// Add circuit breaker headers
-				stats := circuitBreaker.Stats()
-				resp.Header.Set("X-CircuitBreaker-State", stats.State.String())
-				resp.Header.Set("X-CircuitBreaker-Failures", strconv.Itoa(stats.Failures))
+// SetMaxBodyBytes rejects request bodies larger than limit with 413 rather
+// than reading them for a token estimate
+func (h *CerebrasProxyHandler) SetMaxBodyBytes(limit int64) {
+	h.maxBodyBytes = limit
+}
 
-				return nil
-			},
-		},
+// modifyResponse follows the rate limit headers of a response to an
+// admitted request and reports the limiter's state back to the client
+func (h *CerebrasProxyHandler) modifyResponse(resp *http.Response) {
+	// Parse and update limiter with header data
+	if err := h.Limiter.UpdateFromHeaders(resp.Header); err != nil {
+		// Log but don't fail the request
+		log.Printf("Failed to parse rate limit headers: %v", err)
 	}
+
+	// Charge the tokens the response reports in place of the
+	// estimate, once its body has been read. Compressed bodies
+	// keep the estimate.
+	admission, ok := resp.Request.Context().Value(admissionKey{}).(*ratelimit.Admission)
+	if ok && resp.Body != nil && resp.Header.Get("Content-Encoding") == "" {
+		stream := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+		resp.Body = newUsageReader(resp.Body, stream, admission.Reconcile)
+	}
+
+	// Add proxy headers with current state
+	resp.Header.Set("X-RateLimit-Limit-RPM", strconv.Itoa(h.Limiter.RPMLimit()))
+	resp.Header.Set("X-RateLimit-Limit-TPM", strconv.Itoa(h.Limiter.TPMLimit()))
+	resp.Header.Set("X-RateLimit-Current-TPM-Limit", strconv.Itoa(h.Limiter.CurrentTPMLimit()))
+	resp.Header.Set("X-RateLimit-Remaining-TPM", strconv.Itoa(h.Limiter.CurrentTPMRemaining()))
+	resp.Header.Set("X-RateLimit-Queue-Length", strconv.Itoa(h.Limiter.QueueLength()))
+
+	// Add circuit breaker headers
+	stats := h.circuitBreaker.Stats()
+	resp.Header.Set("X-CircuitBreaker-State", stats.State.String())
+	resp.Header.Set("X-CircuitBreaker-Failures", strconv.Itoa(stats.Failures))
+}
+
+// admitted reports whether the request went through the Cerebras queue
+func admitted(req *http.Request) bool {
+	_, ok := req.Context().Value(admissionKey{}).(*ratelimit.Admission)
+	return ok
 }
 
 func (h *CerebrasProxyHandler) IsCerebrasRequest(req *http.Request) bool {
@@ -110,11 +177,25 @@ func (h *CerebrasProxyHandler) EstimateTokens(req *http.Request) (int, error) {
 		return 0, fmt.Errorf("request body is nil")
 	}
 
-	// Read body
-	body, err := io.ReadAll(req.Body)
+	// Read body, one byte past the limit to tell a body at the limit from
+	// a larger one
+	body, err := io.ReadAll(io.LimitReader(req.Body, h.maxBodyBytes+1))
 	if err != nil {
+		// Put back what was read, so the error reaches the upstream request
+		// in place of a truncated body
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		var proxyErr *proxyerrors.ProxyError
+		if errors.As(err, &proxyErr) {
+			return 0, proxyErr
+		}
 		return 0, fmt.Errorf("failed to read request body: %w", err)
 	}
+	if int64(len(body)) > h.maxBodyBytes {
+		return 0, proxyerrors.NewRequestTooLargeError(h.maxBodyBytes)
+	}
 
 	// Restore body for later use
 	req.Body = io.NopCloser(bytes.NewReader(body))
@@ -171,6 +252,15 @@ func (h *CerebrasProxyHandler) CheckRateLimit(req *http.Request, tokens int) tim
 	return h.Limiter.CheckRequestWithDynamicQueue(requestID, tokens)
 }
 
+// tenant names who the request is queued for, or "" when all requests share
+// one queue
+func (h *CerebrasProxyHandler) tenant(req *http.Request) string {
+	if h.tenants == nil {
+		return ""
+	}
+	return h.tenants.Identify(req)
+}
+
 func (h *CerebrasProxyHandler) generateRequestID(req *http.Request) string {
 	return fmt.Sprintf("cerebras-%d-%s", time.Now().UnixNano(), req.Host)
 }
@@ -182,35 +272,56 @@ func (h *CerebrasProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	if err := h.admit(w, req, h.proxy.ServeHTTP); err != nil {
+		http.Error(w, err.Message, err.HTTPStatus())
+	}
+}
+
+// admit waits in the queue until there is RPM/TPM capacity for the request,
+// then passes it to forward behind the circuit breaker. A request refused
+// before being admitted is not answered; its error is returned instead.
+func (h *CerebrasProxyHandler) admit(w http.ResponseWriter, req *http.Request, forward http.HandlerFunc) *proxyerrors.ProxyError {
 	// Estimate tokens for rate limiting
 	tokens, err := h.EstimateTokens(req)
+	var proxyErr *proxyerrors.ProxyError
+	if errors.As(err, &proxyErr) {
+		// Reading the body failed with its own status, e.g. 413
+		return proxyErr
+	}
 	if err != nil {
 		// Log error but continue with default token estimation
 		tokens = 1000 // Conservative default
 	}
 
-	// Check rate limits
-	delay := h.CheckRateLimit(req, tokens)
-	if delay == -1 {
-		// Queue full, reject immediately
-		w.Header().Set("X-RateLimit-Reason", "queue_full")
-		w.Header().Set("Retry-After", "60")
-		http.Error(w, "Rate limit exceeded - queue full", http.StatusTooManyRequests)
-		return
+	// Wait in the queue until there is RPM/TPM capacity for the request
+	start := time.Now()
+	admission, err := h.Limiter.Acquire(req.Context(), h.generateRequestID(req), h.tenant(req), tokens)
+	if err != nil {
+		switch {
+		case errors.Is(err, ratelimit.ErrQueueFull):
+			w.Header().Set("X-RateLimit-Reason", "queue_full")
+			w.Header().Set("Retry-After", "60")
+			return proxyerrors.NewProxyError(proxyerrors.ErrorTypeRateLimitExceeded, "Rate limit exceeded - queue full", err)
+		case errors.Is(err, ratelimit.ErrQueueTimeout):
+			w.Header().Set("X-RateLimit-Reason", "queue_timeout")
+			w.Header().Set("Retry-After", "60")
+			return proxyerrors.NewProxyError(proxyerrors.ErrorTypeRateLimitExceeded, "Rate limit exceeded - timed out in queue", err)
+		default:
+			return proxyerrors.NewRateLimitWaitError(req.Host, err)
+		}
 	}
 
-	if delay > 0 {
+	req = req.WithContext(context.WithValue(req.Context(), admissionKey{}, admission))
+
+	if delay := time.Since(start); delay >= time.Millisecond {
 		// Add delay header for transparency
-		w.Header().Set("X-RateLimit-Delay", delay.String())
+		w.Header().Set("X-RateLimit-Delay", delay.Round(time.Millisecond).String())
 		w.Header().Set("X-RateLimit-Reason", "rate_limited")
-
-		// Wait for the delay
-		time.Sleep(delay)
 	}
 
 	// Add static rate limit headers (dynamic headers added in ModifyResponse)
-	w.Header().Set("X-RateLimit-Limit-RPM", strconv.Itoa(h.Config.RPMLimit))
-	w.Header().Set("X-RateLimit-Limit-TPM", strconv.Itoa(h.Config.TPMLimit))
+	w.Header().Set("X-RateLimit-Limit-RPM", strconv.Itoa(h.Limiter.RPMLimit()))
+	w.Header().Set("X-RateLimit-Limit-TPM", strconv.Itoa(h.Limiter.TPMLimit()))
 	w.Header().Set("X-RateLimit-Queue-Length", strconv.Itoa(h.Limiter.QueueLength()))
 
 	// Add circuit breaker state headers
@@ -218,9 +329,16 @@ func (h *CerebrasProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 	w.Header().Set("X-CircuitBreaker-State", stats.State.String())
 	w.Header().Set("X-CircuitBreaker-Failures", strconv.Itoa(stats.Failures))
 
-	// Use circuit breaker to protect the proxy call
-	var cbErr error
-	cbErr = h.circuitBreaker.Call(func() error {
+	// Use circuit breaker to protect the proxy call. A request that is not
+	// sent after all, because the circuit is open or its client went away,
+	// gives its capacity back.
+	sent := false
+	cbErr := h.circuitBreaker.Call(func() error {
+		if req.Context().Err() != nil {
+			return nil
+		}
+		sent = true
+
 		// Capture response to detect errors
 		responseWriter := &circuitBreakerResponseWriter{
 			ResponseWriter: w,
@@ -228,7 +346,7 @@ func (h *CerebrasProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 		}
 
 		// Forward request to Cerebras API
-		h.proxy.ServeHTTP(responseWriter, req)
+		forward(responseWriter, req)
 
 		// Consider HTTP 5xx errors as failures
 		if responseWriter.statusCode >= 500 {
@@ -237,18 +355,18 @@ func (h *CerebrasProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 
 		return nil
 	})
+	if !sent {
+		admission.Cancel()
+	}
 
-	if cbErr != nil {
-		if circuitbreaker.IsCircuitOpenError(cbErr) {
-			w.Header().Set("X-CircuitBreaker-Reason", "circuit_open")
-			w.Header().Set("Retry-After", "60") // Suggest retry after circuit reset timeout
-			http.Error(w, "Cerebras API temporarily unavailable - circuit breaker open", http.StatusServiceUnavailable)
-		} else {
-			// Other errors (HTTP 5xx from upstream)
-			w.Header().Set("X-CircuitBreaker-Reason", "upstream_error")
-			http.Error(w, "Cerebras API error", http.StatusBadGateway)
-		}
+	// Upstream errors have already been forwarded to the client; only an
+	// open circuit leaves the request unanswered
+	if cbErr != nil && circuitbreaker.IsCircuitOpenError(cbErr) {
+		w.Header().Set("X-CircuitBreaker-Reason", "circuit_open")
+		w.Header().Set("Retry-After", "60") // Suggest retry after circuit reset timeout
+		http.Error(w, "Cerebras API temporarily unavailable - circuit breaker open", http.StatusServiceUnavailable)
 	}
+	return nil
 }
 
 func (h *CerebrasProxyHandler) SetTarget(targetURL *url.URL) {
@@ -2,16 +2,21 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/cooldownp/cooldown-proxy/internal/circuitbreaker"
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
 	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 	"github.com/cooldownp/cooldown-proxy/internal/token"
 	"github.com/stretchr/testify/assert"
@@ -118,6 +123,51 @@ func TestCerebrasProxyHandler_EstimateTokens(t *testing.T) {
 	}
 }
 
+func TestCerebrasProxyRejectsOversizedBody(t *testing.T) {
+	forwarded := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+	mockURL, _ := url.Parse(mockServer.URL)
+
+	cerebrasConfig := &config.CerebrasLimits{RPMLimit: 60, TPMLimit: 100000}
+	limiter := ratelimit.NewCerebrasLimiter(cerebrasConfig.RPMLimit, cerebrasConfig.TPMLimit)
+	handler := NewCerebrasProxyHandler(limiter, token.NewTokenEstimator(), cerebrasConfig)
+	handler.SetTarget(mockURL)
+	handler.SetMaxBodyBytes(16)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "llama3.1-8b"}`))
+	req.Host = "api.cerebras.ai"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, 0, forwarded)
+	requests, _, _ := limiter.Usage()
+	assert.Equal(t, 0, requests)
+}
+
+func TestCerebrasProxyEstimateKeepsBodyOnReadError(t *testing.T) {
+	cerebrasConfig := &config.CerebrasLimits{RPMLimit: 60, TPMLimit: 100000}
+	limiter := ratelimit.NewCerebrasLimiter(cerebrasConfig.RPMLimit, cerebrasConfig.TPMLimit)
+	handler := NewCerebrasProxyHandler(limiter, token.NewTokenEstimator(), cerebrasConfig)
+
+	readErr := errors.New("connection reset")
+	body := io.MultiReader(strings.NewReader(`{"model": `), iotest.ErrReader(readErr))
+	req := httptest.NewRequest("POST", "/v1/chat/completions", body)
+
+	_, err := handler.EstimateTokens(req)
+	assert.True(t, errors.Is(err, readErr))
+
+	// The upstream request reads what was read for the estimate, then the
+	// same error, instead of an empty body
+	forwarded, err := io.ReadAll(req.Body)
+	assert.Equal(t, `{"model": `, string(forwarded))
+	assert.Equal(t, readErr, err)
+}
+
 func TestCerebrasProxyHandler_CheckRateLimit(t *testing.T) {
 	cerebrasConfig := &config.CerebrasLimits{
 		RPMLimit:       1, // Very low limit for testing
@@ -268,3 +318,158 @@ func TestCerebrasProxyHeaderParsingErrors(t *testing.T) {
 	// Current TPM limit should be 0 since header parsing failed
 	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Current-TPM-Limit"))
 }
+
+func TestCerebrasProxyQueuesOverLimitRequests(t *testing.T) {
+	var forwarded int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+	mockURL, _ := url.Parse(mockServer.URL)
+
+	cerebrasConfig := &config.CerebrasLimits{
+		RPMLimit:       1,
+		TPMLimit:       100000,
+		MaxQueueDepth:  1,
+		RequestTimeout: time.Minute,
+	}
+	limiter := ratelimit.NewCerebrasLimiter(cerebrasConfig.RPMLimit, cerebrasConfig.TPMLimit)
+	handler := NewCerebrasProxyHandler(limiter, token.NewTokenEstimator(), cerebrasConfig)
+	handler.SetTarget(mockURL)
+
+	send := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "llama3.1-8b"}`)).WithContext(ctx)
+		req.Host = "api.cerebras.ai"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send(context.Background()).Code)
+
+	// The next request waits in the queue and is dropped when its client
+	// gives up, without being sent upstream
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- send(ctx) }()
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 1 }, time.Second, time.Millisecond)
+
+	// With the queue full, further requests are refused at once
+	w := send(context.Background())
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "queue_full", w.Header().Get("X-RateLimit-Reason"))
+
+	cancel()
+	assert.Equal(t, proxyerrors.StatusClientClosedRequest, (<-done).Code)
+	assert.Equal(t, 0, limiter.QueueLength())
+	assert.Equal(t, 1, forwarded)
+	requests, _, _ := limiter.Usage()
+	assert.Equal(t, 1, requests, "requests that were not sent must not take capacity")
+}
+
+func TestCerebrasProxyReconcilesReportedUsage(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"))
+		w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":20,\"completion_tokens\":5,\"total_tokens\":25}}\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer mockServer.Close()
+	mockURL, _ := url.Parse(mockServer.URL)
+
+	cerebrasConfig := &config.CerebrasLimits{RPMLimit: 60, TPMLimit: 100000}
+	limiter := ratelimit.NewCerebrasLimiter(cerebrasConfig.RPMLimit, cerebrasConfig.TPMLimit)
+	handler := NewCerebrasProxyHandler(limiter, token.NewTokenEstimator(), cerebrasConfig)
+	handler.SetTarget(mockURL)
+
+	body := `{"model": "llama3.1-8b", "stream": true, "max_tokens": 4000, "messages": [{"role": "user", "content": "hi"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Host = "api.cerebras.ai"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "[DONE]")
+	_, tokens, _ := limiter.Usage()
+	assert.Equal(t, 25, tokens, "the request must be charged the tokens it used, not the max_tokens estimate")
+}
+
+func TestCerebrasProxyPeersShareLimits(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+	mockURL, _ := url.Parse(mockServer.URL)
+
+	// Two instances share a cluster-wide limit of 4 requests a minute, and
+	// serve their leases to each other on their own servers
+	handlers := make([]*CerebrasProxyHandler, 2)
+	servers := make([]*httptest.Server, 2)
+	for i := range servers {
+		i := i
+		mux := http.NewServeMux()
+		mux.HandleFunc(ratelimit.PeerLeasePath, func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].Coordinator().ServeHTTP(w, r)
+		})
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		})
+		servers[i] = httptest.NewServer(mux)
+		defer servers[i].Close()
+	}
+	for i := range handlers {
+		cerebrasConfig := &config.CerebrasLimits{
+			RPMLimit: 4,
+			TPMLimit: 100000,
+			Peers: &config.PeerConfig{
+				Self:     servers[i].URL,
+				Peers:    []string{servers[1-i].URL},
+				Interval: 10 * time.Millisecond,
+				LeaseTTL: time.Second,
+				Secret:   "shared",
+			},
+		}
+		limiter := ratelimit.NewCerebrasLimiter(cerebrasConfig.RPMLimit, cerebrasConfig.TPMLimit)
+		handlers[i] = NewCerebrasProxyHandler(limiter, token.NewTokenEstimator(), cerebrasConfig)
+		handlers[i].SetTarget(mockURL)
+	}
+	for _, handler := range handlers {
+		handler.Coordinator().Start()
+		defer handler.Coordinator().Stop()
+	}
+
+	send := func(server *httptest.Server, timeout time.Duration) *http.Response {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "POST", server.URL+"/v1/chat/completions", strings.NewReader(`{"model": "llama3.1-8b"}`))
+		req.Host = "api.cerebras.ai"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Each instance holds half the limit, and says so
+	for _, server := range servers {
+		for i := 0; i < 2; i++ {
+			resp := send(server, time.Second)
+			if assert.NotNil(t, resp) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Limit-RPM"))
+			}
+		}
+	}
+
+	// With the cluster limit used up, neither instance sends more
+	for i, server := range servers {
+		assert.Nil(t, send(server, 50*time.Millisecond), "instance %d went over the shared limit", i)
+	}
+	total := 0
+	for _, handler := range handlers {
+		total += handler.Limiter.RPMLimit()
+	}
+	assert.LessOrEqual(t, total, 4)
+}
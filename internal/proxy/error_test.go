@@ -207,6 +207,21 @@ func TestCustomErrorTypes(t *testing.T) {
 			errorType:      proxyerrors.ErrorTypeInternal,
 			expectedStatus: http.StatusInternalServerError,
 		},
+		{
+			name:           "request too large",
+			errorType:      proxyerrors.ErrorTypeRequestTooLarge,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "request cancelled",
+			errorType:      proxyerrors.ErrorTypeRequestCancelled,
+			expectedStatus: proxyerrors.StatusClientClosedRequest,
+		},
+		{
+			name:           "rate limit timeout",
+			errorType:      proxyerrors.ErrorTypeRateLimitTimeout,
+			expectedStatus: http.StatusGatewayTimeout,
+		},
 	}
 
 	for _, tt := range tests {
@@ -16,16 +16,26 @@ import (
 	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
 )
 
+// limitedRequestKey holds the request as rate limited, before its target
+// was applied, so responses adapt the same bucket
+type limitedRequestKey struct{}
+
 type Handler struct {
-	reverseProxy *httputil.ReverseProxy
-	rateLimiter  *ratelimit.Limiter
-	logger       *log.Logger
-	targetURL    *url.URL
+	reverseProxy  *httputil.ReverseProxy
+	rateLimiter   *ratelimit.Limiter
+	clientLimiter *ratelimit.ClientLimiter
+	cerebras      *CerebrasProxyHandler // nil without the Cerebras queue
+	logger        *log.Logger
+	targetURL     *url.URL
 }
 
 func NewHandler(rateLimiter *ratelimit.Limiter) *Handler {
 	return &Handler{
-		reverseProxy: &httputil.ReverseProxy{},
+		reverseProxy: &httputil.ReverseProxy{
+			// Forward to the request URL as-is until a target is set, so
+			// requests already rewritten by model routing reach their upstream
+			Director: func(req *http.Request) {},
+		},
 		rateLimiter:  rateLimiter,
 		logger:       log.New(log.Writer(), "[proxy] ", log.LstdFlags),
 	}
@@ -47,9 +57,27 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Requests for Cerebras hosts then wait in its queue for RPM/TPM
+	// capacity, which the upstream timeout does not cover
+	if h.cerebras != nil && h.cerebras.IsCerebrasRequest(r) {
+		forward := func(w http.ResponseWriter, r *http.Request) {
+			h.forward(&responseWriter{ResponseWriter: w}, r)
+		}
+		if err := h.cerebras.admit(rw, r, forward); err != nil {
+			h.handleError(rw, r, err)
+		}
+		return
+	}
+
+	h.forward(rw, r)
+}
+
+// forward sends the request upstream once it has been admitted
+func (h *Handler) forward(rw *responseWriter, r *http.Request) {
 	// Apply timeout
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
+	ctx = context.WithValue(ctx, limitedRequestKey{}, r)
 	r = r.WithContext(ctx)
 
 	// Set target if configured
@@ -61,22 +89,44 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.serveProxyWithRetry(rw, r)
 }
 
+// SetClientLimiter adds per-client limits, applied before the per-domain
+// ones so a client over its budget does not hold domain slots while waiting
+func (h *Handler) SetClientLimiter(limiter *ratelimit.ClientLimiter) {
+	h.clientLimiter = limiter
+}
+
+// SetCerebras queues requests for Cerebras hosts for the RPM/TPM capacity
+// of the handler's limiter, after the client and domain limits
+func (h *Handler) SetCerebras(cerebras *CerebrasProxyHandler) {
+	h.cerebras = cerebras
+}
+
 func (h *Handler) applyRateLimiting(r *http.Request) error {
+	ctx := r.Context()
+
+	if h.clientLimiter != nil {
+		reservation := h.clientLimiter.Reserve(r)
+		if err := reservation.Wait(ctx); err != nil {
+			return proxyerrors.NewRateLimitWaitError(r.Host, err)
+		}
+		if delay := reservation.Delay(); delay > 0 {
+			h.logger.Printf("Client rate limited request to %s, delayed by %v", r.Host, delay)
+		}
+	}
+
 	if h.rateLimiter == nil {
 		return nil
 	}
 
-	delay := h.rateLimiter.GetDelay(r.Host)
-	if delay > 0 {
-		// Check if the delay would exceed our timeout context
-		ctx := r.Context()
-		select {
-		case <-ctx.Done():
-			return proxyerrors.NewUpstreamTimeoutError(r.Host, ctx.Err())
-		case <-time.After(delay):
-			// Rate limit delay applied, continue
-			h.logger.Printf("Rate limited request to %s, delayed by %v", r.Host, delay)
-		}
+	// Waiting ends early if the client goes away, giving the slot to the
+	// next request rather than leaving a gap
+	reservation := h.rateLimiter.ReserveRequest(r)
+	if err := reservation.Wait(ctx); err != nil {
+		return proxyerrors.NewRateLimitWaitError(r.Host, err)
+	}
+	if delay := reservation.Delay(); delay > 0 {
+		// Rate limit delay applied, continue
+		h.logger.Printf("Rate limited request to %s, delayed by %v", r.Host, delay)
 	}
 
 	return nil
@@ -108,7 +158,10 @@ func (h *Handler) serveProxyWithRetry(w *responseWriter, r *http.Request) {
 
 		// Determine error type and create appropriate error
 		var proxyErr *proxyerrors.ProxyError
-		if netErr, ok := err.(net.Error); ok {
+		if errors.As(err, &proxyErr) {
+			// Reading the request body failed with its own status, e.g. 413
+			// once the body passes the size limit while streaming upstream
+		} else if netErr, ok := err.(net.Error); ok {
 			if netErr.Timeout() {
 				proxyErr = proxyerrors.NewUpstreamTimeoutError(req.Host, err)
 			} else if netErr.Temporary() {
@@ -128,6 +181,19 @@ func (h *Handler) serveProxyWithRetry(w *responseWriter, r *http.Request) {
 		// Log response status
 		h.logger.Printf("Upstream response: %d %s for %s", resp.StatusCode, resp.Status, resp.Request.URL.Path)
 
+		// Back off on 429s and follow the quota the upstream reports, in the
+		// bucket the request was limited by
+		if h.rateLimiter != nil {
+			limited, ok := resp.Request.Context().Value(limitedRequestKey{}).(*http.Request)
+			if !ok {
+				limited = resp.Request
+			}
+			h.rateLimiter.Observe(limited, resp.StatusCode, resp.Header)
+		}
+		if h.cerebras != nil && admitted(resp.Request) {
+			h.cerebras.modifyResponse(resp)
+		}
+
 		// Handle specific error status codes
 		if resp.StatusCode >= 500 {
 			// Server error from upstream
@@ -174,8 +240,7 @@ func (h *Handler) SetTarget(targetURL *url.URL) {
 func (h *Handler) setTargetRequest(r *http.Request, targetURL *url.URL) {
 	// Update the director to use the specific target
 	h.reverseProxy.Director = func(req *http.Request) {
-		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
+		JoinTargetURL(req.URL, targetURL)
 		req.Host = targetURL.Host
 
 		// Set X-Forwarded headers
@@ -1,11 +1,17 @@
 package proxy
 
 import (
+	"context"
 	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/cooldownp/cooldown-proxy/internal/proxyerrors"
 	"github.com/cooldownp/cooldown-proxy/internal/ratelimit"
+	"github.com/cooldownp/cooldown-proxy/internal/token"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -84,3 +90,166 @@ func TestProxyHandlerWithRateLimit(t *testing.T) {
 		t.Logf("Rate limiting may not be working as expected: first=%v, second=%v", firstDuration, secondDuration)
 	}
 }
+
+func TestProxyHandlerClientRateLimit(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+	targetURL, _ := url.Parse(targetServer.URL)
+
+	limiter := ratelimit.New([]config.RateLimitRule{
+		{Domain: "api.example.com", RequestsPerSecond: 100},
+	})
+	handler := NewHandler(limiter)
+	handler.SetTarget(targetURL)
+	handler.SetClientLimiter(ratelimit.NewClientLimiter(&config.ClientRateLimits{
+		Default: &config.RateLimitRule{Requests: 1, Period: "minute"},
+	}))
+
+	var body string
+	sendCtx := func(ctx context.Context, key string) int {
+		req := httptest.NewRequest("GET", "http://api.example.com/test", nil).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		body = w.Body.String()
+		return w.Code
+	}
+	send := func(key string, timeout time.Duration) int {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return sendCtx(ctx, key)
+	}
+
+	if code := send("noisy", time.Second); code != http.StatusOK {
+		t.Fatalf("Expected first request to pass, got %d", code)
+	}
+
+	// The noisy client waits on its own budget until its deadline...
+	if code := send("noisy", 50*time.Millisecond); code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the noisy client to time out waiting, got %d", code)
+	}
+	// ...which is reported as a rate limit wait, not as an upstream timeout
+	if !strings.Contains(body, "Timed out waiting for rate limit") || strings.Contains(body, "Upstream") {
+		t.Errorf("Expected a rate limit timeout error, got %s", body)
+	}
+
+	// A client that goes away while waiting is reported as cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if code := sendCtx(ctx, "noisy"); code != proxyerrors.StatusClientClosedRequest {
+		t.Errorf("Expected the cancelled client to get %d, got %d", proxyerrors.StatusClientClosedRequest, code)
+	}
+	if !strings.Contains(body, "Request cancelled while rate limited") {
+		t.Errorf("Expected a rate limit cancellation error, got %s", body)
+	}
+
+	// ...without having taken a domain slot, so others are unaffected
+	if code := send("quiet", time.Second); code != http.StatusOK {
+		t.Errorf("Expected another client to pass, got %d", code)
+	}
+	if metrics := limiter.GetMetrics("api.example.com"); metrics.TotalRequests != 2 {
+		t.Errorf("Expected 2 requests against the domain limit, got %d", metrics.TotalRequests)
+	}
+}
+
+func TestProxyHandlerBacksOffOn429(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer targetServer.Close()
+	targetURL, _ := url.Parse(targetServer.URL)
+
+	limiter := ratelimit.New([]config.RateLimitRule{
+		{Domain: "api.example.com", RequestsPerSecond: 100},
+	})
+	handler := NewHandler(limiter)
+	handler.SetTarget(targetURL)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/test", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the 429 to be passed on, got %d", w.Code)
+	}
+
+	if delay := limiter.PeekDelay("api.example.com"); delay < 29*time.Second {
+		t.Errorf("Expected the domain to be paused for Retry-After, got %v", delay)
+	}
+	if metrics := limiter.GetMetrics("api.example.com"); metrics.Throttled != 1 || metrics.RateFactor != 0.5 {
+		t.Errorf("Expected the 429 in the domain's metrics, got %+v", metrics)
+	}
+}
+
+func TestProxyHandlerLimitsRoutedCerebrasRequests(t *testing.T) {
+	var forwarded int32
+	cerebrasServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer cerebrasServer.Close()
+
+	limiter := ratelimit.New([]config.RateLimitRule{
+		{Domain: "api.cerebras.ai", Requests: 2, Period: "minute"},
+	})
+	handler := NewHandler(limiter)
+	handler.SetClientLimiter(ratelimit.NewClientLimiter(&config.ClientRateLimits{
+		Default: &config.RateLimitRule{Requests: 1, Period: "minute"},
+	}))
+	cerebrasLimits := &config.CerebrasLimits{RPMLimit: 60, TPMLimit: 100000}
+	cerebrasLimiter := ratelimit.NewCerebrasLimiter(cerebrasLimits.RPMLimit, cerebrasLimits.TPMLimit)
+	handler.SetCerebras(NewCerebrasProxyHandler(cerebrasLimiter, token.NewTokenEstimator(), cerebrasLimits))
+
+	// Model routing leaves requests addressed to the Cerebras API itself,
+	// so dial the test server in its place
+	transport := cerebrasServer.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, cerebrasServer.Listener.Addr().String())
+	}
+	handler.reverseProxy.Transport = transport
+
+	var header http.Header
+	send := func(key string, timeout time.Duration) int {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req := httptest.NewRequest("POST", "https://api.cerebras.ai/v1/chat/completions",
+			strings.NewReader(`{"model": "llama3.1-8b"}`)).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		header = w.Header()
+		return w.Code
+	}
+
+	if code := send("first", time.Second); code != http.StatusOK {
+		t.Fatalf("Expected first request to pass, got %d", code)
+	}
+	if header.Get("X-RateLimit-Limit-RPM") != "60" {
+		t.Errorf("Expected the request to go through the Cerebras queue, got headers %v", header)
+	}
+
+	// The client limit holds a client over its budget...
+	if code := send("first", 50*time.Millisecond); code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the client limit to hold the request, got %d", code)
+	}
+
+	// ...and the domain limit holds everyone once its slots are used
+	if code := send("second", time.Second); code != http.StatusOK {
+		t.Errorf("Expected another client to pass, got %d", code)
+	}
+	if code := send("third", 50*time.Millisecond); code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the domain limit to hold the request, got %d", code)
+	}
+
+	if metrics := limiter.GetMetrics("api.cerebras.ai"); metrics.TotalRequests != 2 {
+		t.Errorf("Expected 2 requests against the domain limit, got %d", metrics.TotalRequests)
+	}
+	if requests, _, _ := cerebrasLimiter.Usage(); requests != 2 {
+		t.Errorf("Expected only the 2 admitted requests in the Cerebras queue, got %d", requests)
+	}
+	if n := atomic.LoadInt32(&forwarded); n != 2 {
+		t.Errorf("Expected 2 requests forwarded, got %d", n)
+	}
+}
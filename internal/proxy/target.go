@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+)
+
+// JoinTargetURL points u at target, keeping target's base path and query.
+// The request path is appended to the base path unless it already starts
+// with it, so both /chat/completions and /v1/chat/completions reach
+// https://api.openai.com/v1/chat/completions. Target query parameters are
+// prepended to the request's own, as httputil.NewSingleHostReverseProxy does.
+func JoinTargetURL(u *url.URL, target *url.URL) {
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path, u.RawPath = joinTargetPath(target, u)
+
+	switch {
+	case target.RawQuery == "":
+	case u.RawQuery == "":
+		u.RawQuery = target.RawQuery
+	default:
+		u.RawQuery = target.RawQuery + "&" + u.RawQuery
+	}
+}
+
+func joinTargetPath(target, u *url.URL) (string, string) {
+	base := strings.TrimSuffix(target.Path, "/")
+	if base == "" || hasPathPrefix(u.Path, base) {
+		return u.Path, u.RawPath
+	}
+
+	path := u.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if u.RawPath == "" && target.RawPath == "" {
+		return base + path, ""
+	}
+
+	// Keep escaping from either side intact
+	rawBase := strings.TrimSuffix(target.EscapedPath(), "/")
+	rawPath := u.EscapedPath()
+	if !strings.HasPrefix(rawPath, "/") {
+		rawPath = "/" + rawPath
+	}
+	return base + path, rawBase + rawPath
+}
+
+// hasPathPrefix reports whether path starts with prefix at a segment boundary
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
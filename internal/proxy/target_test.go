@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestJoinTargetURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		request     string
+		wantURL     string
+		wantRawPath string
+	}{
+		{"host only target keeps path", "https://api.openai.com", "/v1/chat/completions", "https://api.openai.com/v1/chat/completions", ""},
+		{"base path is prepended", "https://api.cerebras.ai/v1", "/chat/completions", "https://api.cerebras.ai/v1/chat/completions", ""},
+		{"base path already present", "https://api.cerebras.ai/v1", "/v1/chat/completions", "https://api.cerebras.ai/v1/chat/completions", ""},
+		{"trailing slash on target", "https://api.cerebras.ai/v1/", "/chat/completions", "https://api.cerebras.ai/v1/chat/completions", ""},
+		{"prefix only matches whole segments", "https://api.example.com/v1", "/v10/models", "https://api.example.com/v1/v10/models", ""},
+		{"nested base path", "https://open.bigmodel.cn/api/paas/v4", "/chat/completions", "https://open.bigmodel.cn/api/paas/v4/chat/completions", ""},
+		{"request query kept", "https://api.cerebras.ai/v1", "/models?limit=5", "https://api.cerebras.ai/v1/models?limit=5", ""},
+		{"target query prepended", "https://res.openai.azure.com/openai?api-version=2024-06-01", "/chat/completions?x=1", "https://res.openai.azure.com/openai/chat/completions?api-version=2024-06-01&x=1", ""},
+		{"target query alone", "https://res.openai.azure.com/openai?api-version=2024-06-01", "/chat/completions", "https://res.openai.azure.com/openai/chat/completions?api-version=2024-06-01", ""},
+		{"escaped request path preserved", "https://bedrock.example.com/runtime", "/model/a%2Fb/invoke", "https://bedrock.example.com/runtime/model/a%2Fb/invoke", "/runtime/model/a%2Fb/invoke"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatalf("Invalid target: %v", err)
+			}
+			u, err := url.Parse("http://proxy.local" + tt.request)
+			if err != nil {
+				t.Fatalf("Invalid request URL: %v", err)
+			}
+
+			JoinTargetURL(u, target)
+
+			if u.String() != tt.wantURL {
+				t.Errorf("Expected %s, got %s", tt.wantURL, u.String())
+			}
+			if u.RawPath != tt.wantRawPath {
+				t.Errorf("Expected raw path %q, got %q", tt.wantRawPath, u.RawPath)
+			}
+		})
+	}
+}
+
+func TestProxyHandlerPreservesTargetBasePath(t *testing.T) {
+	var gotPath, gotQuery string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotQuery = r.URL.RawQuery
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	targetURL, _ := url.Parse(targetServer.URL + "/v1?key=abc")
+	handler := NewHandler(nil)
+	handler.SetTarget(targetURL)
+
+	req := httptest.NewRequest("POST", "http://example.com/chat/completions?stream=true", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if gotPath != "/v1/chat/completions" {
+		t.Errorf("Expected path /v1/chat/completions, got %s", gotPath)
+	}
+	if gotQuery != "key=abc&stream=true" {
+		t.Errorf("Expected query key=abc&stream=true, got %s", gotQuery)
+	}
+}
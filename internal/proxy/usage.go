@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// maxUsageBody is the most of a response usageReader buffers to find its
+// usage; past it the request keeps its estimate
+const maxUsageBody = 1 << 20
+
+// usageReader passes a response body through while looking for the token
+// usage the upstream reports: in the JSON body, or for a stream in the
+// data: line of the chunk that carries it, usually the last. Once the body
+// has been read to the end it calls report with the tokens used, if any
+// were reported. A body closed early reports nothing.
+type usageReader struct {
+	io.ReadCloser
+	stream bool
+	report func(tokens int)
+
+	buf      []byte // the body so far, or the unfinished line of a stream
+	overflow bool
+	tokens   int // the last usage seen, -1 for none
+	done     bool
+}
+
+func newUsageReader(body io.ReadCloser, stream bool, report func(tokens int)) *usageReader {
+	return &usageReader{ReadCloser: body, stream: stream, report: report, tokens: -1}
+}
+
+func (r *usageReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.scan(p[:n])
+	if err == io.EOF {
+		r.finish()
+	}
+	return n, err
+}
+
+// scan buffers data, handling each complete line of a stream as it arrives
+func (r *usageReader) scan(data []byte) {
+	if r.overflow || len(data) == 0 {
+		return
+	}
+	r.buf = append(r.buf, data...)
+	if r.stream {
+		for {
+			i := bytes.IndexByte(r.buf, '\n')
+			if i < 0 {
+				break
+			}
+			r.line(r.buf[:i])
+			r.buf = r.buf[i+1:]
+		}
+	}
+	if len(r.buf) > maxUsageBody {
+		r.buf, r.overflow = nil, true
+	}
+}
+
+// line picks the usage out of an SSE data: line
+func (r *usageReader) line(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok || !bytes.Contains(data, []byte(`"usage"`)) {
+		return
+	}
+	if tokens, ok := parseUsage(data); ok {
+		r.tokens = tokens
+	}
+}
+
+func (r *usageReader) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	if !r.overflow {
+		if r.stream {
+			r.line(r.buf)
+		} else if tokens, ok := parseUsage(r.buf); ok {
+			r.tokens = tokens
+		}
+	}
+	r.buf = nil
+	if r.tokens >= 0 {
+		r.report(r.tokens)
+	}
+}
+
+// parseUsage returns the total tokens of the usage object in a response or
+// stream chunk, in the OpenAI or Anthropic format
+func parseUsage(data []byte) (int, bool) {
+	var body struct {
+		Usage *struct {
+			TotalTokens      int `json:"total_tokens"`
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			InputTokens      int `json:"input_tokens"`
+			OutputTokens     int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &body); err != nil || body.Usage == nil {
+		return 0, false
+	}
+	u := body.Usage
+	switch {
+	case u.TotalTokens > 0:
+		return u.TotalTokens, true
+	case u.PromptTokens > 0 || u.CompletionTokens > 0:
+		return u.PromptTokens + u.CompletionTokens, true
+	default:
+		return u.InputTokens + u.OutputTokens, true
+	}
+}
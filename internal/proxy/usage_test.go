@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readUsage(t *testing.T, body string, stream bool) []int {
+	var reported []int
+	// Read a byte at a time so lines and JSON arrive split across reads
+	r := newUsageReader(io.NopCloser(strings.NewReader(body)), stream, func(tokens int) {
+		reported = append(reported, tokens)
+	})
+	data, err := io.ReadAll(iotest.OneByteReader(r))
+	require.NoError(t, err)
+	assert.Equal(t, body, string(data), "the body must pass through unchanged")
+	return reported
+}
+
+func TestUsageReaderJSON(t *testing.T) {
+	body := `{"id":"1","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":80,"total_tokens":200}}`
+	assert.Equal(t, []int{200}, readUsage(t, body, false))
+
+	body = `{"type":"message","usage":{"input_tokens":30,"output_tokens":12}}`
+	assert.Equal(t, []int{42}, readUsage(t, body, false))
+
+	assert.Empty(t, readUsage(t, `{"choices":[]}`, false))
+	assert.Empty(t, readUsage(t, `not json`, false))
+}
+
+func TestUsageReaderStream(t *testing.T) {
+	body := "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":50,\"completion_tokens\":7,\"total_tokens\":57}}\n\n" +
+		"data: [DONE]\n\n"
+	assert.Equal(t, []int{57}, readUsage(t, body, true))
+
+	// The last line need not end in a newline
+	assert.Equal(t, []int{9}, readUsage(t, `data: {"usage":{"total_tokens":9}}`, true))
+
+	assert.Empty(t, readUsage(t, "data: {\"choices\":[]}\n\ndata: [DONE]\n\n", true))
+}
+
+func TestUsageReaderClosedEarlyReportsNothing(t *testing.T) {
+	reported := false
+	body := `{"usage":{"total_tokens":200}}`
+	r := newUsageReader(io.NopCloser(strings.NewReader(body)), false, func(int) { reported = true })
+
+	buf := make([]byte, 10)
+	_, err := r.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.False(t, reported)
+}
@@ -1,10 +1,16 @@
 package proxyerrors
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 )
 
+// StatusClientClosedRequest is nginx's status for a request whose client
+// went away before the response. Go has no constant for it.
+const StatusClientClosedRequest = 499
+
 // ProxyError represents different types of proxy errors
 type ProxyError struct {
 	Type    ErrorType
@@ -22,6 +28,9 @@ const (
 	ErrorTypeInvalidRequest
 	ErrorTypeConfiguration
 	ErrorTypeInternal
+	ErrorTypeRequestTooLarge
+	ErrorTypeRequestCancelled
+	ErrorTypeRateLimitTimeout
 )
 
 func (e *ProxyError) Error() string {
@@ -50,6 +59,12 @@ func (e *ProxyError) HTTPStatus() int {
 		return http.StatusInternalServerError
 	case ErrorTypeInternal:
 		return http.StatusInternalServerError
+	case ErrorTypeRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrorTypeRequestCancelled:
+		return StatusClientClosedRequest
+	case ErrorTypeRateLimitTimeout:
+		return http.StatusGatewayTimeout
 	default:
 		return http.StatusInternalServerError
 	}
@@ -91,4 +106,24 @@ func NewConfigurationError(message string, cause error) *ProxyError {
 
 func NewInternalError(message string, cause error) *ProxyError {
 	return NewProxyError(ErrorTypeInternal, fmt.Sprintf("Internal server error: %s", message), cause)
-}
\ No newline at end of file
+}
+
+func NewRequestTooLargeError(limit int64) *ProxyError {
+	return NewProxyError(ErrorTypeRequestTooLarge, fmt.Sprintf("Request body exceeds %d bytes", limit), nil)
+}
+
+// NewRequestCancelledError is for a request whose client gave up while it
+// waited on a rate limit, before anything was sent upstream
+func NewRequestCancelledError(cause error) *ProxyError {
+	return NewProxyError(ErrorTypeRequestCancelled, "Request cancelled while rate limited", cause)
+}
+
+// NewRateLimitWaitError reports a rate limit wait on domain that ended with
+// cause, the context's error: cancelled if the client went away, a gateway
+// timeout if a deadline ran out first
+func NewRateLimitWaitError(domain string, cause error) *ProxyError {
+	if errors.Is(cause, context.Canceled) {
+		return NewRequestCancelledError(cause)
+	}
+	return NewProxyError(ErrorTypeRateLimitTimeout, fmt.Sprintf("Timed out waiting for rate limit: %s", domain), cause)
+}
@@ -6,12 +6,22 @@ import (
 	"time"
 )
 
+// DefaultAging is how long a request waits to gain one priority point
+const DefaultAging = time.Minute
+
+// quantum is the tokens a tenant of weight 1 may send per round
+const quantum = 1000
+
 type QueuedRequest struct {
 	ID        string
+	Tenant    string // the queue serves tenants in turn; "" is a tenant too
 	Tokens    int
 	Priority  float64
 	Timestamp time.Time
 	Timeout   time.Time
+
+	index int     // position in its tenant's heap, -1 once removed
+	rank  float64 // Priority aged from Timestamp, fixed at Enqueue
 }
 
 type priorityQueue []*QueuedRequest
@@ -20,17 +30,22 @@ func (pq priorityQueue) Len() int { return len(pq) }
 
 func (pq priorityQueue) Less(i, j int) bool {
 	// Higher priority first
-	if pq[i].Priority != pq[j].Priority {
-		return pq[i].Priority > pq[j].Priority
+	if pq[i].rank != pq[j].rank {
+		return pq[i].rank > pq[j].rank
 	}
 	// If same priority, earlier timestamp first
 	return pq[i].Timestamp.Before(pq[j].Timestamp)
 }
 
-func (pq priorityQueue) Swap(i, j int) { pq[i], pq[j] = pq[j], pq[i] }
+func (pq priorityQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
 
 func (pq *priorityQueue) Push(x interface{}) {
 	item := x.(*QueuedRequest)
+	item.index = len(*pq)
 	*pq = append(*pq, item)
 }
 
@@ -39,38 +54,93 @@ func (pq *priorityQueue) Pop() interface{} {
 	n := len(old)
 	item := old[n-1]
 	old[n-1] = nil
+	item.index = -1
 	*pq = old[0 : n-1]
 	return item
 }
 
+// tenantQueue is one tenant's waiting requests, highest priority first
+type tenantQueue struct {
+	name    string
+	pq      priorityQueue
+	deficit int // tokens the tenant may still send this round
+
+	dequeued  int64
+	dropped   int64
+	totalWait time.Duration
+}
+
+// TenantStats is a tenant's use of the queue
+type TenantStats struct {
+	Weight      int           `json:"weight"`
+	Queued      int           `json:"queued"`
+	Dequeued    int64         `json:"dequeued"`
+	Dropped     int64         `json:"dropped"` // removed or expired before their turn
+	AverageWait time.Duration `json:"average_wait"`
+	OldestWait  time.Duration `json:"oldest_wait"` // of the requests still queued
+}
+
+// PriorityQueue holds a sub-queue per tenant and serves them by deficit
+// round-robin: each tenant with waiting requests in turn may send its
+// weight in quanta of tokens, so one tenant's batch cannot starve the rest.
+// Within a tenant, requests go by priority, which grows with their wait so
+// large low-priority requests are served eventually.
 type PriorityQueue struct {
-	pq       priorityQueue
+	tenants  map[string]*tenantQueue
+	active   []*tenantQueue // tenants with waiting requests, in serving order
+	next     int            // index in active of the tenant being served
+	topped   bool           // whether it got its quantum this turn
+	size     int
+	weights  map[string]int
+	aging    time.Duration
+	epoch    time.Time
 	mu       sync.RWMutex
 	maxDepth int
 	timeout  time.Duration
 }
 
 func NewPriorityQueue(maxDepth int, timeout time.Duration) *PriorityQueue {
-	pq := &PriorityQueue{
-		pq:       make(priorityQueue, 0),
+	return &PriorityQueue{
+		tenants:  make(map[string]*tenantQueue),
+		aging:    DefaultAging,
+		epoch:    time.Now(),
 		maxDepth: maxDepth,
 		timeout:  timeout,
 	}
-	heap.Init(&pq.pq)
-	return pq
+}
+
+// SetWeights sets the share of each tenant by name. Tenants not listed
+// have weight 1.
+func (pq *PriorityQueue) SetWeights(weights map[string]int) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.weights = weights
+}
+
+// SetAging sets how long a request waits to gain one priority point; 0
+// turns aging off. It applies to requests enqueued from then on.
+func (pq *PriorityQueue) SetAging(aging time.Duration) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.aging = aging
 }
 
 func (pq *PriorityQueue) Len() int {
 	pq.mu.RLock()
 	defer pq.mu.RUnlock()
-	return len(pq.pq)
+	return pq.size
+}
+
+// MaxDepth is the most requests the queue holds
+func (pq *PriorityQueue) MaxDepth() int {
+	return pq.maxDepth
 }
 
 func (pq *PriorityQueue) Enqueue(req *QueuedRequest) bool {
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
 
-	if len(pq.pq) >= pq.maxDepth {
+	if pq.size >= pq.maxDepth {
 		return false // Queue full
 	}
 
@@ -78,32 +148,185 @@ func (pq *PriorityQueue) Enqueue(req *QueuedRequest) bool {
 		req.Timeout = time.Now().Add(pq.timeout)
 	}
 
-	heap.Push(&pq.pq, req)
+	// Aging adds the same to every waiting request's priority per unit of
+	// time, so ranking by priority less the time of arrival keeps the
+	// heap's order valid as they wait
+	req.rank = req.Priority
+	if pq.aging > 0 {
+		req.rank -= float64(req.Timestamp.Sub(pq.epoch)) / float64(pq.aging)
+	}
+
+	t, ok := pq.tenants[req.Tenant]
+	if !ok {
+		t = &tenantQueue{name: req.Tenant}
+		pq.tenants[req.Tenant] = t
+	}
+	if len(t.pq) == 0 {
+		pq.active = append(pq.active, t)
+	}
+	heap.Push(&t.pq, req)
+	pq.size++
 	return true
 }
 
 func (pq *PriorityQueue) Dequeue() *QueuedRequest {
+	return pq.DequeueIf(func(*QueuedRequest) bool { return true })
+}
+
+// DequeueIf removes and returns the request Dequeue would, if accept takes
+// it. Otherwise the queue is left as is and nil returned.
+func (pq *PriorityQueue) DequeueIf(accept func(*QueuedRequest) bool) *QueuedRequest {
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
 
-	if len(pq.pq) == 0 {
+	now := time.Now()
+	pq.dropExpired(now)
+	req := pq.head()
+	if req == nil || !accept(req) {
 		return nil
 	}
 
-	// Remove expired requests
+	t := pq.tenants[req.Tenant]
+	heap.Remove(&t.pq, req.index)
+	pq.size--
+	t.deficit -= cost(req)
+	t.dequeued++
+	t.totalWait += now.Sub(req.Timestamp)
+	if len(t.pq) == 0 {
+		pq.deactivate(t)
+	}
+	return req
+}
+
+// Peek returns the request Dequeue would return, without removing it
+func (pq *PriorityQueue) Peek() *QueuedRequest {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	pq.dropExpired(time.Now())
+	return pq.head()
+}
+
+// Remove takes req out of the queue, e.g. when its caller stopped waiting.
+// It reports whether req was still queued.
+func (pq *PriorityQueue) Remove(req *QueuedRequest) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	t, ok := pq.tenants[req.Tenant]
+	if !ok || req.index < 0 || req.index >= len(t.pq) || t.pq[req.index] != req {
+		return false
+	}
+	pq.drop(t, req.index)
+	return true
+}
+
+// TenantStats returns the queue use of every tenant seen so far
+func (pq *PriorityQueue) TenantStats() map[string]TenantStats {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+
 	now := time.Now()
-	for len(pq.pq) > 0 && pq.pq[0].Timeout.Before(now) {
-		heap.Pop(&pq.pq)
+	stats := make(map[string]TenantStats, len(pq.tenants))
+	for name, t := range pq.tenants {
+		s := TenantStats{
+			Weight:   pq.weight(name),
+			Queued:   len(t.pq),
+			Dequeued: t.dequeued,
+			Dropped:  t.dropped,
+		}
+		if t.dequeued > 0 {
+			s.AverageWait = t.totalWait / time.Duration(t.dequeued)
+		}
+		for _, req := range t.pq {
+			s.OldestWait = max(s.OldestWait, now.Sub(req.Timestamp))
+		}
+		stats[name] = s
 	}
+	return stats
+}
 
-	if len(pq.pq) == 0 {
-		return nil
+// head picks the next request by deficit round-robin: the tenant being
+// served gets its quantum once per turn and keeps the turn while its next
+// request fits its deficit. Callers must hold pq.mu.
+func (pq *PriorityQueue) head() *QueuedRequest {
+	for len(pq.active) > 0 {
+		t := pq.active[pq.next]
+		if !pq.topped {
+			t.deficit += pq.weight(t.name) * quantum
+			pq.topped = true
+		}
+		if req := t.pq[0]; cost(req) <= t.deficit {
+			return req
+		}
+		pq.next = (pq.next + 1) % len(pq.active)
+		pq.topped = false
 	}
+	return nil
+}
 
-	return heap.Pop(&pq.pq).(*QueuedRequest)
+// dropExpired removes the requests at the head of each tenant's queue
+// whose timeout has passed. Callers must hold pq.mu.
+func (pq *PriorityQueue) dropExpired(now time.Time) {
+	for _, t := range append([]*tenantQueue(nil), pq.active...) {
+		for len(t.pq) > 0 && t.pq[0].Timeout.Before(now) {
+			pq.drop(t, 0)
+		}
+	}
 }
 
-func (pq *PriorityQueue) CalculatePriority(tokens int, rpmUsage, tpmUsage float64) float64 {
+// drop removes the request at index i of t's queue unserved. Callers must
+// hold pq.mu.
+func (pq *PriorityQueue) drop(t *tenantQueue, i int) {
+	heap.Remove(&t.pq, i)
+	pq.size--
+	t.dropped++
+	if len(t.pq) == 0 {
+		pq.deactivate(t)
+	}
+}
+
+// deactivate takes a tenant whose queue emptied out of the rotation. Its
+// deficit is forfeit, as in DRR an idle tenant does not save up credit.
+// Callers must hold pq.mu.
+func (pq *PriorityQueue) deactivate(t *tenantQueue) {
+	t.deficit = 0
+	for i, active := range pq.active {
+		if active != t {
+			continue
+		}
+		pq.active = append(pq.active[:i], pq.active[i+1:]...)
+		switch {
+		case i < pq.next:
+			pq.next--
+		case i == pq.next:
+			pq.topped = false
+		}
+		if pq.next >= len(pq.active) {
+			pq.next = 0
+		}
+		return
+	}
+}
+
+// weight is a tenant's configured weight, at least 1. Callers must hold
+// pq.mu.
+func (pq *PriorityQueue) weight(tenant string) int {
+	if w := pq.weights[tenant]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// cost is what serving a request takes from its tenant's deficit
+func cost(req *QueuedRequest) int {
+	return max(req.Tokens, 1)
+}
+
+// CalculatePriority ranks a request by its size once usage of the RPM or
+// TPM limit passes 70%: small requests go first and large ones last, as
+// they hold up fewer others.
+func CalculatePriority(tokens int, rpmUsage, tpmUsage float64) float64 {
 	priorityFactor := max(rpmUsage, tpmUsage)
 
 	if priorityFactor > 0.7 {
@@ -119,9 +342,7 @@ func (pq *PriorityQueue) CalculatePriority(tokens int, rpmUsage, tpmUsage float6
 	return 1.0 // Normal mode
 }
 
-func max(a, b float64) float64 {
-	if a > b {
-		return a
-	}
-	return b
+// CalculatePriority is the package-level CalculatePriority
+func (pq *PriorityQueue) CalculatePriority(tokens int, rpmUsage, tpmUsage float64) float64 {
+	return CalculatePriority(tokens, rpmUsage, tpmUsage)
 }
@@ -66,3 +66,127 @@ func TestPriorityQueue_SmartPriorityCalculation(t *testing.T) {
 		t.Errorf("Large request should get priority penalty, got priority %f", priority)
 	}
 }
+
+func TestPriorityQueue_PeekAndRemove(t *testing.T) {
+	pq := NewPriorityQueue(10, 5*time.Minute)
+	now := time.Now()
+
+	low := &QueuedRequest{ID: "low", Priority: 0.5, Timestamp: now}
+	high := &QueuedRequest{ID: "high", Priority: 2.0, Timestamp: now}
+	normal := &QueuedRequest{ID: "normal", Priority: 1.0, Timestamp: now}
+	pq.Enqueue(low)
+	pq.Enqueue(high)
+	pq.Enqueue(normal)
+
+	if head := pq.Peek(); head != high {
+		t.Errorf("Expected to peek the highest priority request, got %v", head)
+	}
+	if pq.Len() != 3 {
+		t.Errorf("Expected Peek to leave the queue intact, got length %d", pq.Len())
+	}
+
+	if !pq.Remove(high) {
+		t.Error("Expected to remove a queued request")
+	}
+	if pq.Remove(high) {
+		t.Error("Expected removing a request twice to fail")
+	}
+	if !pq.Remove(low) {
+		t.Error("Expected to remove a request from the middle of the queue")
+	}
+
+	if dequeued := pq.Dequeue(); dequeued != normal {
+		t.Errorf("Expected the remaining request, got %v", dequeued)
+	}
+	if pq.Remove(normal) {
+		t.Error("Expected removing a dequeued request to fail")
+	}
+}
+
+func TestPriorityQueue_WeightedFairQueuing(t *testing.T) {
+	pq := NewPriorityQueue(100, 5*time.Minute)
+	pq.SetWeights(map[string]int{"batch": 3})
+	now := time.Now()
+
+	// The batch tenant queues first and more, but both get their share
+	for i := 0; i < 8; i++ {
+		pq.Enqueue(&QueuedRequest{ID: "batch", Tenant: "batch", Tokens: 1000, Priority: 1, Timestamp: now})
+	}
+	for i := 0; i < 8; i++ {
+		pq.Enqueue(&QueuedRequest{ID: "ide", Tenant: "ide", Tokens: 1000, Priority: 1, Timestamp: now})
+	}
+
+	var order string
+	for i := 0; i < 8; i++ {
+		order += pq.Dequeue().ID[:1]
+	}
+	if order != "bbbibbbi" {
+		t.Errorf("Expected 3 batch requests per ide request, got %s", order)
+	}
+
+	// Large requests wait until their tenant has saved up enough credit
+	pq = NewPriorityQueue(100, 5*time.Minute)
+	pq.Enqueue(&QueuedRequest{ID: "large", Tenant: "a", Tokens: 2500, Priority: 1, Timestamp: now})
+	for i := 0; i < 3; i++ {
+		pq.Enqueue(&QueuedRequest{ID: "small", Tenant: "b", Tokens: 1000, Priority: 1, Timestamp: now})
+	}
+	order = ""
+	for pq.Len() > 0 {
+		order += pq.Dequeue().ID[:1]
+	}
+	if order != "ssls" {
+		t.Errorf("Expected the large request in the third round, got %s", order)
+	}
+}
+
+func TestPriorityQueue_AgingPreventsStarvation(t *testing.T) {
+	now := time.Now()
+	enqueue := func(pq *PriorityQueue) {
+		pq.Enqueue(&QueuedRequest{ID: "large", Tokens: 6000, Priority: 0.5, Timestamp: now.Add(-2 * time.Second)})
+		pq.Enqueue(&QueuedRequest{ID: "small", Tokens: 500, Priority: 2.0, Timestamp: now})
+	}
+
+	pq := NewPriorityQueue(10, 5*time.Minute)
+	pq.SetAging(time.Second)
+	enqueue(pq)
+	if head := pq.Peek(); head.ID != "large" {
+		t.Errorf("Expected a request that waited long enough to overtake, got %s", head.ID)
+	}
+
+	pq = NewPriorityQueue(10, 5*time.Minute)
+	pq.SetAging(0)
+	enqueue(pq)
+	if head := pq.Peek(); head.ID != "small" {
+		t.Errorf("Expected priority alone to decide without aging, got %s", head.ID)
+	}
+}
+
+func TestPriorityQueue_TenantStats(t *testing.T) {
+	pq := NewPriorityQueue(10, 5*time.Minute)
+	pq.SetWeights(map[string]int{"a": 2})
+	now := time.Now()
+
+	served := &QueuedRequest{ID: "1", Tenant: "a", Tokens: 100, Priority: 1, Timestamp: now.Add(-3 * time.Second)}
+	gaveUp := &QueuedRequest{ID: "2", Tenant: "a", Tokens: 100, Priority: 1, Timestamp: now}
+	waiting := &QueuedRequest{ID: "3", Tenant: "b", Tokens: 100, Priority: 1, Timestamp: now.Add(-time.Second)}
+	pq.Enqueue(served)
+	pq.Enqueue(gaveUp)
+	pq.Enqueue(waiting)
+
+	if dequeued := pq.Dequeue(); dequeued != served {
+		t.Fatalf("Expected the oldest request of the first tenant, got %v", dequeued)
+	}
+	pq.Remove(gaveUp)
+
+	stats := pq.TenantStats()
+	a, b := stats["a"], stats["b"]
+	if a.Weight != 2 || a.Queued != 0 || a.Dequeued != 1 || a.Dropped != 1 {
+		t.Errorf("Unexpected stats for tenant a: %+v", a)
+	}
+	if a.AverageWait < 3*time.Second {
+		t.Errorf("Expected tenant a's average wait to be at least 3s, got %v", a.AverageWait)
+	}
+	if b.Weight != 1 || b.Queued != 1 || b.OldestWait < time.Second {
+		t.Errorf("Unexpected stats for tenant b: %+v", b)
+	}
+}
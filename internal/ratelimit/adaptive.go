@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+const (
+	// defaultBackoff holds a host after a 429 that says nothing about when
+	// to retry
+	defaultBackoff = time.Second
+	// minFactor is the lowest share of the configured rate a bucket backs
+	// off to
+	minFactor = 1.0 / 64
+	// recoveryStep is the share of the configured rate a backed-off bucket
+	// regains with each response that is not a 429
+	recoveryStep = 0.05
+)
+
+// detectSchemas are tried in order on a 429 from an upstream whose rule
+// names no schema, to find when the limit resets
+var detectSchemas = []string{"openai", "anthropic", "cerebras", "ietf"}
+
+// lowRemaining is the remaining request count below which requests are
+// spread over the rest of the window, when the upstream does not report its
+// limit. With a limit it is a tenth of that.
+const lowRemaining = 10
+
+// SetHeaderSchemas adds the schemas declared in rate_limit_headers, which
+// rules can name besides the built-in ones
+func (l *Limiter) SetHeaderSchemas(schemas map[string]config.HeaderSchema) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.schemas = schemas
+}
+
+// Observe adapts to the response the upstream sent to r. A 429 pauses the
+// host until Retry-After or the limit's reset and halves the rate of the
+// request's bucket; other responses win back the rate step by step. Rules
+// naming a header schema also follow the quota it reports: requests are
+// held until the reset of an exhausted limit and spaced out over the reset
+// when few remain.
+func (l *Limiter) Observe(r *http.Request, status int, headers http.Header) {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	now := time.Now()
+
+	var quota *Quota
+	if schema, ok := l.headerSchema(host, r.Method, r.URL.Path); ok {
+		quota, _ = ParseQuota(schema, headers, now)
+	}
+
+	if status == http.StatusTooManyRequests {
+		if quota == nil {
+			quota = detectQuota(headers, now)
+		}
+		hold := defaultBackoff
+		if quota != nil {
+			if d := quota.Hold(status); d > 0 {
+				hold = d
+			}
+		}
+		// Slow down first, so the pause is measured at the new rate
+		l.hostBucket(normalizeHost(host))
+		l.lookup(host, r.Method, r.URL.Path).backOff(now, hold)
+		l.Pause(host, hold)
+		return
+	}
+
+	if quota != nil {
+		if hold := quota.Hold(status); hold > 0 {
+			l.Pause(host, hold)
+		}
+	}
+	l.lookup(host, r.Method, r.URL.Path).recover(now)
+}
+
+// detectQuota reads the first known schema the headers carry, or just
+// Retry-After
+func detectQuota(headers http.Header, now time.Time) *Quota {
+	for _, name := range detectSchemas {
+		quota, err := ParseQuota(config.HeaderSchemas[name], headers, now)
+		if err == nil && (quota.RemainingRequests >= 0 || quota.RemainingTokens >= 0) {
+			return quota
+		}
+	}
+	quota, _ := ParseQuota(config.HeaderSchema{}, headers, now)
+	return quota
+}
+
+// headerSchema returns the schema named by the most specific rule matching
+// the request, or by the default rule
+func (l *Limiter) headerSchema(host, method, path string) (config.HeaderSchema, bool) {
+	name := l.defaultHeaders
+	host = normalizeHost(host)
+	for _, r := range l.rules {
+		if r.matches(host, method, path) {
+			name = r.headers
+			break
+		}
+	}
+	if name == "" {
+		return config.HeaderSchema{}, false
+	}
+
+	l.mu.RLock()
+	schema, ok := l.schemas[name]
+	l.mu.RUnlock()
+	if ok {
+		return schema, true
+	}
+	schema, ok = config.HeaderSchemas[name]
+	return schema, ok
+}
+
+// Hold is how long requests should wait given the quota: until the reset of
+// an exhausted limit, Retry-After on a 429, or the request reset spread over
+// the requests left when few remain
+func (q *Quota) Hold(status int) time.Duration {
+	var hold time.Duration
+	if status == http.StatusTooManyRequests {
+		hold = q.RetryAfter
+	}
+	if q.RemainingRequests == 0 {
+		hold = max(hold, q.ResetRequests)
+	}
+	if q.RemainingTokens == 0 {
+		hold = max(hold, q.ResetTokens)
+	}
+	if status == http.StatusTooManyRequests && hold == 0 {
+		// Refused without saying which limit: wait for the later reset
+		hold = max(q.ResetRequests, q.ResetTokens)
+	}
+
+	low := lowRemaining
+	if q.LimitRequests > 0 {
+		low = max(q.LimitRequests/10, 1)
+	}
+	if q.RemainingRequests > 0 && q.RemainingRequests < low {
+		hold = max(hold, q.ResetRequests/time.Duration(q.RemainingRequests+1))
+	}
+	return hold
+}
+
+// backOff halves the bucket's rate after a 429. The 429s of requests sent
+// before the pause until holdFor ends all stem from the same overload, so
+// they only count once.
+func (lb *LeakyBucket) backOff(now time.Time, holdFor time.Duration) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.throttled++
+	if now.Before(lb.backoffUntil) {
+		return
+	}
+	lb.backoffUntil = now.Add(holdFor)
+	lb.setFactor(max(lb.factor/2, minFactor))
+}
+
+// recover regains part of the configured rate once the pause after the last
+// 429 is over
+func (lb *LeakyBucket) recover(now time.Time) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.factor >= 1 || now.Before(lb.backoffUntil) {
+		return
+	}
+	lb.setFactor(min(lb.factor+recoveryStep, 1))
+}
+
+// setFactor scales every window's rate to factor of the configured one.
+// Callers must hold lb.mu.
+func (lb *LeakyBucket) setFactor(factor float64) {
+	lb.factor = factor
+	for _, w := range lb.windows {
+		w.interval = time.Duration(float64(w.base) / factor)
+	}
+}
@@ -0,0 +1,328 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/queue"
+)
+
+var (
+	// ErrQueueFull is returned by Acquire when max_queue_depth requests are
+	// already waiting
+	ErrQueueFull = errors.New("cerebras request queue is full")
+	// ErrQueueTimeout is returned by Acquire when a request waited
+	// request_timeout without being admitted
+	ErrQueueTimeout = errors.New("timed out waiting in the cerebras request queue")
+)
+
+// minDispatchWait keeps the dispatcher from spinning when capacity is
+// expected to free up any moment
+const minDispatchWait = 10 * time.Millisecond
+
+// Admission is a request's share of the RPM and TPM limits, taken when it
+// was admitted
+type Admission struct {
+	limiter      *CerebrasLimiter
+	tokens       int
+	request      *list.Element // in rpmWindow, nil once cancelled
+	usage        *list.Element // in tpmWindow
+	headerUpdate time.Time     // of the reported remaining tokens it was taken from, if any
+}
+
+// ticket is a queued request's place in line. ready is closed once the
+// dispatcher has admitted it.
+type ticket struct {
+	ready     chan struct{}
+	admission *Admission
+}
+
+// SetQueueLimits replaces the queue with one holding at most maxDepth
+// waiters for at most timeout each. It is meant to be called before the
+// limiter is used; requests already waiting keep their place in the old
+// queue until they give up.
+func (c *CerebrasLimiter) SetQueueLimits(maxDepth int, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queue = queue.NewPriorityQueue(maxDepth, timeout)
+	c.queue.SetWeights(c.tenantWeights)
+	c.queue.SetAging(c.aging)
+}
+
+// SetFairQueuing sets the weight of each tenant sharing the queue, by the
+// name Acquire is given, and how long a waiting request takes to gain one
+// priority point
+func (c *CerebrasLimiter) SetFairQueuing(weights map[string]int, aging time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tenantWeights = weights
+	c.aging = aging
+	c.queue.SetWeights(weights)
+	c.queue.SetAging(aging)
+}
+
+// TenantStats returns the queue depth and waiting times of each tenant
+func (c *CerebrasLimiter) TenantStats() map[string]queue.TenantStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.queue.TenantStats()
+}
+
+// Acquire admits a request of the given tokens from tenant against the RPM
+// and TPM limits, waiting in the queue until there is capacity for it. As
+// requests age out of the sliding windows, waiters are admitted tenant by
+// tenant in proportion to their weights, and by priority within a tenant;
+// one that does not fit holds back those behind it, so large requests are
+// not starved by small ones. A request that alone exceeds the TPM limit is
+// admitted into an empty window. Acquire fails with ErrQueueFull,
+// ErrQueueTimeout or the context's error, having taken no capacity.
+func (c *CerebrasLimiter) Acquire(ctx context.Context, requestID, tenant string, tokens int) (*Admission, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+
+	now := time.Now()
+	if c.queue.Len() == 0 && c.waitFor(tokens, now) == 0 {
+		admission := c.admit(tokens, now)
+		c.mu.Unlock()
+		return admission, nil
+	}
+
+	req := &queue.QueuedRequest{
+		ID:        requestID,
+		Tenant:    tenant,
+		Tokens:    tokens,
+		Priority:  c.priority(tokens, now),
+		Timestamp: now,
+	}
+	if !c.queue.Enqueue(req) {
+		c.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	t := &ticket{ready: make(chan struct{})}
+	c.waiters[req] = t
+	c.dispatch(now)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(req.Timeout))
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-t.ready:
+		return t.admission, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrQueueTimeout
+	}
+
+	c.mu.Lock()
+	select {
+	case <-t.ready:
+		// Admitted while giving up: hand the capacity back below
+	default:
+		c.queue.Remove(req)
+		delete(c.waiters, req)
+		// Whoever is now at the head may fit where this request did not
+		c.wakeDispatcher()
+	}
+	c.mu.Unlock()
+
+	if t.admission != nil {
+		t.admission.Cancel()
+	}
+	return nil, err
+}
+
+// Cancel returns the capacity of a request that was not sent after all,
+// e.g. because its client went away after it was admitted, and lets the
+// next waiter have it. It is a no-op when called again.
+func (a *Admission) Cancel() {
+	c := a.limiter
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if a.request == nil {
+		return
+	}
+	c.rpmWindow.elements.Remove(a.request)
+	c.tpmWindow.elements.Remove(a.usage)
+	if !a.headerUpdate.IsZero() && a.headerUpdate.Equal(c.lastHeaderUpdate) {
+		c.currentTPMRemaining += a.tokens
+	}
+	a.request, a.usage = nil, nil
+	c.wakeDispatcher()
+}
+
+// Reconcile charges the request the tokens the upstream reported it used in
+// place of the estimate it was admitted with. An overestimate frees the
+// difference for the next waiter at once; an underestimate holds more of the
+// window until the request ages out of it.
+func (a *Admission) Reconcile(tokens int) {
+	c := a.limiter
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if a.usage == nil || tokens < 0 {
+		return
+	}
+	// An element already pruned from the window is no longer counted, so
+	// updating it is harmless
+	a.usage.Value.(*windowElement).value = tokens
+	if !a.headerUpdate.IsZero() && a.headerUpdate.Equal(c.lastHeaderUpdate) {
+		c.currentTPMRemaining += a.tokens - tokens
+	}
+	a.tokens = tokens
+	c.wakeDispatcher()
+}
+
+// dispatch admits the waiters that fit now and makes sure the dispatcher
+// runs while any are left. Callers must hold c.mu.
+func (c *CerebrasLimiter) dispatch(now time.Time) {
+	c.admitQueued(now)
+	if c.queue.Len() == 0 {
+		return
+	}
+	if c.dispatching {
+		c.wakeDispatcher()
+		return
+	}
+	c.dispatching = true
+	go c.dispatcher()
+}
+
+// dispatcher admits waiters as capacity frees up, sleeping until the head
+// of the queue is expected to fit or something changes the limits or the
+// queue. It exits once the queue is empty.
+func (c *CerebrasLimiter) dispatcher() {
+	for {
+		c.mu.Lock()
+		wait := c.admitQueued(time.Now())
+		if c.queue.Len() == 0 {
+			c.dispatching = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		timer := time.NewTimer(max(wait, minDispatchWait))
+		select {
+		case <-timer.C:
+		case <-c.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// wakeDispatcher makes the dispatcher look at the queue again without
+// waiting for its timer
+func (c *CerebrasLimiter) wakeDispatcher() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// admitQueued admits waiters in the queue's order for as long as they fit,
+// and returns how long until the next one is expected to. Callers must
+// hold c.mu.
+func (c *CerebrasLimiter) admitQueued(now time.Time) time.Duration {
+	for {
+		var wait time.Duration
+		next := c.queue.DequeueIf(func(req *queue.QueuedRequest) bool {
+			wait = c.waitFor(req.Tokens, now)
+			return wait == 0
+		})
+		if next == nil {
+			return wait
+		}
+		if t, ok := c.waiters[next]; ok {
+			delete(c.waiters, next)
+			t.admission = c.admit(next.Tokens, now)
+			close(t.ready)
+		}
+	}
+}
+
+// waitFor returns how long until a request of the given tokens fits under
+// the RPM and TPM limits, and under the remaining tokens the upstream last
+// reported. Callers must hold c.mu.
+func (c *CerebrasLimiter) waitFor(tokens int, now time.Time) time.Duration {
+	wait := max(
+		c.rpmWindow.waitFor(1, c.rpmLimit, now),
+		c.tpmWindow.waitFor(tokens, c.tpmLimit, now),
+	)
+	if c.headersRecent(now) && now.Before(c.nextTPMReset) && tokens > c.currentTPMRemaining {
+		wait = max(wait, c.nextTPMReset.Sub(now))
+	}
+	return wait
+}
+
+// admit records a request against the windows and the reported remaining
+// tokens. Callers must hold c.mu.
+func (c *CerebrasLimiter) admit(tokens int, now time.Time) *Admission {
+	a := &Admission{
+		limiter: c,
+		tokens:  tokens,
+		request: c.rpmWindow.add(1, now),
+		usage:   c.tpmWindow.add(tokens, now),
+	}
+	if c.headersRecent(now) && now.Before(c.nextTPMReset) {
+		c.currentTPMRemaining -= tokens
+		a.headerUpdate = c.lastHeaderUpdate
+	}
+	return a
+}
+
+// headersRecent reports whether rate limit headers were received recently
+// enough to trust. Callers must hold c.mu.
+func (c *CerebrasLimiter) headersRecent(now time.Time) bool {
+	return !c.lastHeaderUpdate.IsZero() && now.Sub(c.lastHeaderUpdate) <= 5*time.Minute
+}
+
+// priority ranks a request by its tokens once the limits are nearly used
+// up. Callers must hold c.mu.
+func (c *CerebrasLimiter) priority(tokens int, now time.Time) float64 {
+	requests, _ := c.rpmWindow.recent(now)
+	_, used := c.tpmWindow.recent(now)
+	return queue.CalculatePriority(tokens, usage(requests, c.rpmLimit), usage(used, c.tpmLimit))
+}
+
+func usage(used, limit int) float64 {
+	if limit <= 0 {
+		return 1
+	}
+	return float64(used) / float64(limit)
+}
+
+// prune drops the elements that have left the window
+func (sw *slidingWindow) prune(now time.Time) {
+	for sw.elements.Len() > 0 {
+		front := sw.elements.Front()
+		if now.Sub(front.Value.(*windowElement).timestamp) < sw.size {
+			break
+		}
+		sw.elements.Remove(front)
+	}
+}
+
+// waitFor returns how long until value fits under limit as the oldest
+// elements leave the window. A value over the limit fits once the window
+// is empty.
+func (sw *slidingWindow) waitFor(value, limit int, now time.Time) time.Duration {
+	sw.prune(now)
+	excess := sw.sum() + min(value, max(limit, 0)) - limit
+	for elem := sw.elements.Front(); elem != nil && excess > 0; elem = elem.Next() {
+		e := elem.Value.(*windowElement)
+		excess -= e.value
+		if excess <= 0 {
+			return e.timestamp.Add(sw.size).Sub(now)
+		}
+	}
+	return 0
+}
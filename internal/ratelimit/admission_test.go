@@ -0,0 +1,261 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expireWindows ages every request out of the limiter's sliding windows and
+// wakes the dispatcher, as if a minute had passed
+func expireWindows(c *CerebrasLimiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sw := range []*slidingWindow{c.rpmWindow, c.tpmWindow} {
+		for elem := sw.elements.Front(); elem != nil; elem = elem.Next() {
+			e := elem.Value.(*windowElement)
+			e.timestamp = e.timestamp.Add(-time.Minute)
+		}
+	}
+	c.wakeDispatcher()
+}
+
+func TestAcquireAdmitsWaitersInPriorityOrder(t *testing.T) {
+	limiter := NewCerebrasLimiter(1, 1000000)
+	_, err := limiter.Acquire(context.Background(), "first", "", 100)
+	require.NoError(t, err)
+
+	admitted := make(chan string, 2)
+	acquire := func(id string, tokens int) {
+		if _, err := limiter.Acquire(context.Background(), id, "", tokens); err == nil {
+			admitted <- id
+		}
+	}
+
+	// At full RPM usage small requests go ahead of large ones
+	go acquire("large", 6000)
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 1 }, time.Second, time.Millisecond)
+	go acquire("small", 500)
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 2 }, time.Second, time.Millisecond)
+
+	select {
+	case id := <-admitted:
+		t.Fatalf("Expected waiters to block while the window is full, %s was admitted", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	expireWindows(limiter)
+	select {
+	case id := <-admitted:
+		assert.Equal(t, "small", id)
+	case <-time.After(time.Second):
+		t.Fatal("Expected a waiter to be admitted once capacity freed up")
+	}
+	assert.Equal(t, 1, limiter.QueueLength())
+
+	expireWindows(limiter)
+	select {
+	case id := <-admitted:
+		assert.Equal(t, "large", id)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second waiter to be admitted")
+	}
+	assert.Equal(t, 0, limiter.QueueLength())
+}
+
+func TestAcquireRemovesWaitersThatGiveUp(t *testing.T) {
+	limiter := NewCerebrasLimiter(1, 1000000)
+	_, err := limiter.Acquire(context.Background(), "first", "", 100)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Acquire(ctx, "cancelled", "", 100)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, limiter.QueueLength())
+
+	limiter.SetQueueLimits(1, 20*time.Millisecond)
+	_, err = limiter.Acquire(context.Background(), "timed-out", "", 100)
+	assert.Equal(t, ErrQueueTimeout, err)
+	assert.Equal(t, 0, limiter.QueueLength())
+
+	requests, _, _ := limiter.Usage()
+	assert.Equal(t, 1, requests, "waiters that gave up must not take capacity")
+}
+
+func TestAcquireRejectsWhenQueueFull(t *testing.T) {
+	limiter := NewCerebrasLimiter(1, 1000000)
+	limiter.SetQueueLimits(1, time.Minute)
+	_, err := limiter.Acquire(context.Background(), "first", "", 100)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := limiter.Acquire(ctx, "waiting", "", 100)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 1 }, time.Second, time.Millisecond)
+
+	_, err = limiter.Acquire(context.Background(), "rejected", "", 100)
+	assert.Equal(t, ErrQueueFull, err)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, 0, limiter.QueueLength())
+}
+
+func TestAcquireAdmitsOversizedRequestIntoEmptyWindow(t *testing.T) {
+	limiter := NewCerebrasLimiter(10, 1000)
+	_, err := limiter.Acquire(context.Background(), "small", "", 100)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), "huge", "", 5000)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 1 }, time.Second, time.Millisecond)
+
+	expireWindows(limiter)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected a request over the TPM limit to be admitted into an empty window")
+	}
+}
+
+func TestAdmissionCancelReturnsCapacity(t *testing.T) {
+	limiter := NewCerebrasLimiter(1, 1000)
+	admission, err := limiter.Acquire(context.Background(), "unsent", "", 600)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), "next", "", 600)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 1 }, time.Second, time.Millisecond)
+
+	// The first request was never sent, so the waiter gets its capacity
+	// at once rather than a minute later
+	admission.Cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the cancelled admission's capacity to go to the waiter")
+	}
+
+	admission.Cancel()
+	requests, tokens, _ := limiter.Usage()
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 600, tokens)
+}
+
+func TestAdmissionCancelRestoresReportedTokens(t *testing.T) {
+	limiter := NewCerebrasLimiter(60, 10000)
+	headers := http.Header{}
+	headers.Set("x-ratelimit-limit-tokens-minute", "10000")
+	headers.Set("x-ratelimit-remaining-tokens-minute", "5000")
+	headers.Set("x-ratelimit-reset-tokens-minute", "30")
+	require.NoError(t, limiter.UpdateFromHeaders(headers))
+
+	admission, err := limiter.Acquire(context.Background(), "unsent", "", 2000)
+	require.NoError(t, err)
+	assert.Equal(t, 3000, limiter.CurrentTPMRemaining())
+
+	admission.Cancel()
+	assert.Equal(t, 5000, limiter.CurrentTPMRemaining())
+}
+
+func TestSlidingWindowWaitFor(t *testing.T) {
+	limiter := NewCerebrasLimiter(2, 1000)
+	now := time.Now()
+	limiter.tpmWindow.add(400, now.Add(-50*time.Second))
+	limiter.tpmWindow.add(400, now.Add(-20*time.Second))
+
+	assert.Equal(t, time.Duration(0), limiter.tpmWindow.waitFor(200, 1000, now))
+	assert.Equal(t, 10*time.Second, limiter.tpmWindow.waitFor(300, 1000, now))
+	assert.Equal(t, 40*time.Second, limiter.tpmWindow.waitFor(700, 1000, now))
+	assert.Equal(t, 40*time.Second, limiter.tpmWindow.waitFor(5000, 1000, now))
+}
+
+func TestAcquireSharesCapacityBetweenTenants(t *testing.T) {
+	limiter := NewCerebrasLimiter(1, 1000000)
+	_, err := limiter.Acquire(context.Background(), "first", "batch", 1000)
+	require.NoError(t, err)
+
+	admitted := make(chan string, 4)
+	acquire := func(tenant string) {
+		if _, err := limiter.Acquire(context.Background(), tenant, tenant, 1000); err == nil {
+			admitted <- tenant
+		}
+	}
+
+	// A batch queues up before the interactive request arrives
+	for i := 1; i <= 3; i++ {
+		go acquire("batch")
+		assert.Eventually(t, func() bool { return limiter.QueueLength() == i }, time.Second, time.Millisecond)
+	}
+	go acquire("interactive")
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 4 }, time.Second, time.Millisecond)
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		expireWindows(limiter)
+		select {
+		case tenant := <-admitted:
+			order = append(order, tenant)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a waiter to be admitted, got %v so far", order)
+		}
+	}
+	assert.Equal(t, []string{"batch", "interactive", "batch", "batch"}, order)
+
+	stats := limiter.TenantStats()
+	assert.Equal(t, int64(3), stats["batch"].Dequeued)
+	assert.Equal(t, int64(1), stats["interactive"].Dequeued)
+}
+
+func TestAdmissionReconcileChargesReportedUsage(t *testing.T) {
+	limiter := NewCerebrasLimiter(60, 1000)
+	admission, err := limiter.Acquire(context.Background(), "overestimated", "", 900)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), "next", "", 500)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return limiter.QueueLength() == 1 }, time.Second, time.Millisecond)
+
+	// The first request used far less than estimated, which makes room for
+	// the waiter straight away
+	admission.Reconcile(300)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the overestimate to go to the waiter")
+	}
+
+	_, tokens, _ := limiter.Usage()
+	assert.Equal(t, 800, tokens)
+
+	// An underestimate is charged in full
+	admission.Reconcile(1200)
+	_, tokens, _ = limiter.Usage()
+	assert.Equal(t, 1700, tokens)
+
+	// A cancelled admission has nothing left to reconcile
+	admission.Cancel()
+	admission.Reconcile(100)
+	_, tokens, _ = limiter.Usage()
+	assert.Equal(t, 500, tokens)
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cooldownp/cooldown-proxy/internal/config"
 	"github.com/cooldownp/cooldown-proxy/internal/queue"
 )
 
@@ -28,6 +29,15 @@ type CerebrasLimiter struct {
 	queue     *queue.PriorityQueue
 	mu        sync.RWMutex
 
+	// Admission queue: a ticket per waiter and the dispatcher waking them
+	waiters     map[*queue.QueuedRequest]*ticket
+	dispatching bool
+	wake        chan struct{}
+
+	// Fair queuing between tenants, kept to configure replacement queues
+	tenantWeights map[string]int
+	aging         time.Duration
+
 	// New header-based fields
 	currentTPMLimit     int
 	currentTPMRemaining int
@@ -47,22 +57,19 @@ func NewCerebrasLimiter(rpmLimit, tpmLimit int) *CerebrasLimiter {
 			elements: list.New(),
 			size:     time.Minute,
 		},
-		queue: queue.NewPriorityQueue(100, 10*time.Minute),
+		queue:   queue.NewPriorityQueue(100, 10*time.Minute),
+		waiters: make(map[*queue.QueuedRequest]*ticket),
+		wake:    make(chan struct{}, 1),
+		aging:   queue.DefaultAging,
 	}
 }
 
-func (sw *slidingWindow) add(value int, now time.Time) {
+func (sw *slidingWindow) add(value int, now time.Time) *list.Element {
 	// Remove old elements
-	for sw.elements.Len() > 0 {
-		front := sw.elements.Front()
-		if now.Sub(front.Value.(*windowElement).timestamp) < sw.size {
-			break
-		}
-		sw.elements.Remove(front)
-	}
+	sw.prune(now)
 
 	// Add new element
-	sw.elements.PushBack(&windowElement{
+	return sw.elements.PushBack(&windowElement{
 		timestamp: now,
 		value:     value,
 	})
@@ -76,6 +83,41 @@ func (sw *slidingWindow) sum() int {
 	return total
 }
 
+// recent sums the values added within the window without pruning it
+func (sw *slidingWindow) recent(now time.Time) (count, total int) {
+	for elem := sw.elements.Back(); elem != nil; elem = elem.Prev() {
+		e := elem.Value.(*windowElement)
+		if now.Sub(e.timestamp) >= sw.size {
+			break
+		}
+		count++
+		total += e.value
+	}
+	return count, total
+}
+
+// SetLimits replaces the RPM and TPM limits, e.g. with this instance's
+// lease of a limit shared between peers
+func (c *CerebrasLimiter) SetLimits(rpmLimit, tpmLimit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rpmLimit = rpmLimit
+	c.tpmLimit = tpmLimit
+	c.wakeDispatcher()
+}
+
+// Usage reports the requests and tokens admitted in the last minute and the
+// number of queued requests
+func (c *CerebrasLimiter) Usage() (requests, tokens, queued int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	requests, _ = c.rpmWindow.recent(now)
+	_, tokens = c.tpmWindow.recent(now)
+	return requests, tokens, c.queue.Len()
+}
+
 func (c *CerebrasLimiter) RPMLimit() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -114,51 +156,26 @@ func (c *CerebrasLimiter) CheckRequest(tokens int) time.Duration {
 	return 0
 }
 
+// CheckRequestWithQueue admits the request and returns 0 if it fits and no
+// one is queued ahead of it. Otherwise it returns how long until capacity
+// for it is expected to free up, or -1 if the queue is full. It never
+// waits or queues; callers that can wait should use Acquire.
 func (c *CerebrasLimiter) CheckRequestWithQueue(requestID string, tokens int) time.Duration {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	now := time.Now()
-
-	// Check current usage
-	rpmUsage := float64(c.rpmWindow.sum()) / float64(c.rpmLimit)
-	tpmUsage := float64(c.tpmWindow.sum()) / float64(c.tpmLimit)
-
-	// Check if we can process immediately
-	if c.canProcessImmediately(tokens, now) {
-		c.recordRequest(tokens, now)
+	queued := c.queue.Len()
+	wait := c.waitFor(tokens, now)
+	if queued == 0 && wait == 0 {
+		c.admit(tokens, now)
 		return 0
 	}
 
-	// Queue the request
-	priority := c.calculatePriority(tokens, rpmUsage, tpmUsage)
-	queuedReq := &queue.QueuedRequest{
-		ID:        requestID,
-		Tokens:    tokens,
-		Priority:  priority,
-		Timestamp: now,
-		Timeout:   now.Add(10 * time.Minute),
-	}
-
-	if !c.queue.Enqueue(queuedReq) {
+	if queued >= c.queue.MaxDepth() {
 		return -1 // Queue full, reject immediately
 	}
-
-	return time.Minute // Estimated delay
-}
-
-func (c *CerebrasLimiter) canProcessImmediately(tokens int, now time.Time) bool {
-	rpmCount := c.rpmWindow.sum()
-	if rpmCount >= c.rpmLimit {
-		return false
-	}
-
-	tpmCount := c.tpmWindow.sum() + tokens
-	if tpmCount > c.tpmLimit {
-		return false
-	}
-
-	return true
+	return max(wait, minDispatchWait)
 }
 
 func (c *CerebrasLimiter) recordRequest(tokens int, now time.Time) {
@@ -166,24 +183,6 @@ func (c *CerebrasLimiter) recordRequest(tokens int, now time.Time) {
 	c.tpmWindow.add(tokens, now)
 }
 
-func (c *CerebrasLimiter) calculatePriority(tokens int, rpmUsage, tpmUsage float64) float64 {
-	maxUsage := rpmUsage
-	if tpmUsage > maxUsage {
-		maxUsage = tpmUsage
-	}
-
-	if maxUsage > 0.7 {
-		if tokens < 1000 {
-			return 2.0
-		} else if tokens > 5000 {
-			return 0.5
-		}
-		return 1.0
-	}
-
-	return 1.0
-}
-
 func (c *CerebrasLimiter) QueueLength() int {
 	return c.queue.Len()
 }
@@ -213,8 +212,13 @@ func (c *CerebrasLimiter) NextTPMReset() time.Time {
 	return c.nextTPMReset
 }
 
+// UpdateFromHeaders takes the token quota Cerebras reported on a response.
+// Each field is applied on its own, so a response that only carries some of
+// the headers still updates what it has. Without a reset the remaining count
+// is assumed to hold until the end of the current minute window.
 func (c *CerebrasLimiter) UpdateFromHeaders(headers http.Header) error {
-	parsed, err := ParseRateLimitHeaders(headers)
+	now := time.Now()
+	quota, err := ParseQuota(config.HeaderSchemas["cerebras"], headers, now)
 	if err != nil {
 		// Fall back to configured limits
 		return err
@@ -223,13 +227,19 @@ func (c *CerebrasLimiter) UpdateFromHeaders(headers http.Header) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Update limits with header values
-	if parsed.TPMLimit > 0 {
-		c.currentTPMLimit = parsed.TPMLimit
+	if quota.LimitTokens > 0 {
+		c.currentTPMLimit = quota.LimitTokens
+	}
+	if quota.ResetTokens > 0 {
+		c.nextTPMReset = now.Add(quota.ResetTokens)
+	} else if quota.RemainingTokens >= 0 && !now.Before(c.nextTPMReset) {
+		c.nextTPMReset = now.Add(time.Minute)
+	}
+	if quota.RemainingTokens >= 0 {
+		c.currentTPMRemaining = quota.RemainingTokens
+		c.lastHeaderUpdate = now
 	}
-	c.currentTPMRemaining = parsed.TPMRemaining
-	c.nextTPMReset = time.Now().Add(parsed.TPMReset)
-	c.lastHeaderUpdate = time.Now()
+	c.wakeDispatcher()
 
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCerebrasRateLimiter_Creation(t *testing.T) {
@@ -68,15 +69,15 @@ func TestCerebrasRateLimiter_QueueIntegration(t *testing.T) {
 		t.Errorf("First request should be immediate, got delay %v", delay)
 	}
 
-	// Second request should be queued
+	// Second request should be told how long until capacity frees up
 	delay = limiter.CheckRequestWithQueue("req-2", 100)
-	if delay == 0 {
-		t.Error("Second request should be queued/delayed")
+	if delay <= 0 || delay > time.Minute {
+		t.Errorf("Second request should be delayed by at most a minute, got %v", delay)
 	}
 
-	// Check queue length
-	if limiter.QueueLength() != 1 {
-		t.Errorf("Expected queue length 1, got %d", limiter.QueueLength())
+	// A check never leaves a request behind in the queue
+	if limiter.QueueLength() != 0 {
+		t.Errorf("Expected queue length 0, got %d", limiter.QueueLength())
 	}
 }
 
@@ -104,6 +105,32 @@ func TestCerebrasLimiterHeaderBasedState(t *testing.T) {
 	assert.True(t, time.Now().Add(46*time.Second).After(limiter.nextTPMReset))
 }
 
+func TestCerebrasLimiterUpdateFromPartialHeaders(t *testing.T) {
+	limiter := NewCerebrasLimiter(60, 1000)
+
+	// Remaining tokens alone still count, held to the end of the minute
+	headers := http.Header{}
+	headers.Set("x-ratelimit-remaining-tokens-minute", "300")
+	require.NoError(t, limiter.UpdateFromHeaders(headers))
+
+	assert.Equal(t, 0, limiter.CurrentTPMLimit())
+	assert.Equal(t, 300, limiter.CurrentTPMRemaining())
+	assert.False(t, limiter.LastHeaderUpdate().IsZero())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), limiter.NextTPMReset(), time.Second)
+
+	// A limit and reset without a remaining count keep the last one
+	headers = http.Header{}
+	headers.Set("x-ratelimit-limit-tokens-minute", "2000")
+	headers.Set("x-ratelimit-reset-tokens-minute", "20")
+	require.NoError(t, limiter.UpdateFromHeaders(headers))
+
+	assert.Equal(t, 2000, limiter.CurrentTPMLimit())
+	assert.Equal(t, 300, limiter.CurrentTPMRemaining())
+	assert.WithinDuration(t, time.Now().Add(20*time.Second), limiter.NextTPMReset(), time.Second)
+
+	assert.Error(t, limiter.UpdateFromHeaders(http.Header{}))
+}
+
 func TestCerebrasLimiterConcurrentHeaderUpdates(t *testing.T) {
 	limiter := NewCerebrasLimiter(60, 1000)
 
@@ -0,0 +1,211 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// anonymousClient is the identity of requests that carry none, e.g. no API
+// key. They share one bucket with the default limits.
+const anonymousClient = "anonymous"
+
+// maxIdleClients bounds the per-client buckets kept for the default rule;
+// past it, buckets that have fully refilled are dropped
+const maxIdleClients = 10000
+
+// ClientLimiter limits requests per inbound client, independently of the
+// per-domain Limiter
+type ClientLimiter struct {
+	cfg          *config.ClientRateLimits
+	rules        []*clientRule
+	defaultRates []config.Rate
+	buckets      map[string]*LeakyBucket // default-rule clients, by metrics name
+	mu           sync.Mutex
+}
+
+// clientRule is a configured client and its shared budget
+type clientRule struct {
+	clientMatcher
+	name   string
+	bucket *LeakyBucket
+}
+
+// clientMatcher matches identities against a configured client: an API
+// key or header value, or an IP address or CIDR when clients are told
+// apart by IP
+type clientMatcher struct {
+	value   string
+	network *net.IPNet
+}
+
+func newClientMatcher(key, client string) clientMatcher {
+	m := clientMatcher{value: client}
+	if key == config.ClientKeyIP {
+		if _, network, err := net.ParseCIDR(client); err == nil {
+			m.network = network
+		}
+	}
+	return m
+}
+
+func NewClientLimiter(cfg *config.ClientRateLimits) *ClientLimiter {
+	c := &ClientLimiter{
+		cfg:          cfg,
+		defaultRates: defaultRates,
+		buckets:      make(map[string]*LeakyBucket),
+	}
+
+	if cfg.Default != nil {
+		if rates, err := cfg.Default.Rates(); err == nil {
+			c.defaultRates = rates
+		}
+	}
+
+	for _, client := range cfg.Clients {
+		r := &clientRule{
+			clientMatcher: newClientMatcher(cfg.Key, client.Client),
+			name:          client.Name,
+			bucket:        newRuleBucket(client.RateLimitRule),
+		}
+		if r.name == "" {
+			r.name = c.describe(client.Client)
+		}
+		c.rules = append(c.rules, r)
+	}
+
+	return c
+}
+
+// Reserve reserves the next slot for the client sending r
+func (c *ClientLimiter) Reserve(r *http.Request) *Reservation {
+	return c.bucket(c.Identify(r)).reserve(time.Now())
+}
+
+// Identify returns the client identity of r, or "" if it has none
+func (c *ClientLimiter) Identify(r *http.Request) string {
+	return identify(r, c.cfg.Key, c.cfg.Header, c.cfg.TrustForwardedFor)
+}
+
+// identify returns the identity of the client sending r by key: its IP
+// address, the value of header, or by default its API key
+func identify(r *http.Request, key, header string, trustForwardedFor bool) string {
+	switch key {
+	case config.ClientKeyIP:
+		if trustForwardedFor {
+			if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+				first, _, _ := strings.Cut(forwarded, ",")
+				return strings.TrimSpace(first)
+			}
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	case config.ClientKeyHeader:
+		return r.Header.Get(header)
+	default:
+		if key := r.Header.Get("X-Api-Key"); key != "" {
+			return key
+		}
+		auth := r.Header.Get("Authorization")
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			return auth[7:]
+		}
+		return ""
+	}
+}
+
+func (c *ClientLimiter) bucket(identity string) *LeakyBucket {
+	if identity != "" {
+		for _, r := range c.rules {
+			if r.matches(identity) {
+				return r.bucket
+			}
+		}
+	}
+
+	name := anonymousClient
+	if identity != "" {
+		name = c.describe(identity)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bucket, ok := c.buckets[name]
+	if !ok {
+		if len(c.buckets) >= maxIdleClients {
+			c.evictIdle(time.Now())
+		}
+		bucket = newBucket(c.defaultRates)
+		c.buckets[name] = bucket
+	}
+	return bucket
+}
+
+func (m clientMatcher) matches(identity string) bool {
+	if m.network != nil {
+		ip := net.ParseIP(identity)
+		return ip != nil && m.network.Contains(ip)
+	}
+	return m.value == identity
+}
+
+// describe names a client in metrics
+func (c *ClientLimiter) describe(identity string) string {
+	return describe(c.cfg.Key, identity)
+}
+
+// describe names the client with identity by key in metrics. API keys are
+// hashed so metrics never expose them.
+func describe(key, identity string) string {
+	switch key {
+	case config.ClientKeyIP, config.ClientKeyHeader:
+		return identity
+	default:
+		sum := sha256.Sum256([]byte(identity))
+		return "key:" + hex.EncodeToString(sum[:6])
+	}
+}
+
+// evictIdle drops buckets whose every window has refilled, which behave
+// exactly like new ones. Callers must hold c.mu.
+func (c *ClientLimiter) evictIdle(now time.Time) {
+	for name, bucket := range c.buckets {
+		bucket.mu.Lock()
+		idle := true
+		for _, w := range bucket.windows {
+			if w.tat.After(now) {
+				idle = false
+				break
+			}
+		}
+		bucket.mu.Unlock()
+		if idle {
+			delete(c.buckets, name)
+		}
+	}
+}
+
+// GetAllMetrics returns metrics for each configured client and each client
+// seen under the default rule
+func (c *ClientLimiter) GetAllMetrics() map[string]Metrics {
+	metrics := make(map[string]Metrics)
+	for _, r := range c.rules {
+		metrics[r.name] = r.bucket.metrics()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, bucket := range c.buckets {
+		metrics[name] = bucket.metrics()
+	}
+	return metrics
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientLimiterByAPIKey(t *testing.T) {
+	limiter := NewClientLimiter(&config.ClientRateLimits{
+		Default: &config.RateLimitRule{Requests: 2, Period: "minute"},
+		Clients: []config.ClientRateLimit{
+			{Name: "ci", Client: "sk-proxy-ci", RateLimitRule: config.RateLimitRule{Requests: 100, Period: "minute"}},
+		},
+	})
+
+	request := func(header, value string) *Reservation {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return limiter.Reserve(req)
+	}
+
+	// Each key gets its own default budget
+	for i := 0; i < 2; i++ {
+		assert.Zero(t, request("Authorization", "Bearer sk-proxy-alice").Delay())
+	}
+	assert.True(t, request("Authorization", "Bearer sk-proxy-alice").Delay() > 0)
+	assert.Zero(t, request("X-Api-Key", "sk-proxy-bob").Delay())
+
+	// A configured client has its own, larger budget
+	for i := 0; i < 10; i++ {
+		assert.Zero(t, request("Authorization", "Bearer sk-proxy-ci").Delay())
+	}
+
+	// Requests without a key share one bucket
+	request("", "")
+	request("", "")
+	assert.True(t, request("", "").Delay() > 0)
+
+	metrics := limiter.GetAllMetrics()
+	assert.Equal(t, int64(10), metrics["ci"].TotalRequests)
+	assert.Equal(t, int64(3), metrics["anonymous"].TotalRequests)
+	for name := range metrics {
+		assert.False(t, strings.Contains(name, "sk-proxy"), "metrics must not expose API keys: %s", name)
+	}
+}
+
+func TestClientLimiterByIP(t *testing.T) {
+	limiter := NewClientLimiter(&config.ClientRateLimits{
+		Key:               config.ClientKeyIP,
+		TrustForwardedFor: true,
+		Default:           &config.RateLimitRule{Requests: 1, Period: "minute"},
+		Clients: []config.ClientRateLimit{
+			{Name: "office", Client: "10.0.0.0/8", RateLimitRule: config.RateLimitRule{Requests: 2, Period: "minute"}},
+		},
+	})
+
+	request := func(remoteAddr, forwarded string) *Reservation {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return limiter.Reserve(req)
+	}
+
+	// The CIDR is one budget shared by every address in it
+	assert.Zero(t, request("10.1.2.3:5000", "").Delay())
+	assert.Zero(t, request("10.9.9.9:5000", "").Delay())
+	assert.True(t, request("10.1.2.3:5001", "").Delay() > 0)
+
+	// Other addresses are limited one by one, from X-Forwarded-For when trusted
+	assert.Zero(t, request("192.0.2.1:5000", "").Delay())
+	assert.Zero(t, request("192.0.2.1:5000", "198.51.100.7, 192.0.2.1").Delay())
+	assert.True(t, request("192.0.2.2:5000", "198.51.100.7").Delay() > 0)
+
+	metrics := limiter.GetAllMetrics()
+	assert.Equal(t, int64(3), metrics["office"].TotalRequests)
+	assert.Equal(t, int64(2), metrics["198.51.100.7"].TotalRequests)
+}
+
+func TestClientLimiterByHeader(t *testing.T) {
+	limiter := NewClientLimiter(&config.ClientRateLimits{
+		Key:     config.ClientKeyHeader,
+		Header:  "X-Team",
+		Default: &config.RateLimitRule{Requests: 1, Period: "minute"},
+	})
+
+	request := func(team string) *Reservation {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Team", team)
+		return limiter.Reserve(req)
+	}
+
+	assert.Zero(t, request("search").Delay())
+	assert.True(t, request("search").Delay() > 0)
+	assert.Zero(t, request("billing").Delay())
+	assert.Contains(t, limiter.GetAllMetrics(), "billing")
+}
@@ -0,0 +1,175 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DailyQuotaError is returned instead of sending a request the upstream
+// would refuse because the key's daily request quota is spent
+type DailyQuotaError struct {
+	Limit int
+	Reset time.Time
+}
+
+func (e *DailyQuotaError) Error() string {
+	return fmt.Sprintf("daily request quota of %d exhausted, resets in %v", e.Limit, time.Until(e.Reset).Round(time.Second))
+}
+
+// RetryAfter is how long until the quota resets
+func (e *DailyQuotaError) RetryAfter() time.Duration {
+	return max(time.Until(e.Reset), 0)
+}
+
+// DailyQuota enforces the daily request quota upstreams report per API key.
+// Between responses it counts the requests it lets through itself, so
+// concurrent requests cannot overrun the last few. With spreading, the
+// requests left are paced evenly over the rest of the day instead of being
+// used up in the morning.
+type DailyQuota struct {
+	spread bool
+	mu     sync.Mutex
+	keys   map[string]*dailyWindow
+}
+
+// dailyWindow is one key's quota as last reported, less what was sent since
+type dailyWindow struct {
+	limit     int
+	remaining int
+	reset     time.Time
+	next      time.Time // next slot when spreading
+}
+
+// DailyQuotaStatus is a key's quota as seen by the limiter
+type DailyQuotaStatus struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+func NewDailyQuota(spread bool) *DailyQuota {
+	return &DailyQuota{spread: spread, keys: make(map[string]*dailyWindow)}
+}
+
+// Update records the quota reported for key: its limit, what remains and
+// the time until it resets. Limit and reset may be 0 if not reported, in
+// which case the previous values are kept.
+func (d *DailyQuota) Update(key string, limit, remaining int, reset time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	w, ok := d.keys[key]
+	if !ok {
+		w = &dailyWindow{reset: now.Add(24 * time.Hour)}
+		d.keys[key] = w
+	}
+	if limit > 0 {
+		w.limit = limit
+	} else if remaining > w.limit {
+		// Without a reported limit, what remains is the best guess at it
+		w.limit = remaining
+	}
+	if reset > 0 {
+		w.reset = now.Add(reset)
+	}
+	w.remaining = remaining
+}
+
+// Reserve takes one request from key's quota and returns how long to wait
+// before sending it, which is only ever non-zero when spreading. It fails
+// with a DailyQuotaError once the quota is spent. Keys nothing was reported
+// for yet are not limited.
+func (d *DailyQuota) Reserve(key string) (time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.keys[key]
+	if !ok {
+		return 0, nil
+	}
+
+	now := time.Now()
+	w.roll(now)
+	if w.remaining <= 0 {
+		return 0, &DailyQuotaError{Limit: w.limit, Reset: w.reset}
+	}
+
+	var delay time.Duration
+	if d.spread {
+		at := now
+		if w.next.After(at) {
+			at = w.next
+		}
+		w.next = at.Add(w.reset.Sub(at) / time.Duration(w.remaining))
+		delay = at.Sub(now)
+	}
+	w.remaining--
+	return delay, nil
+}
+
+// Release returns a request Reserve took from key's quota that was not
+// sent after all. Requests reserved since keep their slots.
+func (d *DailyQuota) Release(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if w, ok := d.keys[key]; ok && w.remaining < w.limit {
+		w.remaining++
+	}
+}
+
+// Check fails with a DailyQuotaError naming the earliest reset if none of
+// keys has requests left today
+func (d *DailyQuota) Check(keys ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var spent *DailyQuotaError
+	for _, key := range keys {
+		w, ok := d.keys[key]
+		if !ok {
+			return nil
+		}
+		w.roll(now)
+		if w.remaining > 0 {
+			return nil
+		}
+		if spent == nil || w.reset.Before(spent.Reset) {
+			spent = &DailyQuotaError{Limit: w.limit, Reset: w.reset}
+		}
+	}
+	if spent == nil {
+		return nil
+	}
+	return spent
+}
+
+// Status returns the quota of every key reported so far
+func (d *DailyQuota) Status() map[string]DailyQuotaStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	status := make(map[string]DailyQuotaStatus)
+	for key, w := range d.keys {
+		w.roll(now)
+		status[key] = DailyQuotaStatus{Limit: w.limit, Remaining: w.remaining, Reset: w.reset}
+	}
+	return status
+}
+
+// roll starts a new day once the reset has passed, assuming the full limit
+// until the upstream says otherwise
+func (w *dailyWindow) roll(now time.Time) {
+	if now.Before(w.reset) {
+		return
+	}
+	for !now.Before(w.reset) {
+		w.reset = w.reset.Add(24 * time.Hour)
+	}
+	w.remaining = w.limit
+	w.next = time.Time{}
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDailyQuotaRejectsWhenSpent(t *testing.T) {
+	quota := NewDailyQuota(false)
+
+	// Keys nothing was reported for are not limited
+	delay, err := quota.Reserve("key-a")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	quota.Update("key-a", 1000, 2, 6*time.Hour)
+	for i := 0; i < 2; i++ {
+		_, err := quota.Reserve("key-a")
+		assert.NoError(t, err)
+	}
+
+	_, err = quota.Reserve("key-a")
+	var spent *DailyQuotaError
+	if assert.True(t, errors.As(err, &spent)) {
+		assert.Equal(t, 1000, spent.Limit)
+		assert.InDelta(t, (6 * time.Hour).Seconds(), spent.RetryAfter().Seconds(), 5)
+		assert.Contains(t, err.Error(), "daily request quota of 1000 exhausted")
+	}
+
+	// Another key with quota left keeps the provider usable
+	assert.Error(t, quota.Check("key-a"))
+	quota.Update("key-b", 1000, 10, time.Hour)
+	assert.NoError(t, quota.Check("key-a", "key-b"))
+
+	// With every key spent the earliest reset is reported
+	quota.Update("key-b", 1000, 0, time.Hour)
+	err = quota.Check("key-a", "key-b")
+	if assert.True(t, errors.As(err, &spent)) {
+		assert.InDelta(t, time.Hour.Seconds(), spent.RetryAfter().Seconds(), 5)
+	}
+}
+
+func TestDailyQuotaSpreadsRemainingRequests(t *testing.T) {
+	quota := NewDailyQuota(true)
+	quota.Update("key", 1000, 4, 4*time.Hour)
+
+	var delays []time.Duration
+	for i := 0; i < 4; i++ {
+		delay, err := quota.Reserve("key")
+		assert.NoError(t, err)
+		delays = append(delays, delay)
+	}
+
+	assert.Equal(t, time.Duration(0), delays[0])
+	for i := 1; i < 4; i++ {
+		assert.InDelta(t, float64(i)*time.Hour.Seconds(), delays[i].Seconds(), 60, "request %d", i+1)
+	}
+}
+
+func TestDailyQuotaRefillsAfterReset(t *testing.T) {
+	quota := NewDailyQuota(false)
+	quota.Update("key", 1000, 0, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := quota.Reserve("key")
+	assert.NoError(t, err)
+	status := quota.Status()["key"]
+	assert.Equal(t, 999, status.Remaining)
+	assert.True(t, status.Reset.After(time.Now().Add(23*time.Hour)))
+}
+
+func TestDailyQuotaReleaseReturnsUnsentRequest(t *testing.T) {
+	quota := NewDailyQuota(false)
+	quota.Update("key-a", 10, 1, time.Hour)
+
+	_, err := quota.Reserve("key-a")
+	assert.NoError(t, err)
+	assert.Error(t, quota.Check("key-a"))
+
+	quota.Release("key-a")
+	assert.NoError(t, quota.Check("key-a"))
+	assert.Equal(t, 1, quota.Status()["key-a"].Remaining)
+
+	// Never more than the limit, e.g. after the day rolled over meanwhile
+	quota.Update("key-a", 10, 10, time.Hour)
+	quota.Release("key-a")
+	assert.Equal(t, 10, quota.Status()["key-a"].Remaining)
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
 )
 
 type RateLimitHeaders struct {
@@ -16,39 +19,178 @@ type RateLimitHeaders struct {
 	RequestDayReset     time.Duration
 }
 
+// ParseRateLimitHeaders reads Cerebras' quota headers. The token limit and
+// reset are required, as the Cerebras limiter schedules on them.
 func ParseRateLimitHeaders(headers http.Header) (*RateLimitHeaders, error) {
-	result := &RateLimitHeaders{}
+	quota, err := ParseQuota(config.HeaderSchemas["cerebras"], headers, time.Now())
+	if err != nil || quota.LimitTokens <= 0 || quota.ResetTokens <= 0 {
+		return nil, fmt.Errorf("missing required rate limit headers")
+	}
+
+	return &RateLimitHeaders{
+		TPMLimit:            quota.LimitTokens,
+		TPMRemaining:        max(quota.RemainingTokens, 0),
+		TPMReset:            quota.ResetTokens,
+		RequestDayLimit:     max(quota.LimitRequests, 0),
+		RequestDayRemaining: max(quota.RemainingRequests, 0),
+		RequestDayReset:     quota.ResetRequests,
+	}, nil
+}
+
+// Quota is what an upstream reported about its rate limits on one response.
+// Limits and remaining counts are -1 and resets 0 when not reported.
+type Quota struct {
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
+	RetryAfter        time.Duration
+}
+
+// ParseQuota reads the headers schema describes. Resets given as a time are
+// turned into the duration from now. It fails if none of them are present.
+func ParseQuota(schema config.HeaderSchema, headers http.Header, now time.Time) (*Quota, error) {
+	quota := &Quota{LimitRequests: -1, RemainingRequests: -1, LimitTokens: -1, RemainingTokens: -1}
+
+	if schema.Format == config.HeaderFormatIETF {
+		parseIETF(quota, headers, now)
+	} else {
+		quota.LimitRequests = parseCount(headers.Get(schema.LimitRequests))
+		quota.RemainingRequests = parseCount(headers.Get(schema.RemainingRequests))
+		quota.ResetRequests = parseReset(headers.Get(schema.ResetRequests), schema.ResetFormat, now)
+		quota.LimitTokens = parseCount(headers.Get(schema.LimitTokens))
+		quota.RemainingTokens = parseCount(headers.Get(schema.RemainingTokens))
+		quota.ResetTokens = parseReset(headers.Get(schema.ResetTokens), schema.ResetFormat, now)
+	}
+	quota.RetryAfter = parseRetryAfter(headers, now)
+
+	if quota.LimitRequests < 0 && quota.RemainingRequests < 0 && quota.LimitTokens < 0 &&
+		quota.RemainingTokens < 0 && quota.RetryAfter == 0 {
+		return nil, fmt.Errorf("missing rate limit headers")
+	}
+	return quota, nil
+}
+
+// parseCount returns a header's count, 0 for negative values and -1 if it is
+// missing or not a number
+func parseCount(value string) int {
+	if value == "" {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return -1
+	}
+	return max(n, 0)
+}
+
+// parseReset returns the time until a reset header's reset, or 0
+func parseReset(value, format string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	var d time.Duration
+	switch format {
+	case config.ResetDuration:
+		d, _ = time.ParseDuration(value)
+	case config.ResetRFC3339:
+		if at, err := time.Parse(time.RFC3339, value); err == nil {
+			d = at.Sub(now)
+		}
+	case config.ResetUnix:
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			d = time.Unix(0, int64(seconds*float64(time.Second))).Sub(now)
+		}
+	default:
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			d = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return max(d, 0)
+}
+
+// parseRetryAfter reads retry-after-ms, or Retry-After in seconds or as an
+// HTTP date
+func parseRetryAfter(headers http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.ParseFloat(headers.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	retry := strings.TrimSpace(headers.Get("Retry-After"))
+	if retry == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(retry, 64); err == nil {
+		return max(time.Duration(seconds*float64(time.Second)), 0)
+	}
+	if at, err := http.ParseTime(retry); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
 
-	// Parse TPM limit
-	if tpmLimitStr := headers.Get("x-ratelimit-limit-tokens-minute"); tpmLimitStr != "" {
-		if tpmLimit, err := strconv.Atoi(tpmLimitStr); err == nil && tpmLimit > 0 {
-			result.TPMLimit = tpmLimit
+// parseIETF reads the IETF rate limit fields into the request counts. It
+// understands both the RateLimit/RateLimit-Policy structured fields
+// ("default";r=50;t=30 and "default";q=100;w=60), the earlier combined
+// RateLimit: limit=100, remaining=50, reset=30 and the separate
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers. With
+// several policies the tightest one counts.
+func parseIETF(quota *Quota, headers http.Header, now time.Time) {
+	tightest := func(current, n int) int {
+		if n >= 0 && (current < 0 || n < current) {
+			return n
 		}
+		return current
 	}
 
-	// Parse TPM remaining
-	if tpmRemainingStr := headers.Get("x-ratelimit-remaining-tokens-minute"); tpmRemainingStr != "" {
-		if tpmRemaining, err := strconv.Atoi(tpmRemainingStr); err == nil {
-			if tpmRemaining >= 0 {
-				result.TPMRemaining = tpmRemaining
-			} else {
-				// Handle negative values by setting to 0
-				result.TPMRemaining = 0
+	for _, param := range ietfParams(headers.Values("RateLimit")) {
+		switch param.key {
+		case "r", "remaining":
+			quota.RemainingRequests = tightest(quota.RemainingRequests, parseCount(param.value))
+		case "t", "reset":
+			if reset := parseReset(param.value, config.ResetSeconds, now); reset > quota.ResetRequests {
+				quota.ResetRequests = reset
 			}
+		case "limit":
+			quota.LimitRequests = tightest(quota.LimitRequests, parseCount(param.value))
 		}
 	}
-
-	// Parse TPM reset (may be fractional)
-	if tpmResetStr := headers.Get("x-ratelimit-reset-tokens-minute"); tpmResetStr != "" {
-		if tpmReset, err := strconv.ParseFloat(tpmResetStr, 64); err == nil && tpmReset > 0 {
-			result.TPMReset = time.Duration(tpmReset * float64(time.Second))
+	for _, param := range ietfParams(headers.Values("RateLimit-Policy")) {
+		if param.key == "q" {
+			quota.LimitRequests = tightest(quota.LimitRequests, parseCount(param.value))
 		}
 	}
 
-	// Validate required fields
-	if result.TPMLimit == 0 || result.TPMReset == 0 {
-		return nil, fmt.Errorf("missing required rate limit headers")
+	quota.LimitRequests = tightest(quota.LimitRequests, parseCount(headers.Get("RateLimit-Limit")))
+	quota.RemainingRequests = tightest(quota.RemainingRequests, parseCount(headers.Get("RateLimit-Remaining")))
+	if quota.ResetRequests == 0 {
+		quota.ResetRequests = parseReset(headers.Get("RateLimit-Reset"), config.ResetSeconds, now)
 	}
+}
 
-	return result, nil
+type ietfParam struct {
+	key   string
+	value string
+}
+
+// ietfParams splits structured field lists into their key=value parameters,
+// ignoring the policy names
+func ietfParams(values []string) []ietfParam {
+	var params []ietfParam
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			for _, part := range strings.Split(item, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+				if !ok {
+					continue
+				}
+				params = append(params, ietfParam{key: strings.ToLower(strings.TrimSpace(key)), value: strings.Trim(strings.TrimSpace(value), `"`)})
+			}
+		}
+	}
+	return params
 }
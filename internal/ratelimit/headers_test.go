@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cooldownp/cooldown-proxy/internal/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -86,3 +87,87 @@ func TestParseRateLimitHeadersInvalidValues(t *testing.T) {
 		})
 	}
 }
+
+func TestParseQuotaSchemas(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		schema   config.HeaderSchema
+		headers  map[string]string
+		expected Quota
+	}{
+		{
+			name:   "openai",
+			schema: config.HeaderSchemas["openai"],
+			headers: map[string]string{
+				"x-ratelimit-limit-requests":     "500",
+				"x-ratelimit-remaining-requests": "499",
+				"x-ratelimit-reset-requests":     "6m0s",
+				"x-ratelimit-remaining-tokens":   "0",
+				"x-ratelimit-reset-tokens":       "20ms",
+			},
+			expected: Quota{LimitRequests: 500, RemainingRequests: 499, ResetRequests: 6 * time.Minute, LimitTokens: -1, RemainingTokens: 0, ResetTokens: 20 * time.Millisecond},
+		},
+		{
+			name:   "anthropic",
+			schema: config.HeaderSchemas["anthropic"],
+			headers: map[string]string{
+				"anthropic-ratelimit-requests-limit":     "50",
+				"anthropic-ratelimit-requests-remaining": "3",
+				"anthropic-ratelimit-requests-reset":     "2026-01-01T12:00:30Z",
+			},
+			expected: Quota{LimitRequests: 50, RemainingRequests: 3, ResetRequests: 30 * time.Second, LimitTokens: -1, RemainingTokens: -1},
+		},
+		{
+			name:   "ietf structured fields",
+			schema: config.HeaderSchemas["ietf"],
+			headers: map[string]string{
+				"RateLimit":        `"default";r=50;t=30, "burst";r=5;t=1`,
+				"RateLimit-Policy": `"default";q=100;w=60, "burst";q=10;w=1`,
+			},
+			expected: Quota{LimitRequests: 10, RemainingRequests: 5, ResetRequests: 30 * time.Second, LimitTokens: -1, RemainingTokens: -1},
+		},
+		{
+			name:     "ietf combined",
+			schema:   config.HeaderSchemas["ietf"],
+			headers:  map[string]string{"RateLimit": "limit=100, remaining=50, reset=30"},
+			expected: Quota{LimitRequests: 100, RemainingRequests: 50, ResetRequests: 30 * time.Second, LimitTokens: -1, RemainingTokens: -1},
+		},
+		{
+			name:   "ietf separate headers",
+			schema: config.HeaderSchemas["ietf"],
+			headers: map[string]string{
+				"RateLimit-Limit":     "100",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "12",
+			},
+			expected: Quota{LimitRequests: 100, RemainingRequests: 0, ResetRequests: 12 * time.Second, LimitTokens: -1, RemainingTokens: -1},
+		},
+		{
+			name:   "custom unix reset with retry-after date",
+			schema: config.HeaderSchema{RemainingRequests: "x-rate-remaining", ResetRequests: "x-rate-reset", ResetFormat: config.ResetUnix},
+			headers: map[string]string{
+				"x-rate-remaining": "0",
+				"x-rate-reset":     "1767268860",
+				"Retry-After":      "Thu, 01 Jan 2026 12:00:45 GMT",
+			},
+			expected: Quota{LimitRequests: -1, RemainingRequests: 0, ResetRequests: time.Minute, LimitTokens: -1, RemainingTokens: -1, RetryAfter: 45 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			for name, value := range tt.headers {
+				headers.Set(name, value)
+			}
+			quota, err := ParseQuota(tt.schema, headers, now)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, *quota)
+		})
+	}
+
+	_, err := ParseQuota(config.HeaderSchemas["openai"], http.Header{}, now)
+	assert.Error(t, err)
+}
@@ -1,164 +1,375 @@
 package ratelimit
 
 import (
-	"github.com/cooldownp/cooldown-proxy/internal/config"
-	"strings"
+	"context"
+	"net/http"
 	"sync"
 	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
 )
 
+// LeakyBucket schedules requests with the generic cell rate algorithm
+// (GCRA). Instead of counting tokens each window keeps a theoretical arrival
+// time (tat): the time it would be empty again if every reserved request
+// went through. Each request reserves the next slot that fits every window,
+// so concurrent callers get distinct delays instead of all waking up
+// together.
 type LeakyBucket struct {
-	rate         float64         // requests per second
-	capacity     int             // bucket capacity
-	tokens       int             // current tokens
-	lastLeak     time.Time       // last time tokens leaked
-	mu           sync.Mutex      // mutex for thread safety
+	windows []*window
+	mu      sync.Mutex // mutex for thread safety
+
+	// Backoff after upstream 429s: the configured rates are scaled by
+	// factor, at most 1
+	factor       float64
+	backoffUntil time.Time
+	throttled    int64
 
 	// Metrics
-	totalRequests   int64         // total requests processed
-	delayedRequests int64         // requests that were delayed
-	lastAccess      time.Time     // last access time
+	totalRequests   int64     // total requests processed
+	delayedRequests int64     // requests that were delayed
+	lastAccess      time.Time // last access time
+}
+
+// window is one rate a bucket enforces, e.g. 10 per second or 10000 per day
+type window struct {
+	base     time.Duration // configured time between slots, 1/rate
+	interval time.Duration // time between slots now, base scaled by the backoff
+	capacity int           // burst allowed from an empty window
+	tat      time.Time     // theoretical arrival time
 }
 
 type Metrics struct {
 	TotalRequests   int64     `json:"total_requests"`
 	DelayedRequests int64     `json:"delayed_requests"`
-	CurrentTokens   int       `json:"current_tokens"`
+	CurrentTokens   int       `json:"current_tokens"` // requests that would go through without delay
 	LastAccess      time.Time `json:"last_access"`
-	DelayRate       float64   `json:"delay_rate"` // percentage of delayed requests
+	DelayRate       float64   `json:"delay_rate"`     // percentage of delayed requests
+	RateFactor      float64   `json:"rate_factor"`    // share of the configured rate after 429 backoff
+	EffectiveRate   float64   `json:"effective_rate"` // requests per second now allowed by the tightest window
+	Throttled       int64     `json:"throttled"`      // upstream 429 responses
 }
 
 type Limiter struct {
-	buckets       map[string]*LeakyBucket
+	rules         []*rule                 // most specific first
+	buckets       map[string]*LeakyBucket // by rule key, plus paused hosts without a rule
 	defaultBucket *LeakyBucket
 	mu            sync.RWMutex
+
+	defaultHeaders string                         // quota header schema of the default rule
+	schemas        map[string]config.HeaderSchema // rate_limit_headers
 }
 
-func New(rules []config.RateLimitRule) *Limiter {
-	buckets := make(map[string]*LeakyBucket)
+// Reservation is a slot in a bucket's schedule. Cancel gives the slot back
+// if the caller gives up before using it.
+type Reservation struct {
+	bucket    *LeakyBucket
+	at        time.Time
+	delay     time.Duration
+	intervals []time.Duration // what each window advanced by, in window order
+	cancelled bool
+}
 
-	// Default rate limit: 1 request per second
-	defaultBucket := &LeakyBucket{
-		rate:     1.0,
-		capacity: 1,
-		tokens:   1,
-		lastLeak: time.Now(),
+// defaultRates apply to unknown domains without a default_rate_limit:
+// 1 request per second, no burst
+var defaultRates = []config.Rate{{PerSecond: 1, Burst: 1}}
+
+func newBucket(rates []config.Rate) *LeakyBucket {
+	bucket := &LeakyBucket{factor: 1}
+	for _, rate := range rates {
+		interval := time.Duration(float64(time.Second) / rate.PerSecond)
+		bucket.windows = append(bucket.windows, &window{
+			base:     interval,
+			interval: interval,
+			capacity: max(rate.Burst, 1),
+		})
 	}
+	return bucket
+}
 
-	for _, rule := range rules {
-		rate := float64(rule.RequestsPerSecond)
-		if rate <= 0 {
-			rate = 1.0
-		}
+// newRuleBucket builds a bucket for a rule, falling back to the defaults
+// for a rule that did not pass validation
+func newRuleBucket(rule config.RateLimitRule) *LeakyBucket {
+	rates, err := rule.Rates()
+	if err != nil {
+		rates = defaultRates
+	}
+	return newBucket(rates)
+}
 
-		// Capacity allows for burst of up to 2 seconds worth of requests
-		capacity := int(rate * 2)
-		if capacity < 1 {
-			capacity = 1
-		}
+func New(rules []config.RateLimitRule) *Limiter {
+	return NewWithDefault(rules, nil)
+}
 
-		buckets[rule.Domain] = &LeakyBucket{
-			rate:     rate,
-			capacity: capacity,
-			tokens:   capacity,
-			lastLeak: time.Now(),
-		}
+// NewWithDefault is New with the rule for domains no rule matches, usually
+// default_rate_limit. A nil rule keeps the 1 request per second default.
+func NewWithDefault(rules []config.RateLimitRule, defaultRule *config.RateLimitRule) *Limiter {
+	buckets := make(map[string]*LeakyBucket)
+	var matched []*rule
+
+	for _, r := range rules {
+		matched = append(matched, newRule(r))
+	}
+	sortRules(matched)
+	for _, r := range matched {
+		buckets[r.key] = r.bucket
+	}
+
+	defaultBucket := newBucket(defaultRates)
+	defaultHeaders := ""
+	if defaultRule != nil {
+		defaultBucket = newRuleBucket(*defaultRule)
+		defaultHeaders = defaultRule.Headers
 	}
 
 	return &Limiter{
-		buckets:       buckets,
-		defaultBucket: defaultBucket,
+		rules:          matched,
+		buckets:        buckets,
+		defaultBucket:  defaultBucket,
+		defaultHeaders: defaultHeaders,
 	}
 }
 
+// GetDelay reserves a slot for a request to domain and returns how long the
+// caller must wait for it
 func (l *Limiter) GetDelay(domain string) time.Duration {
-	bucket := l.getBucket(domain)
-	if bucket == nil {
-		bucket = l.defaultBucket
-	}
+	return l.Reserve(domain).Delay()
+}
+
+// Reserve reserves the next slot for a request to domain. A caller that
+// stops waiting, e.g. because its client went away, should Cancel it.
+func (l *Limiter) Reserve(domain string) *Reservation {
+	return l.lookup(domain, "", "").reserve(time.Now())
+}
 
-	return bucket.getDelay()
+// ReserveRequest is Reserve for the bucket matching the request's host,
+// method and path
+func (l *Limiter) ReserveRequest(r *http.Request) *Reservation {
+	return l.lookup(r.Host, r.Method, r.URL.Path).reserve(time.Now())
 }
 
-func (l *Limiter) getBucket(domain string) *LeakyBucket {
+// HasRule reports whether domain has a bucket of its own, from a rule or a
+// pause, rather than falling back to the default
+func (l *Limiter) HasRule(domain string) bool {
+	return l.getBucket(domain, "", "") != nil
+}
+
+// HasRequestRule is HasRule for r, so path and method rules count
+func (l *Limiter) HasRequestRule(r *http.Request) bool {
+	return l.getBucket(r.Host, r.Method, r.URL.Path) != nil
+}
+
+// lookup returns the bucket of the most specific matching rule, the paused
+// bucket of a host without one, or the default bucket
+func (l *Limiter) lookup(host, method, path string) *LeakyBucket {
+	if bucket := l.getBucket(host, method, path); bucket != nil {
+		return bucket
+	}
+	return l.defaultBucket
+}
+
+func (l *Limiter) getBucket(host, method, path string) *LeakyBucket {
+	host = normalizeHost(host)
+	for _, r := range l.rules {
+		if r.matches(host, method, path) {
+			return r.bucket
+		}
+	}
+
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.buckets[host]
+}
 
-	// Exact match first
-	if bucket, exists := l.buckets[domain]; exists {
-		return bucket
+// Pause holds every request to domain for d, e.g. after the upstream
+// signalled throttling. That covers the domain's own bucket and any path or
+// method rules for it. A domain without its own rule gets a bucket with the
+// default limits so the pause does not spill over to other hosts.
+func (l *Limiter) Pause(domain string, d time.Duration) {
+	until := time.Now().Add(d)
+	host := normalizeHost(domain)
+
+	for _, r := range l.rules {
+		if r.scoped() && hostMatches(r.host, host) {
+			r.bucket.pause(until)
+		}
 	}
 
-	// Wildcard matching
-	for pattern, bucket := range l.buckets {
-		if strings.HasPrefix(pattern, "*.") {
-			suffix := strings.TrimPrefix(pattern, "*.")
-			if strings.HasSuffix(domain, suffix) {
-				return bucket
-			}
+	l.hostBucket(host).pause(until)
+}
+
+// hostBucket returns the bucket of host's own rule, creating one with the
+// default limits for a host without, so adapting it leaves other hosts be
+func (l *Limiter) hostBucket(host string) *LeakyBucket {
+	bucket := l.getBucket(host, "", "")
+	if bucket == nil {
+		l.mu.Lock()
+		if bucket = l.buckets[host]; bucket == nil {
+			bucket = l.defaultBucket.clone()
+			l.buckets[host] = bucket
 		}
+		l.mu.Unlock()
 	}
+	return bucket
+}
 
-	return nil
+// PeekDelay reports the delay the next request to domain would get without
+// consuming a token or counting a request, so callers can compare hosts
+func (l *Limiter) PeekDelay(domain string) time.Duration {
+	return l.lookup(domain, "", "").peekDelay(time.Now())
 }
 
-func (lb *LeakyBucket) getDelay() time.Duration {
+// clone returns an empty bucket with the same configured windows
+func (lb *LeakyBucket) clone() *LeakyBucket {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	bucket := &LeakyBucket{factor: 1}
+	for _, w := range lb.windows {
+		bucket.windows = append(bucket.windows, &window{base: w.base, interval: w.base, capacity: w.capacity})
+	}
+	return bucket
+}
+
+// tolerance is how far the window's schedule may run ahead of now before
+// requests are delayed
+func (w *window) tolerance() time.Duration {
+	return time.Duration(w.capacity) * w.interval
+}
+
+// earliest is the first time from now a request fits the window
+func (w *window) earliest(now time.Time) time.Time {
+	at := w.tat.Add(w.interval - w.tolerance())
+	if at.Before(now) {
+		return now
+	}
+	return at
+}
+
+// nextSlot is the first time a request fits every window. Callers must hold
+// lb.mu.
+func (lb *LeakyBucket) nextSlot(now time.Time) time.Time {
+	at := now
+	for _, w := range lb.windows {
+		if earliest := w.earliest(now); earliest.After(at) {
+			at = earliest
+		}
+	}
+	return at
+}
+
+func (lb *LeakyBucket) reserve(now time.Time) *Reservation {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	now := time.Now()
 	lb.lastAccess = now
 	lb.totalRequests++
 
-	// Leak tokens based on time elapsed
-	elapsed := now.Sub(lb.lastLeak).Seconds()
-	tokensToLeak := int(elapsed * lb.rate)
+	at := lb.nextSlot(now)
+	intervals := make([]time.Duration, len(lb.windows))
+	for i, w := range lb.windows {
+		if w.tat.Before(at) {
+			w.tat = at
+		}
+		w.tat = w.tat.Add(w.interval)
+		intervals[i] = w.interval
+	}
 
-	if tokensToLeak > 0 {
-		lb.tokens = max(0, lb.tokens-tokensToLeak)
-		lb.lastLeak = now
+	delay := at.Sub(now)
+	if delay > 0 {
+		lb.delayedRequests++
 	}
+	return &Reservation{bucket: lb, at: at, delay: delay, intervals: intervals}
+}
+
+func (lb *LeakyBucket) peekDelay(now time.Time) time.Duration {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	return lb.nextSlot(now).Sub(now)
+}
+
+// pause pushes the schedule out so the next request goes at until, and the
+// ones after it follow at the normal rate rather than as a burst
+func (lb *LeakyBucket) pause(until time.Time) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	// If we have tokens available, consume one immediately
-	if lb.tokens > 0 {
-		lb.tokens--
-		return 0
+	for _, w := range lb.windows {
+		if tat := until.Add(w.tolerance() - w.interval); tat.After(w.tat) {
+			w.tat = tat
+		}
 	}
+}
 
-	// No tokens available, calculate delay needed for next token
-	// The leaky bucket leaks at a constant rate, so we need to wait
-	// until enough time has passed for one token to leak
-	delayDuration := time.Duration(float64(time.Second) / lb.rate)
-	lb.delayedRequests++
+// available is how many requests would go through without delay, limited
+// by the tightest window. Callers must hold lb.mu.
+func (lb *LeakyBucket) available(now time.Time) int {
+	free := -1
+	for _, w := range lb.windows {
+		ahead := time.Duration(0)
+		if w.tat.After(now) {
+			ahead = w.tat.Sub(now)
+		}
+		if n := int((w.tolerance() - ahead) / w.interval); free < 0 || n < free {
+			free = n
+		}
+	}
+	return max(free, 0)
+}
 
-	return delayDuration
+// Delay is how long the caller must wait before using the slot
+func (r *Reservation) Delay() time.Duration {
+	return r.delay
 }
 
-// GetMetrics returns metrics for a specific domain
-func (l *Limiter) GetMetrics(domain string) Metrics {
-	bucket := l.getBucket(domain)
-	if bucket == nil {
-		bucket = l.defaultBucket
+// Wait blocks until the slot's time or until ctx is done, in which case the
+// slot is cancelled and ctx's error returned
+func (r *Reservation) Wait(ctx context.Context) error {
+	if r.delay <= 0 {
+		return nil
 	}
 
-	bucket.mu.Lock()
-	defer bucket.mu.Unlock()
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
 
-	var delayRate float64
-	if bucket.totalRequests > 0 {
-		delayRate = float64(bucket.delayedRequests) / float64(bucket.totalRequests) * 100
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
+}
 
-	return Metrics{
-		TotalRequests:   bucket.totalRequests,
-		DelayedRequests: bucket.delayedRequests,
-		CurrentTokens:   bucket.tokens,
-		LastAccess:      bucket.lastAccess,
-		DelayRate:       delayRate,
+// Cancel returns an unused slot so the next request can take it, and
+// removes the request from the metrics. Each window is rewound by the
+// interval it was advanced by, even if a backoff has changed it since. It is
+// a no-op once the slot's time has passed or the slot was already cancelled.
+func (r *Reservation) Cancel() {
+	lb := r.bucket
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if r.cancelled || !time.Now().Before(r.at) {
+		return
 	}
+	r.cancelled = true
+	for i, w := range lb.windows {
+		w.tat = w.tat.Add(-r.intervals[i])
+	}
+	lb.totalRequests--
+	if r.delay > 0 {
+		lb.delayedRequests--
+	}
+}
+
+// GetMetrics returns metrics for a specific domain
+func (l *Limiter) GetMetrics(domain string) Metrics {
+	return l.lookup(domain, "", "").metrics()
 }
 
-// GetAllMetrics returns metrics for all domains
+// GetAllMetrics returns metrics for all rules, keyed by RuleKey
 func (l *Limiter) GetAllMetrics() map[string]Metrics {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -167,45 +378,39 @@ func (l *Limiter) GetAllMetrics() map[string]Metrics {
 
 	// Add metrics for all configured buckets
 	for domain, bucket := range l.buckets {
-		bucket.mu.Lock()
-		var delayRate float64
-		if bucket.totalRequests > 0 {
-			delayRate = float64(bucket.delayedRequests) / float64(bucket.totalRequests) * 100
-		}
-
-		metrics[domain] = Metrics{
-			TotalRequests:   bucket.totalRequests,
-			DelayedRequests: bucket.delayedRequests,
-			CurrentTokens:   bucket.tokens,
-			LastAccess:      bucket.lastAccess,
-			DelayRate:       delayRate,
-		}
-		bucket.mu.Unlock()
+		metrics[domain] = bucket.metrics()
 	}
 
 	// Add default bucket metrics
-	l.defaultBucket.mu.Lock()
+	metrics["default"] = l.defaultBucket.metrics()
+
+	return metrics
+}
+
+func (lb *LeakyBucket) metrics() Metrics {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
 	var delayRate float64
-	if l.defaultBucket.totalRequests > 0 {
-		delayRate = float64(l.defaultBucket.delayedRequests) / float64(l.defaultBucket.totalRequests) * 100
+	if lb.totalRequests > 0 {
+		delayRate = float64(lb.delayedRequests) / float64(lb.totalRequests) * 100
 	}
 
-	metrics["default"] = Metrics{
-		TotalRequests:   l.defaultBucket.totalRequests,
-		DelayedRequests: l.defaultBucket.delayedRequests,
-		CurrentTokens:   l.defaultBucket.tokens,
-		LastAccess:      l.defaultBucket.lastAccess,
-		DelayRate:       delayRate,
+	var rate float64
+	for _, w := range lb.windows {
+		if r := float64(time.Second) / float64(w.interval); rate == 0 || r < rate {
+			rate = r
+		}
 	}
-	l.defaultBucket.mu.Unlock()
-
-	return metrics
-}
 
-// Helper function for max
-func max(a, b int) int {
-	if a > b {
-		return a
+	return Metrics{
+		TotalRequests:   lb.totalRequests,
+		DelayedRequests: lb.delayedRequests,
+		CurrentTokens:   lb.available(time.Now()),
+		LastAccess:      lb.lastAccess,
+		DelayRate:       delayRate,
+		RateFactor:      lb.factor,
+		EffectiveRate:   rate,
+		Throttled:       lb.throttled,
 	}
-	return b
 }
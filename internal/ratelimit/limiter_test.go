@@ -1,10 +1,13 @@
 package ratelimit
 
 import (
-	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
 )
 
 func TestRateLimiter(t *testing.T) {
@@ -247,3 +250,411 @@ func TestGetAllMetrics(t *testing.T) {
 		t.Error("Expected metrics for default domain")
 	}
 }
+
+func TestLimiterPause(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "api.example.com", RequestsPerSecond: 100},
+	})
+
+	limiter.Pause("api.example.com", 2*time.Second)
+	if delay := limiter.GetDelay("api.example.com"); delay < time.Second || delay > 2*time.Second {
+		t.Errorf("Expected paused delay close to 2s, got %v", delay)
+	}
+
+	// Pausing an unconfigured domain must not affect other unknown domains
+	limiter.Pause("throttled.example.org", 2*time.Second)
+	if delay := limiter.GetDelay("throttled.example.org"); delay < time.Second {
+		t.Errorf("Expected paused delay for throttled domain, got %v", delay)
+	}
+	if delay := limiter.GetDelay("other.example.org"); delay != 0 {
+		t.Errorf("Expected no delay for unrelated domain, got %v", delay)
+	}
+}
+
+func TestLimiterPeekDelay(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "api.example.com", RequestsPerSecond: 1},
+	})
+
+	// Peeking neither consumes the burst nor counts as a request
+	for i := 0; i < 5; i++ {
+		if delay := limiter.PeekDelay("api.example.com"); delay != 0 {
+			t.Fatalf("Expected headroom on peek %d, got %v", i, delay)
+		}
+	}
+	if metrics := limiter.GetMetrics("api.example.com"); metrics.TotalRequests != 0 {
+		t.Errorf("Expected peeks not to be counted, got %d requests", metrics.TotalRequests)
+	}
+
+	limiter.GetDelay("api.example.com")
+	limiter.GetDelay("api.example.com")
+	if delay := limiter.PeekDelay("api.example.com"); delay == 0 {
+		t.Error("Expected no headroom after the burst was used")
+	}
+
+	limiter.Pause("api.example.com", 2*time.Second)
+	if delay := limiter.PeekDelay("api.example.com"); delay < time.Second {
+		t.Errorf("Expected paused delay, got %v", delay)
+	}
+}
+
+func TestReservationsGetDistinctSlots(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "test.com", RequestsPerSecond: 5},
+	})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	delays := make(map[time.Duration]bool)
+
+	// 10 requests use the burst, the next 5 must queue one interval apart
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delay := limiter.GetDelay("test.com").Round(100 * time.Millisecond)
+
+			mu.Lock()
+			delays[delay] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, want := range []time.Duration{0, 200, 400, 600, 800, 1000} {
+		if !delays[want*time.Millisecond] {
+			t.Errorf("Expected a request delayed by %v, got %v", want*time.Millisecond, delays)
+		}
+	}
+	if len(delays) != 6 {
+		t.Errorf("Expected 6 distinct delays, got %v", delays)
+	}
+}
+
+func TestFractionalRate(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "slow.com", RequestsPerSecond: 0.2},
+	})
+
+	if delay := limiter.GetDelay("slow.com"); delay != 0 {
+		t.Errorf("Expected first request to go immediately, got %v", delay)
+	}
+	for i, want := range []time.Duration{5 * time.Second, 10 * time.Second} {
+		delay := limiter.GetDelay("slow.com")
+		if delay < want-100*time.Millisecond || delay > want {
+			t.Errorf("Expected request %d delayed by about %v, got %v", i+2, want, delay)
+		}
+	}
+}
+
+func TestReservationCancel(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "test.com", RequestsPerSecond: 1},
+	})
+
+	limiter.GetDelay("test.com")
+	limiter.GetDelay("test.com")
+
+	first := limiter.Reserve("test.com")
+	if first.Delay() <= 0 {
+		t.Fatalf("Expected a delay after the burst, got %v", first.Delay())
+	}
+	first.Cancel()
+
+	// The cancelled slot goes to the next caller instead of pushing it back
+	second := limiter.Reserve("test.com")
+	if second.Delay() > first.Delay() {
+		t.Errorf("Expected the released slot (%v), got %v", first.Delay(), second.Delay())
+	}
+	metrics := limiter.GetMetrics("test.com")
+	if metrics.DelayedRequests != 1 || metrics.TotalRequests != 3 {
+		t.Errorf("Expected the cancelled request not to count, got %d delayed of %d", metrics.DelayedRequests, metrics.TotalRequests)
+	}
+
+	// Cancelling twice gives back only one slot
+	second.Cancel()
+	second.Cancel()
+	if metrics := limiter.GetMetrics("test.com"); metrics.DelayedRequests != 0 || metrics.TotalRequests != 2 {
+		t.Errorf("Expected a second Cancel to be a no-op, got %d delayed of %d", metrics.DelayedRequests, metrics.TotalRequests)
+	}
+}
+
+func TestReservationCancelAfterBackoff(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "test.com", RequestsPerSecond: 1},
+	})
+	bucket := limiter.lookup("test.com", "", "")
+
+	limiter.GetDelay("test.com")
+	limiter.GetDelay("test.com")
+	before := bucket.windows[0].tat
+	first := limiter.Reserve("test.com")
+	if first.Delay() <= 0 {
+		t.Fatalf("Expected a delay after the burst, got %v", first.Delay())
+	}
+
+	// A 429 halves the rate while the slot is held, so rewinding by the
+	// current interval would take back two seconds for a one-second slot
+	bucket.backOff(time.Now(), time.Minute)
+	first.Cancel()
+
+	if after := bucket.windows[0].tat; !after.Equal(before) {
+		t.Errorf("Expected the schedule rewound to %v, got %v", before, after)
+	}
+}
+
+func TestDefaultRateLimitRule(t *testing.T) {
+	limiter := NewWithDefault(nil, &config.RateLimitRule{RequestsPerSecond: 10, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if delay := limiter.GetDelay("unknown.com"); delay != 0 {
+			t.Fatalf("Expected request %d within the default burst, got %v", i+1, delay)
+		}
+	}
+	if delay := limiter.GetDelay("unknown.com"); delay <= 0 || delay > 100*time.Millisecond {
+		t.Errorf("Expected the default rate's 100ms interval, got %v", delay)
+	}
+}
+
+func TestRuleBurstAndPeriod(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "minute.com", Requests: 60, Period: "minute", Burst: 5},
+	})
+
+	for i := 0; i < 5; i++ {
+		if delay := limiter.GetDelay("minute.com"); delay != 0 {
+			t.Fatalf("Expected request %d within the burst, got %v", i+1, delay)
+		}
+	}
+	if delay := limiter.GetDelay("minute.com"); delay < 900*time.Millisecond || delay > time.Second {
+		t.Errorf("Expected a 1s interval for 60/minute, got %v", delay)
+	}
+}
+
+func TestStackedWindows(t *testing.T) {
+	limiter := New([]config.RateLimitRule{{
+		Domain:            "stacked.com",
+		RequestsPerSecond: 100,
+		Windows:           []config.RateLimitWindow{{Requests: 5, Period: "hour"}},
+	}})
+
+	// The per-second window has room, but the hourly one allows only 5
+	for i := 0; i < 5; i++ {
+		if delay := limiter.GetDelay("stacked.com"); delay != 0 {
+			t.Fatalf("Expected request %d to go immediately, got %v", i+1, delay)
+		}
+	}
+	if delay := limiter.GetDelay("stacked.com"); delay < 11*time.Minute {
+		t.Errorf("Expected the hourly window to hold the 6th request for about 12m, got %v", delay)
+	}
+	if metrics := limiter.GetMetrics("stacked.com"); metrics.CurrentTokens != 0 {
+		t.Errorf("Expected no headroom left, got %d", metrics.CurrentTokens)
+	}
+}
+
+func TestWildcardPrecedence(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "*.example.com", RequestsPerSecond: 1},
+		{Domain: "*.api.example.com", RequestsPerSecond: 2},
+		{Domain: "v1.api.example.com", RequestsPerSecond: 3},
+	})
+
+	// Map order used to pick between overlapping wildcards at random
+	for i := 0; i < 20; i++ {
+		for host, want := range map[string]string{
+			"v1.api.example.com":      "v1.api.example.com",
+			"v2.api.example.com":      "*.api.example.com",
+			"api.example.com":         "*.example.com",
+			"V2.API.Example.com:443":  "*.api.example.com",
+			"deep.v2.api.example.com": "*.api.example.com",
+		} {
+			if got := limiter.getBucket(host, "", ""); got != limiter.buckets[want] {
+				t.Fatalf("Expected %s to use the %s rule", host, want)
+			}
+		}
+	}
+
+	// The wildcard only matches whole labels below the suffix
+	for _, host := range []string{"example.com", "evilexample.com", "example.com.evil.org"} {
+		if bucket := limiter.getBucket(host, "", ""); bucket != nil {
+			t.Errorf("Expected %s not to match any rule", host)
+		}
+	}
+}
+
+func TestPathAndMethodRules(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "api.openai.com", RequestsPerSecond: 100},
+		{Domain: "api.openai.com", PathPrefix: "/v1/chat/completions", Methods: []string{"post"}, RequestsPerSecond: 1},
+		{Domain: "api.openai.com", PathPrefix: "/v1", RequestsPerSecond: 10},
+	})
+
+	chat := httptest.NewRequest("POST", "https://api.openai.com/v1/chat/completions", nil)
+	models := httptest.NewRequest("GET", "https://api.openai.com/v1/models", nil)
+	other := httptest.NewRequest("GET", "https://api.openai.com/dashboard", nil)
+	prefixOnly := httptest.NewRequest("POST", "https://api.openai.com/v1/chat/completionsx", nil)
+
+	for req, want := range map[*http.Request]string{
+		chat:       "POST api.openai.com/v1/chat/completions",
+		models:     "api.openai.com/v1",
+		other:      "api.openai.com",
+		prefixOnly: "api.openai.com/v1",
+	} {
+		if got := limiter.getBucket(req.Host, req.Method, req.URL.Path); got != limiter.buckets[want] {
+			t.Errorf("Expected %s %s to use the %q rule", req.Method, req.URL.Path, want)
+		}
+	}
+
+	// Chat completions have their own budget; listing models is unaffected
+	limiter.ReserveRequest(chat)
+	limiter.ReserveRequest(chat)
+	if delay := limiter.ReserveRequest(chat).Delay(); delay <= 0 {
+		t.Error("Expected chat completions to be limited after their burst")
+	}
+	if delay := limiter.ReserveRequest(models).Delay(); delay != 0 {
+		t.Errorf("Expected listing models to go immediately, got %v", delay)
+	}
+
+	// A pause for the host covers its path rules too
+	limiter.Pause("api.openai.com", time.Minute)
+	if delay := limiter.ReserveRequest(models).Delay(); delay < 59*time.Second {
+		t.Errorf("Expected the pause to hold /v1/models, got %v", delay)
+	}
+}
+
+func TestObserveQuotaHeaders(t *testing.T) {
+	limiter := New([]config.RateLimitRule{
+		{Domain: "api.openai.com", RequestsPerSecond: 100, Headers: "openai"},
+		{Domain: "api.custom.com", RequestsPerSecond: 100, Headers: "custom"},
+		{Domain: "api.github.com", RequestsPerSecond: 100},
+	})
+	limiter.SetHeaderSchemas(map[string]config.HeaderSchema{
+		"custom": {RemainingRequests: "x-left", ResetRequests: "x-reset"},
+	})
+
+	observe := func(url string, status int, headers map[string]string) {
+		header := http.Header{}
+		for name, value := range headers {
+			header.Set(name, value)
+		}
+		limiter.Observe(httptest.NewRequest("POST", url, nil), status, header)
+	}
+
+	// Plenty left: nothing changes
+	observe("https://api.openai.com/v1/chat/completions", 200, map[string]string{
+		"x-ratelimit-limit-requests":     "500",
+		"x-ratelimit-remaining-requests": "400",
+		"x-ratelimit-reset-requests":     "10s",
+	})
+	if delay := limiter.PeekDelay("api.openai.com"); delay != 0 {
+		t.Errorf("Expected no delay with quota left, got %v", delay)
+	}
+
+	// Few left: the reset is spread over them
+	observe("https://api.openai.com/v1/chat/completions", 200, map[string]string{
+		"x-ratelimit-limit-requests":     "500",
+		"x-ratelimit-remaining-requests": "9",
+		"x-ratelimit-reset-requests":     "10s",
+	})
+	if delay := limiter.PeekDelay("api.openai.com"); delay < 900*time.Millisecond || delay > time.Second {
+		t.Errorf("Expected about 1s between the last requests, got %v", delay)
+	}
+
+	// Tokens exhausted: wait for their reset
+	observe("https://api.openai.com/v1/chat/completions", 200, map[string]string{
+		"x-ratelimit-remaining-tokens": "0",
+		"x-ratelimit-reset-tokens":     "1m0s",
+	})
+	if delay := limiter.PeekDelay("api.openai.com"); delay < 59*time.Second {
+		t.Errorf("Expected to wait for the token reset, got %v", delay)
+	}
+
+	// A custom schema works the same way
+	observe("https://api.custom.com/items", 200, map[string]string{"x-left": "0", "x-reset": "30"})
+	if delay := limiter.PeekDelay("api.custom.com"); delay < 29*time.Second {
+		t.Errorf("Expected the custom schema to pause, got %v", delay)
+	}
+
+	// Rules without a schema ignore the headers
+	observe("https://api.github.com/repos", 200, map[string]string{
+		"x-ratelimit-remaining-requests": "0",
+		"x-ratelimit-reset-requests":     "1m0s",
+	})
+	if delay := limiter.PeekDelay("api.github.com"); delay != 0 {
+		t.Errorf("Expected no delay without a schema, got %v", delay)
+	}
+}
+
+func TestBackoffOn429(t *testing.T) {
+	limiter := New([]config.RateLimitRule{{Domain: "api.example.com", RequestsPerSecond: 10}})
+	req := httptest.NewRequest("POST", "https://api.example.com/v1/chat", nil)
+
+	throttled := http.Header{}
+	throttled.Set("Retry-After", "2")
+	limiter.Observe(req, http.StatusTooManyRequests, throttled)
+
+	if delay := limiter.PeekDelay("api.example.com"); delay < 1900*time.Millisecond {
+		t.Errorf("Expected to wait for Retry-After, got %v", delay)
+	}
+	metrics := limiter.GetMetrics("api.example.com")
+	if metrics.RateFactor != 0.5 || metrics.EffectiveRate != 5 || metrics.Throttled != 1 {
+		t.Errorf("Expected the rate halved to 5/s after one 429, got %+v", metrics)
+	}
+
+	// More 429s from the same overload do not halve it again
+	limiter.Observe(req, http.StatusTooManyRequests, throttled)
+	if metrics := limiter.GetMetrics("api.example.com"); metrics.RateFactor != 0.5 || metrics.Throttled != 2 {
+		t.Errorf("Expected one halving for concurrent 429s, got %+v", metrics)
+	}
+
+	// Nor does success win it back during the pause
+	limiter.Observe(req, http.StatusOK, http.Header{})
+	if metrics := limiter.GetMetrics("api.example.com"); metrics.RateFactor != 0.5 {
+		t.Errorf("Expected no recovery during the pause, got %v", metrics.RateFactor)
+	}
+
+	// Afterwards each success wins back a step
+	bucket := limiter.lookup("api.example.com", "", "")
+	later := time.Now().Add(3 * time.Second)
+	bucket.recover(later)
+	if metrics := limiter.GetMetrics("api.example.com"); metrics.RateFactor != 0.55 {
+		t.Errorf("Expected additive recovery to 0.55, got %v", metrics.RateFactor)
+	}
+	for i := 0; i < 20; i++ {
+		bucket.recover(later)
+	}
+	if metrics := limiter.GetMetrics("api.example.com"); metrics.RateFactor != 1 || metrics.EffectiveRate != 10 {
+		t.Errorf("Expected full recovery, got %+v", metrics)
+	}
+}
+
+func TestBackoffOn429WithoutRule(t *testing.T) {
+	limiter := New(nil)
+
+	// No Retry-After, but the reset header of a known schema
+	headers := http.Header{}
+	headers.Set("x-ratelimit-remaining-tokens", "0")
+	headers.Set("x-ratelimit-reset-tokens", "5s")
+	limiter.Observe(httptest.NewRequest("GET", "https://slow.example.com/", nil), http.StatusTooManyRequests, headers)
+
+	if delay := limiter.PeekDelay("slow.example.com"); delay < 4900*time.Millisecond {
+		t.Errorf("Expected to wait for the reset, got %v", delay)
+	}
+	if metrics := limiter.GetMetrics("slow.example.com"); metrics.RateFactor != 0.5 {
+		t.Errorf("Expected the host's rate halved, got %v", metrics.RateFactor)
+	}
+
+	// Other hosts on the default limits are unaffected
+	if delay := limiter.PeekDelay("other.example.com"); delay != 0 {
+		t.Errorf("Expected other hosts unaffected, got %v", delay)
+	}
+	if metrics := limiter.GetMetrics("other.example.com"); metrics.RateFactor != 1 {
+		t.Errorf("Expected the default rate unchanged, got %v", metrics.RateFactor)
+	}
+
+	// A bare 429 holds the host briefly
+	limiter.Observe(httptest.NewRequest("GET", "https://bare.example.com/", nil), http.StatusTooManyRequests, http.Header{})
+	if delay := limiter.PeekDelay("bare.example.com"); delay < 900*time.Millisecond || delay > time.Second {
+		t.Errorf("Expected the default backoff, got %v", delay)
+	}
+}
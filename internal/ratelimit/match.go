@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// rule is a configured bucket and the requests it applies to
+type rule struct {
+	key     string   // name in metrics
+	host    string   // exact host or *.suffix
+	path    string   // path prefix, matched on segment boundaries
+	methods []string // upper-case; empty means any
+	headers string   // quota header schema, if any
+	bucket  *LeakyBucket
+}
+
+func newRule(r config.RateLimitRule) *rule {
+	matched := &rule{
+		key:     RuleKey(r),
+		host:    strings.ToLower(r.Domain),
+		path:    r.PathPrefix,
+		headers: r.Headers,
+		bucket:  newRuleBucket(r),
+	}
+	for _, method := range r.Methods {
+		matched.methods = append(matched.methods, strings.ToUpper(method))
+	}
+	return matched
+}
+
+// RuleKey names a rule in metrics: the domain, preceded by its methods and
+// followed by its path prefix when it has them, e.g. "POST api.openai.com/v1/chat"
+func RuleKey(r config.RateLimitRule) string {
+	key := strings.ToLower(r.Domain) + r.PathPrefix
+	if len(r.Methods) > 0 {
+		key = strings.ToUpper(strings.Join(r.Methods, ",")) + " " + key
+	}
+	return key
+}
+
+// scoped reports whether the rule only covers some paths or methods
+func (r *rule) scoped() bool {
+	return r.path != "" || len(r.methods) > 0
+}
+
+func (r *rule) matches(host, method, path string) bool {
+	if !hostMatches(r.host, host) {
+		return false
+	}
+	if r.path != "" && !pathHasPrefix(path, r.path) {
+		return false
+	}
+	if len(r.methods) == 0 {
+		return true
+	}
+	for _, m := range r.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches matches a host exactly or under a "*." wildcard. The wildcard
+// needs at least one label in its place, so *.example.com matches
+// api.example.com but neither example.com nor evilexample.com.
+func hostMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return pattern == host
+}
+
+func pathHasPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// specificity ranks how narrowly a rule's host matches: exact hosts first,
+// then wildcards by how many labels they fix
+func (r *rule) specificity() int {
+	if !strings.HasPrefix(r.host, "*.") {
+		return 1 << 16
+	}
+	return strings.Count(r.host, ".")
+}
+
+// sortRules orders rules so the first match is the most specific: by host,
+// then longer path prefix, then method-scoped before any method. Ties keep
+// their configured order.
+func sortRules(rules []*rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.specificity() != b.specificity() {
+			return a.specificity() > b.specificity()
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+		return len(a.methods) > 0 && len(b.methods) == 0
+	})
+}
+
+// normalizeHost lower-cases a request host and drops its port
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
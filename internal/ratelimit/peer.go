@@ -0,0 +1,252 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// PeerLeasePath is where an instance serves its lease to its peers
+const PeerLeasePath = "/cluster/lease"
+
+// Lease is the slice of the shared limits an instance holds, and the demand
+// it uses to ask for more
+type Lease struct {
+	ID        string `json:"id"`
+	RPM       int    `json:"rpm"`
+	TPM       int    `json:"tpm"`
+	DemandRPM int    `json:"demand_rpm"`
+	DemandTPM int    `json:"demand_tpm"`
+}
+
+// Coordinator keeps a CerebrasLimiter within this instance's lease of
+// limits shared with its peers. Every interval it fetches the peers' leases
+// and recomputes its own share in proportion to demand. It only grows into
+// what the others do not hold, so a busy instance waits for the idle ones to
+// shrink first. A peer that has not answered for lease_ttl is treated as
+// gone and its slice is freed.
+type Coordinator struct {
+	cfg      *config.PeerConfig
+	limiter  *CerebrasLimiter
+	rpmLimit int // cluster-wide
+	tpmLimit int // cluster-wide
+	client   *http.Client
+	logger   *log.Logger
+
+	mu    sync.Mutex
+	own   Lease
+	peers map[string]*peerLease
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type peerLease struct {
+	Lease
+	seen time.Time
+}
+
+func NewCoordinator(cfg *config.PeerConfig, limiter *CerebrasLimiter, rpmLimit, tpmLimit int) *Coordinator {
+	c := &Coordinator{
+		cfg:      cfg,
+		limiter:  limiter,
+		rpmLimit: rpmLimit,
+		tpmLimit: tpmLimit,
+		client:   &http.Client{Timeout: cfg.Interval},
+		logger:   log.New(log.Writer(), "[peers] ", log.LstdFlags),
+		peers:    make(map[string]*peerLease),
+	}
+
+	// Until they answer, assume every peer holds an equal share, so a
+	// restart cannot claim the whole limit while the others are busy
+	n := len(cfg.Peers) + 1
+	now := time.Now()
+	for _, peer := range cfg.Peers {
+		c.peers[peer] = &peerLease{Lease: Lease{ID: peer, RPM: rpmLimit / n, TPM: tpmLimit / n}, seen: now}
+	}
+	c.own = Lease{ID: cfg.Self, RPM: max(rpmLimit/n, 1), TPM: max(tpmLimit/n, 1)}
+	limiter.SetLimits(c.own.RPM, c.own.TPM)
+
+	return c
+}
+
+// Start exchanges leases every interval until Stop
+func (c *Coordinator) Start() {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Interval)
+				c.Sync(ctx)
+				cancel()
+			}
+		}
+	}()
+}
+
+// Stop ends the exchange started by Start
+func (c *Coordinator) Stop() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	c.stop = nil
+}
+
+// Lease returns this instance's current lease
+func (c *Coordinator) Lease() Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.own
+}
+
+// ServeHTTP answers peers asking for this instance's lease. Callers must
+// present the shared secret, as a lease reveals the org's traffic.
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(c.cfg.Secret)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Lease())
+}
+
+// Sync fetches every peer's lease and rebalances this instance's own
+func (c *Coordinator) Sync(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, peer := range c.cfg.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			lease, err := c.fetch(ctx, peer)
+			if err != nil {
+				c.logger.Printf("Failed to fetch lease from %s: %v", peer, err)
+				return
+			}
+
+			c.mu.Lock()
+			c.peers[peer] = &peerLease{Lease: lease, seen: time.Now()}
+			c.mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	c.rebalance(time.Now())
+}
+
+func (c *Coordinator) fetch(ctx context.Context, peer string) (Lease, error) {
+	var lease Lease
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(peer, "/")+PeerLeasePath, nil)
+	if err != nil {
+		return lease, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.cfg.Secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return lease, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return lease, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return lease, fmt.Errorf("invalid lease: %w", err)
+	}
+	return lease, nil
+}
+
+// rebalance recomputes this instance's lease from its own demand and the
+// leases of the peers still alive
+func (c *Coordinator) rebalance(now time.Time) {
+	requests, tokens, queued := c.limiter.Usage()
+
+	// Queued requests count as demand too, at the recent tokens per request
+	demandRPM := requests + queued
+	demandTPM := tokens
+	if requests > 0 {
+		demandTPM = tokens * demandRPM / requests
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var live []*peerLease
+	for _, peer := range c.peers {
+		if now.Sub(peer.seen) <= c.cfg.LeaseTTL {
+			live = append(live, peer)
+		}
+	}
+
+	rpmDemands := []int{demandRPM}
+	tpmDemands := []int{demandTPM}
+	heldRPM, heldTPM := 0, 0
+	for _, peer := range live {
+		rpmDemands = append(rpmDemands, peer.DemandRPM)
+		tpmDemands = append(tpmDemands, peer.DemandTPM)
+		heldRPM += peer.RPM
+		heldTPM += peer.TPM
+	}
+
+	c.own = Lease{
+		ID:        c.cfg.Self,
+		RPM:       claim(c.rpmLimit, heldRPM, c.own.RPM, rpmDemands),
+		TPM:       claim(c.tpmLimit, heldTPM, c.own.TPM, tpmDemands),
+		DemandRPM: demandRPM,
+		DemandTPM: demandTPM,
+	}
+	c.limiter.SetLimits(c.own.RPM, c.own.TPM)
+}
+
+// claim returns the share of limit for the instance holding current whose
+// demand is demands[0]. Every instance keeps a tenth of an equal share so it
+// can serve new demand until the next rebalance; the rest is split by
+// demand, or equally when there is none. Shrinking is immediate, but growth
+// is limited to an equal part of what nobody holds, so instances growing in
+// the same round cannot claim the same capacity twice.
+func claim(limit, held, current int, demands []int) int {
+	n := len(demands)
+	minimum := limit / (10 * n)
+
+	total := 0
+	for _, demand := range demands {
+		total += demand
+	}
+
+	share := limit / n
+	if total > 0 {
+		share = minimum + int(int64(limit-n*minimum)*int64(demands[0])/int64(total))
+	}
+
+	if share > current {
+		free := max(limit-held-current, 0)
+		share = min(share, current+free/n)
+	}
+	// Never stall completely; the overshoot is one request until the
+	// others shrink
+	return max(share, 1)
+}
@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type peerInstance struct {
+	server      *httptest.Server
+	limiter     *CerebrasLimiter
+	coordinator *Coordinator
+}
+
+// startPeers runs n instances on localhost that share rpm and tpm
+func startPeers(t *testing.T, n, rpm, tpm int, ttl time.Duration) []*peerInstance {
+	instances := make([]*peerInstance, n)
+	for i := range instances {
+		instance := &peerInstance{limiter: NewCerebrasLimiter(rpm, tpm)}
+		mux := http.NewServeMux()
+		mux.HandleFunc(PeerLeasePath, func(w http.ResponseWriter, r *http.Request) {
+			instance.coordinator.ServeHTTP(w, r)
+		})
+		instance.server = httptest.NewServer(mux)
+		t.Cleanup(instance.server.Close)
+		instances[i] = instance
+	}
+
+	for i, instance := range instances {
+		cfg := &config.PeerConfig{Self: instance.server.URL, Interval: 10 * time.Millisecond, LeaseTTL: ttl, Secret: "shared"}
+		for j, peer := range instances {
+			if j != i {
+				cfg.Peers = append(cfg.Peers, peer.server.URL)
+			}
+		}
+		instance.coordinator = NewCoordinator(cfg, instance.limiter, rpm, tpm)
+	}
+	return instances
+}
+
+func syncAll(instances []*peerInstance) {
+	for _, instance := range instances {
+		instance.coordinator.Sync(context.Background())
+	}
+}
+
+func assertWithinLimits(t *testing.T, instances []*peerInstance, rpm, tpm int) {
+	t.Helper()
+	totalRPM, totalTPM := 0, 0
+	for _, instance := range instances {
+		lease := instance.coordinator.Lease()
+		totalRPM += lease.RPM
+		totalTPM += lease.TPM
+		assert.Equal(t, lease.RPM, instance.limiter.RPMLimit())
+	}
+	assert.LessOrEqual(t, totalRPM, rpm)
+	assert.LessOrEqual(t, totalTPM, tpm)
+}
+
+func TestPeerLeasesRebalanceByDemand(t *testing.T) {
+	instances := startPeers(t, 3, 300, 300000, time.Minute)
+
+	// Everyone starts with an equal share
+	for _, instance := range instances {
+		assert.Equal(t, 100, instance.limiter.RPMLimit())
+		assert.Equal(t, 100000, instance.limiter.TPMLimit())
+	}
+
+	// The first instance is busy, the others idle
+	busy := instances[0]
+	for i := 0; i < 90; i++ {
+		busy.limiter.CheckRequest(1000)
+	}
+
+	for round := 0; round < 10; round++ {
+		syncAll(instances)
+		assertWithinLimits(t, instances, 300, 300000)
+	}
+
+	// The busy instance holds most of the limit; the idle ones keep a floor
+	assert.Greater(t, busy.limiter.RPMLimit(), 250)
+	assert.Greater(t, busy.limiter.TPMLimit(), 250000)
+	for _, idle := range instances[1:] {
+		assert.Equal(t, 10, idle.limiter.RPMLimit())
+	}
+}
+
+func TestPeerLeasesFreedWhenPeerGoesAway(t *testing.T) {
+	ttl := 100 * time.Millisecond
+	instances := startPeers(t, 3, 300, 300000, ttl)
+	syncAll(instances)
+
+	instances[2].server.Close()
+	time.Sleep(ttl + 50*time.Millisecond)
+
+	live := instances[:2]
+	for round := 0; round < 10; round++ {
+		syncAll(live)
+		assertWithinLimits(t, live, 300, 300000)
+	}
+
+	// The remaining two split the whole limit
+	for _, instance := range live {
+		assert.Greater(t, instance.limiter.RPMLimit(), 140)
+	}
+}
+
+func TestPeerCoordinatorStartStop(t *testing.T) {
+	instances := startPeers(t, 2, 100, 100000, time.Second)
+	for _, instance := range instances {
+		instance.coordinator.Start()
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, instance := range instances {
+		instance.coordinator.Stop()
+	}
+
+	for _, instance := range instances {
+		lease := instance.coordinator.Lease()
+		assert.Equal(t, instance.server.URL, lease.ID)
+		assert.Equal(t, 50, lease.RPM)
+	}
+}
+
+func TestPeerLeaseRequiresSecret(t *testing.T) {
+	instances := startPeers(t, 2, 100, 100000, time.Second)
+	url := instances[0].server.URL + PeerLeasePath
+
+	resp, err := http.Get(url)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	req.Header.Set("Authorization", "Bearer shared")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
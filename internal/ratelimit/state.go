@@ -0,0 +1,255 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Snapshots store absolute times, so restoring one later needs no other
+// adjustment for the time that passed: windows whose schedule is in the
+// past are simply full again and old sliding window entries fall out.
+
+type bucketState struct {
+	Windows         []windowState `json:"windows"`
+	TotalRequests   int64         `json:"total_requests"`
+	DelayedRequests int64         `json:"delayed_requests"`
+	LastAccess      time.Time     `json:"last_access"`
+	Factor          float64       `json:"factor,omitempty"`
+	BackoffUntil    time.Time     `json:"backoff_until,omitempty"`
+	Throttled       int64         `json:"throttled,omitempty"`
+}
+
+type windowState struct {
+	Interval time.Duration `json:"interval"`
+	Capacity int           `json:"capacity"`
+	TAT      time.Time     `json:"tat"`
+}
+
+type limiterState struct {
+	Buckets map[string]bucketState `json:"buckets"`
+	Default bucketState            `json:"default"`
+}
+
+func (lb *LeakyBucket) snapshot() bucketState {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	state := bucketState{
+		TotalRequests:   lb.totalRequests,
+		DelayedRequests: lb.delayedRequests,
+		LastAccess:      lb.lastAccess,
+		Factor:          lb.factor,
+		BackoffUntil:    lb.backoffUntil,
+		Throttled:       lb.throttled,
+	}
+	for _, w := range lb.windows {
+		state.Windows = append(state.Windows, windowState{Interval: w.base, Capacity: w.capacity, TAT: w.tat})
+	}
+	return state
+}
+
+// restore applies a snapshot taken with the same windows. A snapshot from
+// before the rule's rates changed is ignored.
+func (lb *LeakyBucket) restore(state bucketState) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if len(state.Windows) != len(lb.windows) {
+		return
+	}
+	for i, w := range lb.windows {
+		if state.Windows[i].Interval != w.base || state.Windows[i].Capacity != w.capacity {
+			return
+		}
+	}
+
+	for i, w := range lb.windows {
+		w.tat = state.Windows[i].TAT
+	}
+	lb.totalRequests = state.TotalRequests
+	lb.delayedRequests = state.DelayedRequests
+	lb.lastAccess = state.LastAccess
+	lb.backoffUntil = state.BackoffUntil
+	lb.throttled = state.Throttled
+	if state.Factor > 0 {
+		lb.setFactor(state.Factor)
+	}
+}
+
+// pending reports whether the bucket is still behind schedule, e.g. paused
+func (state bucketState) pending(now time.Time) bool {
+	for _, w := range state.Windows {
+		if w.TAT.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot returns the state of every bucket for persisting
+func (l *Limiter) Snapshot() interface{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	state := limiterState{Buckets: make(map[string]bucketState), Default: l.defaultBucket.snapshot()}
+	for key, bucket := range l.buckets {
+		state.Buckets[key] = bucket.snapshot()
+	}
+	return state
+}
+
+// Restore applies a Snapshot. Buckets of rules that no longer exist are
+// dropped, except pauses of hosts without a rule that have not ended yet.
+func (l *Limiter) Restore(data json.RawMessage, savedAt time.Time) error {
+	var state limiterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, saved := range state.Buckets {
+		bucket, ok := l.buckets[key]
+		if !ok {
+			if !saved.pending(now) || !pausedHostKey(key) {
+				continue
+			}
+			bucket = l.defaultBucket.clone()
+			l.buckets[key] = bucket
+		}
+		bucket.restore(saved)
+	}
+	l.defaultBucket.restore(state.Default)
+	return nil
+}
+
+// pausedHostKey reports whether key names a host, as Pause stores it, rather
+// than a rule with a wildcard, path or methods
+func pausedHostKey(key string) bool {
+	return key != "" && normalizeHost(key) == key && !strings.ContainsAny(key, "*/ ")
+}
+
+type clientLimiterState struct {
+	Rules   map[string]bucketState `json:"rules"`
+	Clients map[string]bucketState `json:"clients"`
+}
+
+// Snapshot returns the state of every client bucket for persisting. API
+// keys appear only hashed, as in metrics.
+func (c *ClientLimiter) Snapshot() interface{} {
+	state := clientLimiterState{Rules: make(map[string]bucketState), Clients: make(map[string]bucketState)}
+	for _, r := range c.rules {
+		state.Rules[r.name] = r.bucket.snapshot()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, bucket := range c.buckets {
+		state.Clients[name] = bucket.snapshot()
+	}
+	return state
+}
+
+// Restore applies a Snapshot. Clients whose buckets have refilled since are
+// left out, as a new bucket behaves the same.
+func (c *ClientLimiter) Restore(data json.RawMessage, savedAt time.Time) error {
+	var state clientLimiterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	for _, r := range c.rules {
+		if saved, ok := state.Rules[r.name]; ok {
+			r.bucket.restore(saved)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for name, saved := range state.Clients {
+		if !saved.pending(now) || len(c.buckets) >= maxIdleClients {
+			continue
+		}
+		bucket := newBucket(c.defaultRates)
+		bucket.restore(saved)
+		c.buckets[name] = bucket
+	}
+	return nil
+}
+
+type cerebrasState struct {
+	Requests            []windowEntry `json:"requests"`
+	Tokens              []windowEntry `json:"tokens"`
+	CurrentTPMLimit     int           `json:"current_tpm_limit"`
+	CurrentTPMRemaining int           `json:"current_tpm_remaining"`
+	NextTPMReset        time.Time     `json:"next_tpm_reset"`
+	LastHeaderUpdate    time.Time     `json:"last_header_update"`
+}
+
+type windowEntry struct {
+	At    time.Time `json:"at"`
+	Value int       `json:"value"`
+}
+
+func (sw *slidingWindow) snapshot() []windowEntry {
+	var entries []windowEntry
+	for elem := sw.elements.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*windowElement)
+		entries = append(entries, windowEntry{At: e.timestamp, Value: e.value})
+	}
+	return entries
+}
+
+// restore replaces the window with the entries still inside it
+func (sw *slidingWindow) restore(entries []windowEntry, now time.Time) {
+	sw.elements.Init()
+	for _, e := range entries {
+		if now.Sub(e.At) < sw.size {
+			sw.elements.PushBack(&windowElement{timestamp: e.At, value: e.Value})
+		}
+	}
+}
+
+// Snapshot returns the sliding windows and header-derived limits for
+// persisting
+func (c *CerebrasLimiter) Snapshot() interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return cerebrasState{
+		Requests:            c.rpmWindow.snapshot(),
+		Tokens:              c.tpmWindow.snapshot(),
+		CurrentTPMLimit:     c.currentTPMLimit,
+		CurrentTPMRemaining: c.currentTPMRemaining,
+		NextTPMReset:        c.nextTPMReset,
+		LastHeaderUpdate:    c.lastHeaderUpdate,
+	}
+}
+
+// Restore applies a Snapshot. Window entries older than a minute are
+// dropped, and header data is kept as of when it was received, so it is
+// ignored once stale and a reset that has passed refills the remaining
+// tokens as it would have without the restart.
+func (c *CerebrasLimiter) Restore(data json.RawMessage, savedAt time.Time) error {
+	var state cerebrasState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.rpmWindow.restore(state.Requests, now)
+	c.tpmWindow.restore(state.Tokens, now)
+	c.currentTPMLimit = state.CurrentTPMLimit
+	c.currentTPMRemaining = state.CurrentTPMRemaining
+	c.nextTPMReset = state.NextTPMReset
+	c.lastHeaderUpdate = state.LastHeaderUpdate
+	return nil
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func roundTrip(t *testing.T, from interface{ Snapshot() interface{} }) json.RawMessage {
+	data, err := json.Marshal(from.Snapshot())
+	assert.NoError(t, err)
+	return data
+}
+
+func TestLimiterStateSurvivesRestart(t *testing.T) {
+	rules := []config.RateLimitRule{{Domain: "api.example.com", Requests: 2, Period: "minute"}}
+	before := New(rules)
+	before.GetDelay("api.example.com")
+	before.GetDelay("api.example.com")
+	before.Pause("paused.example.com", time.Minute)
+	data := roundTrip(t, before)
+
+	after := New(rules)
+	assert.NoError(t, after.Restore(data, time.Now()))
+
+	// The budget spent before the restart is still spent
+	assert.True(t, after.GetDelay("api.example.com") > 20*time.Second)
+	assert.Equal(t, int64(3), after.GetMetrics("api.example.com").TotalRequests)
+
+	// So is a pause on a host without a rule
+	assert.True(t, after.HasRule("paused.example.com"))
+	assert.True(t, after.PeekDelay("paused.example.com") > 50*time.Second)
+}
+
+func TestLimiterStateIgnoresChangedRules(t *testing.T) {
+	before := New([]config.RateLimitRule{{Domain: "api.example.com", Requests: 2, Period: "minute"}})
+	before.GetDelay("api.example.com")
+	before.GetDelay("api.example.com")
+	data := roundTrip(t, before)
+
+	after := New([]config.RateLimitRule{{Domain: "api.example.com", Requests: 100, Period: "minute"}})
+	assert.NoError(t, after.Restore(data, time.Now()))
+	assert.Equal(t, time.Duration(0), after.GetDelay("api.example.com"))
+}
+
+func TestClientLimiterStateSurvivesRestart(t *testing.T) {
+	cfg := &config.ClientRateLimits{
+		Key:     config.ClientKeyHeader,
+		Header:  "X-Tenant",
+		Default: &config.RateLimitRule{Requests: 1, Period: "minute"},
+	}
+	before := NewClientLimiter(cfg)
+	before.bucket("acme").reserve(time.Now())
+	data := roundTrip(t, before)
+
+	after := NewClientLimiter(cfg)
+	assert.NoError(t, after.Restore(data, time.Now()))
+	assert.True(t, after.bucket("acme").reserve(time.Now()).Delay() > 50*time.Second)
+	assert.Equal(t, time.Duration(0), after.bucket("other").reserve(time.Now()).Delay())
+}
+
+func TestCerebrasStateDropsExpiredEntries(t *testing.T) {
+	before := NewCerebrasLimiter(10, 1000)
+	now := time.Now()
+	before.recordRequest(100, now.Add(-2*time.Minute))
+	before.recordRequest(200, now.Add(-10*time.Second))
+	data := roundTrip(t, before)
+
+	after := NewCerebrasLimiter(10, 1000)
+	assert.NoError(t, after.Restore(data, now))
+
+	requests, tokens, _ := after.Usage()
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 200, tokens)
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"net/http"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// Tenants tells apart the tenants sharing the Cerebras queue, the same way
+// the ClientLimiter tells apart clients
+type Tenants struct {
+	cfg    *config.FairQueuingConfig
+	shares []*tenantShare
+}
+
+// tenantShare is a configured tenant and its weight
+type tenantShare struct {
+	clientMatcher
+	name   string
+	weight int
+}
+
+func NewTenants(cfg *config.FairQueuingConfig) *Tenants {
+	t := &Tenants{cfg: cfg}
+	for _, tenant := range cfg.Tenants {
+		s := &tenantShare{
+			clientMatcher: newClientMatcher(cfg.Key, tenant.Client),
+			name:          tenant.Name,
+			weight:        tenant.Weight,
+		}
+		if s.name == "" {
+			s.name = describe(cfg.Key, tenant.Client)
+		}
+		t.shares = append(t.shares, s)
+	}
+	return t
+}
+
+// Identify returns the name of the tenant sending r: that of the matching
+// configured tenant, else one derived from the client identity like client
+// metrics names
+func (t *Tenants) Identify(r *http.Request) string {
+	identity := identify(r, t.cfg.Key, t.cfg.Header, t.cfg.TrustForwardedFor)
+	if identity == "" {
+		return anonymousClient
+	}
+	for _, s := range t.shares {
+		if s.matches(identity) {
+			return s.name
+		}
+	}
+	return describe(t.cfg.Key, identity)
+}
+
+// Weights returns the weight of each configured tenant by name
+func (t *Tenants) Weights() map[string]int {
+	weights := make(map[string]int, len(t.shares))
+	for _, s := range t.shares {
+		weights[s.name] = s.weight
+	}
+	return weights
+}
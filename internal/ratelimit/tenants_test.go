@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantsIdentify(t *testing.T) {
+	tenants := NewTenants(&config.FairQueuingConfig{
+		Tenants: []config.TenantShare{
+			{Name: "interactive", Client: "ide-key", Weight: 4},
+			{Client: "batch-key", Weight: 2},
+		},
+	})
+
+	request := func(key string) string {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		return tenants.Identify(r)
+	}
+
+	assert.Equal(t, "interactive", request("ide-key"))
+	assert.Equal(t, describe(config.ClientKeyAPIKey, "batch-key"), request("batch-key"))
+	assert.Equal(t, describe(config.ClientKeyAPIKey, "other-key"), request("other-key"))
+	assert.NotContains(t, request("other-key"), "other-key", "API keys must not leak into tenant names")
+	assert.Equal(t, anonymousClient, request(""))
+
+	assert.Equal(t, map[string]int{
+		"interactive": 4,
+		describe(config.ClientKeyAPIKey, "batch-key"): 2,
+	}, tenants.Weights())
+}
+
+func TestTenantsIdentifyByIP(t *testing.T) {
+	tenants := NewTenants(&config.FairQueuingConfig{
+		Key:     config.ClientKeyIP,
+		Tenants: []config.TenantShare{{Name: "office", Client: "10.0.0.0/8", Weight: 3}},
+	})
+
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	assert.Equal(t, "office", tenants.Identify(r))
+
+	r.RemoteAddr = "192.168.1.1:5000"
+	assert.Equal(t, "192.168.1.1", tenants.Identify(r))
+}
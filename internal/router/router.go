@@ -21,6 +21,17 @@ func New(routes map[string]*url.URL, rateLimiter *ratelimit.Limiter) *Router {
 	}
 }
 
+// SetClientLimiter adds per-client limits to proxied requests
+func (r *Router) SetClientLimiter(limiter *ratelimit.ClientLimiter) {
+	r.proxyHandler.SetClientLimiter(limiter)
+}
+
+// SetCerebras queues proxied requests for Cerebras hosts for their RPM/TPM
+// capacity
+func (r *Router) SetCerebras(cerebras *proxy.CerebrasProxyHandler) {
+	r.proxyHandler.SetCerebras(cerebras)
+}
+
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Extract target from request
 	targetURL := r.getTarget(req)
@@ -0,0 +1,162 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+)
+
+// Component is a part of the proxy whose state survives restarts, e.g. a
+// rate limiter. Snapshot must return a JSON-encodable value; Restore gets
+// that value back along with when it was saved.
+type Component interface {
+	Snapshot() interface{}
+	Restore(data json.RawMessage, savedAt time.Time) error
+}
+
+// file is the on-disk layout of a snapshot
+type file struct {
+	SavedAt    time.Time                  `json:"saved_at"`
+	Components map[string]json.RawMessage `json:"components"`
+}
+
+// Store writes the state of its components to a local file every interval
+// and on Stop, and restores it with Load
+type Store struct {
+	cfg    *config.StateConfig
+	logger *log.Logger
+
+	mu         sync.Mutex
+	components map[string]Component
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewStore(cfg *config.StateConfig) *Store {
+	return &Store{
+		cfg:        cfg,
+		logger:     log.New(log.Writer(), "[state] ", log.LstdFlags),
+		components: make(map[string]Component),
+	}
+}
+
+// Register adds a component under name, which must stay the same across
+// restarts for its state to be restored
+func (s *Store) Register(name string, c Component) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.components[name] = c
+}
+
+// Load restores every registered component from the file. A missing file is
+// not an error; a component that fails to restore is logged and skipped so
+// the others still get their state.
+func (s *Store) Load() error {
+	data, err := os.ReadFile(s.cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var saved file
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid state file %s: %w", s.cfg.Path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, c := range s.components {
+		raw, ok := saved.Components[name]
+		if !ok {
+			continue
+		}
+		if err := c.Restore(raw, saved.SavedAt); err != nil {
+			s.logger.Printf("Failed to restore %s: %v", name, err)
+		}
+	}
+	s.logger.Printf("Restored state saved at %s", saved.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// Save writes every component's snapshot to the file. It writes a temporary
+// file and renames it, so a crash mid-write leaves the previous snapshot.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	saved := file{SavedAt: time.Now(), Components: make(map[string]json.RawMessage)}
+	for name, c := range s.components {
+		raw, err := json.Marshal(c.Snapshot())
+		if err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to encode %s: %w", name, err)
+		}
+		saved.Components[name] = raw
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.Path), filepath.Base(s.cfg.Path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.cfg.Path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// Start saves the state every interval until Stop
+func (s *Store) Start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.Save(); err != nil {
+					s.logger.Printf("Failed to save state: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the saving started by Start and writes a final snapshot
+func (s *Store) Stop() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	return s.Save()
+}
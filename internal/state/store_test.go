@@ -0,0 +1,63 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cooldownp/cooldown-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type counter struct {
+	n       int
+	savedAt time.Time
+}
+
+func (c *counter) Snapshot() interface{} {
+	return c.n
+}
+
+func (c *counter) Restore(data json.RawMessage, savedAt time.Time) error {
+	c.savedAt = savedAt
+	return json.Unmarshal(data, &c.n)
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	cfg := &config.StateConfig{Path: filepath.Join(t.TempDir(), "state.json"), Interval: time.Hour}
+
+	before := NewStore(cfg)
+	before.Register("counter", &counter{n: 42})
+	before.Start()
+	assert.NoError(t, before.Stop())
+
+	restored := &counter{}
+	after := NewStore(cfg)
+	after.Register("counter", restored)
+	after.Register("new", &counter{})
+	assert.NoError(t, after.Load())
+
+	assert.Equal(t, 42, restored.n)
+	assert.WithinDuration(t, time.Now(), restored.savedAt, time.Minute)
+
+	// Only the snapshot itself is left behind
+	entries, err := os.ReadDir(filepath.Dir(cfg.Path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestStoreLoadWithoutFile(t *testing.T) {
+	store := NewStore(&config.StateConfig{Path: filepath.Join(t.TempDir(), "missing.json")})
+	store.Register("counter", &counter{})
+	assert.NoError(t, store.Load())
+}
+
+func TestStoreLoadCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0o644))
+
+	store := NewStore(&config.StateConfig{Path: path})
+	assert.Error(t, store.Load())
+}